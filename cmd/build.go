@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"context"
+	"os"
 	"runtime"
 
 	"github.com/nlewo/comin/internal/executor"
@@ -35,7 +36,7 @@ var buildCmd = &cobra.Command{
 			if err != nil {
 				logrus.Errorf("Failed to evaluate the configuration '%s': '%s'", host, err)
 			}
-			err = executor.Build(ctx, drvPath)
+			err = executor.Build(ctx, drvPath, os.Stderr, nil)
 			if err != nil {
 				logrus.Errorf("Failed to build the configuration '%s': '%s'", host, err)
 			}
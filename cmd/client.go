@@ -0,0 +1,114 @@
+package cmd
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+var (
+	apiUrl       string
+	apiSocket    string
+	apiTokenFile string
+	apiCAFile    string
+	apiCertFile  string
+	apiKeyFile   string
+)
+
+// apiClient returns a client of the comin API. It connects to the
+// Unix socket of the API when --api-socket is set. The client has no
+// timeout when timeout is 0.
+func apiClient(timeout time.Duration) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if apiSocket != "" {
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", apiSocket)
+		}
+	}
+	tlsConfig, err := apiTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: transport,
+	}, nil
+}
+
+// apiTLSConfig returns the TLS configuration used to connect to a
+// HTTPS API. The server certificate is verified with --api-ca-file
+// when set, and the client certificate is used when the API requires
+// mTLS.
+func apiTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{}
+	if apiCAFile != "" {
+		pem, err := os.ReadFile(apiCAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in %s", apiCAFile)
+		}
+		config.RootCAs = pool
+	}
+	if (apiCertFile == "") != (apiKeyFile == "") {
+		return nil, fmt.Errorf("both --api-cert-file and --api-key-file have to be set")
+	}
+	if apiCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(apiCertFile, apiKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// newApiRequest creates a request to an API endpoint. The bearer
+// token read from --api-token-file is added to the request.
+func newApiRequest(method, path string) (*http.Request, error) {
+	url := strings.TrimSuffix(apiUrl, "/")
+	// The host is ignored when the Unix socket is used
+	if apiSocket != "" {
+		url = "http://localhost:4242"
+	}
+	req, err := http.NewRequest(method, url+path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if apiTokenFile != "" {
+		token, err := os.ReadFile(apiTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+	return req, nil
+}
+
+// envOr returns the value of the environment variable name or def if
+// it is not set
+func envOr(name, def string) string {
+	if value := os.Getenv(name); value != "" {
+		return value
+	}
+	return def
+}
+
+func init() {
+	rootCmd.PersistentFlags().StringVarP(&apiUrl, "api-url", "", envOr("COMIN_API_URL", "http://localhost:4242"), "the URL of the API, such as https://machine:4242 (default to $COMIN_API_URL)")
+	rootCmd.PersistentFlags().StringVarP(&apiSocket, "api-socket", "", os.Getenv("COMIN_API_SOCKET"), "the Unix socket of the API (default to $COMIN_API_SOCKET)")
+	rootCmd.PersistentFlags().StringVarP(&apiTokenFile, "api-token-file", "", os.Getenv("COMIN_API_TOKEN_FILE"), "the file containing the bearer token of the API (default to $COMIN_API_TOKEN_FILE)")
+	rootCmd.PersistentFlags().StringVarP(&apiCAFile, "api-ca-file", "", os.Getenv("COMIN_API_CA_FILE"), "the CA verifying the certificate of a HTTPS API (default to $COMIN_API_CA_FILE)")
+	rootCmd.PersistentFlags().StringVarP(&apiCertFile, "api-cert-file", "", os.Getenv("COMIN_API_CERT_FILE"), "the client certificate presented to a HTTPS API (default to $COMIN_API_CERT_FILE)")
+	rootCmd.PersistentFlags().StringVarP(&apiKeyFile, "api-key-file", "", os.Getenv("COMIN_API_KEY_FILE"), "the key of the client certificate (default to $COMIN_API_KEY_FILE)")
+}
@@ -0,0 +1,107 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/nlewo/comin/internal/store"
+	"github.com/spf13/cobra"
+)
+
+// postApi sends a POST request to an API endpoint and exits if the
+// request fails.
+func postApi(path string, query url.Values) {
+	if len(query) != 0 {
+		path += "?" + query.Encode()
+	}
+	client, err := apiClient(time.Second * 2)
+	if err != nil {
+		fmt.Printf("error: %s\n", err)
+		os.Exit(1)
+	}
+	req, err := newApiRequest(http.MethodPost, path)
+	if err != nil {
+		fmt.Printf("error: %s\n", err)
+		os.Exit(1)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		fmt.Printf("error: %s\n", err)
+		os.Exit(1)
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(resp.Body)
+		fmt.Printf("error: %s\n", string(body))
+		os.Exit(1)
+	}
+}
+
+var confirmCmd = &cobra.Command{
+	Use:   "confirm",
+	Short: "Confirm the running deployment",
+	Long:  "This command confirms the deployment waiting for a confirmation. If the deployment is not confirmed before the confirmation timeout, comin re-activates the previous deployment.",
+	Args:  cobra.MinimumNArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		postApi("/api/deployer/confirm", nil)
+	},
+}
+
+var approveCmd = &cobra.Command{
+	Use:   "approve GENERATION",
+	Short: "Approve the deployment of a generation",
+	Long:  "This command approves the deployment of the generation waiting for an approval. The generation UUID is shown by 'comin status'. The approval expires when a newer commit is fetched.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		postApi("/api/deployer/approve", url.Values{"generation": []string{args[0]}})
+	},
+}
+
+var (
+	rollbackTo   string
+	rollbackList bool
+)
+
+// listDeployments prints the deployments of the store, from the most
+// recent to the older.
+func listDeployments() {
+	status, err := getStatus()
+	if err != nil {
+		fmt.Printf("error: %s\n", err)
+		os.Exit(1)
+	}
+	for _, d := range status.Store.Deployments {
+		fmt.Printf("%s  %s  %-11s  %s  %s/%s\n",
+			d.UUID, d.StartedAt.Local().Format(time.DateTime), store.StatusToString(d.Status),
+			d.Generation.SelectedCommitId, d.Generation.SelectedRemoteName, d.Generation.SelectedBranchName)
+	}
+}
+
+var rollbackCmd = &cobra.Command{
+	Use:   "rollback",
+	Short: "Roll back to a past deployment",
+	Long:  "This command redeploys the generation of a past deployment, by default the previous successful deployment. The deployment UUIDs are shown by 'comin rollback --list'. comin is suspended in order to not deploy new commits until 'comin resume' is run.",
+	Args:  cobra.MinimumNArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		if rollbackList {
+			listDeployments()
+			return
+		}
+		query := url.Values{}
+		if rollbackTo != "" {
+			query.Set("deployment", rollbackTo)
+		}
+		postApi("/api/deployer/rollback", query)
+	},
+}
+
+func init() {
+	rollbackCmd.PersistentFlags().StringVarP(&rollbackTo, "to", "", "", "the UUID of the deployment to roll back to")
+	rollbackCmd.PersistentFlags().BoolVarP(&rollbackList, "list", "", false, "list the deployments")
+	rootCmd.AddCommand(confirmCmd)
+	rootCmd.AddCommand(approveCmd)
+	rootCmd.AddCommand(rollbackCmd)
+}
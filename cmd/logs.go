@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	logsFollow     bool
+	logsDeployment bool
+)
+
+var logsCmd = &cobra.Command{
+	Use:   "logs [UUID]",
+	Short: "Show the logs of a generation or a deployment",
+	Long:  "This command shows the evaluation and build logs of a generation or, with --deployment, the activation logs of a deployment. Without UUID, the logs of the current generation (or deployment) are shown. The UUIDs are shown by 'comin status' and 'comin rollback --list'.",
+	Args:  cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		var id string
+		if len(args) == 1 {
+			id = args[0]
+		} else {
+			status, err := getStatus()
+			if err != nil {
+				fmt.Printf("error: %s\n", err)
+				os.Exit(1)
+			}
+			if logsDeployment && status.Deployer.Deployment != nil {
+				id = status.Deployer.Deployment.UUID
+			} else if !logsDeployment {
+				id = status.Builder.GenerationUUID
+			}
+			if id == "" {
+				fmt.Printf("error: there is no current generation or deployment\n")
+				os.Exit(1)
+			}
+		}
+		kind := "generations"
+		if logsDeployment {
+			kind = "deployments"
+		}
+		path := fmt.Sprintf("/api/%s/%s/logs", kind, id)
+		if logsFollow {
+			path += "?follow=1"
+		}
+		req, err := newApiRequest(http.MethodGet, path)
+		if err != nil {
+			fmt.Printf("error: %s\n", err)
+			os.Exit(1)
+		}
+		// The client has no timeout since the log is streamed
+		// until it is closed
+		client, err := apiClient(0)
+		if err != nil {
+			fmt.Printf("error: %s\n", err)
+			os.Exit(1)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			fmt.Printf("error: %s\n", err)
+			os.Exit(1)
+		}
+		defer resp.Body.Close() // nolint
+		if resp.StatusCode != http.StatusOK {
+			body, _ := io.ReadAll(resp.Body)
+			fmt.Printf("error: %s\n", string(body))
+			os.Exit(1)
+		}
+		_, _ = io.Copy(os.Stdout, resp.Body)
+	},
+}
+
+func init() {
+	logsCmd.Flags().BoolVarP(&logsFollow, "follow", "f", false, "follow the log until the evaluation, the build or the deployment is finished")
+	logsCmd.Flags().BoolVarP(&logsDeployment, "deployment", "", false, "show the logs of a deployment")
+	rootCmd.AddCommand(logsCmd)
+}
@@ -1,10 +1,7 @@
 package cmd
 
 import (
-	"fmt"
-	"io"
-	"net/http"
-	"time"
+	"net/url"
 
 	"github.com/spf13/cobra"
 )
@@ -15,19 +12,7 @@ var suspendCmd = &cobra.Command{
 	Long:  "This command suspends the build and deploy operations. If a build is running, it is stopped. If a deployment is running, it is not interupted but future deployment will be suspended.",
 	Args:  cobra.MinimumNArgs(0),
 	Run: func(cmd *cobra.Command, args []string) {
-		url := "http://localhost:4242/api/manager/suspend"
-		client := http.Client{
-			Timeout: time.Second * 2,
-		}
-		req, err := http.NewRequest(http.MethodPost, url, nil)
-		if err != nil {
-			return
-		}
-		resp, _ := client.Do(req)
-		if resp.StatusCode != http.StatusOK {
-			body, _ := io.ReadAll(resp.Body)
-			fmt.Printf("error: %s", string(body))
-		}
+		postApi("/api/manager/suspend", nil)
 	},
 }
 var resumeCmd = &cobra.Command{
@@ -36,23 +21,32 @@ var resumeCmd = &cobra.Command{
 	Long:  "This command resumes the build and deploy operations. If a build has been suspended, it will be restarted.",
 	Args:  cobra.MinimumNArgs(0),
 	Run: func(cmd *cobra.Command, args []string) {
-		url := "http://localhost:4242/api/manager/resume"
-		client := http.Client{
-			Timeout: time.Second * 2,
-		}
-		req, err := http.NewRequest(http.MethodPost, url, nil)
-		if err != nil {
-			return
-		}
-		resp, _ := client.Do(req)
-		if resp.StatusCode != http.StatusOK {
-			body, _ := io.ReadAll(resp.Body)
-			fmt.Printf("error: %s", string(body))
-		}
+		postApi("/api/manager/resume", nil)
+	},
+}
+
+var pinCmd = &cobra.Command{
+	Use:   "pin COMMIT",
+	Short: "Pin the machine to a commit",
+	Long:  "This command pins the machine to a commit: the remotes are still fetched but this commit is deployed until 'comin unpin' is run. The commit has to be the head of a main branch or one of its ancestors.",
+	Args:  cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		postApi("/api/manager/pin", url.Values{"commit": []string{args[0]}})
+	},
+}
+var unpinCmd = &cobra.Command{
+	Use:   "unpin",
+	Short: "Unpin the machine",
+	Long:  "This command removes the pin of the machine: the heads of the branches are deployed again.",
+	Args:  cobra.MinimumNArgs(0),
+	Run: func(cmd *cobra.Command, args []string) {
+		postApi("/api/manager/unpin", nil)
 	},
 }
 
 func init() {
 	rootCmd.AddCommand(suspendCmd)
 	rootCmd.AddCommand(resumeCmd)
+	rootCmd.AddCommand(pinCmd)
+	rootCmd.AddCommand(unpinCmd)
 }
@@ -1,6 +1,7 @@
 package cmd
 
 import (
+	"errors"
 	"os"
 	"path"
 	"runtime"
@@ -9,10 +10,13 @@ import (
 	"github.com/nlewo/comin/internal/builder"
 	"github.com/nlewo/comin/internal/config"
 	"github.com/nlewo/comin/internal/deployer"
+	"github.com/nlewo/comin/internal/events"
 	executorPkg "github.com/nlewo/comin/internal/executor"
 	"github.com/nlewo/comin/internal/fetcher"
 	"github.com/nlewo/comin/internal/http"
+	logsPkg "github.com/nlewo/comin/internal/logs"
 	"github.com/nlewo/comin/internal/manager"
+	"github.com/nlewo/comin/internal/notifier"
 	"github.com/nlewo/comin/internal/prometheus"
 	"github.com/nlewo/comin/internal/repository"
 	"github.com/nlewo/comin/internal/scheduler"
@@ -53,15 +57,26 @@ var runCmd = &cobra.Command{
 		metrics := prometheus.New()
 		storeFilename := path.Join(cfg.StateDir, "store.json")
 		gcRootsDir := path.Join(cfg.StateDir, "gcroots")
-		store, err := storePkg.New(storeFilename, gcRootsDir, 10, 10)
+		bus := events.New()
+		store, err := storePkg.New(storeFilename, gcRootsDir, cfg.Store.CapacityMain, cfg.Store.CapacityTesting, cfg.Store.CapacityGenerations, bus)
 		if err != nil {
 			logrus.Error(err)
 			os.Exit(1)
 		}
-		if err := store.Load(); err != nil {
+		if err := store.Load(); errors.Is(err, storePkg.ErrUnsupportedVersion) {
+			// The state file must not be overwritten since it
+			// would lose data of the more recent comin version
+			logrus.Errorf("Failed to load the state file %s: %s", storeFilename, err)
+			os.Exit(1)
+		} else if err != nil {
 			logrus.Errorf("Ignoring the state file %s because of the loading error: %s", storeFilename, err)
 		}
 		metrics.SetBuildInfo(cmd.Version)
+		logs, err := logsPkg.New(path.Join(cfg.StateDir, "logs"))
+		if err != nil {
+			logrus.Errorf("Failed to create the logs directory: %s", err)
+			os.Exit(1)
+		}
 
 		// We get the last mainCommitId to avoid useless
 		// redeployment as well as non fast forward checkouts
@@ -78,20 +93,37 @@ var runCmd = &cobra.Command{
 			os.Exit(1)
 		}
 
-		fetcher := fetcher.NewFetcher(repository)
-		fetcher.Start()
+		if pin := store.Pin(); pin != nil {
+			logrus.Infof("The machine is pinned to the commit %s", pin.CommitId)
+			repository.SetPin(pin.CommitId)
+		}
+
+		fetcher := fetcher.NewFetcher(repository, bus)
 		sched := scheduler.New()
-		sched.FetchRemotes(fetcher, cfg.Remotes)
 
-		builder := builder.New(store, executor, gitConfig.Path, gitConfig.Dir, cfg.Hostname, 30*time.Minute, 30*time.Minute)
-		deployer := deployer.New(executor.Deploy, lastDeployment, cfg.PostDeploymentCommand)
+		builder := builder.New(store, executor, gitConfig.Path, gitConfig.Dir, cfg.Hostname,
+			time.Duration(cfg.Builder.EvalTimeout)*time.Second, time.Duration(cfg.Builder.BuildTimeout)*time.Second, logs, bus)
+		deployer := deployer.New(executor.Deploy, executor.DiffClosures, executor.RebootReasons, lastDeployment, store.LastActivatedOutPath(), cfg.Hooks, cfg.HealthChecks, cfg.Confirmation, cfg.Remotes, logs, bus)
 
-		manager := manager.New(store, metrics, sched, fetcher, builder, deployer, machineId, executor)
+		notifier, err := notifier.New(cfg.Notifiers, cfg.Hostname)
+		if err != nil {
+			logrus.Errorf("Failed to create the notifier: %s", err)
+			os.Exit(1)
+		}
+
+		manager := manager.New(store, metrics, sched, fetcher, builder, deployer, machineId, executor, cfg.Reboot, cfg.Drift, logs, bus)
+		notifier.Run(bus)
+
+		// The fetcher is started once the manager and the notifier
+		// are subscribed to its events
+		fetcher.Start()
+		sched.FetchRemotes(fetcher, cfg.Remotes)
 
 		http.Serve(manager,
 			metrics,
-			cfg.ApiServer.ListenAddress, cfg.ApiServer.Port,
-			cfg.Exporter.ListenAddress, cfg.Exporter.Port)
+			cfg.ApiServer,
+			cfg.Exporter,
+			cfg.Webhook, cfg.Remotes)
 		manager.Run()
 	},
 }
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"io"
 	"net/http"
+	"strings"
 	"time"
 
 	"github.com/dustin/go-humanize"
@@ -15,14 +16,17 @@ import (
 	"github.com/spf13/cobra"
 )
 
-var statusOneline bool
+var (
+	statusOneline bool
+	statusWatch   bool
+)
 
 func getStatus() (status manager.State, err error) {
-	url := "http://localhost:4242/api/status"
-	client := http.Client{
-		Timeout: time.Second * 2,
+	client, err := apiClient(time.Second * 2)
+	if err != nil {
+		return
 	}
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	req, err := newApiRequest(http.MethodGet, "/api/status")
 	if err != nil {
 		return
 	}
@@ -37,6 +41,10 @@ func getStatus() (status manager.State, err error) {
 	if err != nil {
 		return
 	}
+	if res.StatusCode != http.StatusOK {
+		err = fmt.Errorf("%s", string(body))
+		return
+	}
 	err = json.Unmarshal(body, &status)
 	if err != nil {
 		return
@@ -47,12 +55,31 @@ func getStatus() (status manager.State, err error) {
 func longStatus(status manager.State) {
 	fmt.Printf("Status of the machine %s\n", status.Builder.Hostname)
 	if status.NeedToReboot {
-		fmt.Printf("  Need to reboot: yes\n")
+		if len(status.RebootReasons) > 0 {
+			fmt.Printf("  Need to reboot: yes (%s)\n", strings.Join(status.RebootReasons, ", "))
+		} else {
+			fmt.Printf("  Need to reboot: yes\n")
+		}
+	}
+	if status.PendingReboot != nil {
+		fmt.Printf("  Pending reboot: requested %s by the deployment %s\n", humanize.Time(status.PendingReboot.RequestedAt), status.PendingReboot.DeploymentUUID)
+		if status.NextRebootAt != nil {
+			fmt.Printf("    Next reboot window: %s\n", humanize.Time(*status.NextRebootAt))
+		}
 	}
 	if status.IsSuspended {
 		fmt.Printf("  Is suspended: yes\n")
 	}
+	if status.Pin != nil {
+		fmt.Printf("  Pinned to the commit %s by %s %s\n", status.Pin.CommitId, status.Pin.By, humanize.Time(status.Pin.PinnedAt))
+	}
+	if status.Drift != nil {
+		fmt.Printf("  Drift: the running system %s is not the generation of the deployment %s (detected %s)\n", status.Drift.OutPath, status.Drift.DeploymentUUID, humanize.Time(status.Drift.DetectedAt))
+	}
 	fmt.Printf("  Fetcher\n")
+	if status.Fetcher.RepositoryStatus.ErrorMsg != "" {
+		fmt.Printf("    Error: %s\n", status.Fetcher.RepositoryStatus.ErrorMsg)
+	}
 	if status.Fetcher.RepositoryStatus.SelectedCommitShouldBeSigned {
 		if status.Fetcher.RepositoryStatus.SelectedCommitSigned {
 			fmt.Printf("    Commit %s signed by %s\n", status.Fetcher.RepositoryStatus.SelectedCommitId, status.Fetcher.RepositoryStatus.SelectedCommitSignedBy)
@@ -64,10 +91,24 @@ func longStatus(status manager.State) {
 		fmt.Printf("    Remote %s %s fetched %s\n",
 			r.Name, r.Url, humanize.Time(r.FetchedAt),
 		)
+		if r.Main != nil && r.Main.ErrorMsg != "" {
+			fmt.Printf("      Branch %s: %s\n", r.Main.Name, r.Main.ErrorMsg)
+		}
+		if r.Testing != nil && r.Testing.ErrorMsg != "" {
+			fmt.Printf("      Branch %s: %s\n", r.Testing.Name, r.Testing.ErrorMsg)
+		}
 	}
 	fmt.Printf("  Builder\n")
 	if status.Builder.Generation != nil {
 		store.GenerationShow(*status.Builder.Generation)
+		if p := status.Builder.BuildProgress; p != nil {
+			fmt.Printf("      Derivations built: %d/%d\n", p.DerivationsBuilt, p.DerivationsTotal)
+			fmt.Printf("      Paths downloaded: %d/%d (%s/%s)\n", p.PathsDownloaded, p.PathsTotal,
+				humanize.Bytes(uint64(p.BytesDownloaded)), humanize.Bytes(uint64(p.BytesTotal)))
+			for _, drvPath := range p.RunningBuilds {
+				fmt.Printf("      Building %s\n", drvPath)
+			}
+		}
 	} else {
 		fmt.Printf("    No build available\n")
 	}
@@ -79,12 +120,18 @@ func onelineStatus(status manager.State) {
 	if status.IsSuspended {
 		fmt.Printf(" ⏸️ ")
 	}
+	if status.Drift != nil {
+		fmt.Printf(" ⚠️ ")
+	}
 	if status.Builder.Generation != nil && status.Builder.IsEvaluating {
 		fmt.Printf(" eval   %s/%s (%s)", status.Builder.Generation.SelectedRemoteName, status.Builder.Generation.SelectedBranchName,
 			humanize.Time(status.Builder.Generation.EvalStartedAt))
 	} else if status.Builder.Generation != nil && status.Builder.IsBuilding {
 		fmt.Printf(" build  %s/%s (%s)", status.Builder.Generation.SelectedRemoteName, status.Builder.Generation.SelectedBranchName,
 			humanize.Time(status.Builder.Generation.BuildStartedAt))
+		if p := status.Builder.BuildProgress; p != nil && p.DerivationsTotal > 0 {
+			fmt.Printf(" %d/%d", p.DerivationsBuilt, p.DerivationsTotal)
+		}
 	} else if status.Builder.Generation != nil && status.Builder.Generation.EvalStatus == store.EvalFailed {
 		fmt.Printf(" %s/%s (%s)", status.Builder.Generation.SelectedRemoteName, status.Builder.Generation.SelectedBranchName,
 			humanize.Time(status.Builder.Generation.EvalEndedAt))
@@ -102,18 +149,109 @@ func onelineStatus(status manager.State) {
 		case store.Done:
 			fmt.Printf(" %s/%s (%s)", status.Deployer.Deployment.Generation.SelectedRemoteName, status.Deployer.Deployment.Generation.SelectedBranchName,
 				humanize.Time(status.Deployer.Deployment.EndedAt))
+		case store.RolledBack:
+			fmt.Printf(" %s/%s (%s)", status.Deployer.Deployment.Generation.SelectedRemoteName, status.Deployer.Deployment.Generation.SelectedBranchName,
+				humanize.Time(status.Deployer.Deployment.EndedAt))
 		}
 	}
-	if status.NeedToReboot {
+	if status.NeedToReboot || status.PendingReboot != nil {
 		fmt.Printf(" ")
 	}
 }
 
+// watchEvents reads the event stream of the API and sends the type of
+// each received event on the returned channel. The error channel
+// receives the error closing the stream.
+func watchEvents() (<-chan string, <-chan error) {
+	eventCh := make(chan string)
+	errCh := make(chan error, 1)
+	go func() {
+		req, err := newApiRequest(http.MethodGet, "/api/events?format=ndjson")
+		if err != nil {
+			errCh <- err
+			return
+		}
+		// The client has no timeout since the events are
+		// streamed until the stream is closed
+		client, err := apiClient(0)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			errCh <- err
+			return
+		}
+		defer resp.Body.Close() // nolint
+		if resp.StatusCode != http.StatusOK {
+			errCh <- fmt.Errorf("unexpected status %s", resp.Status)
+			return
+		}
+		decoder := json.NewDecoder(resp.Body)
+		for {
+			var e struct {
+				Type string `json:"type"`
+			}
+			if err := decoder.Decode(&e); err != nil {
+				if err == io.EOF {
+					err = fmt.Errorf("the event stream has been closed")
+				}
+				errCh <- err
+				return
+			}
+			eventCh <- e.Type
+		}
+	}()
+	return eventCh, errCh
+}
+
+// watchStatus shows the status each time an event is received. While
+// a build is running, the status is also periodically refreshed to
+// show the build progress.
+func watchStatus() {
+	eventCh, errCh := watchEvents()
+	refresh := time.NewTicker(2 * time.Second)
+	defer refresh.Stop()
+	for {
+		status, err := getStatus()
+		if err != nil {
+			logrus.Fatal(err)
+		}
+		if statusOneline {
+			onelineStatus(status)
+			fmt.Printf("\n")
+		} else {
+			// Clear the terminal
+			fmt.Printf("\033[H\033[2J")
+			longStatus(status)
+		}
+	wait:
+		for {
+			select {
+			case <-eventCh:
+				break wait
+			case <-refresh.C:
+				if status.Builder.IsBuilding {
+					break wait
+				}
+			case err := <-errCh:
+				logrus.Fatal(err)
+			}
+		}
+	}
+}
+
 var statusCmd = &cobra.Command{
 	Use:   "status",
 	Short: "Get the status of the local machine",
+	Long:  "This command shows the status of the local machine. With --watch, the status is shown again each time the fetcher, the builder, the deployer or the store publishes an event on the /api/events stream.",
 	Args:  cobra.MinimumNArgs(0),
 	Run: func(cmd *cobra.Command, args []string) {
+		if statusWatch {
+			watchStatus()
+			return
+		}
 		status, err := getStatus()
 		if err != nil {
 			logrus.Fatal(err)
@@ -128,5 +266,6 @@ var statusCmd = &cobra.Command{
 
 func init() {
 	statusCmd.PersistentFlags().BoolVarP(&statusOneline, "oneline", "", false, "oneline")
+	statusCmd.PersistentFlags().BoolVarP(&statusWatch, "watch", "w", false, "show the status again on each state change")
 	rootCmd.AddCommand(statusCmd)
 }
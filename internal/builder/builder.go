@@ -12,17 +12,25 @@ package builder
 import (
 	"context"
 	"fmt"
+	"io"
 	"sync"
 	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/nlewo/comin/internal/events"
 	"github.com/nlewo/comin/internal/executor"
+	"github.com/nlewo/comin/internal/logs"
 	"github.com/nlewo/comin/internal/repository"
 	"github.com/nlewo/comin/internal/store"
+	"github.com/nlewo/comin/internal/types"
 	"github.com/sirupsen/logrus"
 )
 
+// closureDiffTimeout is the maximal duration of the computation of the
+// closure diff of a built generation
+const closureDiffTimeout = 5 * time.Minute
+
 type Builder struct {
 	store          *store.Store
 	executor       executor.Executor
@@ -31,10 +39,16 @@ type Builder struct {
 	repositoryDir  string
 	evalTimeout    time.Duration
 	buildTimeout   time.Duration
+	// The outputs of the evaluations and builds are written to
+	// the logs of the generations
+	logs *logs.Logs
 
 	mu           sync.Mutex
 	isEvaluating atomic.Bool
 	isBuilding   atomic.Bool
+	// The progress of the running build. nil when no build is
+	// running.
+	buildProgress atomic.Pointer[types.BuildProgress]
 
 	// GenerationUUID is the generation UUID currently managed by
 	// the builder. This generation can be evaluating, evaluated,
@@ -42,10 +56,9 @@ type Builder struct {
 	// To access this generation, you need to query the store.
 	GenerationUUID *uuid.UUID
 
-	// EvaluationDone is used to be notified a evaluation is finished. Be careful since only a single goroutine can listen it.
-	EvaluationDone chan uuid.UUID
-	// BuildDone is used to be notified a build is finished. Be careful since only a single goroutine can listen it.
-	BuildDone chan uuid.UUID
+	// The EvaluationDone and BuildDone events are published on
+	// the bus
+	bus *events.Bus
 
 	evaluator   Exec
 	evaluatorWg *sync.WaitGroup
@@ -53,10 +66,16 @@ type Builder struct {
 	buildator   Exec
 	buildatorWg *sync.WaitGroup
 
+	// The closure diff is computed in the background since it is
+	// only a report: it doesn't delay the deployment of the
+	// generation. It is canceled by Stop.
+	closureDiffCancel context.CancelFunc
+	closureDiffWg     *sync.WaitGroup
+
 	isSuspended bool
 }
 
-func New(store *store.Store, executor executor.Executor, repositoryPath, repositoryDir, hostname string, evalTimeout time.Duration, buildTimeout time.Duration) *Builder {
+func New(store *store.Store, executor executor.Executor, repositoryPath, repositoryDir, hostname string, evalTimeout time.Duration, buildTimeout time.Duration, logs *logs.Logs, bus *events.Bus) *Builder {
 	logrus.Infof("builder: initialization with repositoryPath=%s, repositoryDir=%s, hostname=%s, evalTimeout=%fs, buildTimeout=%fs, )",
 		repositoryPath, repositoryDir, hostname, evalTimeout.Seconds(), buildTimeout.Seconds())
 	return &Builder{
@@ -67,10 +86,11 @@ func New(store *store.Store, executor executor.Executor, repositoryPath, reposit
 		hostname:       hostname,
 		evalTimeout:    evalTimeout,
 		buildTimeout:   buildTimeout,
-		EvaluationDone: make(chan uuid.UUID, 1),
-		BuildDone:      make(chan uuid.UUID, 1),
+		logs:           logs,
+		bus:            bus,
 		evaluatorWg:    &sync.WaitGroup{},
 		buildatorWg:    &sync.WaitGroup{},
+		closureDiffWg:  &sync.WaitGroup{},
 	}
 }
 
@@ -81,6 +101,8 @@ type State struct {
 	Generation     *store.Generation `json:"generation"`
 	GenerationUUID string            `json:"generation_uuid"`
 	IsSuspended    bool              `json:"is_suspended"`
+	// BuildProgress is set when a build is running
+	BuildProgress *types.BuildProgress `json:"build_progress,omitempty"`
 }
 
 func (b *Builder) State() State {
@@ -104,9 +126,16 @@ func (b *Builder) State() State {
 		Generation:     generation,
 		GenerationUUID: generationUUID,
 		IsSuspended:    b.isSuspended,
+		BuildProgress:  b.buildProgress.Load(),
 	}
 }
 
+// BuildProgress returns the progress of the running build or nil if
+// no build is running.
+func (b *Builder) BuildProgress() *types.BuildProgress {
+	return b.buildProgress.Load()
+}
+
 func (b *Builder) IsEvaluating() bool {
 	return b.isEvaluating.Load()
 }
@@ -139,7 +168,11 @@ func (b *Builder) Stop() {
 	b.stopBuild()
 
 	b.mu.Lock()
-	defer b.mu.Unlock()
+	if b.closureDiffCancel != nil {
+		b.closureDiffCancel()
+	}
+	b.mu.Unlock()
+	b.closureDiffWg.Wait()
 }
 
 type Evaluator struct {
@@ -147,6 +180,7 @@ type Evaluator struct {
 	hostname string
 
 	evalFunc executor.EvalFunc
+	logs     io.Writer
 
 	drvPath   string
 	outPath   string
@@ -154,17 +188,19 @@ type Evaluator struct {
 }
 
 func (r *Evaluator) Run(ctx context.Context) (err error) {
-	r.drvPath, r.outPath, r.machineId, err = r.evalFunc(ctx, r.flakeUrl, r.hostname)
+	r.drvPath, r.outPath, r.machineId, err = r.evalFunc(ctx, r.flakeUrl, r.hostname, r.logs)
 	return err
 }
 
 type Buildator struct {
-	drvPath   string
-	buildFunc executor.BuildFunc
+	drvPath    string
+	buildFunc  executor.BuildFunc
+	logs       io.Writer
+	onProgress executor.ProgressFunc
 }
 
 func (r *Buildator) Run(ctx context.Context) (err error) {
-	return r.buildFunc(ctx, r.drvPath)
+	return r.buildFunc(ctx, r.drvPath, r.logs, r.onProgress)
 }
 
 // Eval evaluates a generation. It cancels current any generation
@@ -189,10 +225,13 @@ func (b *Builder) Eval(rs repository.RepositoryStatus) error {
 	}
 	b.GenerationUUID = &g.UUID
 
+	log := b.logs.Open(logs.Generation, g.UUID.String())
+	fmt.Fprintf(log, "comin: evaluating the commit %s of %s/%s\n", g.SelectedCommitId, g.SelectedRemoteName, g.SelectedBranchName)
 	evaluator := &Evaluator{
 		hostname: b.hostname,
 		flakeUrl: g.FlakeUrl,
 		evalFunc: b.executor.Eval,
+		logs:     log,
 	}
 	b.evaluator = NewExec(evaluator, b.evalTimeout)
 
@@ -203,6 +242,11 @@ func (b *Builder) Eval(rs repository.RepositoryStatus) error {
 	go func() {
 		defer b.evaluatorWg.Done()
 		b.evaluator.Wait()
+		if err := b.evaluator.getErr(); err != nil {
+			fmt.Fprintf(log, "comin: the evaluation failed: %s\n", err)
+		}
+		_ = log.Close()
+		alreadyBuilt := b.evaluator.getErr() == nil && b.executor.IsStorePathExist(evaluator.outPath)
 		b.mu.Lock()
 		defer b.mu.Unlock()
 		if err := b.store.GenerationEvalFinished(
@@ -216,28 +260,47 @@ func (b *Builder) Eval(rs repository.RepositoryStatus) error {
 		}
 
 		b.isEvaluating.Store(false)
-		if b.executor.IsStorePathExist(evaluator.outPath) {
+		if alreadyBuilt {
 			if err := b.store.GenerationBuildStart(g.UUID); err != nil {
 				logrus.Errorf("builder: %s", err)
 			}
 			if err := b.store.GenerationBuildFinished(g.UUID, nil); err != nil {
 				logrus.Errorf("builder: %s", err)
 			}
-			select {
-			case b.BuildDone <- g.UUID:
-			default:
-			}
-
+			b.startClosureDiff(g.UUID, evaluator.outPath)
+		}
+		generation, err := b.store.GenerationGet(g.UUID)
+		if err != nil {
+			logrus.Errorf("builder: %s", err)
+			return
+		}
+		if alreadyBuilt {
+			b.bus.Publish(BuildDone{Generation: generation})
 		} else {
-			select {
-			case b.EvaluationDone <- g.UUID:
-			default:
-			}
+			b.bus.Publish(EvaluationDone{Generation: generation})
 		}
 	}()
 	return nil
 }
 
+// Adopt makes the builder manage the last generation of the store,
+// which could have been loaded from the store file at startup. This
+// allows to expose the last evaluation and build after a restart of
+// comin. It returns true if this generation is built: it could then
+// be deployed without being evaluated again.
+func (b *Builder) Adopt() (generation store.Generation, built bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	generation, ok := b.store.LastGeneration()
+	if !ok {
+		return generation, false
+	}
+	logrus.Infof("builder: adopting the generation %s with eval status '%s' and build status '%s'",
+		generation.UUID, generation.EvalStatus, generation.BuildStatus)
+	b.GenerationUUID = &generation.UUID
+	return generation, generation.BuildStatus == store.Built
+}
+
 func (b *Builder) Suspend() error {
 	if b.isSuspended {
 		return fmt.Errorf("the builder is already suspended")
@@ -258,6 +321,10 @@ func (b *Builder) Resume() error {
 		return fmt.Errorf("the builder is not suspended")
 	} else {
 		b.isSuspended = false
+		if b.GenerationUUID == nil {
+			logrus.Infof("builder: builder is resumed while no generation has to be built")
+			return nil
+		}
 		generation, err := b.store.GenerationGet(*b.GenerationUUID)
 		if err != nil {
 			return err
@@ -292,6 +359,41 @@ func (b *Builder) SubmitBuild(generationUUID uuid.UUID) {
 	}
 }
 
+// startClosureDiff computes in the background the differences
+// between the closure of the running system and the closure of the
+// built generation. A ClosureDiffDone event is published once it is
+// stored in the generation. It cancels the computation of a previous
+// closure diff. This is not thread safe.
+func (b *Builder) startClosureDiff(generationUUID uuid.UUID, outPath string) {
+	if b.closureDiffCancel != nil {
+		b.closureDiffCancel()
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), closureDiffTimeout)
+	b.closureDiffCancel = cancel
+	b.closureDiffWg.Add(1)
+	go func() {
+		defer b.closureDiffWg.Done()
+		defer cancel()
+		diff, err := b.executor.DiffClosures(ctx, outPath)
+		if err != nil {
+			logrus.Errorf("builder: failed to compute the closure diff of the generation %s: %s", generationUUID, err)
+			err = b.store.GenerationClosureDiffSet(generationUUID, nil, err)
+		} else {
+			err = b.store.GenerationClosureDiffSet(generationUUID, &diff, nil)
+		}
+		if err != nil {
+			logrus.Errorf("builder: %s", err)
+			return
+		}
+		generation, err := b.store.GenerationGet(generationUUID)
+		if err != nil {
+			logrus.Errorf("builder: %s", err)
+			return
+		}
+		b.bus.Publish(ClosureDiffDone{Generation: generation})
+	}()
+}
+
 // build builds a generation which has been previously evaluated. This is not thread safe.
 func (b *Builder) build(generationUUID uuid.UUID) error {
 	logrus.Infof("builder: build of generation %s is starting", generationUUID.String())
@@ -318,9 +420,16 @@ func (b *Builder) build(generationUUID uuid.UUID) error {
 		return err
 	}
 	b.isBuilding.Store(true)
+	log := b.logs.Open(logs.Generation, generationUUID.String())
+	fmt.Fprintf(log, "comin: building the derivation %s\n", generation.DrvPath)
+	b.buildProgress.Store(&types.BuildProgress{})
 	buildator := &Buildator{
 		drvPath:   generation.DrvPath,
 		buildFunc: b.executor.Build,
+		logs:      log,
+		onProgress: func(progress types.BuildProgress) {
+			b.buildProgress.Store(&progress)
+		},
 	}
 	b.buildator = NewExec(buildator, b.buildTimeout)
 
@@ -331,17 +440,26 @@ func (b *Builder) build(generationUUID uuid.UUID) error {
 	go func() {
 		defer b.buildatorWg.Done()
 		b.buildator.Wait()
+		if err := b.buildator.getErr(); err != nil {
+			fmt.Fprintf(log, "comin: the build failed: %s\n", err)
+		}
+		_ = log.Close()
 		b.mu.Lock()
 		defer b.mu.Unlock()
+		b.buildProgress.Store(nil)
 		err := b.store.GenerationBuildFinished(generationUUID, b.buildator.getErr())
 		if err != nil {
 			logrus.Error(err)
 		}
+		if b.buildator.getErr() == nil {
+			b.startClosureDiff(generationUUID, generation.OutPath)
+		}
 		b.isBuilding.Store(false)
-		select {
-		case b.BuildDone <- generationUUID:
-		default:
+		if generation, err = b.store.GenerationGet(generationUUID); err != nil {
+			logrus.Errorf("builder: %s", err)
+			return
 		}
+		b.bus.Publish(BuildDone{Generation: generation})
 	}()
 	return nil
 }
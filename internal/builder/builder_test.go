@@ -1,13 +1,20 @@
 package builder
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"io"
 	"log"
 	"testing"
 	"time"
 
+	"github.com/nlewo/comin/internal/events"
+	"github.com/nlewo/comin/internal/executor"
+	"github.com/nlewo/comin/internal/logs"
 	"github.com/nlewo/comin/internal/repository"
 	"github.com/nlewo/comin/internal/store"
+	"github.com/nlewo/comin/internal/types"
 	"github.com/stretchr/testify/assert"
 
 	"net/http"
@@ -18,33 +25,59 @@ type ExecutorMock struct {
 	evalDone     chan struct{}
 	buildDone    chan struct{}
 	alreadyBuilt bool
+	// The closure diff blocks until it is canceled
+	slowDiff bool
 }
 
 func (n ExecutorMock) ReadMachineId() (string, error) {
 	return "", nil
 }
-func (n ExecutorMock) NeedToReboot() bool {
-	return false
+func (n ExecutorMock) NeedToReboot() []string {
+	return nil
+}
+func (n ExecutorMock) RebootReasons(outPath string) []string {
+	return nil
+}
+func (n ExecutorMock) Reboot() error {
+	return nil
+}
+func (n ExecutorMock) ReadBootId() (string, error) {
+	return "", nil
+}
+func (n ExecutorMock) CurrentSystem() (string, error) {
+	return "", nil
 }
 func (n ExecutorMock) IsStorePathExist(storePath string) bool {
 	return n.alreadyBuilt
 }
-func (n ExecutorMock) Deploy(ctx context.Context, outPath, operation string) (needToRestartComin bool, profilePath string, err error) {
+func (n ExecutorMock) DiffClosures(ctx context.Context, outPath string) (types.ClosureDiff, error) {
+	if n.slowDiff {
+		<-ctx.Done()
+		return types.ClosureDiff{}, ctx.Err()
+	}
+	return types.ClosureDiff{Added: []types.PackageChange{{Name: outPath}}, SizeDelta: 1024}, nil
+}
+func (n ExecutorMock) Deploy(ctx context.Context, outPath, operation string, logs io.Writer) (needToRestartComin bool, profilePath string, err error) {
 	return false, "", nil
 }
-func (n ExecutorMock) Eval(ctx context.Context, flakeUrl, hostname string) (drvPath string, outPath string, machineId string, err error) {
+func (n ExecutorMock) Eval(ctx context.Context, flakeUrl, hostname string, logs io.Writer) (drvPath string, outPath string, machineId string, err error) {
 	select {
 	case <-ctx.Done():
 		return "", "", "", ctx.Err()
 	case <-n.evalDone:
+		fmt.Fprintf(logs, "evaluated\n")
 		return "drv-path", "out-path", "", nil
 	}
 }
-func (n ExecutorMock) Build(ctx context.Context, drvPath string) (err error) {
+func (n ExecutorMock) Build(ctx context.Context, drvPath string, logs io.Writer, onProgress executor.ProgressFunc) (err error) {
+	if onProgress != nil {
+		onProgress(types.BuildProgress{DerivationsBuilt: 1, DerivationsTotal: 2, RunningBuilds: []string{drvPath}})
+	}
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
 	case <-n.buildDone:
+		fmt.Fprintf(logs, "built\n")
 		return nil
 	}
 }
@@ -62,14 +95,16 @@ func TestBuilderBuild(t *testing.T) {
 	}()
 
 	tmp := t.TempDir()
-	s, err := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1)
+	s, err := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1, 10, nil)
 	assert.Nil(t, err)
 	eMock := NewExecutorMock(false)
-	b := New(s, eMock, "", "", "my-machine", 2*time.Second, 2*time.Second)
+	bus := events.New()
+	sub := bus.Subscribe()
+	b := New(s, eMock, "", "", "my-machine", 2*time.Second, 2*time.Second, nil, bus)
 
 	// Run the evaluator
 	_ = b.Eval(repository.RepositoryStatus{})
-	gUUID := <-b.EvaluationDone // The evaluation timeouts
+	gUUID := events.Next[EvaluationDone](sub).Generation.UUID // The evaluation timeouts
 	assert.ErrorContains(t, b.build(gUUID), "the generation is not evaluated")
 
 	_ = b.Eval(repository.RepositoryStatus{})
@@ -80,7 +115,7 @@ func TestBuilderBuild(t *testing.T) {
 	assert.EventuallyWithT(t, func(c *assert.CollectT) {
 		assert.False(c, b.isEvaluating.Load())
 	}, 2*time.Second, 100*time.Millisecond)
-	gUUID = <-b.EvaluationDone
+	gUUID = events.Next[EvaluationDone](sub).Generation.UUID
 
 	err = b.build(gUUID)
 	assert.Nil(t, err)
@@ -92,7 +127,7 @@ func TestBuilderBuild(t *testing.T) {
 
 	// Stop the evaluator and builder
 	b.Stop()
-	gUUID = <-b.BuildDone
+	gUUID = events.Next[BuildDone](sub).Generation.UUID
 	assert.EventuallyWithT(t, func(c *assert.CollectT) {
 		assert.False(c, b.isBuilding.Load())
 		g, _ := b.store.GenerationGet(gUUID)
@@ -115,6 +150,11 @@ func TestBuilderBuild(t *testing.T) {
 		assert.False(c, b.isBuilding.Load())
 	}, 3*time.Second, 100*time.Millisecond)
 
+	// The closure diff is computed once the generation is built
+	g := events.Next[ClosureDiffDone](sub).Generation
+	assert.Equal(t, gUUID, g.UUID)
+	assert.Equal(t, &types.ClosureDiff{Added: []types.PackageChange{{Name: "out-path"}}, SizeDelta: 1024}, g.ClosureDiff)
+
 	// The generation is already built
 	err = b.build(gUUID)
 	assert.ErrorContains(t, err, "the generation is already built")
@@ -122,15 +162,17 @@ func TestBuilderBuild(t *testing.T) {
 
 func TestEval(t *testing.T) {
 	tmp := t.TempDir()
-	s, err := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1)
+	s, err := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1, 10, nil)
 	assert.Nil(t, err)
 	eMock := NewExecutorMock(false)
-	b := New(s, eMock, "", "", "", 5*time.Second, 5*time.Second)
+	bus := events.New()
+	sub := bus.Subscribe()
+	b := New(s, eMock, "", "", "", 5*time.Second, 5*time.Second, nil, bus)
 	_ = b.Eval(repository.RepositoryStatus{})
 	assert.True(t, b.isEvaluating.Load())
 
 	eMock.evalDone <- struct{}{}
-	gUUID := <-b.EvaluationDone
+	gUUID := events.Next[EvaluationDone](sub).Generation.UUID
 	assert.EventuallyWithT(t, func(c *assert.CollectT) {
 		assert.False(c, b.isEvaluating.Load())
 		g, _ := b.store.GenerationGet(gUUID)
@@ -143,15 +185,18 @@ func TestEval(t *testing.T) {
 // TestEvalAlreadyBuilt tests the evaluation when the storepath has been already built.
 func TestEvalAlreadyBuilt(t *testing.T) {
 	tmp := t.TempDir()
-	s, err := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1)
+	s, err := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1, 10, nil)
 	assert.Nil(t, err)
 	eMock := NewExecutorMock(true)
-	b := New(s, eMock, "", "", "", 5*time.Second, 5*time.Second)
+	bus := events.New()
+	sub := bus.Subscribe()
+	b := New(s, eMock, "", "", "", 5*time.Second, 5*time.Second, nil, bus)
 	_ = b.Eval(repository.RepositoryStatus{})
 	assert.True(t, b.IsEvaluating())
 
 	eMock.evalDone <- struct{}{}
-	gUUID := <-b.BuildDone
+	gUUID := events.Next[BuildDone](sub).Generation.UUID
+	events.Next[ClosureDiffDone](sub)
 	assert.EventuallyWithT(t, func(c *assert.CollectT) {
 		assert.False(c, b.IsEvaluating())
 		g, _ := b.store.GenerationGet(gUUID)
@@ -162,12 +207,34 @@ func TestEvalAlreadyBuilt(t *testing.T) {
 	}, 2*time.Second, 100*time.Millisecond)
 }
 
+// TestBuilderSlowClosureDiff tests the closure diff doesn't delay the
+// end of the build and is canceled by Stop.
+func TestBuilderSlowClosureDiff(t *testing.T) {
+	tmp := t.TempDir()
+	s, err := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1, 10, nil)
+	assert.Nil(t, err)
+	eMock := NewExecutorMock(true)
+	eMock.slowDiff = true
+	bus := events.New()
+	sub := bus.Subscribe()
+	b := New(s, eMock, "", "", "", 5*time.Second, 5*time.Second, nil, bus)
+	_ = b.Eval(repository.RepositoryStatus{})
+	eMock.evalDone <- struct{}{}
+	g := events.Next[BuildDone](sub).Generation
+	assert.Equal(t, store.Built, g.BuildStatus)
+	assert.Nil(t, g.ClosureDiff)
+
+	b.Stop()
+	g = events.Next[ClosureDiffDone](sub).Generation
+	assert.Contains(t, g.ClosureDiffErr, "context canceled")
+}
+
 func TestBuilderPreemption(t *testing.T) {
 	tmp := t.TempDir()
-	s, err := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1)
+	s, err := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1, 10, nil)
 	assert.Nil(t, err)
 	eMock := NewExecutorMock(false)
-	b := New(s, eMock, "", "", "", 5*time.Second, 5*time.Second)
+	b := New(s, eMock, "", "", "", 5*time.Second, 5*time.Second, nil, nil)
 	_ = b.Eval(repository.RepositoryStatus{SelectedCommitId: "commit-1"})
 	assert.True(t, b.isEvaluating.Load())
 	assert.EventuallyWithT(t, func(c *assert.CollectT) {
@@ -186,10 +253,10 @@ func TestBuilderPreemption(t *testing.T) {
 
 func TestBuilderStop(t *testing.T) {
 	tmp := t.TempDir()
-	s, err := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1)
+	s, err := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1, 10, nil)
 	assert.Nil(t, err)
 	eMock := NewExecutorMock(false)
-	b := New(s, eMock, "", "", "", 5*time.Second, 5*time.Second)
+	b := New(s, eMock, "", "", "", 5*time.Second, 5*time.Second, nil, nil)
 	_ = b.Eval(repository.RepositoryStatus{})
 	assert.True(t, b.isEvaluating.Load())
 	b.Stop()
@@ -201,10 +268,10 @@ func TestBuilderStop(t *testing.T) {
 
 func TestBuilderTimeout(t *testing.T) {
 	tmp := t.TempDir()
-	s, err := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1)
+	s, err := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1, 10, nil)
 	assert.Nil(t, err)
 	eMock := NewExecutorMock(false)
-	b := New(s, eMock, "", "", "", 1*time.Second, 5*time.Second)
+	b := New(s, eMock, "", "", "", 1*time.Second, 5*time.Second, nil, nil)
 	_ = b.Eval(repository.RepositoryStatus{})
 	assert.True(t, b.isEvaluating.Load())
 	assert.EventuallyWithT(t, func(c *assert.CollectT) {
@@ -215,17 +282,19 @@ func TestBuilderTimeout(t *testing.T) {
 
 func TestBuilderSuspend(t *testing.T) {
 	tmp := t.TempDir()
-	s, err := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1)
+	s, err := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1, 10, nil)
 	assert.Nil(t, err)
 	eMock := NewExecutorMock(false)
-	b := New(s, eMock, "", "", "", 1*time.Second, 5*time.Second)
+	bus := events.New()
+	sub := bus.Subscribe()
+	b := New(s, eMock, "", "", "", 1*time.Second, 5*time.Second, nil, bus)
 	_ = b.Suspend()
 	assert.True(t, b.isSuspended)
 	_ = b.Eval(repository.RepositoryStatus{})
 	assert.True(t, b.isEvaluating.Load())
 
 	eMock.evalDone <- struct{}{}
-	gUUID := <-b.EvaluationDone
+	gUUID := events.Next[EvaluationDone](sub).Generation.UUID
 	assert.EventuallyWithT(t, func(c *assert.CollectT) {
 		assert.False(c, b.isEvaluating.Load())
 	}, 3*time.Second, 100*time.Millisecond)
@@ -239,3 +308,81 @@ func TestBuilderSuspend(t *testing.T) {
 		assert.True(c, b.isBuilding.Load())
 	}, 3*time.Second, 100*time.Millisecond)
 }
+
+func TestBuilderAdopt(t *testing.T) {
+	tmp := t.TempDir()
+	s, err := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1, 10, nil)
+	assert.Nil(t, err)
+	eMock := NewExecutorMock(true)
+	bus := events.New()
+	sub := bus.Subscribe()
+	b := New(s, eMock, "", "", "", 5*time.Second, 5*time.Second, nil, bus)
+	_, built := b.Adopt()
+	assert.False(t, built)
+	assert.Nil(t, b.GenerationUUID)
+
+	_ = b.Eval(repository.RepositoryStatus{SelectedCommitId: "commit-1"})
+	eMock.evalDone <- struct{}{}
+	gUUID := events.Next[BuildDone](sub).Generation.UUID
+	events.Next[ClosureDiffDone](sub)
+
+	// This simulates a restart of comin
+	s, err = store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1, 10, nil)
+	assert.Nil(t, err)
+	err = s.Load()
+	assert.Nil(t, err)
+	b = New(s, eMock, "", "", "", 5*time.Second, 5*time.Second, nil, bus)
+	g, built := b.Adopt()
+	assert.True(t, built)
+	assert.Equal(t, gUUID, g.UUID)
+	assert.Equal(t, "commit-1", g.SelectedCommitId)
+	assert.Equal(t, gUUID, *b.GenerationUUID)
+}
+
+func TestBuilderLogs(t *testing.T) {
+	tmp := t.TempDir()
+	s, _ := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1, 10, nil)
+	l, _ := logs.New(tmp + "/logs")
+	eMock := NewExecutorMock(false)
+	bus := events.New()
+	sub := bus.Subscribe()
+	b := New(s, eMock, "", "", "my-machine", 2*time.Second, 2*time.Second, l, bus)
+
+	_ = b.Eval(repository.RepositoryStatus{SelectedCommitId: "commit-1", SelectedRemoteName: "origin", SelectedBranchName: "main"})
+	eMock.evalDone <- struct{}{}
+	gUUID := events.Next[EvaluationDone](sub).Generation.UUID
+	_ = b.build(gUUID)
+	eMock.buildDone <- struct{}{}
+	events.Next[BuildDone](sub)
+	events.Next[ClosureDiffDone](sub)
+
+	var out bytes.Buffer
+	err := l.Read(context.TODO(), logs.Generation, gUUID.String(), &out, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "comin: evaluating the commit commit-1 of origin/main\nevaluated\ncomin: building the derivation drv-path\nbuilt\n", out.String())
+}
+
+func TestBuilderProgress(t *testing.T) {
+	tmp := t.TempDir()
+	s, _ := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1, 10, nil)
+	eMock := NewExecutorMock(false)
+	bus := events.New()
+	sub := bus.Subscribe()
+	b := New(s, eMock, "", "", "my-machine", 2*time.Second, 2*time.Second, nil, bus)
+	assert.Nil(t, b.State().BuildProgress)
+
+	_ = b.Eval(repository.RepositoryStatus{SelectedCommitId: "commit-1"})
+	eMock.evalDone <- struct{}{}
+	gUUID := events.Next[EvaluationDone](sub).Generation.UUID
+	_ = b.build(gUUID)
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		progress := b.State().BuildProgress
+		assert.NotNil(c, progress)
+		assert.Equal(c, &types.BuildProgress{DerivationsBuilt: 1, DerivationsTotal: 2, RunningBuilds: []string{"drv-path"}}, progress)
+	}, 2*time.Second, 100*time.Millisecond)
+
+	eMock.buildDone <- struct{}{}
+	events.Next[BuildDone](sub)
+	events.Next[ClosureDiffDone](sub)
+	assert.Nil(t, b.State().BuildProgress)
+}
@@ -0,0 +1,29 @@
+package builder
+
+import "github.com/nlewo/comin/internal/store"
+
+// EvaluationDone is published when the evaluation of a generation is
+// finished, successfully or not. It is not published when the
+// evaluated generation is already built: a BuildDone event is
+// published instead.
+type EvaluationDone struct {
+	Generation store.Generation `json:"generation"`
+}
+
+func (EvaluationDone) EventType() string { return "builder.evaluation_done" }
+
+// BuildDone is published when the build of a generation is finished,
+// successfully or not.
+type BuildDone struct {
+	Generation store.Generation `json:"generation"`
+}
+
+func (BuildDone) EventType() string { return "builder.build_done" }
+
+// ClosureDiffDone is published when the closure diff of a built
+// generation has been computed, successfully or not.
+type ClosureDiffDone struct {
+	Generation store.Generation `json:"generation"`
+}
+
+func (ClosureDiffDone) EventType() string { return "builder.closure_diff_done" }
@@ -1,10 +1,14 @@
 package config
 
 import (
+	"fmt"
+	"net/url"
 	"os"
 	"path/filepath"
 	"strings"
 
+	"github.com/nlewo/comin/internal/notifier"
+	"github.com/nlewo/comin/internal/scheduler"
 	"github.com/nlewo/comin/internal/types"
 	"github.com/sirupsen/logrus"
 	"gopkg.in/yaml.v2"
@@ -29,9 +33,72 @@ func Read(path string) (config types.Configuration, err error) {
 			}
 			config.Remotes[i].Auth.AccessToken = strings.TrimSpace(string(content))
 		}
+		if remote.Auth.SshPrivateKeyPassphrasePath != "" {
+			content, err := os.ReadFile(remote.Auth.SshPrivateKeyPassphrasePath)
+			if err != nil {
+				return config, err
+			}
+			config.Remotes[i].Auth.SshPrivateKeyPassphrase = strings.TrimRight(string(content), "\r\n")
+		}
 		if remote.Timeout == 0 {
 			config.Remotes[i].Timeout = 300
 		}
+		for _, branch := range []types.Branch{remote.Branches.Main, remote.Branches.Testing} {
+			switch branch.Operation {
+			case "", "switch", "test", "boot":
+			default:
+				return config, fmt.Errorf("the operation of the branch %s of the remote %s has to be switch, test or boot (current value: %s)", branch.Name, remote.Name, branch.Operation)
+			}
+			for _, w := range branch.Windows {
+				if err := scheduler.ValidateWindow(w); err != nil {
+					return config, fmt.Errorf("invalid window of the branch %s of the remote %s: %w", branch.Name, remote.Name, err)
+				}
+			}
+			for _, f := range branch.Freezes {
+				if err := scheduler.ValidateFreeze(f); err != nil {
+					return config, fmt.Errorf("invalid freeze of the branch %s of the remote %s: %w", branch.Name, remote.Name, err)
+				}
+			}
+		}
+	}
+
+	if config.Webhook.SecretPath != "" {
+		content, err := os.ReadFile(config.Webhook.SecretPath)
+		if err != nil {
+			return config, err
+		}
+		config.Webhook.Secret = strings.TrimSpace(string(content))
+	}
+
+	for name, server := range map[string]*types.HttpServer{
+		"api_server": &config.ApiServer,
+		"exporter":   &config.Exporter,
+	} {
+		if server.TokenPath != "" {
+			content, err := os.ReadFile(server.TokenPath)
+			if err != nil {
+				return config, err
+			}
+			server.Token = strings.TrimSpace(string(content))
+			if server.Token == "" {
+				return config, fmt.Errorf("the token of %s read from %s can not be empty", name, server.TokenPath)
+			}
+		}
+		if (server.TLS.CertPath == "") != (server.TLS.KeyPath == "") {
+			return config, fmt.Errorf("both the tls.cert_path and the tls.key_path of %s have to be set", name)
+		}
+		if server.TLS.ClientCAPath != "" && server.TLS.CertPath == "" {
+			return config, fmt.Errorf("the tls.client_ca_path of %s requires the tls.cert_path and the tls.key_path", name)
+		}
+	}
+	if config.Exporter.UnixSocket.Path != "" {
+		return config, fmt.Errorf("the exporter doesn't support a unix_socket")
+	}
+
+	for _, w := range config.Reboot.Windows {
+		if err := scheduler.ValidateWindow(w); err != nil {
+			return config, fmt.Errorf("invalid reboot window: %w", err)
+		}
 	}
 
 	if config.ApiServer.ListenAddress == "" {
@@ -52,10 +119,148 @@ func Read(path string) (config types.Configuration, err error) {
 	if config.FlakeSubdirectory == "" {
 		config.FlakeSubdirectory = "."
 	}
-	logrus.Debugf("Config is '%#v'", config)
+	for name, value := range map[string]*int{
+		"builder.eval_timeout":       &config.Builder.EvalTimeout,
+		"builder.build_timeout":      &config.Builder.BuildTimeout,
+		"store.capacity_main":        &config.Store.CapacityMain,
+		"store.capacity_testing":     &config.Store.CapacityTesting,
+		"store.capacity_generations": &config.Store.CapacityGenerations,
+		"health_checks.timeout":      &config.HealthChecks.Timeout,
+		"health_checks.interval":     &config.HealthChecks.Interval,
+		"confirmation.timeout":       &config.Confirmation.Timeout,
+		"drift.interval":             &config.Drift.Interval,
+	} {
+		if *value < 0 {
+			return config, fmt.Errorf("the configuration attribute %s has to be positive or zero (0 means the default), current value: %d", name, *value)
+		}
+	}
+	if config.Builder.EvalTimeout == 0 {
+		config.Builder.EvalTimeout = 30 * 60
+	}
+	if config.Builder.BuildTimeout == 0 {
+		config.Builder.BuildTimeout = 30 * 60
+	}
+	if config.Store.CapacityMain == 0 {
+		config.Store.CapacityMain = 10
+	}
+	if config.Store.CapacityTesting == 0 {
+		config.Store.CapacityTesting = 10
+	}
+	if config.Store.CapacityGenerations == 0 {
+		config.Store.CapacityGenerations = 10
+	}
+	if argv := config.HealthChecks.Argv; argv != nil && (len(argv) == 0 || argv[0] == "") {
+		return config, fmt.Errorf("the health_checks.argv can not be empty")
+	}
+	if config.HealthChecks.Timeout == 0 {
+		config.HealthChecks.Timeout = 120
+	}
+	if config.HealthChecks.Interval == 0 {
+		config.HealthChecks.Interval = 5
+	}
+	if config.Confirmation.Timeout == 0 {
+		config.Confirmation.Timeout = 300
+	}
+	if config.Drift.Interval == 0 {
+		config.Drift.Interval = 300
+	}
+	switch config.Drift.Policy {
+	case "":
+		config.Drift.Policy = "alert"
+	case "alert", "reconcile":
+	default:
+		return config, fmt.Errorf("the drift policy has to be alert or reconcile (current value: %s)", config.Drift.Policy)
+	}
+	// The post deployment command is run as the first
+	// post-deployment hook
+	if config.PostDeploymentCommand != "" {
+		config.Hooks.PostDeployment = append([]types.Hook{{Argv: []string{config.PostDeploymentCommand}}}, config.Hooks.PostDeployment...)
+	}
+	for _, stage := range []struct {
+		name  string
+		hooks []types.Hook
+	}{
+		{"pre_deployment", config.Hooks.PreDeployment},
+		{"post_deployment", config.Hooks.PostDeployment},
+	} {
+		hooks := stage.hooks
+		for i := range hooks {
+			if len(hooks[i].Argv) == 0 {
+				return config, fmt.Errorf("the argv of the hook %d of hooks.%s can not be empty", i, stage.name)
+			}
+			if hooks[i].Timeout < 0 {
+				return config, fmt.Errorf("the timeout of the hook %d of hooks.%s has to be positive or zero (0 means the default), current value: %d", i, stage.name, hooks[i].Timeout)
+			}
+			if hooks[i].Timeout == 0 {
+				hooks[i].Timeout = 300
+			}
+		}
+	}
+	for i, n := range config.Notifiers {
+		if err := notifier.Validate(n); err != nil {
+			return config, fmt.Errorf("invalid notifier %d: %w", i, err)
+		}
+		if n.TokenPath != "" {
+			content, err := os.ReadFile(n.TokenPath)
+			if err != nil {
+				return config, err
+			}
+			config.Notifiers[i].Token = strings.TrimSpace(string(content))
+		}
+		if n.SMTP.PasswordPath != "" {
+			content, err := os.ReadFile(n.SMTP.PasswordPath)
+			if err != nil {
+				return config, err
+			}
+			config.Notifiers[i].SMTP.Password = strings.TrimRight(string(content), "\r\n")
+		}
+		if n.Timeout < 0 {
+			return config, fmt.Errorf("the timeout of the notifier %d has to be positive or zero (0 means the default), current value: %d", i, n.Timeout)
+		}
+		if n.Timeout == 0 {
+			config.Notifiers[i].Timeout = 10
+		}
+	}
+	logrus.Debugf("Config is '%#v'", redact(config))
 	return
 }
 
+// redact returns a copy of the configuration whose secrets, read from
+// files, are masked in order to be logged. The path and the query of
+// the notifier URLs are also masked since they can contain a token.
+func redact(config types.Configuration) types.Configuration {
+	mask := func(secret *string) {
+		if *secret != "" {
+			*secret = "<redacted>"
+		}
+	}
+	maskURL := func(rawURL *string) {
+		u, err := url.Parse(*rawURL)
+		if err != nil {
+			mask(rawURL)
+			return
+		}
+		if u.User != nil || u.Path != "" || u.RawQuery != "" || u.Opaque != "" {
+			*rawURL = (&url.URL{Scheme: u.Scheme, Host: u.Host}).String() + "/<redacted>"
+		}
+	}
+	config.Remotes = append([]types.Remote(nil), config.Remotes...)
+	for i := range config.Remotes {
+		mask(&config.Remotes[i].Auth.AccessToken)
+		mask(&config.Remotes[i].Auth.SshPrivateKeyPassphrase)
+	}
+	mask(&config.ApiServer.Token)
+	mask(&config.Exporter.Token)
+	mask(&config.Webhook.Secret)
+	config.Notifiers = append([]types.Notifier(nil), config.Notifiers...)
+	for i := range config.Notifiers {
+		mask(&config.Notifiers[i].Token)
+		maskURL(&config.Notifiers[i].URL)
+		mask(&config.Notifiers[i].SMTP.Password)
+	}
+	return config
+}
+
 func MkGitConfig(config types.Configuration) types.GitConfig {
 	return types.GitConfig{
 		Path:              filepath.Join(config.StateDir, "repository"),
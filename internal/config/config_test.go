@@ -1,6 +1,8 @@
 package config
 
 import (
+	"fmt"
+	"os"
 	"testing"
 
 	"github.com/nlewo/comin/internal/types"
@@ -34,6 +36,17 @@ func TestConfig(t *testing.T) {
 				},
 				Timeout: 300,
 			},
+			{
+				Name: "gitea",
+				URL:  "git@gitea.example.org:owner/infra.git",
+				Auth: types.Auth{
+					SshPrivateKeyPath:           "/run/secrets/deploy_key",
+					SshPrivateKeyPassphrasePath: "./ssh_passphrase",
+					SshPrivateKeyPassphrase:     "my-passphrase",
+					SshKnownHostsPath:           "/etc/comin/known_hosts",
+				},
+				Timeout: 300,
+			},
 		},
 		ApiServer: types.HttpServer{
 			ListenAddress: "127.0.0.1",
@@ -43,8 +56,432 @@ func TestConfig(t *testing.T) {
 			ListenAddress: "0.0.0.0",
 			Port:          4243,
 		},
+		Webhook: types.Webhook{
+			SecretPath: "./secret",
+			Secret:     "my-secret",
+		},
+		Builder: types.Builder{
+			EvalTimeout:  1800,
+			BuildTimeout: 1800,
+		},
+		Store: types.Store{
+			CapacityMain:        10,
+			CapacityTesting:     10,
+			CapacityGenerations: 10,
+		},
+		HealthChecks: types.HealthChecks{
+			Timeout:       120,
+			Interval:      5,
+			HttpUrl:       "http://localhost:8080/health",
+			NoFailedUnits: true,
+		},
+		Confirmation: types.Confirmation{
+			Timeout: 300,
+		},
+		Hooks: types.Hooks{
+			PostDeployment: []types.Hook{
+				{Argv: []string{"/some/path"}, Timeout: 300},
+			},
+		},
+		Drift: types.Drift{
+			Interval: 300,
+			Policy:   "alert",
+		},
 	}
 	config, err := Read(configPath)
 	assert.Nil(t, err)
 	assert.Equal(t, expected, config)
 }
+
+func TestConfigValidation(t *testing.T) {
+	tmp := t.TempDir()
+	configPath := tmp + "/configuration.yaml"
+	content := `
+hostname: machine
+state_dir: /var/lib/comin
+builder:
+  build_timeout: 7200
+store:
+  capacity_main: 50
+  capacity_generations: 3
+`
+	_ = os.WriteFile(configPath, []byte(content), 0644)
+	config, err := Read(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, types.Builder{EvalTimeout: 1800, BuildTimeout: 7200}, config.Builder)
+	assert.Equal(t, types.Store{CapacityMain: 50, CapacityTesting: 10, CapacityGenerations: 3}, config.Store)
+
+	content = `
+hostname: machine
+state_dir: /var/lib/comin
+builder:
+  eval_timeout: -1
+`
+	_ = os.WriteFile(configPath, []byte(content), 0644)
+	_, err = Read(configPath)
+	assert.ErrorContains(t, err, "builder.eval_timeout has to be positive or zero (0 means the default)")
+}
+
+func TestConfigReboot(t *testing.T) {
+	tmp := t.TempDir()
+	configPath := tmp + "/configuration.yaml"
+	content := `
+hostname: machine
+state_dir: /var/lib/comin
+remotes:
+  - name: origin
+    url: https://framagit.org/owner/infra
+    branches:
+      main:
+        name: main
+        operation: boot
+reboot:
+  windows:
+    - cron: "0 2 * * 6"
+      duration: 7200
+`
+	_ = os.WriteFile(configPath, []byte(content), 0644)
+	config, err := Read(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "boot", config.Remotes[0].Branches.Main.Operation)
+	assert.Equal(t, []types.Window{{Cron: "0 2 * * 6", Duration: 7200}}, config.Reboot.Windows)
+
+	content = `
+hostname: machine
+state_dir: /var/lib/comin
+remotes:
+  - name: origin
+    url: https://framagit.org/owner/infra
+    branches:
+      main:
+        name: main
+        operation: reboot
+`
+	_ = os.WriteFile(configPath, []byte(content), 0644)
+	_, err = Read(configPath)
+	assert.ErrorContains(t, err, "has to be switch, test or boot")
+
+	content = `
+hostname: machine
+state_dir: /var/lib/comin
+reboot:
+  windows:
+    - cron: "0 2 * *"
+      duration: 7200
+`
+	_ = os.WriteFile(configPath, []byte(content), 0644)
+	_, err = Read(configPath)
+	assert.ErrorContains(t, err, "invalid reboot window")
+
+	content = `
+hostname: machine
+state_dir: /var/lib/comin
+health_checks:
+  argv: ["systemctl", "is-active", "nginx.service"]
+`
+	_ = os.WriteFile(configPath, []byte(content), 0644)
+	config, err = Read(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"systemctl", "is-active", "nginx.service"}, config.HealthChecks.Argv)
+
+	content = `
+hostname: machine
+state_dir: /var/lib/comin
+health_checks:
+  argv: []
+`
+	_ = os.WriteFile(configPath, []byte(content), 0644)
+	_, err = Read(configPath)
+	assert.ErrorContains(t, err, "the health_checks.argv can not be empty")
+}
+
+func TestConfigDeploymentWindows(t *testing.T) {
+	tmp := t.TempDir()
+	configPath := tmp + "/configuration.yaml"
+	content := `
+hostname: machine
+state_dir: /var/lib/comin
+remotes:
+  - name: origin
+    url: https://framagit.org/owner/infra
+    branches:
+      main:
+        name: main
+        windows:
+          - cron: "0 2 * * 1-5"
+            duration: 10800
+        freezes:
+          - from: "2024-12-20"
+            to: "2025-01-05"
+            reason: holidays
+        require_approval: true
+      testing:
+        name: testing
+`
+	_ = os.WriteFile(configPath, []byte(content), 0644)
+	config, err := Read(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, []types.Window{{Cron: "0 2 * * 1-5", Duration: 10800}}, config.Remotes[0].Branches.Main.Windows)
+	assert.Equal(t, []types.Freeze{{From: "2024-12-20", To: "2025-01-05", Reason: "holidays"}}, config.Remotes[0].Branches.Main.Freezes)
+	assert.Empty(t, config.Remotes[0].Branches.Testing.Windows)
+	assert.True(t, config.Remotes[0].Branches.Main.RequireApproval)
+
+	content = `
+hostname: machine
+state_dir: /var/lib/comin
+remotes:
+  - name: origin
+    url: https://framagit.org/owner/infra
+    branches:
+      main:
+        name: main
+        freezes:
+          - from: "2025-01-05"
+            to: "2024-12-20"
+`
+	_ = os.WriteFile(configPath, []byte(content), 0644)
+	_, err = Read(configPath)
+	assert.ErrorContains(t, err, "invalid freeze of the branch main of the remote origin")
+}
+
+func TestConfigHooks(t *testing.T) {
+	tmp := t.TempDir()
+	configPath := tmp + "/configuration.yaml"
+	content := `
+hostname: machine
+state_dir: /var/lib/comin
+post_deployment_command: /some/path
+hooks:
+  pre_deployment:
+    - argv: ["systemctl", "stop", "app"]
+      timeout: 30
+  post_deployment:
+    - argv: ["systemctl", "start", "app"]
+remotes:
+  - name: origin
+    url: https://framagit.org/owner/infra
+`
+	_ = os.WriteFile(configPath, []byte(content), 0644)
+	config, err := Read(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, []types.Hook{{Argv: []string{"systemctl", "stop", "app"}, Timeout: 30}}, config.Hooks.PreDeployment)
+	assert.Equal(t, []types.Hook{
+		{Argv: []string{"/some/path"}, Timeout: 300},
+		{Argv: []string{"systemctl", "start", "app"}, Timeout: 300},
+	}, config.Hooks.PostDeployment)
+
+	content = `
+hostname: machine
+state_dir: /var/lib/comin
+hooks:
+  pre_deployment:
+    - timeout: 30
+remotes:
+  - name: origin
+    url: https://framagit.org/owner/infra
+`
+	_ = os.WriteFile(configPath, []byte(content), 0644)
+	_, err = Read(configPath)
+	assert.ErrorContains(t, err, "the argv of the hook 0 of hooks.pre_deployment can not be empty")
+}
+
+func TestConfigDrift(t *testing.T) {
+	tmp := t.TempDir()
+	configPath := tmp + "/configuration.yaml"
+	content := `
+hostname: machine
+state_dir: /var/lib/comin
+remotes:
+  - name: origin
+    url: https://framagit.org/owner/infra
+`
+	_ = os.WriteFile(configPath, []byte(content), 0644)
+	config, err := Read(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, types.Drift{Interval: 300, Policy: "alert"}, config.Drift)
+
+	_ = os.WriteFile(configPath, []byte(content+"drift:\n  policy: repair\n"), 0644)
+	_, err = Read(configPath)
+	assert.ErrorContains(t, err, "the drift policy has to be alert or reconcile (current value: repair)")
+}
+
+func TestConfigNotifiers(t *testing.T) {
+	tmp := t.TempDir()
+	configPath := tmp + "/configuration.yaml"
+	_ = os.WriteFile(tmp+"/token", []byte("my-token\n"), 0600)
+	content := `
+hostname: machine
+state_dir: /var/lib/comin
+remotes:
+  - name: origin
+    url: https://framagit.org/owner/infra
+notifiers:
+  - type: ntfy
+    url: https://ntfy.sh/comin
+    token_path: ` + tmp + `/token
+    events: [build_failed, deployment_finished]
+`
+	_ = os.WriteFile(configPath, []byte(content), 0644)
+	config, err := Read(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, []types.Notifier{{
+		Type:      "ntfy",
+		URL:       "https://ntfy.sh/comin",
+		TokenPath: tmp + "/token",
+		Token:     "my-token",
+		Events:    []string{"build_failed", "deployment_finished"},
+		Timeout:   10,
+	}}, config.Notifiers)
+
+	_ = os.WriteFile(configPath, []byte(content+"  - type: ntfy\n    url: https://ntfy.sh/comin\n    events: [deployed]\n"), 0644)
+	_, err = Read(configPath)
+	assert.ErrorContains(t, err, "invalid notifier 1: unknown event deployed")
+
+	_ = os.WriteFile(configPath, []byte(content+"  - type: irc\n"), 0644)
+	_, err = Read(configPath)
+	assert.ErrorContains(t, err, "the type has to be webhook, matrix, ntfy, slack or smtp (current value: irc)")
+
+	_ = os.WriteFile(configPath, []byte(content+"  - type: webhook\n    url: http://localhost\n    template: '{{.Hostname'\n"), 0644)
+	_, err = Read(configPath)
+	assert.ErrorContains(t, err, "invalid notifier 1: invalid template")
+}
+
+func TestConfigApiServer(t *testing.T) {
+	tmp := t.TempDir()
+	configPath := tmp + "/configuration.yaml"
+	_ = os.WriteFile(tmp+"/token", []byte("my-token\n"), 0600)
+	content := `
+hostname: machine
+state_dir: /var/lib/comin
+remotes:
+  - name: origin
+    url: https://framagit.org/owner/infra
+api_server:
+  token_path: ` + tmp + `/token
+  unix_socket:
+    path: /run/comin/api.sock
+    allowed_uids: [1000]
+    allowed_gids: [10]
+`
+	_ = os.WriteFile(configPath, []byte(content), 0644)
+	config, err := Read(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, types.HttpServer{
+		ListenAddress: "127.0.0.1",
+		Port:          4242,
+		TokenPath:     tmp + "/token",
+		Token:         "my-token",
+		UnixSocket: types.UnixSocket{
+			Path:        "/run/comin/api.sock",
+			AllowedUids: []uint32{1000},
+			AllowedGids: []uint32{10},
+		},
+	}, config.ApiServer)
+
+	_ = os.WriteFile(tmp+"/token", []byte("\n"), 0600)
+	_, err = Read(configPath)
+	assert.ErrorContains(t, err, "the token of api_server read from "+tmp+"/token can not be empty")
+
+	_ = os.WriteFile(tmp+"/token", []byte("my-token\n"), 0600)
+	_ = os.WriteFile(configPath, []byte(content+"exporter:\n  unix_socket:\n    path: /run/comin/metrics.sock\n"), 0644)
+	_, err = Read(configPath)
+	assert.ErrorContains(t, err, "the exporter doesn't support a unix_socket")
+}
+
+func TestConfigTLS(t *testing.T) {
+	tmp := t.TempDir()
+	configPath := tmp + "/configuration.yaml"
+	content := `
+hostname: machine
+state_dir: /var/lib/comin
+remotes:
+  - name: origin
+    url: https://framagit.org/owner/infra
+exporter:
+  tls:
+    cert_path: /run/comin/cert.pem
+    key_path: /run/comin/key.pem
+    client_ca_path: /run/comin/ca.pem
+`
+	_ = os.WriteFile(configPath, []byte(content), 0644)
+	config, err := Read(configPath)
+	assert.Nil(t, err)
+	assert.Equal(t, types.TLS{
+		CertPath:     "/run/comin/cert.pem",
+		KeyPath:      "/run/comin/key.pem",
+		ClientCAPath: "/run/comin/ca.pem",
+	}, config.Exporter.TLS)
+
+	_ = os.WriteFile(configPath, []byte(content+"api_server:\n  tls:\n    cert_path: /run/comin/cert.pem\n"), 0644)
+	_, err = Read(configPath)
+	assert.ErrorContains(t, err, "both the tls.cert_path and the tls.key_path of api_server have to be set")
+
+	_ = os.WriteFile(configPath, []byte(content+"api_server:\n  tls:\n    client_ca_path: /run/comin/ca.pem\n"), 0644)
+	_, err = Read(configPath)
+	assert.ErrorContains(t, err, "the tls.client_ca_path of api_server requires the tls.cert_path and the tls.key_path")
+}
+
+func TestConfigInlineSecrets(t *testing.T) {
+	tmp := t.TempDir()
+	configPath := tmp + "/configuration.yaml"
+	content := `
+hostname: machine
+state_dir: /var/lib/comin
+remotes:
+  - name: origin
+    url: https://framagit.org/owner/infra
+    auth:
+      accesstoken: inline-access-token
+      sshprivatekeypassphrase: inline-passphrase
+webhook:
+  secret: inline-secret
+notifiers:
+  - type: ntfy
+    url: https://ntfy.example.org/comin
+    token: inline-token
+`
+	_ = os.WriteFile(configPath, []byte(content), 0644)
+	config, err := Read(configPath)
+	assert.Nil(t, err)
+	// The secrets are only read from the files of the *_path
+	// attributes
+	assert.Equal(t, "", config.Remotes[0].Auth.AccessToken)
+	assert.Equal(t, "", config.Remotes[0].Auth.SshPrivateKeyPassphrase)
+	assert.Equal(t, "", config.Webhook.Secret)
+	assert.Equal(t, "", config.Notifiers[0].Token)
+}
+
+func TestConfigRedact(t *testing.T) {
+	config := types.Configuration{
+		Remotes: []types.Remote{{
+			Name: "origin",
+			Auth: types.Auth{AccessToken: "access-token", SshPrivateKeyPassphrase: "passphrase"},
+		}},
+		ApiServer: types.HttpServer{Token: "api-token"},
+		Exporter:  types.HttpServer{Token: "exporter-token"},
+		Webhook:   types.Webhook{Secret: "webhook-secret"},
+		Notifiers: []types.Notifier{{
+			Type:  "smtp",
+			Token: "notifier-token",
+			SMTP:  types.NotifierSMTP{Password: "smtp-password"},
+		}, {
+			Type: "slack",
+			URL:  "https://hooks.slack.example.org/services/slack-path?token=url-token",
+		}, {
+			Type: "ntfy",
+			URL:  "https://ntfy.example.org",
+		}},
+	}
+	redacted := fmt.Sprintf("%#v", redact(config))
+	for _, secret := range []string{"access-token", "passphrase", "api-token", "exporter-token", "webhook-secret", "notifier-token", "smtp-password", "slack-path", "url-token"} {
+		assert.NotContains(t, redacted, secret)
+	}
+	assert.Contains(t, redacted, "<redacted>")
+	assert.Contains(t, redacted, `"https://hooks.slack.example.org/<redacted>"`)
+	assert.Contains(t, redacted, `"https://ntfy.example.org"`)
+	// The configuration itself is not modified
+	assert.Equal(t, "access-token", config.Remotes[0].Auth.AccessToken)
+	assert.Equal(t, "smtp-password", config.Notifiers[0].SMTP.Password)
+	assert.Equal(t, "api-token", config.ApiServer.Token)
+	assert.Equal(t, "https://hooks.slack.example.org/services/slack-path?token=url-token", config.Notifiers[1].URL)
+}
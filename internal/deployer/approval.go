@@ -0,0 +1,96 @@
+package deployer
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/nlewo/comin/internal/store"
+	"github.com/nlewo/comin/internal/types"
+	"github.com/sirupsen/logrus"
+)
+
+// PendingApproval is a generation waiting for an approval before
+// being deployed
+type PendingApproval struct {
+	GenerationUUID string `json:"generation_uuid"`
+	CommitId       string `json:"commit_id"`
+	CommitMsg      string `json:"commit_msg"`
+	// The differences between the closure of the running system
+	// and the closure of the generation
+	ClosureDiff    *types.ClosureDiff `json:"closure_diff,omitempty"`
+	ClosureDiffErr string             `json:"closure_diff_err,omitempty"`
+}
+
+func (p PendingApproval) Show(padding string) {
+	fmt.Printf("%sGeneration %s is waiting for an approval (comin approve %s)\n", padding, p.GenerationUUID, p.GenerationUUID)
+	fmt.Printf("%s  Commit ID %s\n", padding, p.CommitId)
+	fmt.Printf("%s  Commit message %s\n", padding, strings.Trim(p.CommitMsg, "\n"))
+	if p.ClosureDiffErr != "" {
+		fmt.Printf("%s  Closure diff failed: %s\n", padding, p.ClosureDiffErr)
+	} else if p.ClosureDiff != nil {
+		fmt.Printf("%s  Closure diff\n", padding)
+		for _, line := range strings.Split(strings.TrimRight(p.ClosureDiff.String(), "\n"), "\n") {
+			fmt.Printf("%s    %s\n", padding, line)
+		}
+	}
+}
+
+// waitApproval waits until the generation g is approved or until a
+// new generation is submitted.
+func (d *Deployer) waitApproval(g store.Generation) {
+	d.mu.Lock()
+	computeDiff := d.pendingApproval == nil || d.pendingApproval.GenerationUUID != g.UUID.String()
+	if computeDiff {
+		logrus.Infof("deployer: the generation %s is waiting for an approval", g.UUID)
+		d.pendingApproval = &PendingApproval{
+			GenerationUUID: g.UUID.String(),
+			CommitId:       g.SelectedCommitId,
+			CommitMsg:      g.SelectedCommitMsg,
+		}
+	}
+	d.mu.Unlock()
+
+	if computeDiff && d.diffFunc != nil {
+		diff, err := d.diffFunc(context.TODO(), g.OutPath)
+		d.mu.Lock()
+		if d.pendingApproval != nil && d.pendingApproval.GenerationUUID == g.UUID.String() {
+			// A copy is stored since the pending approval
+			// could be read by State
+			p := *d.pendingApproval
+			if err != nil {
+				logrus.Errorf("deployer: failed to compute the closure diff of the generation %s: %s", g.UUID, err)
+				p.ClosureDiffErr = err.Error()
+			} else {
+				p.ClosureDiff = &diff
+			}
+			d.pendingApproval = &p
+		}
+		d.mu.Unlock()
+	}
+
+	select {
+	case <-d.approveCh:
+	case <-d.generationAvailableCh:
+	}
+}
+
+// Approve approves the generation waiting for an approval. The
+// approval expires when a newer commit is submitted.
+func (d *Deployer) Approve(generationUUID string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.pendingApproval == nil {
+		return fmt.Errorf("no generation is waiting for an approval")
+	}
+	if generationUUID != d.pendingApproval.GenerationUUID {
+		return fmt.Errorf("the generation %s is not waiting for an approval (the generation %s is)", generationUUID, d.pendingApproval.GenerationUUID)
+	}
+	logrus.Infof("deployer: the generation %s has been approved", generationUUID)
+	d.approvedCommitId = d.pendingApproval.CommitId
+	select {
+	case d.approveCh <- struct{}{}:
+	default:
+	}
+	return nil
+}
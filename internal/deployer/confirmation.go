@@ -0,0 +1,116 @@
+package deployer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/nlewo/comin/internal/logs"
+	"github.com/nlewo/comin/internal/store"
+	"github.com/sirupsen/logrus"
+)
+
+// confirmationPollPeriod is the period used to poll the confirmation
+// URL
+const confirmationPollPeriod = 5 * time.Second
+
+// waitConfirmation waits until the deployment is confirmed, either by
+// an operator or by successfully reaching the confirmation URL. It
+// returns an error if the deployment is not confirmed before the
+// deadline.
+func (d *Deployer) waitConfirmation(ctx context.Context, deadline time.Time) error {
+	timeout := time.Duration(d.confirmation.Timeout) * time.Second
+	d.mu.Lock()
+	d.confirmationDeadline = &deadline
+	// A confirmation sent for a previous deployment is ignored
+	select {
+	case <-d.confirmCh:
+	default:
+	}
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		d.confirmationDeadline = nil
+		d.mu.Unlock()
+	}()
+	logrus.Infof("deployer: waiting for a confirmation of the deployment until %s", deadline)
+
+	ctx, cancel := context.WithDeadline(ctx, deadline)
+	defer cancel()
+	ticker := time.NewTicker(confirmationPollPeriod)
+	defer ticker.Stop()
+	for {
+		if d.confirmation.Url != "" {
+			if err := httpProbe(ctx, d.confirmation.Url); err == nil {
+				logrus.Infof("deployer: the deployment has been confirmed by reaching %s", d.confirmation.Url)
+				return nil
+			} else {
+				logrus.Debugf("deployer: the deployment is not confirmed: %s", err)
+			}
+		}
+		select {
+		case <-d.confirmCh:
+			logrus.Infof("deployer: the deployment has been confirmed by an operator")
+			return nil
+		case <-ctx.Done():
+			return fmt.Errorf("the deployment has not been confirmed within %s", timeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// Confirm confirms the deployment which is waiting for a
+// confirmation.
+func (d *Deployer) Confirm() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.confirmationDeadline == nil {
+		return fmt.Errorf("no deployment is waiting for a confirmation")
+	}
+	select {
+	case d.confirmCh <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// ResumeConfirmation makes the deployer wait for the confirmation of a
+// deployment which was waiting for a confirmation when comin has been
+// stopped. If it is not confirmed before its deadline, the deployment
+// is rolled back. This has to be called before Run.
+func (d *Deployer) ResumeConfirmation(pending store.PendingConfirmation) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.resumedConfirmation = &pending
+}
+
+// resumeConfirmation waits for the confirmation of a deployment done
+// before a restart of comin. The deployment is rolled back if the
+// deadline has already passed.
+func (d *Deployer) resumeConfirmation(pending store.PendingConfirmation) {
+	deployment := pending.Deployment
+	logrus.Infof("deployer: resuming the wait of the confirmation of the deployment %s", deployment.UUID)
+	d.mu.Lock()
+	d.previousDeployment.Swap(d.Deployment())
+	d.deployment.Store(&deployment)
+	d.isDeploying.Store(true)
+	d.mu.Unlock()
+
+	ctx := context.TODO()
+	log := d.logs.Open(logs.Deployment, deployment.UUID)
+	defer log.Close() // nolint
+	fmt.Fprintf(log, "comin: comin has been restarted while the deployment was waiting for a confirmation\n")
+	d.confirm(ctx, &deployment, pending.Deadline, log)
+	d.finish(ctx, &deployment)
+}
+
+// confirm waits for the confirmation of the deployment and rolls it
+// back if it is not confirmed before the deadline
+func (d *Deployer) confirm(ctx context.Context, deployment *store.Deployment, deadline time.Time, log io.Writer) {
+	d.bus.Publish(ConfirmationRequired{Deployment: *deployment, Deadline: deadline})
+	if err := d.waitConfirmation(ctx, deadline); err != nil {
+		logrus.Errorf("deployer: deploying generation %s, %s", deployment.Generation.UUID, err)
+		d.rollback(ctx, deployment, err, log)
+	}
+}
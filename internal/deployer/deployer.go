@@ -3,6 +3,7 @@ package deployer
 import (
 	"context"
 	"fmt"
+	"io"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -10,16 +11,41 @@ import (
 
 	"github.com/dustin/go-humanize"
 	"github.com/google/uuid"
+	"github.com/nlewo/comin/internal/events"
+	"github.com/nlewo/comin/internal/logs"
+	"github.com/nlewo/comin/internal/profile"
+	"github.com/nlewo/comin/internal/scheduler"
 	"github.com/nlewo/comin/internal/store"
+	"github.com/nlewo/comin/internal/types"
 	"github.com/sirupsen/logrus"
 )
 
-type DeployFunc func(context.Context, string, string) (bool, string, error)
+// DeployFunc activates an outpath with an operation. The outputs of
+// the activation are written to the io.Writer.
+type DeployFunc func(context.Context, string, string, io.Writer) (bool, string, error)
+
+// DiffFunc returns the differences between the closure of the running
+// system and the closure of an outpath.
+type DiffFunc func(context.Context, string) (types.ClosureDiff, error)
+
+// RebootReasonsFunc returns the components of the system of an
+// outpath which are only activated by a reboot and which differ from
+// the booted system.
+type RebootReasonsFunc func(string) []string
+
+// windowPollPeriod is the maximal delay between two checks of the
+// deployment window, in order to cope with clock changes.
+const windowPollPeriod = time.Minute
+
+// closureDiffTimeout is the maximal duration of the computation of
+// the closure diff of a generation submitted without it.
+const closureDiffTimeout = 2 * time.Minute
 
 type Deployer struct {
 	GenerationCh       chan store.Generation
 	deployerFunc       DeployFunc
-	DeploymentDoneCh   chan store.Deployment
+	diffFunc           DiffFunc
+	rebootReasonsFunc  RebootReasonsFunc
 	mu                 sync.Mutex
 	deployment         atomic.Pointer[store.Deployment]
 	previousDeployment atomic.Pointer[store.Deployment]
@@ -27,13 +53,53 @@ type Deployer struct {
 	// The next generation to deploy. nil when there is no new generation to deploy
 	GenerationToDeploy    *store.Generation
 	generationAvailableCh chan struct{}
-	postDeploymentCommand string
+	hooks                 types.Hooks
+	healthChecks          types.HealthChecks
+	confirmation          types.Confirmation
+	confirmCh             chan struct{}
+	// The deadline of the confirmation of the running
+	// deployment. nil when no deployment is waiting for a
+	// confirmation.
+	confirmationDeadline *time.Time
+	// The deployment which was waiting for a confirmation when
+	// comin has been stopped. Its confirmation is waited before
+	// running new deployments.
+	resumedConfirmation *store.PendingConfirmation
+	// The next opening of the deployment window of the generation
+	// to deploy. nil when this generation is not waiting for its
+	// deployment window.
+	nextWindowOpening *time.Time
+	// The generation to deploy waiting for an approval. nil when
+	// the generation to deploy doesn't require an approval.
+	pendingApproval *PendingApproval
+	// The last approved commit. An approval expires when a newer
+	// commit is submitted.
+	approvedCommitId string
+	approveCh        chan struct{}
+	// A deployment of a past generation, requested by an operator
+	// (rollback) or by the drift reconciliation
+	redeployment *store.Deployment
+	remotes      []types.Remote
+	// The outputs of the activations are written to the logs of
+	// the deployments
+	logs *logs.Logs
+	// The commit of a deployment which has been rolled back. It is
+	// not deployed again until a new commit is submitted.
+	blockedCommitId string
+	// The outpath re-activated when a deployment is rolled back:
+	// the outpath activated by the last deployment which didn't
+	// fail
+	rollbackOutPath string
 
 	isSuspended atomic.Bool
 	resumeCh    chan struct{}
 	// This is true when the runner is actually suspended. This is
 	// mainly used for testing purpose.
 	runnerIsSuspended atomic.Bool
+
+	// The DeploymentStarted and DeploymentDone events are
+	// published on the bus
+	bus *events.Bus
 }
 
 type State struct {
@@ -42,6 +108,16 @@ type State struct {
 	Deployment         *store.Deployment `json:"deployment"`
 	PreviousDeployment *store.Deployment `json:"previous_deployment"`
 	IsSuspended        bool              `json:"is_suspended"`
+	BlockedCommitId    string            `json:"blocked_commit_id,omitempty"`
+	// ConfirmationDeadline is set when the deployment is waiting
+	// for a confirmation
+	ConfirmationDeadline *time.Time `json:"confirmation_deadline,omitempty"`
+	// NextWindowOpening is set when the generation to deploy is
+	// waiting for the deployment window of its branch
+	NextWindowOpening *time.Time `json:"next_window_opening,omitempty"`
+	// PendingApproval is set when the generation to deploy is
+	// waiting for an approval
+	PendingApproval *PendingApproval `json:"pending_approval,omitempty"`
 }
 
 func (d *Deployer) State() State {
@@ -53,6 +129,11 @@ func (d *Deployer) State() State {
 		Deployment:         d.deployment.Load(),
 		PreviousDeployment: d.previousDeployment.Load(),
 		IsSuspended:        d.isSuspended.Load(),
+		BlockedCommitId:    d.blockedCommitId,
+
+		ConfirmationDeadline: d.confirmationDeadline,
+		NextWindowOpening:    d.nextWindowOpening,
+		PendingApproval:      d.pendingApproval,
 	}
 }
 
@@ -85,15 +166,44 @@ func showDeployment(padding string, d store.Deployment) {
 		fmt.Printf("%sDeployment failed %s\n", padding, humanize.Time(d.EndedAt))
 		fmt.Printf("%sOperation %s\n", padding, d.Operation)
 		fmt.Printf("%sProfilePath %s\n", padding, d.ProfilePath)
+	case store.RolledBack:
+		fmt.Printf("%sDeployment rolled back %s\n", padding, humanize.Time(d.EndedAt))
+		fmt.Printf("%sOperation %s\n", padding, d.Operation)
+		fmt.Printf("%sError %s\n", padding, d.ErrorMsg)
+		fmt.Printf("%sRolled back to %s\n", padding, d.RolledBackTo)
+	}
+	if d.RollbackOf != "" {
+		fmt.Printf("%sRollback to the deployment %s\n", padding, d.RollbackOf)
+	}
+	if d.ReconciledOutPath != "" {
+		fmt.Printf("%sReconciliation of the out-of-band system %s\n", padding, d.ReconciledOutPath)
 	}
 	fmt.Printf("%sGeneration %s\n", padding, d.Generation.UUID)
 	fmt.Printf("%sCommit ID %s from %s/%s\n", padding, d.Generation.SelectedCommitId, d.Generation.SelectedRemoteName, d.Generation.SelectedBranchName)
 	fmt.Printf("%sCommit message %s\n", padding, strings.Trim(d.Generation.SelectedCommitMsg, "\n"))
 	fmt.Printf("%sOutpath %s\n", padding, d.Generation.OutPath)
+	for _, h := range d.Hooks {
+		if h.ErrorMsg != "" {
+			fmt.Printf("%sHook %s '%s' failed with exit code %d: %s\n", padding, h.Stage, strings.Join(h.Argv, " "), h.ExitCode, h.ErrorMsg)
+		} else {
+			fmt.Printf("%sHook %s '%s' succeeded\n", padding, h.Stage, strings.Join(h.Argv, " "))
+		}
+		if output := strings.TrimRight(h.Output, "\n"); output != "" {
+			for _, line := range strings.Split(output, "\n") {
+				fmt.Printf("%s  %s\n", padding, line)
+			}
+		}
+	}
 }
 
 func (s State) Show(padding string) {
 	fmt.Printf("  Deployer\n")
+	if s.PendingApproval != nil {
+		s.PendingApproval.Show(padding)
+	}
+	if s.GenerationToDeploy != nil && s.NextWindowOpening != nil {
+		fmt.Printf("%sGeneration %s is waiting for the deployment window opening %s\n", padding, s.GenerationToDeploy.UUID, humanize.Time(*s.NextWindowOpening))
+	}
 	if s.Deployment == nil {
 		if s.PreviousDeployment == nil {
 			fmt.Printf("%sNo deployment yet\n", padding)
@@ -103,16 +213,32 @@ func (s State) Show(padding string) {
 		return
 	}
 	showDeployment(padding, *s.Deployment)
+	if s.ConfirmationDeadline != nil {
+		fmt.Printf("%sWaiting for a confirmation until %s (comin confirm)\n", padding, humanize.Time(*s.ConfirmationDeadline))
+	}
 }
 
-func New(deployFunc DeployFunc, previousDeployment *store.Deployment, postDeploymentCommand string) *Deployer {
+func New(deployFunc DeployFunc, diffFunc DiffFunc, rebootReasonsFunc RebootReasonsFunc, previousDeployment *store.Deployment, rollbackOutPath string, hooks types.Hooks, healthChecks types.HealthChecks, confirmation types.Confirmation, remotes []types.Remote, logs *logs.Logs, bus *events.Bus) *Deployer {
 	deployer := &Deployer{
-		DeploymentDoneCh:      make(chan store.Deployment, 1),
 		deployerFunc:          deployFunc,
+		diffFunc:              diffFunc,
+		rebootReasonsFunc:     rebootReasonsFunc,
 		generationAvailableCh: make(chan struct{}, 1),
-		postDeploymentCommand: postDeploymentCommand,
+		hooks:                 hooks,
+		healthChecks:          healthChecks,
+		confirmation:          confirmation,
+		confirmCh:             make(chan struct{}, 1),
+		approveCh:             make(chan struct{}, 1),
+		remotes:               remotes,
+		logs:                  logs,
+		bus:                   bus,
 
 		resumeCh: make(chan struct{}, 1),
+
+		rollbackOutPath: rollbackOutPath,
+	}
+	if previousDeployment != nil && previousDeployment.Status == store.RolledBack {
+		deployer.blockedCommitId = previousDeployment.Generation.SelectedCommitId
 	}
 
 	deployer.previousDeployment.Store(previousDeployment)
@@ -138,87 +264,338 @@ func (d *Deployer) Resume() {
 // Submit submits a generation to be deployed. If a deployment is
 // running, this generation will be deployed once the current
 // deployment is finished. If this generation is the same than the one
-// of the last deployment, this generation is skipped.
+// of the last deployment, this generation is skipped. A generation
+// whose commit has been rolled back is also skipped.
 func (d *Deployer) Submit(generation store.Generation) {
 	logrus.Infof("deployer: submiting generation %s", generation.UUID)
 	d.mu.Lock()
 	previous := d.previousDeployment.Load()
-	if previous == nil || generation.SelectedCommitId != previous.Generation.SelectedCommitId || generation.SelectedBranchIsTesting != previous.Generation.SelectedBranchIsTesting {
+	if d.blockedCommitId != "" && generation.SelectedCommitId == d.blockedCommitId {
+		logrus.Infof("deployer: skipping deployment of the generation %s because the commit %s has been rolled back", generation.UUID, generation.SelectedCommitId)
+	} else if previous == nil || generation.SelectedCommitId != previous.Generation.SelectedCommitId || generation.SelectedBranchIsTesting != previous.Generation.SelectedBranchIsTesting {
 		d.GenerationToDeploy = &generation
 		select {
 		case d.generationAvailableCh <- struct{}{}:
 		default:
 		}
+		d.blockedCommitId = ""
+		if generation.SelectedCommitId != d.approvedCommitId {
+			d.approvedCommitId = ""
+		}
 	} else {
 		logrus.Infof("deployer: skipping deployment of the generation %s because it is the same than the last deployment", generation.UUID)
 	}
 	d.mu.Unlock()
 }
 
-func (d *Deployer) Run() {
-	go func() {
-		for {
-			<-d.generationAvailableCh
+// branch returns the configuration of the branch of the generation.
+func (d *Deployer) branch(g store.Generation) (types.Branch, bool) {
+	for _, remote := range d.remotes {
+		if remote.Name != g.SelectedRemoteName {
+			continue
+		}
+		if g.SelectedBranchIsTesting {
+			return remote.Branches.Testing, true
+		}
+		return remote.Branches.Main, true
+	}
+	return types.Branch{}, false
+}
 
-			if d.isSuspended.Load() {
-				d.runnerIsSuspended.Store(true)
-				<-d.resumeCh
-				d.runnerIsSuspended.Store(false)
-			}
+// operation returns the switch-to-configuration operation of the
+// branch of the generation.
+func (d *Deployer) operation(g store.Generation) string {
+	if branch, found := d.branch(g); found && branch.Operation != "" {
+		return branch.Operation
+	}
+	if g.SelectedBranchIsTesting {
+		return "test"
+	}
+	return "switch"
+}
 
-			d.mu.Lock()
-			g := d.GenerationToDeploy
-			d.GenerationToDeploy = nil
-			d.mu.Unlock()
-			logrus.Infof("deployer: deploying generation %s", g.UUID)
+// rollback re-activates the outpath of the previous deployment
+// because the deployment has not been validated by the health checks
+// or has not been confirmed. The commit of the deployment is then
+// blocked until a new commit is submitted.
+func (d *Deployer) rollback(ctx context.Context, deployment *store.Deployment, reason error, log io.Writer) {
+	deployment.Err = reason
+	deployment.ErrorMsg = reason.Error()
+	deployment.Status = store.Failed
 
-			operation := "switch"
-			if g.SelectedBranchIsTesting {
-				operation = "test"
-			}
-			dpl := store.Deployment{
-				UUID:       uuid.NewString(),
-				Generation: *g,
-				Operation:  operation,
-				StartedAt:  time.Now().UTC(),
-				Status:     store.Running,
+	d.mu.Lock()
+	outPath := d.rollbackOutPath
+	d.mu.Unlock()
+	if outPath == "" {
+		logrus.Errorf("deployer: the generation %s can not be rolled back because there is no previous successful deployment", deployment.Generation.UUID)
+		return
+	}
+	logrus.Infof("deployer: rolling back the generation %s to %s", deployment.Generation.UUID, outPath)
+	fmt.Fprintf(log, "comin: rolling back to %s: %s\n", outPath, reason)
+	cominNeedRestart, profilePath, err := d.deployerFunc(ctx, outPath, deployment.Operation, log)
+	if err != nil {
+		deployment.ErrorMsg = fmt.Sprintf("%s (the rollback to %s failed: %s)", deployment.ErrorMsg, outPath, err)
+		return
+	}
+	// The profile of the rolled back deployment is removed since
+	// it is not expected to be booted.
+	if deployment.ProfilePath != "" && deployment.ProfilePath != profilePath {
+		_ = profile.RemoveProfilePath(deployment.ProfilePath)
+	}
+	deployment.ProfilePath = profilePath
+	deployment.RestartComin = deployment.RestartComin || cominNeedRestart
+	deployment.Status = store.RolledBack
+	deployment.RolledBackTo = outPath
+
+	d.mu.Lock()
+	d.blockedCommitId = deployment.Generation.SelectedCommitId
+	d.mu.Unlock()
+}
+
+// next waits for the next deployment to run: a redeployment (rollback
+// or drift reconciliation) or the generation to deploy. The generation to deploy
+// is held while the deployer is suspended, until it has been approved
+// (if its branch requires an approval) and until the deployment
+// window of its branch is open. It can be replaced by Submit
+// meanwhile. It returns nil if there is nothing to deploy.
+func (d *Deployer) next() *store.Deployment {
+	for {
+		d.mu.Lock()
+		if dpl := d.redeployment; dpl != nil {
+			d.redeployment = nil
+			d.mu.Unlock()
+			return dpl
+		}
+		g := d.GenerationToDeploy
+		if g == nil {
+			d.mu.Unlock()
+			return nil
+		}
+		if d.isSuspended.Load() {
+			d.mu.Unlock()
+			d.runnerIsSuspended.Store(true)
+			select {
+			case <-d.resumeCh:
+			case <-d.generationAvailableCh:
 			}
-			d.mu.Lock()
-			d.previousDeployment.Swap(d.Deployment())
-			d.deployment.Store(&dpl)
-			d.isDeploying.Store(true)
+			d.runnerIsSuspended.Store(false)
+			continue
+		}
+		branch, found := d.branch(*g)
+		if found && branch.RequireApproval && g.SelectedCommitId != d.approvedCommitId {
+			d.nextWindowOpening = nil
 			d.mu.Unlock()
+			d.waitApproval(*g)
+			continue
+		}
+		d.pendingApproval = nil
 
-			ctx := context.TODO()
-			cominNeedRestart, profilePath, err := d.deployerFunc(
-				ctx,
-				g.OutPath,
-				operation,
-			)
-
-			deployment := *d.Deployment()
-			deployment.EndedAt = time.Now().UTC()
-			deployment.Err = err
+		now := time.Now()
+		next := now
+		if found {
+			var err error
+			next, err = scheduler.NextDeploymentOpening(branch.Windows, branch.Freezes, now)
 			if err != nil {
-				deployment.ErrorMsg = err.Error()
-				deployment.Status = store.Failed
-			} else {
-				deployment.Status = store.Done
+				logrus.Errorf("deployer: failed to compute the deployment window of the generation %s: %s", g.UUID, err)
+				next = now
 			}
-			deployment.RestartComin = cominNeedRestart
-			deployment.ProfilePath = profilePath
-
-			cmd := d.postDeploymentCommand
-			if cmd != "" {
-				_, err = runPostDeploymentCommand(cmd, deployment)
-				if err != nil {
-					logrus.Errorf("deployer: deploying generation %s, post deployment command [%s] failed %v", g.UUID, cmd, err)
-				}
+		}
+		if next.After(now) {
+			if d.nextWindowOpening == nil || !d.nextWindowOpening.Equal(next) {
+				logrus.Infof("deployer: the generation %s is waiting for the deployment window opening at %s", g.UUID, next)
+			}
+			d.nextWindowOpening = &next
+			d.mu.Unlock()
+			select {
+			case <-time.After(min(next.Sub(now), windowPollPeriod)):
+			case <-d.generationAvailableCh:
 			}
+			continue
+		}
+		d.nextWindowOpening = nil
+		d.GenerationToDeploy = nil
+		d.mu.Unlock()
+		return &store.Deployment{
+			Generation: *g,
+			Operation:  d.operation(*g),
+		}
+	}
+}
+
+// deploy runs the deployment dpl and publishes a DeploymentDone event
+// once finished.
+func (d *Deployer) deploy(dpl store.Deployment) {
+	g := dpl.Generation
+	if dpl.RollbackOf != "" {
+		logrus.Infof("deployer: rolling back to the deployment %s (generation %s)", dpl.RollbackOf, g.UUID)
+	} else if dpl.ReconciledOutPath != "" {
+		logrus.Infof("deployer: reconciling the out-of-band system %s with the generation %s", dpl.ReconciledOutPath, g.UUID)
+	} else {
+		logrus.Infof("deployer: deploying generation %s", g.UUID)
+	}
+	// The boot operation is only used when the generation changes
+	// a component which is activated by a reboot. Otherwise, the
+	// generation is switched to without rebooting the machine.
+	if dpl.Operation == "boot" && d.rebootReasonsFunc != nil {
+		dpl.RebootReasons = d.rebootReasonsFunc(g.OutPath)
+		if len(dpl.RebootReasons) == 0 {
+			logrus.Infof("deployer: the generation %s doesn't need a reboot, it is deployed with the switch operation", g.UUID)
+			dpl.Operation = "switch"
+		}
+	}
+	// The closure diff is computed in the background by the
+	// builder and can still be missing when the generation is
+	// submitted. Since it is exposed to the hooks and to the
+	// notifiers, it is then computed before the activation.
+	if g.ClosureDiff == nil && g.ClosureDiffErr == "" && d.diffFunc != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), closureDiffTimeout)
+		diff, err := d.diffFunc(ctx, g.OutPath)
+		cancel()
+		if err != nil {
+			logrus.Errorf("deployer: failed to compute the closure diff of the generation %s: %s", g.UUID, err)
+			dpl.Generation.ClosureDiffErr = err.Error()
+		} else {
+			dpl.Generation.ClosureDiff = &diff
+		}
+		g = dpl.Generation
+	}
+	operation := dpl.Operation
+	dpl.UUID = uuid.NewString()
+	dpl.StartedAt = time.Now().UTC()
+	dpl.Status = store.Running
+	d.mu.Lock()
+	// The failed deployments don't change the outpath to roll
+	// back to
+	if previous := d.Deployment(); previous != nil && previous.ActivatedOutPath() != "" {
+		d.rollbackOutPath = previous.ActivatedOutPath()
+	}
+	d.previousDeployment.Swap(d.Deployment())
+	d.deployment.Store(&dpl)
+	d.isDeploying.Store(true)
+	d.mu.Unlock()
+	d.bus.Publish(DeploymentStarted{Deployment: dpl})
+
+	ctx := context.TODO()
+	deployment := dpl
+	log := d.logs.Open(logs.Deployment, deployment.UUID)
+	defer log.Close() // nolint
+	var cominNeedRestart bool
+	var profilePath string
+	err := runHooks(ctx, "pre-deployment", d.hooks.PreDeployment, &deployment, true)
+	if err != nil {
+		err = fmt.Errorf("the deployment has been aborted: %w", err)
+	} else {
+		fmt.Fprintf(log, "comin: running the %s operation of %s\n", operation, g.OutPath)
+		cominNeedRestart, profilePath, err = d.deployerFunc(
+			ctx,
+			g.OutPath,
+			operation,
+			log,
+		)
+	}
+	if err != nil {
+		fmt.Fprintf(log, "comin: the deployment failed: %s\n", err)
+	}
+
+	deployment.EndedAt = time.Now().UTC()
+	deployment.Err = err
+	if err != nil {
+		deployment.ErrorMsg = err.Error()
+		deployment.Status = store.Failed
+	} else {
+		deployment.Status = store.Done
+	}
+	deployment.RestartComin = cominNeedRestart
+	deployment.ProfilePath = profilePath
+
+	// With the boot operation, the deployment is only activated
+	// at the next reboot. A redeployment of a past generation is
+	// not rolled back.
+	checked := operation != "boot" && deployment.RollbackOf == "" && deployment.ReconciledOutPath == ""
+	if err == nil && checked && healthChecksEnabled(d.healthChecks) {
+		if err := runHealthChecks(ctx, d.healthChecks); err != nil {
+			logrus.Errorf("deployer: deploying generation %s, %s", g.UUID, err)
+			d.rollback(ctx, &deployment, err, log)
+		}
+	}
+	if deployment.Status == store.Done && checked && d.confirmation.Enable {
+		deadline := time.Now().UTC().Add(time.Duration(d.confirmation.Timeout) * time.Second)
+		d.confirm(ctx, &deployment, deadline, log)
+	}
+	d.finish(ctx, &deployment)
+}
+
+// finish runs the post-deployment hooks and publishes the end of the
+// deployment
+func (d *Deployer) finish(ctx context.Context, deployment *store.Deployment) {
+	// The errors of the post-deployment hooks are only recorded
+	_ = runHooks(ctx, "post-deployment", d.hooks.PostDeployment, deployment, false)
+
+	d.isDeploying.Store(false)
+	d.deployment.Store(deployment)
+	d.bus.Publish(DeploymentDone{Deployment: *deployment})
+}
+
+// Rollback requests the deployment of the generation of a past
+// deployment. It is deployed even if the deployer is suspended and
+// is recorded as a new deployment referencing this past deployment.
+func (d *Deployer) Rollback(target store.Deployment) error {
+	logrus.Infof("deployer: rollback to the deployment %s requested", target.UUID)
+	return d.redeploy(&store.Deployment{
+		Generation: target.Generation,
+		Operation:  target.Operation,
+		RollbackOf: target.UUID,
+	})
+}
+
+// Reconcile requests the deployment of the generation of the last
+// deployment because the running system outPath has been activated
+// outside of comin. It is deployed even if the deployer is suspended.
+func (d *Deployer) Reconcile(last store.Deployment, outPath string) error {
+	logrus.Infof("deployer: reconciliation of the out-of-band system %s requested", outPath)
+	// The running system is only replaced by a switch
+	operation := last.Operation
+	if operation == "boot" {
+		operation = "switch"
+	}
+	return d.redeploy(&store.Deployment{
+		Generation:        last.Generation,
+		Operation:         operation,
+		ReconciledOutPath: outPath,
+	})
+}
+
+func (d *Deployer) redeploy(dpl *store.Deployment) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if r := d.redeployment; r != nil {
+		if r.RollbackOf != "" {
+			return fmt.Errorf("a rollback to the deployment %s is already requested", r.RollbackOf)
+		}
+		return fmt.Errorf("a reconciliation of the out-of-band system %s is already requested", r.ReconciledOutPath)
+	}
+	d.redeployment = dpl
+	select {
+	case d.generationAvailableCh <- struct{}{}:
+	default:
+	}
+	return nil
+}
 
-			d.isDeploying.Store(false)
-			d.deployment.Store(&deployment)
-			d.DeploymentDoneCh <- *d.Deployment()
+func (d *Deployer) Run() {
+	go func() {
+		d.mu.Lock()
+		pending := d.resumedConfirmation
+		d.resumedConfirmation = nil
+		d.mu.Unlock()
+		if pending != nil {
+			d.resumeConfirmation(*pending)
+		}
+		for {
+			<-d.generationAvailableCh
+			for dpl := d.next(); dpl != nil; dpl = d.next() {
+				d.deploy(*dpl)
+			}
 		}
 	}()
 }
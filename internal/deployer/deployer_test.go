@@ -1,23 +1,34 @@
 package deployer_test
 
 import (
+	"bytes"
 	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/nlewo/comin/internal/deployer"
+	"github.com/nlewo/comin/internal/events"
+	"github.com/nlewo/comin/internal/logs"
 	"github.com/nlewo/comin/internal/store"
+	"github.com/nlewo/comin/internal/types"
 	"github.com/stretchr/testify/assert"
 )
 
 func TestDeployerBasic(t *testing.T) {
+	bus := events.New()
+	sub := bus.Subscribe()
 	deployDone := make(chan struct{})
-	var deployFunc = func(context.Context, string, string) (bool, string, error) {
+	var deployFunc = func(context.Context, string, string, io.Writer) (bool, string, error) {
 		<-deployDone
 		return false, "profile-path", nil
 	}
 
-	d := deployer.New(deployFunc, nil, "")
+	d := deployer.New(deployFunc, nil, nil, nil, "", types.Hooks{}, types.HealthChecks{}, types.Confirmation{}, nil, nil, bus)
 	d.Run()
 	assert.False(t, d.IsDeploying())
 
@@ -34,20 +45,22 @@ func TestDeployerBasic(t *testing.T) {
 	}, 5*time.Second, 100*time.Millisecond)
 
 	assert.EventuallyWithT(t, func(c *assert.CollectT) {
-		dpl := <-d.DeploymentDoneCh
+		dpl := events.Next[deployer.DeploymentDone](sub).Deployment
 		assert.Equal(c, "profile-path", dpl.ProfilePath)
 		assert.Equal(c, "commit-1", dpl.Generation.SelectedCommitId)
 	}, 5*time.Second, 100*time.Millisecond)
 }
 
 func TestDeployerSubmit(t *testing.T) {
+	bus := events.New()
+	sub := bus.Subscribe()
 	deployDone := make(chan struct{})
-	var deployFunc = func(context.Context, string, string) (bool, string, error) {
+	var deployFunc = func(context.Context, string, string, io.Writer) (bool, string, error) {
 		<-deployDone
 		return false, "profile-path", nil
 	}
 
-	d := deployer.New(deployFunc, nil, "")
+	d := deployer.New(deployFunc, nil, nil, nil, "", types.Hooks{}, types.HealthChecks{}, types.Confirmation{}, nil, nil, bus)
 	d.Run()
 	assert.False(t, d.IsDeploying())
 
@@ -71,7 +84,7 @@ func TestDeployerSubmit(t *testing.T) {
 	}, 5*time.Second, 100*time.Millisecond)
 
 	assert.EventuallyWithT(t, func(c *assert.CollectT) {
-		dpl := <-d.DeploymentDoneCh
+		dpl := events.Next[deployer.DeploymentDone](sub).Deployment
 		assert.Equal(c, "profile-path", dpl.ProfilePath)
 		assert.Equal(c, "commit-1", dpl.Generation.SelectedCommitId)
 	}, 5*time.Second, 100*time.Millisecond)
@@ -79,12 +92,12 @@ func TestDeployerSubmit(t *testing.T) {
 
 func TestDeployerSuspend(t *testing.T) {
 	deployDone := make(chan struct{})
-	var deployFunc = func(context.Context, string, string) (bool, string, error) {
+	var deployFunc = func(context.Context, string, string, io.Writer) (bool, string, error) {
 		<-deployDone
 		return false, "profile-path", nil
 	}
 
-	d := deployer.New(deployFunc, nil, "")
+	d := deployer.New(deployFunc, nil, nil, nil, "", types.Hooks{}, types.HealthChecks{}, types.Confirmation{}, nil, nil, nil)
 	d.Run()
 	assert.False(t, d.IsSuspended())
 	d.Suspend()
@@ -103,3 +116,546 @@ func TestDeployerSuspend(t *testing.T) {
 		assert.True(t, d.IsDeploying())
 	}, 3*time.Second, 100*time.Millisecond)
 }
+
+func TestDeployerRollback(t *testing.T) {
+	bus := events.New()
+	sub := bus.Subscribe()
+	var deployedOutPaths []string
+	var deployFunc = func(ctx context.Context, outPath, operation string, logs io.Writer) (bool, string, error) {
+		deployedOutPaths = append(deployedOutPaths, outPath)
+		return false, "", nil
+	}
+	previous := store.Deployment{
+		Generation: store.Generation{SelectedCommitId: "commit-1", OutPath: "out-path-1"},
+		Status:     store.Done,
+	}
+	d := deployer.New(deployFunc, nil, nil, &previous, "", types.Hooks{}, types.HealthChecks{
+		Timeout:  1,
+		Interval: 1,
+		Argv:     []string{"false"},
+	}, types.Confirmation{}, nil, nil, bus)
+	d.Run()
+
+	d.Submit(store.Generation{SelectedCommitId: "commit-2", OutPath: "out-path-2"})
+	dpl := events.Next[deployer.DeploymentDone](sub).Deployment
+	assert.Equal(t, store.RolledBack, dpl.Status)
+	assert.Equal(t, "out-path-1", dpl.RolledBackTo)
+	assert.Contains(t, dpl.ErrorMsg, "the command 'false' failed")
+	assert.Equal(t, []string{"out-path-2", "out-path-1"}, deployedOutPaths)
+	assert.Equal(t, "commit-2", d.State().BlockedCommitId)
+
+	// The rolled back commit is not deployed again
+	d.Submit(store.Generation{SelectedCommitId: "commit-2", OutPath: "out-path-2"})
+	assert.Nil(t, d.GenerationToDeploy)
+
+	// Until a new commit is submitted
+	d.Submit(store.Generation{SelectedCommitId: "commit-3", OutPath: "out-path-3"})
+	dpl = events.Next[deployer.DeploymentDone](sub).Deployment
+	assert.Equal(t, store.RolledBack, dpl.Status)
+	// The previous deployment has been rolled back, so the
+	// rollback target is still the first outpath
+	assert.Equal(t, "out-path-1", dpl.RolledBackTo)
+	assert.Equal(t, "commit-3", d.State().BlockedCommitId)
+}
+
+// TestDeployerRollbackAfterFailure tests a failed deployment doesn't
+// change the outpath to roll back to.
+func TestDeployerRollbackAfterFailure(t *testing.T) {
+	bus := events.New()
+	sub := bus.Subscribe()
+	var deployedOutPaths []string
+	var deployFunc = func(ctx context.Context, outPath, operation string, logs io.Writer) (bool, string, error) {
+		deployedOutPaths = append(deployedOutPaths, outPath)
+		if outPath == "out-path-2" {
+			return false, "", fmt.Errorf("switch failed")
+		}
+		return false, "", nil
+	}
+	previous := store.Deployment{
+		Generation: store.Generation{SelectedCommitId: "commit-1", OutPath: "out-path-1"},
+		Status:     store.Done,
+	}
+	d := deployer.New(deployFunc, nil, nil, &previous, "out-path-1", types.Hooks{}, types.HealthChecks{
+		Timeout:  1,
+		Interval: 1,
+		Argv:     []string{"false"},
+	}, types.Confirmation{}, nil, nil, bus)
+	d.Run()
+
+	d.Submit(store.Generation{SelectedCommitId: "commit-2", OutPath: "out-path-2"})
+	dpl := events.Next[deployer.DeploymentDone](sub).Deployment
+	assert.Equal(t, store.Failed, dpl.Status)
+
+	d.Submit(store.Generation{SelectedCommitId: "commit-3", OutPath: "out-path-3"})
+	dpl = events.Next[deployer.DeploymentDone](sub).Deployment
+	assert.Equal(t, store.RolledBack, dpl.Status)
+	assert.Equal(t, "out-path-1", dpl.RolledBackTo)
+	assert.Equal(t, []string{"out-path-2", "out-path-3", "out-path-1"}, deployedOutPaths)
+}
+
+func TestDeployerHealthChecks(t *testing.T) {
+	bus := events.New()
+	sub := bus.Subscribe()
+	var deployFunc = func(ctx context.Context, outPath, operation string, logs io.Writer) (bool, string, error) {
+		return false, "", nil
+	}
+	d := deployer.New(deployFunc, nil, nil, nil, "", types.Hooks{}, types.HealthChecks{
+		Timeout:  1,
+		Interval: 1,
+		Argv:     []string{"true"},
+	}, types.Confirmation{}, nil, nil, bus)
+	d.Run()
+	d.Submit(store.Generation{SelectedCommitId: "commit-1", OutPath: "out-path-1"})
+	dpl := events.Next[deployer.DeploymentDone](sub).Deployment
+	assert.Equal(t, store.Done, dpl.Status)
+
+	// Without previous deployment, the deployment can not be
+	// rolled back
+	d = deployer.New(deployFunc, nil, nil, nil, "", types.Hooks{}, types.HealthChecks{
+		Timeout:  1,
+		Interval: 1,
+		Argv:     []string{"false"},
+	}, types.Confirmation{}, nil, nil, bus)
+	d.Run()
+	d.Submit(store.Generation{SelectedCommitId: "commit-1", OutPath: "out-path-1"})
+	dpl = events.Next[deployer.DeploymentDone](sub).Deployment
+	assert.Equal(t, store.Failed, dpl.Status)
+	assert.Contains(t, dpl.ErrorMsg, "health checks did not succeed")
+}
+
+func TestDeployerBlockedAfterRestart(t *testing.T) {
+	var deployFunc = func(ctx context.Context, outPath, operation string, logs io.Writer) (bool, string, error) {
+		return false, "", nil
+	}
+	previous := store.Deployment{
+		Generation:   store.Generation{SelectedCommitId: "commit-2", OutPath: "out-path-2"},
+		Status:       store.RolledBack,
+		RolledBackTo: "out-path-1",
+	}
+	d := deployer.New(deployFunc, nil, nil, &previous, "", types.Hooks{}, types.HealthChecks{}, types.Confirmation{}, nil, nil, nil)
+	assert.Equal(t, "commit-2", d.State().BlockedCommitId)
+}
+
+func TestDeployerConfirmation(t *testing.T) {
+	bus := events.New()
+	sub := bus.Subscribe()
+	var deployedOutPaths []string
+	var deployFunc = func(ctx context.Context, outPath, operation string, logs io.Writer) (bool, string, error) {
+		deployedOutPaths = append(deployedOutPaths, outPath)
+		return false, "", nil
+	}
+	previous := store.Deployment{
+		Generation: store.Generation{SelectedCommitId: "commit-1", OutPath: "out-path-1"},
+		Status:     store.Done,
+	}
+	d := deployer.New(deployFunc, nil, nil, &previous, "", types.Hooks{}, types.HealthChecks{}, types.Confirmation{
+		Enable:  true,
+		Timeout: 5,
+	}, nil, nil, bus)
+	d.Run()
+	assert.ErrorContains(t, d.Confirm(), "no deployment is waiting for a confirmation")
+
+	d.Submit(store.Generation{SelectedCommitId: "commit-2", OutPath: "out-path-2"})
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.NotNil(c, d.State().ConfirmationDeadline)
+	}, 3*time.Second, 100*time.Millisecond)
+	assert.Nil(t, d.Confirm())
+	dpl := events.Next[deployer.DeploymentDone](sub).Deployment
+	assert.Equal(t, store.Done, dpl.Status)
+	assert.Nil(t, d.State().ConfirmationDeadline)
+	assert.Equal(t, []string{"out-path-2"}, deployedOutPaths)
+}
+
+func TestDeployerConfirmationTimeout(t *testing.T) {
+	bus := events.New()
+	sub := bus.Subscribe()
+	var deployedOutPaths []string
+	var deployFunc = func(ctx context.Context, outPath, operation string, logs io.Writer) (bool, string, error) {
+		deployedOutPaths = append(deployedOutPaths, outPath)
+		return false, "", nil
+	}
+	previous := store.Deployment{
+		Generation: store.Generation{SelectedCommitId: "commit-1", OutPath: "out-path-1"},
+		Status:     store.Done,
+	}
+	d := deployer.New(deployFunc, nil, nil, &previous, "", types.Hooks{}, types.HealthChecks{}, types.Confirmation{
+		Enable:  true,
+		Timeout: 1,
+	}, nil, nil, bus)
+	d.Run()
+	d.Submit(store.Generation{SelectedCommitId: "commit-2", OutPath: "out-path-2"})
+	dpl := events.Next[deployer.DeploymentDone](sub).Deployment
+	assert.Equal(t, store.RolledBack, dpl.Status)
+	assert.Contains(t, dpl.ErrorMsg, "the deployment has not been confirmed within 1s")
+	assert.Equal(t, []string{"out-path-2", "out-path-1"}, deployedOutPaths)
+}
+
+func TestDeployerResumeConfirmation(t *testing.T) {
+	bus := events.New()
+	sub := bus.Subscribe()
+	var deployedOutPaths []string
+	var deployFunc = func(ctx context.Context, outPath, operation string, logs io.Writer) (bool, string, error) {
+		deployedOutPaths = append(deployedOutPaths, outPath)
+		return false, "", nil
+	}
+	previous := store.Deployment{
+		UUID:       "dpl-1",
+		Generation: store.Generation{SelectedCommitId: "commit-1", OutPath: "out-path-1"},
+		Status:     store.Done,
+	}
+	pending := store.Deployment{
+		UUID:       "dpl-2",
+		Generation: store.Generation{SelectedCommitId: "commit-2", OutPath: "out-path-2"},
+		Status:     store.Done,
+	}
+	confirmation := types.Confirmation{Enable: true, Timeout: 5}
+
+	// The deadline has passed while comin was stopped
+	d := deployer.New(deployFunc, nil, nil, &previous, "out-path-1", types.Hooks{}, types.HealthChecks{}, confirmation, nil, nil, bus)
+	d.ResumeConfirmation(store.PendingConfirmation{Deployment: pending, Deadline: time.Now().Add(-time.Minute)})
+	d.Run()
+	dpl := events.Next[deployer.DeploymentDone](sub).Deployment
+	assert.Equal(t, "dpl-2", dpl.UUID)
+	assert.Equal(t, store.RolledBack, dpl.Status)
+	assert.Equal(t, "out-path-1", dpl.RolledBackTo)
+	assert.Equal(t, []string{"out-path-1"}, deployedOutPaths)
+	assert.Equal(t, "commit-2", d.State().BlockedCommitId)
+
+	// The wait is resumed until the deadline
+	deployedOutPaths = nil
+	d = deployer.New(deployFunc, nil, nil, &previous, "out-path-1", types.Hooks{}, types.HealthChecks{}, confirmation, nil, nil, bus)
+	d.ResumeConfirmation(store.PendingConfirmation{Deployment: pending, Deadline: time.Now().Add(time.Minute)})
+	d.Run()
+	events.Next[deployer.ConfirmationRequired](sub)
+	assert.Nil(t, d.Confirm())
+	dpl = events.Next[deployer.DeploymentDone](sub).Deployment
+	assert.Equal(t, "dpl-2", dpl.UUID)
+	assert.Equal(t, store.Done, dpl.Status)
+	assert.Empty(t, deployedOutPaths)
+}
+
+func TestDeployerConfirmationUrl(t *testing.T) {
+	bus := events.New()
+	sub := bus.Subscribe()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer server.Close()
+	var deployFunc = func(ctx context.Context, outPath, operation string, logs io.Writer) (bool, string, error) {
+		return false, "", nil
+	}
+	previous := store.Deployment{
+		Generation: store.Generation{SelectedCommitId: "commit-1", OutPath: "out-path-1"},
+		Status:     store.Done,
+	}
+	d := deployer.New(deployFunc, nil, nil, &previous, "", types.Hooks{}, types.HealthChecks{}, types.Confirmation{
+		Enable:  true,
+		Timeout: 5,
+		Url:     server.URL,
+	}, nil, nil, bus)
+	d.Run()
+	d.Submit(store.Generation{SelectedCommitId: "commit-2", OutPath: "out-path-2"})
+	dpl := events.Next[deployer.DeploymentDone](sub).Deployment
+	assert.Equal(t, store.Done, dpl.Status)
+}
+
+func TestDeployerOperation(t *testing.T) {
+	bus := events.New()
+	sub := bus.Subscribe()
+	var operations []string
+	var deployFunc = func(ctx context.Context, outPath, operation string, logs io.Writer) (bool, string, error) {
+		operations = append(operations, operation)
+		return false, "", nil
+	}
+	remotes := []types.Remote{
+		{
+			Name: "origin",
+			Branches: types.Branches{
+				Main:    types.Branch{Name: "main", Operation: "boot"},
+				Testing: types.Branch{Name: "testing"},
+			},
+		},
+	}
+	// Health checks are not run on boot deployments
+	d := deployer.New(deployFunc, nil, nil, nil, "", types.Hooks{}, types.HealthChecks{Timeout: 1, Interval: 1, Argv: []string{"false"}}, types.Confirmation{}, remotes, nil, bus)
+	d.Run()
+	d.Submit(store.Generation{SelectedCommitId: "commit-1", SelectedRemoteName: "origin"})
+	dpl := events.Next[deployer.DeploymentDone](sub).Deployment
+	assert.Equal(t, "boot", dpl.Operation)
+	assert.Equal(t, store.Done, dpl.Status)
+
+	d = deployer.New(deployFunc, nil, nil, nil, "", types.Hooks{}, types.HealthChecks{}, types.Confirmation{}, remotes, nil, bus)
+	d.Run()
+	d.Submit(store.Generation{SelectedCommitId: "commit-2", SelectedRemoteName: "origin", SelectedBranchIsTesting: true})
+	dpl = events.Next[deployer.DeploymentDone](sub).Deployment
+	assert.Equal(t, "test", dpl.Operation)
+	d.Submit(store.Generation{SelectedCommitId: "commit-3", SelectedRemoteName: "other"})
+	dpl = events.Next[deployer.DeploymentDone](sub).Deployment
+	assert.Equal(t, "switch", dpl.Operation)
+	assert.Equal(t, []string{"boot", "test", "switch"}, operations)
+}
+
+func TestDeployerBootWithoutRebootReasons(t *testing.T) {
+	bus := events.New()
+	sub := bus.Subscribe()
+	var operations []string
+	var deployFunc = func(ctx context.Context, outPath, operation string, logs io.Writer) (bool, string, error) {
+		operations = append(operations, operation)
+		return false, "", nil
+	}
+	// Only the out-path-2 system has a new kernel
+	var rebootReasonsFunc = func(outPath string) []string {
+		if outPath == "out-path-2" {
+			return []string{"kernel"}
+		}
+		return nil
+	}
+	remotes := []types.Remote{
+		{
+			Name: "origin",
+			Branches: types.Branches{
+				Main: types.Branch{Name: "main", Operation: "boot"},
+			},
+		},
+	}
+	d := deployer.New(deployFunc, nil, rebootReasonsFunc, nil, "", types.Hooks{}, types.HealthChecks{}, types.Confirmation{}, remotes, nil, bus)
+	d.Run()
+
+	// The kernel is unchanged: the generation is switched to
+	d.Submit(store.Generation{SelectedCommitId: "commit-1", SelectedRemoteName: "origin", OutPath: "out-path-1"})
+	dpl := events.Next[deployer.DeploymentDone](sub).Deployment
+	assert.Equal(t, "switch", dpl.Operation)
+	assert.Empty(t, dpl.RebootReasons)
+
+	d.Submit(store.Generation{SelectedCommitId: "commit-2", SelectedRemoteName: "origin", OutPath: "out-path-2"})
+	dpl = events.Next[deployer.DeploymentDone](sub).Deployment
+	assert.Equal(t, "boot", dpl.Operation)
+	assert.Equal(t, []string{"kernel"}, dpl.RebootReasons)
+	assert.Equal(t, []string{"switch", "boot"}, operations)
+}
+
+func TestDeployerWindow(t *testing.T) {
+	bus := events.New()
+	sub := bus.Subscribe()
+	var deployFunc = func(ctx context.Context, outPath, operation string, logs io.Writer) (bool, string, error) {
+		return false, "", nil
+	}
+	now := time.Now()
+	remotes := []types.Remote{
+		{
+			Name: "origin",
+			Branches: types.Branches{
+				Main: types.Branch{
+					Name: "main",
+					Freezes: []types.Freeze{{
+						From: now.Add(-time.Hour).Format(time.RFC3339),
+						To:   now.Add(3 * time.Second).Format(time.RFC3339),
+					}},
+				},
+				Testing: types.Branch{Name: "testing"},
+			},
+		},
+	}
+	d := deployer.New(deployFunc, nil, nil, nil, "", types.Hooks{}, types.HealthChecks{}, types.Confirmation{}, remotes, nil, bus)
+	d.Run()
+
+	// The testing branch has no window
+	d.Submit(store.Generation{SelectedCommitId: "commit-1", SelectedRemoteName: "origin", SelectedBranchIsTesting: true})
+	dpl := events.Next[deployer.DeploymentDone](sub).Deployment
+	assert.Equal(t, "commit-1", dpl.Generation.SelectedCommitId)
+
+	d.Submit(store.Generation{SelectedCommitId: "commit-2", SelectedRemoteName: "origin"})
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		state := d.State()
+		assert.NotNil(c, state.NextWindowOpening)
+		assert.NotNil(c, state.GenerationToDeploy)
+	}, 2*time.Second, 100*time.Millisecond)
+	assert.False(t, d.IsDeploying())
+
+	dpl = events.Next[deployer.DeploymentDone](sub).Deployment
+	assert.Equal(t, "commit-2", dpl.Generation.SelectedCommitId)
+	assert.False(t, dpl.StartedAt.Before(now.Add(2*time.Second)))
+	assert.Nil(t, d.State().NextWindowOpening)
+}
+
+func TestDeployerApproval(t *testing.T) {
+	bus := events.New()
+	sub := bus.Subscribe()
+	var deployFunc = func(ctx context.Context, outPath, operation string, logs io.Writer) (bool, string, error) {
+		return false, "", nil
+	}
+	var diffFunc = func(ctx context.Context, outPath string) (types.ClosureDiff, error) {
+		return types.ClosureDiff{Added: []types.PackageChange{{Name: outPath}}}, nil
+	}
+	remotes := []types.Remote{
+		{
+			Name: "origin",
+			Branches: types.Branches{
+				Main:    types.Branch{Name: "main", RequireApproval: true},
+				Testing: types.Branch{Name: "testing"},
+			},
+		},
+	}
+	d := deployer.New(deployFunc, diffFunc, nil, nil, "", types.Hooks{}, types.HealthChecks{}, types.Confirmation{}, remotes, nil, bus)
+	d.Run()
+	assert.ErrorContains(t, d.Approve("unknown"), "no generation is waiting for an approval")
+
+	g1 := store.Generation{UUID: uuid.New(), SelectedCommitId: "commit-1", SelectedCommitMsg: "msg-1", SelectedRemoteName: "origin", OutPath: "out-path-1"}
+	d.Submit(g1)
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		p := d.State().PendingApproval
+		assert.NotNil(c, p)
+		if p != nil {
+			assert.Equal(c, g1.UUID.String(), p.GenerationUUID)
+			assert.Equal(c, "msg-1", p.CommitMsg)
+			assert.Equal(c, &types.ClosureDiff{Added: []types.PackageChange{{Name: "out-path-1"}}}, p.ClosureDiff)
+		}
+	}, 2*time.Second, 100*time.Millisecond)
+	assert.False(t, d.IsDeploying())
+
+	// The approval expires when a newer commit is submitted
+	g2 := store.Generation{UUID: uuid.New(), SelectedCommitId: "commit-2", SelectedRemoteName: "origin", OutPath: "out-path-2"}
+	d.Submit(g2)
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		p := d.State().PendingApproval
+		assert.NotNil(c, p)
+		if p != nil {
+			assert.Equal(c, g2.UUID.String(), p.GenerationUUID)
+		}
+	}, 2*time.Second, 100*time.Millisecond)
+	assert.ErrorContains(t, d.Approve(g1.UUID.String()), "is not waiting for an approval")
+
+	assert.Nil(t, d.Approve(g2.UUID.String()))
+	dpl := events.Next[deployer.DeploymentDone](sub).Deployment
+	assert.Equal(t, "commit-2", dpl.Generation.SelectedCommitId)
+	assert.Nil(t, d.State().PendingApproval)
+
+	// The testing branch doesn't require an approval
+	d.Submit(store.Generation{UUID: uuid.New(), SelectedCommitId: "commit-3", SelectedRemoteName: "origin", SelectedBranchIsTesting: true})
+	dpl = events.Next[deployer.DeploymentDone](sub).Deployment
+	assert.Equal(t, "commit-3", dpl.Generation.SelectedCommitId)
+}
+
+func TestDeployerManualRollback(t *testing.T) {
+	bus := events.New()
+	sub := bus.Subscribe()
+	var deployedOutPaths []string
+	var deployFunc = func(ctx context.Context, outPath, operation string, logs io.Writer) (bool, string, error) {
+		deployedOutPaths = append(deployedOutPaths, outPath)
+		return false, "", nil
+	}
+	// The health checks are not run on a rollback requested by an
+	// operator
+	d := deployer.New(deployFunc, nil, nil, nil, "", types.Hooks{}, types.HealthChecks{Timeout: 1, Interval: 1, Argv: []string{"false"}}, types.Confirmation{}, nil, nil, bus)
+	d.Run()
+	d.Suspend()
+	d.Submit(store.Generation{SelectedCommitId: "commit-2", OutPath: "out-path-2"})
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.True(c, d.RunnerIsSuspended())
+	}, 3*time.Second, 100*time.Millisecond)
+
+	// The rollback is deployed while the deployer is suspended
+	target := store.Deployment{UUID: "dpl-1", Operation: "switch", Generation: store.Generation{SelectedCommitId: "commit-1", OutPath: "out-path-1"}}
+	assert.Nil(t, d.Rollback(target))
+	dpl := events.Next[deployer.DeploymentDone](sub).Deployment
+	assert.Equal(t, store.Done, dpl.Status)
+	assert.Equal(t, "dpl-1", dpl.RollbackOf)
+	assert.Equal(t, "switch", dpl.Operation)
+	assert.Equal(t, []string{"out-path-1"}, deployedOutPaths)
+	assert.NotNil(t, d.State().GenerationToDeploy)
+
+	d.Resume()
+	dpl = events.Next[deployer.DeploymentDone](sub).Deployment
+	assert.Equal(t, "commit-2", dpl.Generation.SelectedCommitId)
+	assert.Empty(t, dpl.RollbackOf)
+}
+
+func TestDeployerHooks(t *testing.T) {
+	bus := events.New()
+	sub := bus.Subscribe()
+	deployed := false
+	var deployFunc = func(ctx context.Context, outPath, operation string, logs io.Writer) (bool, string, error) {
+		deployed = true
+		return false, "", nil
+	}
+	hooks := types.Hooks{
+		PreDeployment: []types.Hook{
+			{Argv: []string{"sh", "-c", "echo pre $COMIN_GIT_SHA"}, Timeout: 10},
+			{Argv: []string{"false"}, Timeout: 10},
+		},
+		PostDeployment: []types.Hook{
+			{Argv: []string{"sh", "-c", "echo post $COMIN_STATUS"}, Timeout: 10},
+		},
+	}
+	// A failing pre-deployment hook aborts the deployment
+	d := deployer.New(deployFunc, nil, nil, nil, "", hooks, types.HealthChecks{}, types.Confirmation{}, nil, nil, bus)
+	d.Run()
+	d.Submit(store.Generation{SelectedCommitId: "commit-1"})
+	dpl := events.Next[deployer.DeploymentDone](sub).Deployment
+	assert.False(t, deployed)
+	assert.Equal(t, store.Failed, dpl.Status)
+	assert.Contains(t, dpl.ErrorMsg, "the deployment has been aborted: the pre-deployment hook 'false' failed")
+	assert.Equal(t, 3, len(dpl.Hooks))
+	assert.Equal(t, "pre commit-1\n", dpl.Hooks[0].Output)
+	assert.Equal(t, 1, dpl.Hooks[1].ExitCode)
+	assert.Equal(t, "post-deployment", dpl.Hooks[2].Stage)
+	assert.Equal(t, "post failed\n", dpl.Hooks[2].Output)
+
+	hooks.PreDeployment = hooks.PreDeployment[:1]
+	d = deployer.New(deployFunc, nil, nil, nil, "", hooks, types.HealthChecks{}, types.Confirmation{}, nil, nil, bus)
+	d.Run()
+	d.Submit(store.Generation{SelectedCommitId: "commit-1"})
+	dpl = events.Next[deployer.DeploymentDone](sub).Deployment
+	assert.True(t, deployed)
+	assert.Equal(t, store.Done, dpl.Status)
+	assert.Equal(t, 2, len(dpl.Hooks))
+	assert.Equal(t, "post done\n", dpl.Hooks[1].Output)
+}
+
+func TestDeployerClosureDiff(t *testing.T) {
+	bus := events.New()
+	sub := bus.Subscribe()
+	var deployFunc = func(ctx context.Context, outPath, operation string, logs io.Writer) (bool, string, error) {
+		return false, "", nil
+	}
+	diffStarted := make(chan struct{})
+	diffDone := make(chan struct{})
+	var diffFunc = func(ctx context.Context, outPath string) (types.ClosureDiff, error) {
+		close(diffStarted)
+		<-diffDone
+		return types.ClosureDiff{SizeDelta: 1024}, nil
+	}
+	hooks := types.Hooks{
+		PostDeployment: []types.Hook{
+			{Argv: []string{"sh", "-c", "echo -n \"$COMIN_CLOSURE_DIFF\""}, Timeout: 10},
+		},
+	}
+	d := deployer.New(deployFunc, diffFunc, nil, nil, "", hooks, types.HealthChecks{}, types.Confirmation{}, nil, nil, bus)
+	d.Run()
+	// The closure diff of the generation finishes after its
+	// submission
+	d.Submit(store.Generation{SelectedCommitId: "commit-1", OutPath: "out-path"})
+	<-diffStarted
+	close(diffDone)
+	dpl := events.Next[deployer.DeploymentDone](sub).Deployment
+	assert.Equal(t, store.Done, dpl.Status)
+	assert.Equal(t, &types.ClosureDiff{SizeDelta: 1024}, dpl.Generation.ClosureDiff)
+	assert.Equal(t, "Closure size: +1.0 KiB\n", dpl.Hooks[0].Output)
+}
+
+func TestDeployerLogs(t *testing.T) {
+	bus := events.New()
+	sub := bus.Subscribe()
+	l, _ := logs.New(t.TempDir())
+	var deployFunc = func(ctx context.Context, outPath, operation string, log io.Writer) (bool, string, error) {
+		fmt.Fprintf(log, "activating %s\n", outPath)
+		return false, "", nil
+	}
+	d := deployer.New(deployFunc, nil, nil, nil, "", types.Hooks{}, types.HealthChecks{}, types.Confirmation{}, nil, l, bus)
+	d.Run()
+	d.Submit(store.Generation{SelectedCommitId: "commit-1", OutPath: "out-1"})
+	dpl := events.Next[deployer.DeploymentDone](sub).Deployment
+
+	var out bytes.Buffer
+	err := l.Read(context.TODO(), logs.Deployment, dpl.UUID, &out, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "comin: running the switch operation of out-1\nactivating out-1\n", out.String())
+}
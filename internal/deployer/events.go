@@ -0,0 +1,31 @@
+package deployer
+
+import (
+	"time"
+
+	"github.com/nlewo/comin/internal/store"
+)
+
+// DeploymentStarted is published when a deployment starts
+type DeploymentStarted struct {
+	Deployment store.Deployment `json:"deployment"`
+}
+
+func (DeploymentStarted) EventType() string { return "deployer.deployment_started" }
+
+// DeploymentDone is published when a deployment is finished,
+// successfully or not
+type DeploymentDone struct {
+	Deployment store.Deployment `json:"deployment"`
+}
+
+func (DeploymentDone) EventType() string { return "deployer.deployment_done" }
+
+// ConfirmationRequired is published when a deployment starts to wait
+// for a confirmation
+type ConfirmationRequired struct {
+	Deployment store.Deployment `json:"deployment"`
+	Deadline   time.Time        `json:"deadline"`
+}
+
+func (ConfirmationRequired) EventType() string { return "deployer.confirmation_required" }
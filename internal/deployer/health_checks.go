@@ -0,0 +1,96 @@
+package deployer
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/sirupsen/logrus"
+)
+
+func healthChecksEnabled(hc types.HealthChecks) bool {
+	return len(hc.Argv) != 0 || hc.HttpUrl != "" || hc.NoFailedUnits
+}
+
+// runHealthChecks runs the health checks until they succeed or the
+// timeout is reached.
+func runHealthChecks(ctx context.Context, hc types.HealthChecks) error {
+	timeout := time.Duration(hc.Timeout) * time.Second
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	for {
+		err := healthCheck(ctx, hc)
+		if err == nil {
+			logrus.Infof("deployer: health checks succeeded")
+			return nil
+		}
+		logrus.Infof("deployer: health checks failed: %s", err)
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("health checks did not succeed within %s: %w", timeout, err)
+		case <-time.After(time.Duration(hc.Interval) * time.Second):
+		}
+	}
+}
+
+func healthCheck(ctx context.Context, hc types.HealthChecks) error {
+	if len(hc.Argv) != 0 {
+		cmd := exec.CommandContext(ctx, hc.Argv[0], hc.Argv[1:]...)
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			return fmt.Errorf("the command '%s' failed with %s: %s", strings.Join(hc.Argv, " "), err, strings.TrimSpace(string(output)))
+		}
+	}
+	if hc.HttpUrl != "" {
+		if err := httpProbe(ctx, hc.HttpUrl); err != nil {
+			return err
+		}
+	}
+	if hc.NoFailedUnits {
+		cmd := exec.CommandContext(ctx, "systemctl", "list-units", "--state=failed", "--no-legend", "--plain")
+		var stdout bytes.Buffer
+		cmd.Stdout = &stdout
+		if err := cmd.Run(); err != nil {
+			return fmt.Errorf("the command 'systemctl list-units --state=failed' failed with %s", err)
+		}
+		if units := failedUnits(stdout.String()); len(units) != 0 {
+			return fmt.Errorf("the systemd units %s are failed", strings.Join(units, ", "))
+		}
+	}
+	return nil
+}
+
+// httpProbe returns an error if the url doesn't respond with a 2xx
+// status code
+func httpProbe(ctx context.Context, url string) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("the request to %s failed: %w", url, err)
+	}
+	resp.Body.Close() // nolint
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("the request to %s returned the status code %d", url, resp.StatusCode)
+	}
+	return nil
+}
+
+// failedUnits parses the output of 'systemctl list-units
+// --state=failed --no-legend --plain'
+func failedUnits(output string) (units []string) {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 0 {
+			units = append(units, fields[0])
+		}
+	}
+	return
+}
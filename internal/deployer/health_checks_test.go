@@ -0,0 +1,40 @@
+package deployer
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHealthCheck(t *testing.T) {
+	healthy := true
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+
+	err := healthCheck(context.Background(), types.HealthChecks{HttpUrl: server.URL})
+	assert.Nil(t, err)
+	healthy = false
+	err = healthCheck(context.Background(), types.HealthChecks{HttpUrl: server.URL})
+	assert.ErrorContains(t, err, "returned the status code 503")
+
+	err = healthCheck(context.Background(), types.HealthChecks{Argv: []string{"true"}})
+	assert.Nil(t, err)
+	err = healthCheck(context.Background(), types.HealthChecks{Argv: []string{"sh", "-c", "echo unhealthy; exit 1"}})
+	assert.ErrorContains(t, err, "the command 'sh -c echo unhealthy; exit 1' failed with exit status 1: unhealthy")
+}
+
+func TestFailedUnits(t *testing.T) {
+	output := `nginx.service   loaded failed failed A high performance web server
+postgresql.service loaded failed failed PostgreSQL Server
+`
+	assert.Equal(t, []string{"nginx.service", "postgresql.service"}, failedUnits(output))
+	assert.Empty(t, failedUnits(""))
+}
@@ -0,0 +1,133 @@
+package deployer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/nlewo/comin/internal/store"
+	"github.com/nlewo/comin/internal/types"
+	"github.com/sirupsen/logrus"
+)
+
+func envGitSha(d store.Deployment) string {
+	return d.Generation.SelectedCommitId
+}
+
+func envGitRef(d store.Deployment) string {
+	return fmt.Sprintf("%s/%s", d.Generation.SelectedRemoteName, d.Generation.SelectedBranchName)
+}
+
+func envGitMessage(d store.Deployment) string {
+	return strings.Trim(d.Generation.SelectedCommitMsg, "\n")
+}
+
+func envCominGeneration(d store.Deployment) string {
+	return d.Generation.UUID.String()
+}
+
+func envCominHostname(d store.Deployment) string {
+	return d.Generation.Hostname
+}
+
+func envCominStatus(d store.Deployment) string {
+	return store.StatusToString(d.Status)
+}
+
+func envCominErrorMessage(d store.Deployment) string {
+	return d.ErrorMsg
+}
+
+func envCominFlakeUrl(d store.Deployment) string {
+	return d.Generation.FlakeUrl
+}
+
+func envCominClosureDiff(d store.Deployment) string {
+	if d.Generation.ClosureDiff == nil {
+		return ""
+	}
+	return d.Generation.ClosureDiff.String()
+}
+
+// hookOutputMaxSize is the maximal size of the output of a hook
+// stored in the deployment. The beginning of a longer output is
+// truncated.
+const hookOutputMaxSize = 64 * 1024
+
+// hookWaitDelay is the delay to wait for the output of a hook once it
+// has been killed, in case its children still hold it.
+const hookWaitDelay = 5 * time.Second
+
+func hookEnv(d store.Deployment) []string {
+	return append(os.Environ(),
+		"COMIN_GIT_SHA="+envGitSha(d),
+		"COMIN_GIT_REF="+envGitRef(d),
+		"COMIN_GIT_MSG="+envGitMessage(d),
+		"COMIN_HOSTNAME="+envCominHostname(d),
+		"COMIN_FLAKE_URL="+envCominFlakeUrl(d),
+		"COMIN_GENERATION="+envCominGeneration(d),
+		"COMIN_STATUS="+envCominStatus(d),
+		"COMIN_ERROR_MSG="+envCominErrorMessage(d),
+		"COMIN_CLOSURE_DIFF="+envCominClosureDiff(d),
+	)
+}
+
+// runHook runs a hook with the COMIN_* environment variables of the
+// deployment d.
+func runHook(ctx context.Context, stage string, hook types.Hook, d store.Deployment) store.HookResult {
+	result := store.HookResult{
+		Stage:     stage,
+		Argv:      hook.Argv,
+		StartedAt: time.Now().UTC(),
+		ExitCode:  -1,
+	}
+	timeout := time.Duration(hook.Timeout) * time.Second
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	logrus.Infof("deployer: running the %s hook '%s'", stage, strings.Join(hook.Argv, " "))
+	cmd := exec.CommandContext(ctx, hook.Argv[0], hook.Argv[1:]...)
+	cmd.Env = hookEnv(d)
+	cmd.WaitDelay = hookWaitDelay
+	output, err := cmd.CombinedOutput()
+	result.EndedAt = time.Now().UTC()
+	if len(output) > hookOutputMaxSize {
+		output = output[len(output)-hookOutputMaxSize:]
+	}
+	result.Output = string(output)
+	if cmd.ProcessState != nil {
+		result.ExitCode = cmd.ProcessState.ExitCode()
+	}
+	if ctx.Err() == context.DeadlineExceeded {
+		err = fmt.Errorf("the %s hook '%s' did not finish within %s", stage, strings.Join(hook.Argv, " "), timeout)
+	} else if err != nil {
+		err = fmt.Errorf("the %s hook '%s' failed: %w", stage, strings.Join(hook.Argv, " "), err)
+	}
+	if err != nil {
+		result.ErrorMsg = err.Error()
+		logrus.Errorf("deployer: %s", err)
+	}
+	logrus.Debugf("deployer: the %s hook '%s' output: %s", stage, strings.Join(hook.Argv, " "), result.Output)
+	return result
+}
+
+// runHooks runs the hooks in order and appends their results to the
+// deployment. If stopOnError is true, the remaining hooks are not run
+// once a hook failed. It returns the error of the first failing hook.
+func runHooks(ctx context.Context, stage string, hooks []types.Hook, d *store.Deployment, stopOnError bool) (err error) {
+	for _, hook := range hooks {
+		result := runHook(ctx, stage, hook, *d)
+		d.Hooks = append(d.Hooks, result)
+		if result.ErrorMsg != "" && err == nil {
+			err = errors.New(result.ErrorMsg)
+			if stopOnError {
+				return
+			}
+		}
+	}
+	return
+}
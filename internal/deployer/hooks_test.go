@@ -0,0 +1,76 @@
+package deployer
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/nlewo/comin/internal/store"
+	"github.com/nlewo/comin/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBasic(t *testing.T) {
+
+	startedAt := time.Now()
+	endedAt := startedAt.Add(10 * time.Second)
+	deployment := store.Deployment{
+		UUID: "uuid",
+		// Generation builder.Generation
+		StartedAt:    startedAt,
+		EndedAt:      endedAt,
+		Err:          nil,
+		ErrorMsg:     "",
+		RestartComin: false,
+		ProfilePath:  "",
+		Status:       store.Done,
+		Operation:    "",
+	}
+
+	result := runHook(context.TODO(), "post-deployment", types.Hook{Argv: []string{"env"}, Timeout: 10}, deployment)
+	assert.Empty(t, result.ErrorMsg)
+	assert.Equal(t, 0, result.ExitCode)
+	assert.Contains(t, result.Output, "COMIN_GIT_SHA=")
+	assert.Contains(t, result.Output, "COMIN_STATUS=done")
+	assert.Contains(t, result.Output, "COMIN_CLOSURE_DIFF=\n")
+
+	deployment.Generation.ClosureDiff = &types.ClosureDiff{
+		Upgraded:  []types.PackageChange{{Name: "hello", OldVersions: []string{"2.10"}, NewVersions: []string{"2.12"}, SizeDelta: 2048}},
+		SizeDelta: 2048,
+	}
+	result = runHook(context.TODO(), "post-deployment", types.Hook{Argv: []string{"env"}, Timeout: 10}, deployment)
+	assert.Contains(t, result.Output, "COMIN_CLOSURE_DIFF=[U] hello: 2.10 → 2.12 (+2.0 KiB)\nClosure size: +2.0 KiB\n")
+}
+
+func TestRunHook(t *testing.T) {
+	result := runHook(context.TODO(), "pre-deployment", types.Hook{Argv: []string{"sh", "-c", "echo failing; exit 3"}, Timeout: 10}, store.Deployment{})
+	assert.Equal(t, 3, result.ExitCode)
+	assert.Equal(t, "failing\n", result.Output)
+	assert.Contains(t, result.ErrorMsg, "the pre-deployment hook 'sh -c echo failing; exit 3' failed")
+
+	result = runHook(context.TODO(), "pre-deployment", types.Hook{Argv: []string{"sleep", "10"}, Timeout: 1}, store.Deployment{})
+	assert.Equal(t, -1, result.ExitCode)
+	assert.Contains(t, result.ErrorMsg, "did not finish within 1s")
+
+	result = runHook(context.TODO(), "pre-deployment", types.Hook{Argv: []string{"does-not-exist"}, Timeout: 1}, store.Deployment{})
+	assert.Equal(t, -1, result.ExitCode)
+	assert.Contains(t, result.ErrorMsg, "executable file not found")
+}
+
+func TestRunHooks(t *testing.T) {
+	hooks := []types.Hook{
+		{Argv: []string{"false"}, Timeout: 10},
+		{Argv: []string{"true"}, Timeout: 10},
+	}
+	d := store.Deployment{}
+	err := runHooks(context.TODO(), "pre-deployment", hooks, &d, true)
+	assert.ErrorContains(t, err, "the pre-deployment hook 'false' failed")
+	assert.Equal(t, 1, len(d.Hooks))
+
+	d = store.Deployment{}
+	err = runHooks(context.TODO(), "post-deployment", hooks, &d, false)
+	assert.ErrorContains(t, err, "the post-deployment hook 'false' failed")
+	assert.Equal(t, 2, len(d.Hooks))
+	assert.Equal(t, 1, d.Hooks[0].ExitCode)
+	assert.Equal(t, 0, d.Hooks[1].ExitCode)
+}
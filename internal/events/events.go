@@ -0,0 +1,132 @@
+// Package events is an in-process bus on which the fetcher, the
+// builder, the deployer and the store publish their transitions. Any
+// number of subscribers can receive these events. An event is never
+// dropped: each subscription queues the events until they are
+// received, and they are received in the order they have been
+// published.
+package events
+
+import (
+	"sync"
+	"time"
+)
+
+// Payload is the data of an event. The payloads are defined by the
+// publishing packages.
+type Payload interface {
+	// EventType returns the name of the event, such as
+	// builder.build_done
+	EventType() string
+}
+
+type Event struct {
+	Type string    `json:"type"`
+	Time time.Time `json:"time"`
+	Data Payload   `json:"data"`
+}
+
+type Bus struct {
+	mu            sync.Mutex
+	subscriptions map[*Subscription]struct{}
+}
+
+func New() *Bus {
+	return &Bus{
+		subscriptions: make(map[*Subscription]struct{}),
+	}
+}
+
+// Publish sends an event to all subscriptions. It doesn't block. A
+// nil Bus discards the events.
+func (b *Bus) Publish(p Payload) {
+	if b == nil {
+		return
+	}
+	e := Event{
+		Type: p.EventType(),
+		Time: time.Now().UTC(),
+		Data: p,
+	}
+	// The lock ensures the events are queued in the same order in
+	// all subscriptions
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for s := range b.subscriptions {
+		s.push(e)
+	}
+}
+
+// Subscribe returns a subscription receiving the events published
+// from now on. It has to be unsubscribed to release its resources.
+func (b *Bus) Subscribe() *Subscription {
+	ch := make(chan Event)
+	s := &Subscription{
+		C:      ch,
+		ch:     ch,
+		notify: make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	b.mu.Lock()
+	b.subscriptions[s] = struct{}{}
+	b.mu.Unlock()
+	go s.run()
+	return s
+}
+
+// Unsubscribe stops the subscription. Its channel is then closed.
+func (b *Bus) Unsubscribe(s *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subscriptions[s]; ok {
+		delete(b.subscriptions, s)
+		close(s.done)
+	}
+}
+
+type Subscription struct {
+	// C receives the events
+	C  <-chan Event
+	ch chan Event
+
+	mu sync.Mutex
+	// The events not received yet
+	queue  []Event
+	notify chan struct{}
+	done   chan struct{}
+}
+
+func (s *Subscription) push(e Event) {
+	s.mu.Lock()
+	s.queue = append(s.queue, e)
+	s.mu.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+// run sends the queued events to the channel of the subscription
+func (s *Subscription) run() {
+	defer close(s.ch)
+	for {
+		s.mu.Lock()
+		if len(s.queue) == 0 {
+			s.mu.Unlock()
+			select {
+			case <-s.notify:
+				continue
+			case <-s.done:
+				return
+			}
+		}
+		e := s.queue[0]
+		s.queue[0] = Event{}
+		s.queue = s.queue[1:]
+		s.mu.Unlock()
+		select {
+		case s.ch <- e:
+		case <-s.done:
+			return
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package events
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type counted struct {
+	N int
+}
+
+func (counted) EventType() string { return "test.counted" }
+
+type other struct{}
+
+func (other) EventType() string { return "test.other" }
+
+func TestBus(t *testing.T) {
+	b := New()
+	s1 := b.Subscribe()
+	s2 := b.Subscribe()
+
+	// The events are queued since they are not received yet
+	for i := 0; i < 100; i++ {
+		b.Publish(counted{N: i})
+	}
+	for i := 0; i < 100; i++ {
+		e := <-s1.C
+		assert.Equal(t, "test.counted", e.Type)
+		assert.Equal(t, counted{N: i}, e.Data)
+	}
+	for i := 0; i < 100; i++ {
+		assert.Equal(t, counted{N: i}, Next[counted](s2))
+	}
+
+	b.Unsubscribe(s1)
+	_, ok := <-s1.C
+	assert.False(t, ok)
+	b.Publish(counted{N: 100})
+	assert.Equal(t, counted{N: 100}, Next[counted](s2))
+}
+
+func TestNext(t *testing.T) {
+	b := New()
+	s := b.Subscribe()
+	defer b.Unsubscribe(s)
+	b.Publish(other{})
+	b.Publish(counted{N: 1})
+	assert.Equal(t, counted{N: 1}, Next[counted](s))
+
+	// A subscription only receives the events published after
+	// its creation
+	b.Publish(counted{N: 2})
+	late := b.Subscribe()
+	defer b.Unsubscribe(late)
+	b.Publish(counted{N: 3})
+	select {
+	case e := <-late.C:
+		assert.Equal(t, counted{N: 3}, e.Data)
+	case <-time.After(time.Second):
+		t.Fatal("no event received")
+	}
+}
+
+func TestNilBus(t *testing.T) {
+	var b *Bus
+	b.Publish(counted{})
+}
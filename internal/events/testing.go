@@ -0,0 +1,14 @@
+package events
+
+// Next returns the payload of the next event of type T received by
+// the subscription. The other events are skipped. This is mainly used
+// by tests to wait for an event.
+func Next[T Payload](s *Subscription) T {
+	for e := range s.C {
+		if p, ok := e.Data.(T); ok {
+			return p
+		}
+	}
+	var zero T
+	return zero
+}
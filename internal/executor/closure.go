@@ -0,0 +1,115 @@
+package executor
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/nlewo/comin/internal/types"
+)
+
+var (
+	ansiRe = regexp.MustCompile(`\x1b\[[0-9;]*m`)
+	// The size difference of a package, such as +12.3 KiB
+	sizeDeltaRe = regexp.MustCompile(`(?:^|, )([+-][0-9]+(?:\.[0-9]+)?) (B|KiB|MiB|GiB)$`)
+)
+
+var sizeUnits = map[string]float64{
+	"B":   1,
+	"KiB": 1 << 10,
+	"MiB": 1 << 20,
+	"GiB": 1 << 30,
+}
+
+// parseVersions parses a set of versions printed by nix store
+// diff-closures, where ∅ is the empty set and ε an empty version.
+func parseVersions(s string) (versions []string) {
+	if s == "∅" {
+		return nil
+	}
+	for _, v := range strings.Split(s, ", ") {
+		if v == "ε" {
+			v = ""
+		}
+		versions = append(versions, v)
+	}
+	return
+}
+
+// parseClosureDiff parses the output of nix store diff-closures. Each
+// line looks like "hello: 2.10 → 2.12, +12.3 KiB". The packages whose
+// versions didn't change are ignored.
+func parseClosureDiff(output string) (diff types.ClosureDiff) {
+	scanner := bufio.NewScanner(strings.NewReader(ansiRe.ReplaceAllString(output, "")))
+	for scanner.Scan() {
+		name, rest, found := strings.Cut(strings.TrimSpace(scanner.Text()), ": ")
+		if !found {
+			continue
+		}
+		change := types.PackageChange{Name: name}
+		if m := sizeDeltaRe.FindStringSubmatch(rest); m != nil {
+			size, _ := strconv.ParseFloat(m[1], 64)
+			change.SizeDelta = int64(size * sizeUnits[m[2]])
+			rest = strings.TrimSuffix(rest, m[0])
+		}
+		old, new, found := strings.Cut(rest, " → ")
+		if !found {
+			continue
+		}
+		change.OldVersions = parseVersions(old)
+		change.NewVersions = parseVersions(new)
+		switch {
+		case len(change.OldVersions) == 0:
+			diff.Added = append(diff.Added, change)
+		case len(change.NewVersions) == 0:
+			diff.Removed = append(diff.Removed, change)
+		default:
+			diff.Upgraded = append(diff.Upgraded, change)
+		}
+	}
+	return
+}
+
+// closureSize returns the size in bytes of the closure of a store path
+func closureSize(ctx context.Context, path string) (int64, error) {
+	var stdout bytes.Buffer
+	args := []string{"path-info", "--closure-size", path}
+	if err := runNixCommand(ctx, args, &stdout, os.Stderr); err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(stdout.String())
+	if len(fields) != 2 {
+		return 0, fmt.Errorf("unexpected output of nix path-info: %s", stdout.String())
+	}
+	return strconv.ParseInt(fields[1], 10, 64)
+}
+
+func diffClosures(ctx context.Context, from, to string) (diff types.ClosureDiff, err error) {
+	args := []string{
+		"store",
+		"diff-closures",
+		from,
+		to,
+	}
+	var stdout bytes.Buffer
+	err = runNixCommand(ctx, args, &stdout, os.Stderr)
+	if err != nil {
+		return
+	}
+	diff = parseClosureDiff(stdout.String())
+	fromSize, err := closureSize(ctx, from)
+	if err != nil {
+		return
+	}
+	toSize, err := closureSize(ctx, to)
+	if err != nil {
+		return
+	}
+	diff.SizeDelta = toSize - fromSize
+	return
+}
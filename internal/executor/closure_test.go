@@ -0,0 +1,30 @@
+package executor
+
+import (
+	"testing"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseClosureDiff(t *testing.T) {
+	output := "firefox: 133.0 → 134.0, \x1b[31;1m+1228.8 KiB\x1b[0m\n" +
+		"htop: ∅ → 3.3.0, \x1b[31;1m+412.0 KiB\x1b[0m\n" +
+		"nano: 8.2 → ∅, \x1b[32;1m-2.0 MiB\x1b[0m\n" +
+		"initrd: ε → ∅\n" +
+		"linux: 6.6.1, 6.6.1-modules → 6.6.2, 6.6.2-modules\n" +
+		"nixos-system: \x1b[31;1m+10.0 KiB\x1b[0m\n"
+	assert.Equal(t, types.ClosureDiff{
+		Added: []types.PackageChange{
+			{Name: "htop", NewVersions: []string{"3.3.0"}, SizeDelta: 421888},
+		},
+		Removed: []types.PackageChange{
+			{Name: "nano", OldVersions: []string{"8.2"}, SizeDelta: -2097152},
+			{Name: "initrd", OldVersions: []string{""}},
+		},
+		Upgraded: []types.PackageChange{
+			{Name: "firefox", OldVersions: []string{"133.0"}, NewVersions: []string{"134.0"}, SizeDelta: 1258291},
+			{Name: "linux", OldVersions: []string{"6.6.1", "6.6.1-modules"}, NewVersions: []string{"6.6.2", "6.6.2-modules"}},
+		},
+	}, parseClosureDiff(output))
+}
@@ -2,12 +2,14 @@ package executor
 
 import (
 	"context"
+	"io"
 
+	"github.com/nlewo/comin/internal/types"
 	"github.com/sirupsen/logrus"
 )
 
-type EvalFunc func(ctx context.Context, flakeUrl string, hostname string) (drvPath string, outPath string, machineId string, err error)
-type BuildFunc func(ctx context.Context, drvPath string) error
+type EvalFunc func(ctx context.Context, flakeUrl string, hostname string, logs io.Writer) (drvPath string, outPath string, machineId string, err error)
+type BuildFunc func(ctx context.Context, drvPath string, logs io.Writer, onProgress ProgressFunc) error
 
 // Executor contains the function used by comin to actually do actions
 // on the host. This allows us to abstract the way Nix expression are
@@ -15,11 +17,32 @@ type BuildFunc func(ctx context.Context, drvPath string) error
 // Garnix implementation (such as proposed in
 // https://github.com/nlewo/comin/pull/74)
 type Executor interface {
-	Eval(ctx context.Context, flakeUrl, hostname string) (drvPath string, outPath string, machineId string, err error)
-	Build(ctx context.Context, drvPath string) (err error)
-	Deploy(ctx context.Context, outPath, operation string) (needToRestartComin bool, profilePath string, err error)
-	NeedToReboot() bool
+	// The outputs of the commands run by Eval, Build and Deploy
+	// are written to logs
+	Eval(ctx context.Context, flakeUrl, hostname string, logs io.Writer) (drvPath string, outPath string, machineId string, err error)
+	// Build reports the progress of the build to onProgress (if
+	// not nil)
+	Build(ctx context.Context, drvPath string, logs io.Writer, onProgress ProgressFunc) (err error)
+	Deploy(ctx context.Context, outPath, operation string, logs io.Writer) (needToRestartComin bool, profilePath string, err error)
+	// DiffClosures returns the differences between the closure of
+	// the running system and the closure of outPath
+	DiffClosures(ctx context.Context, outPath string) (types.ClosureDiff, error)
+	// NeedToReboot returns the reasons why the machine needs to be
+	// rebooted to run the current system. It is empty when no
+	// reboot is needed.
+	NeedToReboot() []string
+	// RebootReasons returns the components of the system outPath
+	// which differ from the booted system. They are only
+	// activated by a reboot.
+	RebootReasons(outPath string) []string
+	// Reboot reboots the machine
+	Reboot() error
+	// ReadBootId returns an identifier of the current boot. It
+	// changes at each reboot.
+	ReadBootId() (string, error)
 	ReadMachineId() (string, error)
+	// CurrentSystem returns the outpath of the running system
+	CurrentSystem() (string, error)
 	// IsStorePathExist returns true if a storepath exists. This
 	// is used to detect if a build will be required or not.
 	IsStorePathExist(string) bool
@@ -2,6 +2,7 @@ package executor
 
 import (
 	"context"
+	"io"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -54,7 +55,7 @@ func TestNixExecutorEval(t *testing.T) {
 			// Test that Eval doesn't panic and handles parameters correctly
 			// This will error in test environment since nix commands will fail,
 			// but we're testing the code path and parameter handling
-			_, _, _, err = executor.Eval(ctx, tt.flakeUrl, tt.hostname)
+			_, _, _, err = executor.Eval(ctx, tt.flakeUrl, tt.hostname, io.Discard)
 			t.Logf("Eval with %s returned error: %v (expected in test environment)", tt.configurationAttr, err)
 		})
 	}
@@ -154,7 +155,7 @@ func TestNixExecutorDeploy(t *testing.T) {
 			ctx := context.Background()
 
 			// Test that Deploy doesn't panic and delegates to the correct platform-specific function
-			_, _, err = executor.Deploy(ctx, tt.outPath, tt.operation)
+			_, _, err = executor.Deploy(ctx, tt.outPath, tt.operation, io.Discard)
 			t.Logf("Deploy with %s returned error: %v (expected in test environment)", tt.configurationAttr, err)
 		})
 	}
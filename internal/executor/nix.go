@@ -5,8 +5,10 @@ import (
 	"context"
 	"encoding/json"
 	"errors"
+	"io"
 	"os"
 
+	"github.com/nlewo/comin/internal/types"
 	"github.com/nlewo/comin/internal/utils"
 )
 
@@ -25,18 +27,44 @@ func (n *NixLocal) ReadMachineId() (string, error) {
 	return utils.ReadMachineIdLinux()
 }
 
-func (n *NixLocal) NeedToReboot() bool {
+func (n *NixLocal) NeedToReboot() []string {
 	if n.configurationAttr == "darwinConfigurations" {
 		// TODO: Implement proper reboot detection for Darwin
 		// Unlike NixOS which has /run/current-system vs /run/booted-system paths,
 		// Darwin/macOS doesn't have equivalent mechanisms for detecting when
 		// a reboot is needed after nix-darwin configuration changes.
 		// For now, conservatively assume no reboot is needed.
-		return false
+		return nil
 	}
 	return utils.NeedToRebootLinux()
 }
 
+func (n *NixLocal) RebootReasons(outPath string) []string {
+	if n.configurationAttr == "darwinConfigurations" {
+		// As for NeedToReboot, no reboot is considered as needed
+		return nil
+	}
+	return utils.RebootReasons(outPath, "/run/booted-system")
+}
+
+func (n *NixLocal) Reboot() error {
+	if n.configurationAttr == "darwinConfigurations" {
+		return utils.RebootDarwin()
+	}
+	return utils.RebootLinux()
+}
+
+func (n *NixLocal) ReadBootId() (string, error) {
+	if n.configurationAttr == "darwinConfigurations" {
+		return utils.ReadBootIdDarwin()
+	}
+	return utils.ReadBootIdLinux()
+}
+
+func (n *NixLocal) CurrentSystem() (string, error) {
+	return utils.ReadCurrentSystem()
+}
+
 func (n *NixLocal) IsStorePathExist(storePath string) bool {
 	if _, err := os.Stat(storePath); errors.Is(err, os.ErrNotExist) {
 		return false
@@ -45,24 +73,28 @@ func (n *NixLocal) IsStorePathExist(storePath string) bool {
 }
 
 func (n *NixLocal) ShowDerivation(ctx context.Context, flakeUrl, hostname string) (drvPath string, outPath string, err error) {
-	return showDerivation(ctx, flakeUrl, hostname, n.configurationAttr)
+	return showDerivation(ctx, flakeUrl, hostname, n.configurationAttr, os.Stderr)
 }
 
-func (n *NixLocal) Eval(ctx context.Context, flakeUrl, hostname string) (drvPath string, outPath string, machineId string, err error) {
-	drvPath, outPath, err = showDerivation(ctx, flakeUrl, hostname, n.configurationAttr)
+func (n *NixLocal) Eval(ctx context.Context, flakeUrl, hostname string, logs io.Writer) (drvPath string, outPath string, machineId string, err error) {
+	drvPath, outPath, err = showDerivation(ctx, flakeUrl, hostname, n.configurationAttr, logs)
 	if err != nil {
 		return
 	}
-	machineId, err = getExpectedMachineId(ctx, flakeUrl, hostname, n.configurationAttr)
+	machineId, err = getExpectedMachineId(ctx, flakeUrl, hostname, n.configurationAttr, logs)
 	return
 }
 
-func (n *NixLocal) Build(ctx context.Context, drvPath string) (err error) {
-	return build(ctx, drvPath)
+func (n *NixLocal) Build(ctx context.Context, drvPath string, logs io.Writer, onProgress ProgressFunc) (err error) {
+	return build(ctx, drvPath, logs, onProgress)
+}
+
+func (n *NixLocal) DiffClosures(ctx context.Context, outPath string) (types.ClosureDiff, error) {
+	return diffClosures(ctx, "/run/current-system", outPath)
 }
 
-func (n *NixLocal) Deploy(ctx context.Context, outPath, operation string) (needToRestartComin bool, profilePath string, err error) {
-	return deploy(ctx, outPath, operation, n.configurationAttr)
+func (n *NixLocal) Deploy(ctx context.Context, outPath, operation string, logs io.Writer) (needToRestartComin bool, profilePath string, err error) {
+	return deploy(ctx, outPath, operation, n.configurationAttr, logs)
 }
 
 type Path struct {
@@ -0,0 +1,181 @@
+package executor
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/nlewo/comin/internal/types"
+)
+
+// ProgressFunc is called each time the progress of a build changes
+type ProgressFunc func(types.BuildProgress)
+
+// Activity and result types of the Nix internal-json log format
+const (
+	actFileTransfer = 101
+	actCopyPaths    = 103
+	actBuilds       = 104
+	actBuild        = 105
+
+	resBuildLogLine = 101
+	resProgress     = 105
+	resSetExpected  = 106
+
+	// The default verbosity of Nix
+	lvlInfo = 3
+)
+
+type nixLogEntry struct {
+	Action string `json:"action"`
+	Id     uint64 `json:"id"`
+	Level  int    `json:"level"`
+	Type   int    `json:"type"`
+	Text   string `json:"text"`
+	Msg    string `json:"msg"`
+	Fields []any  `json:"fields"`
+}
+
+// field returns the integer field i of an entry or 0
+func (e nixLogEntry) field(i int) int64 {
+	if i >= len(e.Fields) {
+		return 0
+	}
+	if f, ok := e.Fields[i].(float64); ok {
+		return int64(f)
+	}
+	return 0
+}
+
+// progressWriter parses the internal-json log format of Nix to report
+// the progress of a build. The messages and the build logs are
+// written in a human readable format to logs.
+type progressWriter struct {
+	logs       io.Writer
+	onProgress ProgressFunc
+	buf        []byte
+	// The type of the running activities
+	activities map[uint64]int
+	// The derivation of the running builds
+	builds map[uint64]string
+	// The bytes downloaded by each file transfer
+	transfers map[uint64]int64
+	progress  types.BuildProgress
+}
+
+func newProgressWriter(logs io.Writer, onProgress ProgressFunc) *progressWriter {
+	return &progressWriter{
+		logs:       logs,
+		onProgress: onProgress,
+		activities: make(map[uint64]int),
+		builds:     make(map[uint64]string),
+		transfers:  make(map[uint64]int64),
+	}
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	p.buf = append(p.buf, b...)
+	for {
+		i := bytes.IndexByte(p.buf, '\n')
+		if i < 0 {
+			break
+		}
+		p.handleLine(p.buf[:i])
+		p.buf = p.buf[i+1:]
+	}
+	return len(b), nil
+}
+
+// flush handles the last line if it is not terminated by a newline
+func (p *progressWriter) flush() {
+	if len(p.buf) > 0 {
+		p.handleLine(p.buf)
+		p.buf = nil
+	}
+}
+
+// derivationName returns the name of a derivation from its path
+func derivationName(drvPath string) string {
+	name := strings.TrimSuffix(filepath.Base(drvPath), ".drv")
+	if _, n, found := strings.Cut(name, "-"); found {
+		return n
+	}
+	return name
+}
+
+func (p *progressWriter) handleLine(line []byte) {
+	data, found := bytes.CutPrefix(line, []byte("@nix "))
+	if !found {
+		fmt.Fprintf(p.logs, "%s\n", line)
+		return
+	}
+	var e nixLogEntry
+	if err := json.Unmarshal(data, &e); err != nil {
+		fmt.Fprintf(p.logs, "%s\n", line)
+		return
+	}
+	changed := false
+	switch e.Action {
+	case "msg":
+		fmt.Fprintf(p.logs, "%s\n", e.Msg)
+	case "start":
+		p.activities[e.Id] = e.Type
+		if e.Text != "" && e.Level <= lvlInfo {
+			fmt.Fprintf(p.logs, "%s\n", e.Text)
+		}
+		if e.Type == actBuild && len(e.Fields) > 0 {
+			if drvPath, ok := e.Fields[0].(string); ok {
+				p.builds[e.Id] = drvPath
+				changed = true
+			}
+		}
+	case "stop":
+		if _, ok := p.builds[e.Id]; ok {
+			delete(p.builds, e.Id)
+			changed = true
+		}
+		delete(p.activities, e.Id)
+	case "result":
+		switch e.Type {
+		case resBuildLogLine:
+			if len(e.Fields) > 0 {
+				fmt.Fprintf(p.logs, "%s> %v\n", derivationName(p.builds[e.Id]), e.Fields[0])
+			}
+		case resProgress:
+			switch p.activities[e.Id] {
+			case actBuilds:
+				p.progress.DerivationsBuilt = int(e.field(0))
+				p.progress.DerivationsTotal = int(e.field(1))
+				changed = true
+			case actCopyPaths:
+				p.progress.PathsDownloaded = int(e.field(0))
+				p.progress.PathsTotal = int(e.field(1))
+				changed = true
+			case actFileTransfer:
+				p.transfers[e.Id] = e.field(0)
+				p.progress.BytesDownloaded = 0
+				for _, done := range p.transfers {
+					p.progress.BytesDownloaded += done
+				}
+				changed = true
+			}
+		case resSetExpected:
+			if e.field(0) == actFileTransfer {
+				p.progress.BytesTotal = e.field(1)
+				changed = true
+			}
+		}
+	}
+	if changed && p.onProgress != nil {
+		p.progress.RunningBuilds = make([]string, 0, len(p.builds))
+		for _, drvPath := range p.builds {
+			p.progress.RunningBuilds = append(p.progress.RunningBuilds, drvPath)
+		}
+		sort.Strings(p.progress.RunningBuilds)
+		p.onProgress(p.progress)
+	}
+}
@@ -0,0 +1,58 @@
+package executor
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProgressWriter(t *testing.T) {
+	var logs bytes.Buffer
+	var progress []types.BuildProgress
+	p := newProgressWriter(&logs, func(bp types.BuildProgress) {
+		progress = append(progress, bp)
+	})
+	lines := []string{
+		`@nix {"action":"start","id":1,"level":5,"parent":0,"text":"","type":104}`,
+		`@nix {"action":"start","id":2,"level":5,"parent":0,"text":"","type":103}`,
+		`@nix {"action":"result","fields":[0,2,0,0],"id":1,"type":105}`,
+		`@nix {"action":"result","fields":[101,4096],"id":3,"type":106}`,
+		`@nix {"action":"start","fields":["/nix/store/aaa-hello-2.12.drv","",1,1],"id":4,"level":3,"parent":0,"text":"building '/nix/store/aaa-hello-2.12.drv'","type":105}`,
+		`@nix {"action":"result","fields":["Hello world"],"id":4,"type":101}`,
+		`@nix {"action":"start","id":5,"level":4,"parent":0,"text":"downloading 'https://cache.nixos.org/nar/x.nar.xz'","type":101}`,
+		`@nix {"action":"result","fields":[1024,4096,0,0],"id":5,"type":105}`,
+		`@nix {"action":"result","fields":[1,3,0,0],"id":2,"type":105}`,
+		`@nix {"action":"msg","level":0,"msg":"error: something"}`,
+		`not a json line`,
+		`@nix {"action":"stop","id":4}`,
+		`@nix {"action":"result","fields":[1,2,0,0],"id":1,"type":105}`,
+	}
+	for _, l := range lines {
+		_, _ = p.Write([]byte(l + "\n"))
+	}
+	// The last line is not terminated by a newline
+	_, _ = p.Write([]byte("last"))
+	p.flush()
+
+	assert.Equal(t, "building '/nix/store/aaa-hello-2.12.drv'\nhello-2.12> Hello world\nerror: something\nnot a json line\nlast\n", logs.String())
+	assert.Equal(t, types.BuildProgress{
+		DerivationsBuilt: 0,
+		DerivationsTotal: 2,
+		PathsDownloaded:  1,
+		PathsTotal:       3,
+		BytesDownloaded:  1024,
+		BytesTotal:       4096,
+		RunningBuilds:    []string{"/nix/store/aaa-hello-2.12.drv"},
+	}, progress[len(progress)-3])
+	assert.Equal(t, types.BuildProgress{
+		DerivationsBuilt: 1,
+		DerivationsTotal: 2,
+		PathsDownloaded:  1,
+		PathsTotal:       3,
+		BytesDownloaded:  1024,
+		BytesTotal:       4096,
+		RunningBuilds:    []string{},
+	}, progress[len(progress)-1])
+}
@@ -18,7 +18,7 @@ import (
 
 // GetExpectedMachineId evals nixosConfigurations or darwinConfigurations based on configurationAttr
 // returns (machine-id, nil) is comin.machineId is set, ("", nil) otherwise.
-func getExpectedMachineId(ctx context.Context, path, hostname, configurationAttr string) (machineId string, err error) {
+func getExpectedMachineId(ctx context.Context, path, hostname, configurationAttr string, logs io.Writer) (machineId string, err error) {
 	expr := fmt.Sprintf("%s#%s.%s.config.services.comin.machineId", path, configurationAttr, hostname)
 	args := []string{
 		"eval",
@@ -26,7 +26,7 @@ func getExpectedMachineId(ctx context.Context, path, hostname, configurationAttr
 		"--json",
 	}
 	var stdout bytes.Buffer
-	err = runNixCommand(ctx, args, &stdout, os.Stderr)
+	err = runNixCommand(ctx, args, &stdout, logs)
 	if err != nil {
 		return
 	}
@@ -60,7 +60,7 @@ func runNixCommand(ctx context.Context, args []string, stdout, stderr io.Writer)
 	return nil
 }
 
-func showDerivation(ctx context.Context, flakeUrl, hostname, configurationAttr string) (drvPath string, outPath string, err error) {
+func showDerivation(ctx context.Context, flakeUrl, hostname, configurationAttr string, logs io.Writer) (drvPath string, outPath string, err error) {
 	installable := fmt.Sprintf("%s#%s.%s.config.system.build.toplevel", flakeUrl, configurationAttr, hostname)
 	args := []string{
 		"derivation",
@@ -70,7 +70,7 @@ func showDerivation(ctx context.Context, flakeUrl, hostname, configurationAttr s
 		"--show-trace",
 	}
 	var stdout bytes.Buffer
-	err = runNixCommand(ctx, args, &stdout, os.Stderr)
+	err = runNixCommand(ctx, args, &stdout, logs)
 	if err != nil {
 		return
 	}
@@ -91,13 +91,19 @@ func showDerivation(ctx context.Context, flakeUrl, hostname, configurationAttr s
 	return
 }
 
-func build(ctx context.Context, drvPath string) (err error) {
+// build builds a derivation. The progress of the build is parsed from
+// the internal-json log format and reported to onProgress (if not
+// nil).
+func build(ctx context.Context, drvPath string, logs io.Writer, onProgress ProgressFunc) (err error) {
 	args := []string{
 		"build",
 		fmt.Sprintf("%s^*", drvPath),
 		"-L",
-		"--no-link"}
-	err = runNixCommand(ctx, args, os.Stdout, os.Stderr)
+		"--no-link",
+		"--log-format", "internal-json"}
+	progress := newProgressWriter(logs, onProgress)
+	defer progress.flush()
+	err = runNixCommand(ctx, args, logs, progress)
 	if err != nil {
 		return
 	}
@@ -143,19 +149,19 @@ func cominUnitFileHashDarwin() string {
 	return hash
 }
 
-func switchToConfiguration(operation string, outPath string, dryRun bool, configurationAttr string) error {
+func switchToConfiguration(operation string, outPath string, dryRun bool, configurationAttr string, logs io.Writer) error {
 	if configurationAttr == "darwinConfigurations" {
-		return switchToConfigurationDarwin(operation, outPath, dryRun)
+		return switchToConfigurationDarwin(operation, outPath, dryRun, logs)
 	}
-	return switchToConfigurationLinux(operation, outPath, dryRun)
+	return switchToConfigurationLinux(operation, outPath, dryRun, logs)
 }
 
-func switchToConfigurationLinux(operation string, outPath string, dryRun bool) error {
+func switchToConfigurationLinux(operation string, outPath string, dryRun bool, logs io.Writer) error {
 	switchToConfigurationExe := filepath.Join(outPath, "bin", "switch-to-configuration")
 	logrus.Infof("nix: running '%s %s'", switchToConfigurationExe, operation)
 	cmd := exec.Command(switchToConfigurationExe, operation)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = logs
+	cmd.Stderr = logs
 	if dryRun {
 		logrus.Infof("nix: dry-run enabled: '%s %s' has not been executed", switchToConfigurationExe, operation)
 	} else {
@@ -167,7 +173,7 @@ func switchToConfigurationLinux(operation string, outPath string, dryRun bool) e
 	return nil
 }
 
-func switchToConfigurationDarwin(operation string, outPath string, dryRun bool) error {
+func switchToConfigurationDarwin(operation string, outPath string, dryRun bool, logs io.Writer) error {
 	activateUserExe := filepath.Join(outPath, "activate-user")
 	activateExe := filepath.Join(outPath, "activate")
 
@@ -178,16 +184,16 @@ func switchToConfigurationDarwin(operation string, outPath string, dryRun bool)
 
 	logrus.Infof("nix: activating user environment: '%s'", activateUserExe)
 	userCmd := exec.Command(activateUserExe)
-	userCmd.Stdout = os.Stdout
-	userCmd.Stderr = os.Stderr
+	userCmd.Stdout = logs
+	userCmd.Stderr = logs
 	if err := userCmd.Run(); err != nil {
 		return fmt.Errorf("user activation command %s fails with %s", activateUserExe, err)
 	}
 
 	logrus.Infof("nix: activating system environment: '%s'", activateExe)
 	cmd := exec.Command(activateExe)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stdout = logs
+	cmd.Stderr = logs
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("system activation command %s fails with %s", activateExe, err)
 	}
@@ -196,14 +202,14 @@ func switchToConfigurationDarwin(operation string, outPath string, dryRun bool)
 	return nil
 }
 
-func deploy(ctx context.Context, outPath, operation, configurationAttr string) (needToRestartComin bool, profilePath string, err error) {
+func deploy(ctx context.Context, outPath, operation, configurationAttr string, logs io.Writer) (needToRestartComin bool, profilePath string, err error) {
 	if configurationAttr == "darwinConfigurations" {
-		return deployDarwin(ctx, outPath, operation)
+		return deployDarwin(ctx, outPath, operation, logs)
 	}
-	return deployLinux(ctx, outPath, operation)
+	return deployLinux(ctx, outPath, operation, logs)
 }
 
-func deployLinux(ctx context.Context, outPath, operation string) (needToRestartComin bool, profilePath string, err error) {
+func deployLinux(ctx context.Context, outPath, operation string, logs io.Writer) (needToRestartComin bool, profilePath string, err error) {
 	// FIXME: this check doesn't have to be here. It should be
 	// done by the manager.
 	beforeCominUnitFileHash := cominUnitFileHashLinux()
@@ -214,7 +220,7 @@ func deployLinux(ctx context.Context, outPath, operation string) (needToRestartC
 		return
 	}
 
-	if err = switchToConfigurationLinux(operation, outPath, false); err != nil {
+	if err = switchToConfigurationLinux(operation, outPath, false, logs); err != nil {
 		return
 	}
 
@@ -229,7 +235,7 @@ func deployLinux(ctx context.Context, outPath, operation string) (needToRestartC
 	return
 }
 
-func deployDarwin(ctx context.Context, outPath, operation string) (needToRestartComin bool, profilePath string, err error) {
+func deployDarwin(ctx context.Context, outPath, operation string, logs io.Writer) (needToRestartComin bool, profilePath string, err error) {
 	// FIXME: this check doesn't have to be here. It should be
 	// done by the manager.
 	beforeCominUnitFileHash := cominUnitFileHashDarwin()
@@ -240,7 +246,7 @@ func deployDarwin(ctx context.Context, outPath, operation string) (needToRestart
 		return
 	}
 
-	if err = switchToConfigurationDarwin(operation, outPath, false); err != nil {
+	if err = switchToConfigurationDarwin(operation, outPath, false, logs); err != nil {
 		return
 	}
 
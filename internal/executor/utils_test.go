@@ -2,6 +2,7 @@ package executor
 
 import (
 	"context"
+	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -35,7 +36,7 @@ func TestGetExpectedMachineId(t *testing.T) {
 		t.Run(tt.name, func(t *testing.T) {
 			// We can't actually run nix eval in tests, but we can test that
 			// the function constructs the right expression and doesn't panic
-			_, err := getExpectedMachineId(context.TODO(), tt.path, tt.hostname, tt.configurationAttr)
+			_, err := getExpectedMachineId(context.TODO(), tt.path, tt.hostname, tt.configurationAttr, os.Stderr)
 
 			// This will likely error because nix eval will fail in test environment,
 			// but that's expected and fine - we're testing the code path
@@ -73,7 +74,7 @@ func TestShowDerivation(t *testing.T) {
 			ctx := context.Background()
 
 			// Test that the function doesn't panic and handles the parameters correctly
-			_, _, err := showDerivation(ctx, tt.flakeUrl, tt.hostname, tt.configurationAttr)
+			_, _, err := showDerivation(ctx, tt.flakeUrl, tt.hostname, tt.configurationAttr, os.Stderr)
 
 			// This will error in test environment because nix command will fail,
 			// but we're testing the code path and parameter handling
@@ -142,7 +143,7 @@ func TestSwitchToConfiguration(t *testing.T) {
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			// Test with dry run to avoid actual system modifications
-			err := switchToConfiguration(tt.operation, tt.outPath, tt.dryRun, tt.configurationAttr)
+			err := switchToConfiguration(tt.operation, tt.outPath, tt.dryRun, tt.configurationAttr, os.Stderr)
 
 			// May error due to missing files in test environment, but shouldn't panic
 			t.Logf("switchToConfiguration with %s returned error: %v", tt.configurationAttr, err)
@@ -179,7 +180,7 @@ func TestDeployFunctions(t *testing.T) {
 			ctx := context.Background()
 
 			// Test that deploy function delegates correctly without panicking
-			_, _, err := deploy(ctx, tt.outPath, tt.operation, tt.configurationAttr)
+			_, _, err := deploy(ctx, tt.outPath, tt.operation, tt.configurationAttr, os.Stderr)
 
 			// Will likely error in test environment, but shouldn't panic
 			t.Logf("deploy with %s returned error: %v (expected in test environment)", tt.configurationAttr, err)
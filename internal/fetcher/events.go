@@ -0,0 +1,23 @@
+package fetcher
+
+import "github.com/nlewo/comin/internal/repository"
+
+// CommitSelected is published when the fetcher selects a new commit
+// to be deployed
+type CommitSelected struct {
+	RepositoryStatus repository.RepositoryStatus `json:"repository_status"`
+}
+
+func (CommitSelected) EventType() string { return "fetcher.commit_selected" }
+
+// FetchRefused is published when a protected branch refuses its new
+// head, because it has been hard reset or it is not signed. It is
+// published once per refused commit.
+type FetchRefused struct {
+	RemoteName string `json:"remote_name"`
+	BranchName string `json:"branch_name"`
+	CommitId   string `json:"commit_id"`
+	ErrorMsg   string `json:"error_msg"`
+}
+
+func (FetchRefused) EventType() string { return "fetcher.fetch_refused" }
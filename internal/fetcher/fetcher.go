@@ -6,24 +6,30 @@ import (
 	"sync/atomic"
 	"time"
 
+	"github.com/nlewo/comin/internal/events"
 	"github.com/nlewo/comin/internal/repository"
 	"github.com/sirupsen/logrus"
 )
 
 type Fetcher struct {
-	isFetching         atomic.Bool
-	repositoryStatus   repository.RepositoryStatus
-	mu                 sync.RWMutex
-	submitRemotes      chan []string
-	RepositoryStatusCh chan repository.RepositoryStatus
-	repo               repository.Repository
+	isFetching       atomic.Bool
+	repositoryStatus repository.RepositoryStatus
+	mu               sync.RWMutex
+	submitRemotes    chan []string
+	repo             repository.Repository
+	// A CommitSelected event is published on the bus when a new
+	// commit is selected
+	bus *events.Bus
+	// The refused commits already published, by remote and branch
+	refused map[string]string
 }
 
-func NewFetcher(repo repository.Repository) *Fetcher {
+func NewFetcher(repo repository.Repository, bus *events.Bus) *Fetcher {
 	f := &Fetcher{
-		repo:               repo,
-		submitRemotes:      make(chan []string),
-		RepositoryStatusCh: make(chan repository.RepositoryStatus),
+		repo:          repo,
+		submitRemotes: make(chan []string),
+		bus:           bus,
+		refused:       make(map[string]string),
 	}
 	f.repositoryStatus = repo.GetRepositoryStatus()
 	return f
@@ -38,6 +44,25 @@ func (f *Fetcher) TriggerFetch(remotes []string) {
 	f.submitRemotes <- remotes
 }
 
+// CheckPin checks a commit can be pinned and returns its full commit
+// ID
+func (f *Fetcher) CheckPin(commitId string) (string, error) {
+	return f.repo.CheckPin(commitId)
+}
+
+// Pin pins the repository to a commit (an empty commitId removes the
+// pin) and triggers a fetch of all remotes to apply it.
+func (f *Fetcher) Pin(commitId string) {
+	f.repo.SetPin(commitId)
+	f.mu.RLock()
+	remotes := make([]string, len(f.repositoryStatus.Remotes))
+	for i, r := range f.repositoryStatus.Remotes {
+		remotes[i] = r.Name
+	}
+	f.mu.RUnlock()
+	f.TriggerFetch(remotes)
+}
+
 type RemoteState struct {
 	Name      string    `json:"name"`
 	FetchedAt time.Time `json:"fetched_at"`
@@ -70,11 +95,15 @@ func (f *Fetcher) Start() {
 			case rs := <-workerRepositoryStatusCh:
 				f.isFetching.Store(false)
 				f.mu.Lock()
-				if rs.SelectedCommitId != f.repositoryStatus.SelectedCommitId || rs.SelectedBranchIsTesting != f.repositoryStatus.SelectedBranchIsTesting {
-					f.repositoryStatus = rs
-					f.RepositoryStatusCh <- rs
+				changed := rs.SelectedCommitId != f.repositoryStatus.SelectedCommitId || rs.SelectedBranchIsTesting != f.repositoryStatus.SelectedBranchIsTesting
+				// The status is always updated to expose
+				// errors, such as an invalid pinned commit
+				f.repositoryStatus = rs
+				if changed {
+					f.bus.Publish(CommitSelected{RepositoryStatus: rs})
 				}
 				f.mu.Unlock()
+				f.publishRefused(rs)
 			}
 			if !f.isFetching.Load() && len(remotes) != 0 {
 				f.isFetching.Store(true)
@@ -85,6 +114,28 @@ func (f *Fetcher) Start() {
 	}()
 }
 
+// publishRefused publishes a FetchRefused event for each head newly
+// refused by a protected branch
+func (f *Fetcher) publishRefused(rs repository.RepositoryStatus) {
+	for _, remote := range rs.Remotes {
+		var branches []FetchRefused
+		if remote.Main != nil {
+			branches = append(branches, FetchRefused{RemoteName: remote.Name, BranchName: remote.Main.Name, CommitId: remote.Main.RefusedCommitId, ErrorMsg: remote.Main.ErrorMsg})
+		}
+		if remote.Testing != nil {
+			branches = append(branches, FetchRefused{RemoteName: remote.Name, BranchName: remote.Testing.Name, CommitId: remote.Testing.RefusedCommitId, ErrorMsg: remote.Testing.ErrorMsg})
+		}
+		for _, b := range branches {
+			key := b.RemoteName + "/" + b.BranchName
+			if b.CommitId != "" && b.CommitId != f.refused[key] {
+				logrus.Infof("fetcher: the commit %s of %s is refused", b.CommitId, key)
+				f.bus.Publish(b)
+			}
+			f.refused[key] = b.CommitId
+		}
+	}
+}
+
 func union(array1, array2 []string) []string {
 	for _, e2 := range array2 {
 		exist := false
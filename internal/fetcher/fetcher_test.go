@@ -5,6 +5,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/nlewo/comin/internal/events"
 	"github.com/nlewo/comin/internal/repository"
 	"github.com/nlewo/comin/internal/utils"
 	"github.com/stretchr/testify/assert"
@@ -12,7 +13,9 @@ import (
 
 func TestFetcher(t *testing.T) {
 	r := utils.NewRepositoryMock()
-	f := NewFetcher(r)
+	bus := events.New()
+	sub := bus.Subscribe()
+	f := NewFetcher(r, bus)
 	f.Start()
 	var commitId string
 
@@ -30,7 +33,7 @@ func TestFetcher(t *testing.T) {
 			SelectedCommitId: commitId,
 		}
 		assert.EventuallyWithT(t, func(c *assert.CollectT) {
-			rs := <-f.RepositoryStatusCh
+			rs := events.Next[CommitSelected](sub).RepositoryStatus
 			assert.Equal(c, commitId, rs.SelectedCommitId)
 		}, 5*time.Second, 100*time.Millisecond, "fetcher failed to fetch")
 
@@ -42,7 +45,7 @@ func TestFetcher(t *testing.T) {
 		SelectedCommitId: "id-5",
 	}
 	assert.EventuallyWithT(t, func(c *assert.CollectT) {
-		rs := <-f.RepositoryStatusCh
+		rs := events.Next[CommitSelected](sub).RepositoryStatus
 		assert.Equal(c, "id-5", rs.SelectedCommitId)
 	}, 5*time.Second, 100*time.Millisecond, "fetcher failed to fetch")
 
@@ -52,10 +55,42 @@ func TestFetcher(t *testing.T) {
 	r.RsCh <- repository.RepositoryStatus{
 		SelectedCommitId: "id-6",
 	}
-	rs := <-f.RepositoryStatusCh
+	rs := events.Next[CommitSelected](sub).RepositoryStatus
 	assert.NotEqual(t, "id-5", rs.SelectedCommitId)
 }
 
+func TestFetcherRefused(t *testing.T) {
+	r := utils.NewRepositoryMock()
+	bus := events.New()
+	sub := bus.Subscribe()
+	f := NewFetcher(r, bus)
+	f.Start()
+
+	refused := func(commitId string) repository.RepositoryStatus {
+		return repository.RepositoryStatus{
+			SelectedCommitId: "id-1",
+			Remotes: []*repository.Remote{{
+				Name: "origin",
+				Main: &repository.MainBranch{
+					Name:            "main",
+					Protected:       true,
+					RefusedCommitId: commitId,
+					ErrorMsg:        "refused",
+				},
+			}},
+		}
+	}
+	f.TriggerFetch([]string{"origin"})
+	r.RsCh <- refused("id-2")
+	e := events.Next[FetchRefused](sub)
+	assert.Equal(t, FetchRefused{RemoteName: "origin", BranchName: "main", CommitId: "id-2", ErrorMsg: "refused"}, e)
+
+	// A commit already refused is not published again
+	r.RsCh <- refused("id-2")
+	r.RsCh <- refused("id-3")
+	assert.Equal(t, "id-3", events.Next[FetchRefused](sub).CommitId)
+}
+
 func TestUnion(t *testing.T) {
 	res := union([]string{"r1", "r2"}, []string{"r1", "r3"})
 	assert.Equal(t, []string{"r1", "r2", "r3"}, res)
@@ -0,0 +1,130 @@
+package http
+
+import (
+	"context"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"net/http"
+	"os/user"
+	"slices"
+	"strconv"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/sirupsen/logrus"
+)
+
+// requireToken only serves the requests authenticated by the bearer
+// token. The exempted paths are authenticated by other means, such as
+// the webhook secret.
+func requireToken(h http.Handler, token string, exempted ...string) http.Handler {
+	expected := []byte("Bearer " + token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token == "" || slices.Contains(exempted, r.URL.Path) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) == 1 {
+			h.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tokenAuthKey{}, true)))
+			return
+		}
+		logrus.Infof("http: refusing the unauthenticated request %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		w.WriteHeader(http.StatusUnauthorized)
+		_, _ = w.Write([]byte("a valid bearer token is required"))
+	})
+}
+
+// tokenAuthKey is set in the context of the requests authenticated
+// by the bearer token
+type tokenAuthKey struct{}
+
+type peerCredKey struct{}
+
+// peerCred are the credentials of the process connected to the Unix
+// socket
+type peerCred struct {
+	uid uint32
+	gid uint32
+	err error
+}
+
+// peerCredContext adds the credentials of the peer of a Unix socket
+// connection to the context of its requests.
+func peerCredContext(ctx context.Context, c net.Conn) context.Context {
+	uc, ok := c.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	var cred peerCred
+	cred.uid, cred.gid, cred.err = peerCredentials(uc)
+	return context.WithValue(ctx, peerCredKey{}, cred)
+}
+
+// peerAllowed returns true if the peer is root, if its uid is allowed
+// or if its group or one of the groups of its user is allowed.
+func peerAllowed(cred peerCred, socket types.UnixSocket) bool {
+	if cred.err != nil {
+		return false
+	}
+	if cred.uid == 0 || slices.Contains(socket.AllowedUids, cred.uid) || slices.Contains(socket.AllowedGids, cred.gid) {
+		return true
+	}
+	if len(socket.AllowedGids) == 0 {
+		return false
+	}
+	u, err := user.LookupId(strconv.FormatUint(uint64(cred.uid), 10))
+	if err != nil {
+		return false
+	}
+	gids, err := u.GroupIds()
+	if err != nil {
+		return false
+	}
+	for _, g := range gids {
+		if gid, err := strconv.ParseUint(g, 10, 32); err == nil && slices.Contains(socket.AllowedGids, uint32(gid)) {
+			return true
+		}
+	}
+	return false
+}
+
+// requirePeer only serves the requests sent by an allowed peer of the
+// Unix socket.
+func requirePeer(h http.Handler, socket types.UnixSocket) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cred, ok := r.Context().Value(peerCredKey{}).(peerCred)
+		if ok && peerAllowed(cred, socket) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if ok && cred.err != nil {
+			logrus.Errorf("http: failed to get the credentials of the peer of the socket %s: %s", socket.Path, cred.err)
+		} else {
+			logrus.Infof("http: refusing the request %s %s from the uid %d and the gid %d", r.Method, r.URL.Path, cred.uid, cred.gid)
+		}
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte("the user is not allowed to use the comin API"))
+	})
+}
+
+// requestIdentity returns the identity of the client of a request, as
+// authenticated by the server: the user of the peer of the Unix
+// socket, the common name of the verified TLS client certificate or
+// "token" if the request has been authenticated by the bearer token.
+// It is "anonymous" when the client is not authenticated.
+func requestIdentity(r *http.Request) string {
+	if cred, ok := r.Context().Value(peerCredKey{}).(peerCred); ok && cred.err == nil {
+		if u, err := user.LookupId(strconv.FormatUint(uint64(cred.uid), 10)); err == nil {
+			return u.Username
+		}
+		return fmt.Sprintf("uid %d", cred.uid)
+	}
+	if r.TLS != nil && len(r.TLS.VerifiedChains) > 0 && len(r.TLS.VerifiedChains[0]) > 0 {
+		return r.TLS.VerifiedChains[0][0].Subject.CommonName
+	}
+	if ok, _ := r.Context().Value(tokenAuthKey{}).(bool); ok {
+		return "token"
+	}
+	return "anonymous"
+}
@@ -0,0 +1,135 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+var okHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	w.WriteHeader(http.StatusOK)
+})
+
+func TestRequireToken(t *testing.T) {
+	h := requireToken(okHandler, "my-token", "/api/fetcher/webhook")
+	for _, c := range []struct {
+		path          string
+		authorization string
+		status        int
+	}{
+		{"/api/status", "", http.StatusUnauthorized},
+		{"/api/status", "Bearer wrong", http.StatusUnauthorized},
+		{"/api/status", "my-token", http.StatusUnauthorized},
+		{"/api/status", "Bearer my-token", http.StatusOK},
+		{"/api/fetcher/webhook", "", http.StatusOK},
+	} {
+		r := httptest.NewRequest(http.MethodGet, c.path, nil)
+		if c.authorization != "" {
+			r.Header.Set("Authorization", c.authorization)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, c.status, w.Code, "%s with '%s'", c.path, c.authorization)
+	}
+
+	// No token is required when it is not configured
+	w := httptest.NewRecorder()
+	requireToken(okHandler, "").ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	assert.Equal(t, http.StatusOK, w.Code)
+}
+
+func TestRequirePeer(t *testing.T) {
+	socket := types.UnixSocket{AllowedUids: []uint32{1000}, AllowedGids: []uint32{100}}
+	h := requirePeer(okHandler, socket)
+	for _, c := range []struct {
+		cred   *peerCred
+		status int
+	}{
+		{nil, http.StatusForbidden},
+		{&peerCred{uid: 0, gid: 0}, http.StatusOK},
+		{&peerCred{uid: 1000, gid: 1000}, http.StatusOK},
+		{&peerCred{uid: 1001, gid: 100}, http.StatusOK},
+		{&peerCred{uid: 1001, gid: 1001}, http.StatusForbidden},
+		{&peerCred{uid: 0, gid: 0, err: fmt.Errorf("no credentials")}, http.StatusForbidden},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/api/status", nil)
+		if c.cred != nil {
+			r = r.WithContext(context.WithValue(r.Context(), peerCredKey{}, *c.cred))
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		assert.Equal(t, c.status, w.Code, "%#v", c.cred)
+	}
+}
+
+func TestUnixSocket(t *testing.T) {
+	path := t.TempDir() + "/run/api.sock"
+	listener, err := listenUnix(path)
+	assert.Nil(t, err)
+	fi, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0666), fi.Mode().Perm())
+
+	uid := uint32(os.Getuid())
+	server := httptest.NewUnstartedServer(requirePeer(okHandler, types.UnixSocket{Path: path, AllowedUids: []uint32{uid}}))
+	server.Listener = listener
+	server.Config.ConnContext = peerCredContext
+	server.Start()
+	defer server.Close()
+
+	client := http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+	resp, err := client.Get("http://localhost/api/status")
+	assert.Nil(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	_ = resp.Body.Close()
+
+	// The socket left by a previous process is replaced
+	server.Close()
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	assert.Nil(t, err)
+	stale.SetUnlinkOnClose(false)
+	_ = stale.Close()
+	listener, err = listenUnix(path)
+	assert.Nil(t, err)
+	_ = listener.Close()
+}
+
+func TestRequestIdentity(t *testing.T) {
+	var identity string
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		identity = requestIdentity(r)
+	})
+
+	r := httptest.NewRequest(http.MethodPost, "/api/manager/pin", nil)
+	requireToken(h, "").ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal(t, "anonymous", identity)
+
+	r = httptest.NewRequest(http.MethodPost, "/api/manager/pin?by=alice", nil)
+	r.Header.Set("Authorization", "Bearer my-token")
+	requireToken(h, "my-token").ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal(t, "token", identity)
+
+	r = httptest.NewRequest(http.MethodPost, "/api/manager/pin", nil)
+	r = r.WithContext(context.WithValue(r.Context(), peerCredKey{}, peerCred{uid: 0, gid: 0}))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal(t, "root", identity)
+
+	r = httptest.NewRequest(http.MethodPost, "/api/manager/pin", nil)
+	r = r.WithContext(context.WithValue(r.Context(), peerCredKey{}, peerCred{uid: 4242424, gid: 0}))
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	assert.Equal(t, "uid 4242424", identity)
+}
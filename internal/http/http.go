@@ -2,13 +2,21 @@ package http
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
+	"path/filepath"
+	"strings"
+	"time"
 
+	"github.com/nlewo/comin/internal/logs"
 	"github.com/nlewo/comin/internal/manager"
 	"github.com/nlewo/comin/internal/prometheus"
+	"github.com/nlewo/comin/internal/types"
+	"github.com/nlewo/comin/internal/webhook"
 	"github.com/sirupsen/logrus"
 )
 
@@ -24,10 +32,172 @@ func handlerStatus(m *manager.Manager, w http.ResponseWriter, r *http.Request) {
 	_, _ = io.Writer.Write(w, rJson)
 }
 
+// handlerPin pins the machine to a commit. The commit is checked by
+// the repository and a refused commit is reported with a conflict.
+func handlerPin(m *manager.Manager, w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodPost:
+		if err := m.Pin(r.FormValue("commit"), requestIdentity(r)); err != nil {
+			w.WriteHeader(http.StatusConflict)
+			_, _ = io.Writer.Write(w, []byte(err.Error()))
+		} else {
+			w.WriteHeader(http.StatusOK)
+		}
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// handlerWebhook triggers a fetch of the remotes corresponding to a
+// push event sent by a Git forge.
+func handlerWebhook(m *manager.Manager, webhookConfig types.Webhook, remotes []types.Remote, w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if webhookConfig.Secret == "" {
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = io.Writer.Write(w, []byte("the webhook is not configured"))
+		return
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = io.Writer.Write(w, []byte(err.Error()))
+		return
+	}
+	push, err := webhook.Parse(r.Header, body, webhookConfig.Secret)
+	if errors.Is(err, webhook.ErrUnauthorized) {
+		logrus.Infof("http: refusing the webhook request from %s: %s", r.RemoteAddr, err)
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	} else if errors.Is(err, webhook.ErrNotPush) {
+		w.WriteHeader(http.StatusOK)
+		_, _ = io.Writer.Write(w, []byte("ignored"))
+		return
+	} else if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = io.Writer.Write(w, []byte(err.Error()))
+		return
+	}
+	names := push.Remotes(remotes)
+	if len(names) == 0 {
+		logrus.Debugf("http: no remote corresponds to the %s push of the branch %s on %s", push.Forge, push.Branch, push.URLs)
+		w.WriteHeader(http.StatusOK)
+		_, _ = io.Writer.Write(w, []byte("no remote corresponds to this push"))
+		return
+	}
+	logrus.Infof("http: the %s push of the branch %s triggers a fetch of the remotes %s", push.Forge, push.Branch, names)
+	m.Fetcher.TriggerFetch(names)
+	w.WriteHeader(http.StatusAccepted)
+	_, _ = io.Writer.Write(w, []byte(strings.Join(names, ",")))
+}
+
+// flushWriter flushes the response after each write in order to
+// stream it.
+type flushWriter struct {
+	w       io.Writer
+	rc      *http.ResponseController
+	written bool
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	f.written = true
+	n, err := f.w.Write(p)
+	if err != nil {
+		return n, err
+	}
+	return n, f.rc.Flush()
+}
+
+// handlerLogs sends the log of a generation or a deployment. With
+// follow=1, the log is streamed until it is closed.
+func handlerLogs(m *manager.Manager, kind logs.Kind, w http.ResponseWriter, r *http.Request) {
+	follow := r.FormValue("follow") == "1"
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fw := &flushWriter{w: w, rc: http.NewResponseController(w)}
+	err := m.ReadLogs(r.Context(), kind, r.PathValue("uuid"), fw, follow)
+	switch {
+	case err == nil:
+	case fw.written:
+		logrus.Errorf("http: failed to send the log %s/%s: %s", kind, r.PathValue("uuid"), err)
+	case errors.Is(err, logs.ErrNotFound):
+		w.WriteHeader(http.StatusNotFound)
+		_, _ = io.Writer.Write(w, []byte(err.Error()))
+	default:
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = io.Writer.Write(w, []byte(err.Error()))
+	}
+}
+
+// eventsKeepAlive is the period of the comments sent on the event
+// stream to keep the connection open through proxies
+const eventsKeepAlive = 30 * time.Second
+
+// handlerEvents streams the events published by the comin components
+// as server-sent events or, with format=ndjson, as newline-delimited
+// JSON. The stream is closed by the client.
+func handlerEvents(m *manager.Manager, w http.ResponseWriter, r *http.Request) {
+	ndjson := r.FormValue("format") == "ndjson"
+	sub := m.SubscribeEvents()
+	defer m.UnsubscribeEvents(sub)
+
+	if ndjson {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+	} else {
+		w.Header().Set("Content-Type", "text/event-stream")
+	}
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	rc := http.NewResponseController(w)
+	if err := rc.Flush(); err != nil {
+		logrus.Errorf("http: the event stream can not be flushed: %s", err)
+		return
+	}
+	logrus.Debugf("http: streaming the events to %s", r.RemoteAddr)
+
+	keepAlive := time.NewTicker(eventsKeepAlive)
+	defer keepAlive.Stop()
+	for {
+		var err error
+		select {
+		case <-r.Context().Done():
+			logrus.Debugf("http: the event stream of %s is closed", r.RemoteAddr)
+			return
+		case <-keepAlive.C:
+			if ndjson {
+				_, err = io.WriteString(w, "\n")
+			} else {
+				_, err = io.WriteString(w, ": keep-alive\n\n")
+			}
+		case e := <-sub.C:
+			var data []byte
+			data, err = json.Marshal(e)
+			if err != nil {
+				logrus.Errorf("http: failed to marshal the event %s: %s", e.Type, err)
+				continue
+			}
+			if ndjson {
+				_, err = fmt.Fprintf(w, "%s\n", data)
+			} else {
+				_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data)
+			}
+		}
+		if err == nil {
+			err = rc.Flush()
+		}
+		if err != nil {
+			logrus.Debugf("http: failed to send an event to %s: %s", r.RemoteAddr, err)
+			return
+		}
+	}
+}
+
 // Serve starts http servers. We create two HTTP servers to easily be
 // able to expose metrics publicly while keeping on localhost only the
-// API.
-func Serve(m *manager.Manager, p prometheus.Prometheus, apiAddress string, apiPort int, metricsAddress string, metricsPort int) {
+// API. The API can also be served on a Unix socket whose clients are
+// authorized by their peer credentials.
+func Serve(m *manager.Manager, p prometheus.Prometheus, apiServer, exporter types.HttpServer, webhookConfig types.Webhook, remotes []types.Remote) {
 	handlerStatusFn := func(w http.ResponseWriter, r *http.Request) {
 		handlerStatus(m, w, r)
 	}
@@ -51,6 +221,9 @@ func Serve(m *manager.Manager, p prometheus.Prometheus, apiAddress string, apiPo
 			w.WriteHeader(http.StatusMethodNotAllowed)
 		}
 	}
+	handlerWebhookFn := func(w http.ResponseWriter, r *http.Request) {
+		handlerWebhook(m, webhookConfig, remotes, w, r)
+	}
 	handlerBuilderSuspendFn := func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodPost:
@@ -101,33 +274,148 @@ func Serve(m *manager.Manager, p prometheus.Prometheus, apiAddress string, apiPo
 			w.WriteHeader(http.StatusMethodNotAllowed)
 		}
 	}
+	handlerDeployerConfirmFn := func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			if err := m.Confirm(); err != nil {
+				w.WriteHeader(http.StatusConflict)
+				_, _ = io.Writer.Write(w, []byte(err.Error()))
+			} else {
+				w.WriteHeader(http.StatusOK)
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+	handlerDeployerApproveFn := func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			if err := m.Approve(r.FormValue("generation")); err != nil {
+				w.WriteHeader(http.StatusConflict)
+				_, _ = io.Writer.Write(w, []byte(err.Error()))
+			} else {
+				w.WriteHeader(http.StatusOK)
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+	handlerDeployerRollbackFn := func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			if err := m.Rollback(r.FormValue("deployment")); err != nil {
+				w.WriteHeader(http.StatusConflict)
+				_, _ = io.Writer.Write(w, []byte(err.Error()))
+			} else {
+				w.WriteHeader(http.StatusOK)
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+	handlerManagerPinFn := func(w http.ResponseWriter, r *http.Request) {
+		handlerPin(m, w, r)
+	}
+	handlerManagerUnpinFn := func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			if err := m.Unpin(); err != nil {
+				w.WriteHeader(http.StatusConflict)
+				_, _ = io.Writer.Write(w, []byte(err.Error()))
+			} else {
+				w.WriteHeader(http.StatusOK)
+			}
+		default:
+			w.WriteHeader(http.StatusMethodNotAllowed)
+		}
+	}
+
+	handlerEventsFn := func(w http.ResponseWriter, r *http.Request) {
+		handlerEvents(m, w, r)
+	}
+	handlerGenerationLogsFn := func(w http.ResponseWriter, r *http.Request) {
+		handlerLogs(m, logs.Generation, w, r)
+	}
+	handlerDeploymentLogsFn := func(w http.ResponseWriter, r *http.Request) {
+		handlerLogs(m, logs.Deployment, w, r)
+	}
 
 	muxApi := http.NewServeMux()
 	muxApi.HandleFunc("/api/status", handlerStatusFn)
 	muxApi.HandleFunc("/api/fetcher", handlerFetcherFn)
 	muxApi.HandleFunc("/api/fetcher/fetch", handlerFetcherFetchFn)
+	muxApi.HandleFunc("/api/fetcher/webhook", handlerWebhookFn)
 	muxApi.HandleFunc("/api/builder/suspend", handlerBuilderSuspendFn)
 	muxApi.HandleFunc("/api/builder/resume", handlerBuilderResumeFn)
 	muxApi.HandleFunc("/api/manager/suspend", handlerManagerSuspendFn)
 	muxApi.HandleFunc("/api/manager/resume", handlerManagerResumeFn)
+	muxApi.HandleFunc("/api/manager/pin", handlerManagerPinFn)
+	muxApi.HandleFunc("/api/manager/unpin", handlerManagerUnpinFn)
+	muxApi.HandleFunc("/api/deployer/confirm", handlerDeployerConfirmFn)
+	muxApi.HandleFunc("/api/deployer/approve", handlerDeployerApproveFn)
+	muxApi.HandleFunc("/api/deployer/rollback", handlerDeployerRollbackFn)
+	muxApi.HandleFunc("GET /api/events", handlerEventsFn)
+	muxApi.HandleFunc("GET /api/generations/{uuid}/logs", handlerGenerationLogsFn)
+	muxApi.HandleFunc("GET /api/deployments/{uuid}/logs", handlerDeploymentLogsFn)
 
 	muxMetrics := http.NewServeMux()
 	muxMetrics.Handle("/metrics", p.Handler())
 
+	if apiServer.UnixSocket.Path != "" {
+		listener, err := listenUnix(apiServer.UnixSocket.Path)
+		if err != nil {
+			logrus.Errorf("Error while creating the API socket: %s", err)
+			os.Exit(1)
+		}
+		server := &http.Server{
+			Handler:     requirePeer(muxApi, apiServer.UnixSocket),
+			ConnContext: peerCredContext,
+		}
+		go func() {
+			logrus.Infof("Starting the API server on the socket %s", apiServer.UnixSocket.Path)
+			if err := server.Serve(listener); err != nil {
+				logrus.Errorf("Error while running the API server on the socket: %s", err)
+				os.Exit(1)
+			}
+		}()
+	}
 	go func() {
-		url := fmt.Sprintf("%s:%d", apiAddress, apiPort)
-		logrus.Infof("Starting the API server on %s", url)
-		if err := http.ListenAndServe(url, muxApi); err != nil {
+		logrus.Infof("Starting the API server on %s:%d", apiServer.ListenAddress, apiServer.Port)
+		// The webhook requests are authenticated by the webhook secret
+		if err := listenAndServe(apiServer, requireToken(muxApi, apiServer.Token, "/api/fetcher/webhook")); err != nil {
 			logrus.Errorf("Error while running the API server: %s", err)
 			os.Exit(1)
 		}
 	}()
 	go func() {
-		url := fmt.Sprintf("%s:%d", metricsAddress, metricsPort)
-		logrus.Infof("Starting the metrics server on %s", url)
-		if err := http.ListenAndServe(url, muxMetrics); err != nil {
+		logrus.Infof("Starting the metrics server on %s:%d", exporter.ListenAddress, exporter.Port)
+		if err := listenAndServe(exporter, requireToken(muxMetrics, exporter.Token)); err != nil {
 			logrus.Errorf("Error while running the metrics server: %s", err)
 			os.Exit(1)
 		}
 	}()
 }
+
+// listenUnix listens on a Unix socket. Since the clients are
+// authorized by their peer credentials, all users can connect to the
+// socket.
+func listenUnix(path string) (net.Listener, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	// The socket of a previous comin process is removed
+	if fi, err := os.Lstat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0666); err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
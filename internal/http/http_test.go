@@ -0,0 +1,57 @@
+package http
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/nlewo/comin/internal/builder"
+	"github.com/nlewo/comin/internal/deployer"
+	"github.com/nlewo/comin/internal/events"
+	"github.com/nlewo/comin/internal/fetcher"
+	"github.com/nlewo/comin/internal/manager"
+	"github.com/nlewo/comin/internal/prometheus"
+	"github.com/nlewo/comin/internal/scheduler"
+	"github.com/nlewo/comin/internal/store"
+	"github.com/nlewo/comin/internal/types"
+	"github.com/nlewo/comin/internal/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func postPin(m *manager.Manager, commitId string) *httptest.ResponseRecorder {
+	form := url.Values{"commit": {commitId}}
+	r := httptest.NewRequest(http.MethodPost, "/api/manager/pin", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	w := httptest.NewRecorder()
+	handlerPin(m, w, r)
+	return w
+}
+
+func TestHandlerPin(t *testing.T) {
+	bus := events.New()
+	tmp := t.TempDir()
+	s, _ := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1, 10, bus)
+	r := utils.NewRepositoryMock()
+	f := fetcher.NewFetcher(r, bus)
+	f.Start()
+	b := builder.New(s, nil, "repoPath", "", "my-machine", time.Second, time.Second, nil, bus)
+	d := deployer.New(nil, nil, nil, nil, "", types.Hooks{}, types.HealthChecks{}, types.Confirmation{}, nil, nil, bus)
+	m := manager.New(s, prometheus.New(), scheduler.New(), f, b, d, "", nil, types.Reboot{}, types.Drift{}, nil, bus)
+
+	r.PinErr = fmt.Errorf("the pinned commit not-a-commit doesn't exist")
+	w := postPin(m, "not-a-commit")
+	assert.Equal(t, http.StatusConflict, w.Code)
+	assert.Equal(t, "the pinned commit not-a-commit doesn't exist", w.Body.String())
+	assert.Nil(t, s.Pin())
+	assert.Equal(t, "", r.PinnedCommitId)
+
+	r.PinErr = nil
+	w = postPin(m, "commit-1")
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, "commit-1", s.Pin().CommitId)
+	assert.Equal(t, "anonymous", s.Pin().By)
+}
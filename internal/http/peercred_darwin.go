@@ -0,0 +1,31 @@
+package http
+
+import (
+	"fmt"
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerCredentials returns the uid and the gid of the peer with
+// LOCAL_PEERCRED
+func peerCredentials(c *net.UnixConn) (uid, gid uint32, err error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return
+	}
+	var cred *unix.Xucred
+	var credErr error
+	if err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptXucred(int(fd), unix.SOL_LOCAL, unix.LOCAL_PEERCRED)
+	}); err != nil {
+		return
+	}
+	if credErr != nil {
+		return 0, 0, credErr
+	}
+	if cred.Ngroups == 0 {
+		return 0, 0, fmt.Errorf("the peer credentials have no group")
+	}
+	return cred.Uid, cred.Groups[0], nil
+}
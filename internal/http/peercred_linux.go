@@ -0,0 +1,27 @@
+package http
+
+import (
+	"net"
+
+	"golang.org/x/sys/unix"
+)
+
+// peerCredentials returns the uid and the gid of the peer with
+// SO_PEERCRED
+func peerCredentials(c *net.UnixConn) (uid, gid uint32, err error) {
+	raw, err := c.SyscallConn()
+	if err != nil {
+		return
+	}
+	var cred *unix.Ucred
+	var credErr error
+	if err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return
+	}
+	if credErr != nil {
+		return 0, 0, credErr
+	}
+	return cred.Uid, cred.Gid, nil
+}
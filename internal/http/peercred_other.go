@@ -0,0 +1,13 @@
+//go:build !linux && !darwin
+
+package http
+
+import (
+	"fmt"
+	"net"
+	"runtime"
+)
+
+func peerCredentials(c *net.UnixConn) (uid, gid uint32, err error) {
+	return 0, 0, fmt.Errorf("the peer credentials are not supported on %s", runtime.GOOS)
+}
@@ -0,0 +1,157 @@
+package http
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/sirupsen/logrus"
+)
+
+// tlsCheckPeriod is the minimal delay between two checks of the
+// modification times of the certificate files
+var tlsCheckPeriod = 10 * time.Second
+
+// tlsReloader provides the TLS configuration of a listener. The
+// certificate, the key and the client CA are reloaded on a handshake
+// when their files have changed, so that a renewed certificate is used
+// without restarting comin.
+type tlsReloader struct {
+	cfg types.TLS
+
+	mu        sync.Mutex
+	config    *tls.Config
+	modTimes  []time.Time
+	checkedAt time.Time
+}
+
+func newTLSReloader(cfg types.TLS) (*tlsReloader, error) {
+	r := &tlsReloader{cfg: cfg}
+	modTimes, err := r.stat()
+	if err != nil {
+		return nil, err
+	}
+	config, err := r.load()
+	if err != nil {
+		return nil, err
+	}
+	r.config = config
+	r.modTimes = modTimes
+	r.checkedAt = time.Now()
+	return r, nil
+}
+
+func (r *tlsReloader) paths() []string {
+	paths := []string{r.cfg.CertPath, r.cfg.KeyPath}
+	if r.cfg.ClientCAPath != "" {
+		paths = append(paths, r.cfg.ClientCAPath)
+	}
+	return paths
+}
+
+func (r *tlsReloader) stat() ([]time.Time, error) {
+	modTimes := make([]time.Time, 0)
+	for _, path := range r.paths() {
+		fi, err := os.Stat(path)
+		if err != nil {
+			return nil, err
+		}
+		modTimes = append(modTimes, fi.ModTime())
+	}
+	return modTimes, nil
+}
+
+func (r *tlsReloader) load() (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(r.cfg.CertPath, r.cfg.KeyPath)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		MinVersion:   tls.VersionTLS12,
+		Certificates: []tls.Certificate{cert},
+	}
+	if r.cfg.ClientCAPath != "" {
+		pem, err := os.ReadFile(r.cfg.ClientCAPath)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in the client CA file %s", r.cfg.ClientCAPath)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// getConfigForClient returns the current configuration. When the files
+// can not be reloaded, the previous configuration is kept.
+func (r *tlsReloader) getConfigForClient(*tls.ClientHelloInfo) (*tls.Config, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if time.Since(r.checkedAt) < tlsCheckPeriod {
+		return r.config, nil
+	}
+	r.checkedAt = time.Now()
+	modTimes, err := r.stat()
+	if err != nil {
+		logrus.Errorf("http: failed to check the certificate %s: %s", r.cfg.CertPath, err)
+		return r.config, nil
+	}
+	if equalTimes(modTimes, r.modTimes) {
+		return r.config, nil
+	}
+	config, err := r.load()
+	if err != nil {
+		logrus.Errorf("http: failed to reload the certificate %s: %s", r.cfg.CertPath, err)
+		return r.config, nil
+	}
+	logrus.Infof("http: the certificate %s has been reloaded", r.cfg.CertPath)
+	r.config = config
+	r.modTimes = modTimes
+	return r.config, nil
+}
+
+// tlsConfig returns the configuration to use in a http.Server
+func (r *tlsReloader) tlsConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		GetConfigForClient: r.getConfigForClient,
+	}
+}
+
+func equalTimes(a, b []time.Time) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if !a[i].Equal(b[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// listenAndServe serves the handler on the TCP listener of the
+// server, with HTTPS when a certificate is configured
+func listenAndServe(server types.HttpServer, handler http.Handler) error {
+	s := &http.Server{
+		Addr:    fmt.Sprintf("%s:%d", server.ListenAddress, server.Port),
+		Handler: handler,
+	}
+	if server.TLS.CertPath == "" {
+		return s.ListenAndServe()
+	}
+	reloader, err := newTLSReloader(server.TLS)
+	if err != nil {
+		return err
+	}
+	s.TLSConfig = reloader.tlsConfig()
+	return s.ListenAndServeTLS("", "")
+}
@@ -0,0 +1,187 @@
+package http
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testCert struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+	tls  tls.Certificate
+}
+
+// newTestCert creates a certificate signed by the parent one. It is
+// self signed when parent is nil.
+func newTestCert(t *testing.T, name string, parent *testCert) testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature
+	} else {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	return testCert{
+		cert: cert,
+		key:  key,
+		tls:  tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+	}
+}
+
+func (c testCert) write(t *testing.T, certPath, keyPath string) {
+	require.NoError(t, os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.cert.Raw}), 0644))
+	if keyPath != "" {
+		der, err := x509.MarshalECPrivateKey(c.key)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: der}), 0600))
+	}
+}
+
+func newTestServer(t *testing.T, cfg types.TLS) *httptest.Server {
+	reloader, err := newTLSReloader(cfg)
+	require.NoError(t, err)
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(requestIdentity(r)))
+	}))
+	s.TLS = reloader.tlsConfig()
+	s.StartTLS()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// tlsGet returns the certificate of the server and the identity of
+// the client as seen by the server
+func tlsGet(url string, ca *testCert, client *testCert) (*x509.Certificate, string, error) {
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.cert)
+	config := &tls.Config{RootCAs: pool}
+	if client != nil {
+		config.Certificates = []tls.Certificate{client.tls}
+	}
+	c := http.Client{Transport: &http.Transport{TLSClientConfig: config}}
+	resp, err := c.Get(url)
+	if err != nil {
+		return nil, "", err
+	}
+	defer resp.Body.Close()
+	identity, err := io.ReadAll(resp.Body)
+	return resp.TLS.PeerCertificates[0], string(identity), err
+}
+
+func TestTLSReload(t *testing.T) {
+	tlsCheckPeriod = 0
+	defer func() { tlsCheckPeriod = 10 * time.Second }()
+
+	dir := t.TempDir()
+	cfg := types.TLS{
+		CertPath: filepath.Join(dir, "cert.pem"),
+		KeyPath:  filepath.Join(dir, "key.pem"),
+	}
+	ca := newTestCert(t, "ca", nil)
+	first := newTestCert(t, "first", &ca)
+	first.write(t, cfg.CertPath, cfg.KeyPath)
+	s := newTestServer(t, cfg)
+
+	cert, _, err := tlsGet(s.URL, &ca, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "first", cert.Subject.CommonName)
+
+	second := newTestCert(t, "second", &ca)
+	second.write(t, cfg.CertPath, cfg.KeyPath)
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(cfg.CertPath, later, later))
+	cert, _, err = tlsGet(s.URL, &ca, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "second", cert.Subject.CommonName)
+
+	// An invalid key pair is not loaded: the previous certificate is
+	// still used
+	first.write(t, cfg.CertPath, "")
+	later = later.Add(time.Minute)
+	require.NoError(t, os.Chtimes(cfg.CertPath, later, later))
+	cert, _, err = tlsGet(s.URL, &ca, nil)
+	require.NoError(t, err)
+	assert.Equal(t, "second", cert.Subject.CommonName)
+}
+
+func TestTLSClientCA(t *testing.T) {
+	dir := t.TempDir()
+	cfg := types.TLS{
+		CertPath:     filepath.Join(dir, "cert.pem"),
+		KeyPath:      filepath.Join(dir, "key.pem"),
+		ClientCAPath: filepath.Join(dir, "client-ca.pem"),
+	}
+	ca := newTestCert(t, "ca", nil)
+	newTestCert(t, "server", &ca).write(t, cfg.CertPath, cfg.KeyPath)
+	clientCA := newTestCert(t, "client-ca", nil)
+	clientCA.write(t, cfg.ClientCAPath, "")
+	s := newTestServer(t, cfg)
+
+	client := newTestCert(t, "prometheus", &clientCA)
+	_, identity, err := tlsGet(s.URL, &ca, &client)
+	assert.NoError(t, err)
+	assert.Equal(t, "prometheus", identity)
+
+	_, _, err = tlsGet(s.URL, &ca, nil)
+	assert.Error(t, err)
+
+	// A client certificate signed by another CA is rejected
+	other := newTestCert(t, "prometheus", &ca)
+	_, _, err = tlsGet(s.URL, &ca, &other)
+	assert.Error(t, err)
+}
+
+func TestNewTLSReloader(t *testing.T) {
+	dir := t.TempDir()
+	_, err := newTLSReloader(types.TLS{
+		CertPath: filepath.Join(dir, "cert.pem"),
+		KeyPath:  filepath.Join(dir, "key.pem"),
+	})
+	assert.Error(t, err)
+
+	cfg := types.TLS{
+		CertPath:     filepath.Join(dir, "cert.pem"),
+		KeyPath:      filepath.Join(dir, "key.pem"),
+		ClientCAPath: filepath.Join(dir, "client-ca.pem"),
+	}
+	ca := newTestCert(t, "ca", nil)
+	ca.write(t, cfg.CertPath, cfg.KeyPath)
+	require.NoError(t, os.WriteFile(cfg.ClientCAPath, []byte("not a certificate"), 0644))
+	_, err = newTLSReloader(cfg)
+	assert.ErrorContains(t, err, "no certificate found")
+}
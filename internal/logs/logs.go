@@ -0,0 +1,177 @@
+// Package logs stores the outputs of the evaluations and builds of
+// the generations and of the activations of the deployments into
+// files. A log can be followed while it is written.
+package logs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/sirupsen/logrus"
+)
+
+type Kind string
+
+const (
+	Generation Kind = "generations"
+	Deployment Kind = "deployments"
+)
+
+// followPeriod is the delay between two reads of a followed log
+const followPeriod = 500 * time.Millisecond
+
+var ErrNotFound = errors.New("log not found")
+
+type Logs struct {
+	dir string
+	mu  sync.Mutex
+	// The number of writers of the log files being written
+	writers map[string]int
+}
+
+// New creates the directories of the logs in dir.
+func New(dir string) (*Logs, error) {
+	for _, kind := range []Kind{Generation, Deployment} {
+		if err := os.MkdirAll(filepath.Join(dir, string(kind)), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &Logs{
+		dir:     dir,
+		writers: make(map[string]int),
+	}, nil
+}
+
+// path returns the path of the log file of the generation or the
+// deployment id. The id has to be an UUID to not escape the logs
+// directory.
+func (l *Logs) path(kind Kind, id string) (string, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return "", fmt.Errorf("invalid %s UUID '%s': %w", strings.TrimSuffix(string(kind), "s"), id, err)
+	}
+	return filepath.Join(l.dir, string(kind), id+".log"), nil
+}
+
+type writer struct {
+	*os.File
+	logs *Logs
+	path string
+}
+
+func (w *writer) Close() error {
+	w.logs.mu.Lock()
+	defer w.logs.mu.Unlock()
+	w.logs.writers[w.path]--
+	if w.logs.writers[w.path] == 0 {
+		delete(w.logs.writers, w.path)
+	}
+	return w.File.Close()
+}
+
+type discard struct{ io.Writer }
+
+func (discard) Close() error { return nil }
+
+// Open opens the log of the generation or the deployment id for
+// appending. The log is followed by readers until it is closed. A nil
+// Logs or a log which can not be opened discards the writes.
+func (l *Logs) Open(kind Kind, id string) io.WriteCloser {
+	if l == nil {
+		return discard{io.Discard}
+	}
+	path, err := l.path(kind, id)
+	if err != nil {
+		logrus.Errorf("logs: %s", err)
+		return discard{io.Discard}
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		logrus.Errorf("logs: failed to open the log file: %s", err)
+		return discard{io.Discard}
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.writers[path]++
+	return &writer{File: f, logs: l, path: path}
+}
+
+func (l *Logs) isWritten(path string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.writers[path] > 0
+}
+
+// Read copies the log of the generation or the deployment id to
+// w. When follow is true, it waits for new writes until the log is
+// closed or ctx is done. It returns ErrNotFound if the log doesn't
+// exist.
+func (l *Logs) Read(ctx context.Context, kind Kind, id string, w io.Writer, follow bool) error {
+	if l == nil {
+		return ErrNotFound
+	}
+	path, err := l.path(kind, id)
+	if err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return ErrNotFound
+	} else if err != nil {
+		return err
+	}
+	defer f.Close() // nolint
+	for {
+		// The log has to be read after checking it is not
+		// written anymore to not miss the last writes
+		written := follow && l.isWritten(path)
+		if _, err := io.Copy(w, f); err != nil {
+			return err
+		}
+		if !written {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(followPeriod):
+		}
+	}
+}
+
+// Clean removes the logs of the generations and deployments which are
+// not in the store anymore. The logs being written are kept.
+func (l *Logs) Clean(generations, deployments []string) {
+	if l == nil {
+		return
+	}
+	for kind, ids := range map[Kind][]string{Generation: generations, Deployment: deployments} {
+		keep := make(map[string]bool)
+		for _, id := range ids {
+			keep[id+".log"] = true
+		}
+		dir := filepath.Join(l.dir, string(kind))
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			logrus.Errorf("logs: failed to read the directory %s: %s", dir, err)
+			continue
+		}
+		for _, e := range entries {
+			path := filepath.Join(dir, e.Name())
+			if keep[e.Name()] || l.isWritten(path) {
+				continue
+			}
+			logrus.Debugf("logs: removing the log file %s", path)
+			if err := os.Remove(path); err != nil {
+				logrus.Errorf("logs: failed to remove the log file: %s", err)
+			}
+		}
+	}
+}
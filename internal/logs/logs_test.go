@@ -0,0 +1,105 @@
+package logs
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOpenRead(t *testing.T) {
+	l, err := New(t.TempDir())
+	assert.Nil(t, err)
+	id := uuid.NewString()
+
+	var out bytes.Buffer
+	err = l.Read(context.TODO(), Generation, id, &out, false)
+	assert.ErrorIs(t, err, ErrNotFound)
+	err = l.Read(context.TODO(), Generation, "../../etc/passwd", &out, false)
+	assert.ErrorContains(t, err, "invalid generation UUID")
+
+	w := l.Open(Generation, id)
+	fmt.Fprintf(w, "evaluating\n")
+	_ = w.Close()
+	w = l.Open(Generation, id)
+	fmt.Fprintf(w, "building\n")
+	_ = w.Close()
+	err = l.Read(context.TODO(), Generation, id, &out, true)
+	assert.Nil(t, err)
+	assert.Equal(t, "evaluating\nbuilding\n", out.String())
+
+	// A nil Logs discards the writes
+	var nilLogs *Logs
+	w = nilLogs.Open(Deployment, id)
+	_, err = fmt.Fprintf(w, "discarded\n")
+	assert.Nil(t, err)
+	assert.Nil(t, w.Close())
+}
+
+func TestFollow(t *testing.T) {
+	l, _ := New(t.TempDir())
+	id := uuid.NewString()
+	w := l.Open(Deployment, id)
+	fmt.Fprintf(w, "line 1\n")
+
+	done := make(chan string)
+	go func() {
+		var out bytes.Buffer
+		_ = l.Read(context.TODO(), Deployment, id, &out, true)
+		done <- out.String()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	fmt.Fprintf(w, "line 2\n")
+	select {
+	case <-done:
+		t.Fatal("the log is not followed until it is closed")
+	case <-time.After(time.Second):
+	}
+	_ = w.Close()
+	assert.Equal(t, "line 1\nline 2\n", <-done)
+
+	// The follow stops when the context is done
+	w = l.Open(Deployment, id)
+	defer w.Close() // nolint
+	ctx, cancel := context.WithCancel(context.TODO())
+	go func() {
+		var out bytes.Buffer
+		_ = l.Read(ctx, Deployment, id, &out, true)
+		done <- out.String()
+	}()
+	cancel()
+	assert.Equal(t, "line 1\nline 2\n", <-done)
+}
+
+func TestClean(t *testing.T) {
+	dir := t.TempDir()
+	l, _ := New(dir)
+	g1, g2, d1, d2 := uuid.NewString(), uuid.NewString(), uuid.NewString(), uuid.NewString()
+	for _, id := range []string{g1, g2} {
+		_ = l.Open(Generation, id).Close()
+	}
+	_ = l.Open(Deployment, d1).Close()
+	w := l.Open(Deployment, d2)
+
+	l.Clean([]string{g1}, []string{})
+	_, err := os.Stat(filepath.Join(dir, "generations", g1+".log"))
+	assert.Nil(t, err)
+	_, err = os.Stat(filepath.Join(dir, "generations", g2+".log"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	_, err = os.Stat(filepath.Join(dir, "deployments", d1+".log"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	// The log being written is kept
+	_, err = os.Stat(filepath.Join(dir, "deployments", d2+".log"))
+	assert.Nil(t, err)
+
+	_ = w.Close()
+	l.Clean([]string{g1}, []string{})
+	_, err = os.Stat(filepath.Join(dir, "deployments", d2+".log"))
+	assert.ErrorIs(t, err, os.ErrNotExist)
+}
@@ -0,0 +1,15 @@
+package manager
+
+import "github.com/nlewo/comin/internal/store"
+
+// RebootNeeded is published when a deployment needs a reboot to be
+// activated, because it has been done with the boot operation or
+// because some components of the booted system differ from the
+// deployed ones
+type RebootNeeded struct {
+	Deployment store.Deployment `json:"deployment"`
+	// The components differing from the deployed system
+	Reasons []string `json:"reasons,omitempty"`
+}
+
+func (RebootNeeded) EventType() string { return "manager.reboot_needed" }
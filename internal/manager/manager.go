@@ -6,27 +6,47 @@
 package manager
 
 import (
+	"context"
 	"fmt"
+	"io"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/nlewo/comin/internal/builder"
 	"github.com/nlewo/comin/internal/deployer"
+	"github.com/nlewo/comin/internal/events"
 	"github.com/nlewo/comin/internal/executor"
 	"github.com/nlewo/comin/internal/fetcher"
+	"github.com/nlewo/comin/internal/logs"
 	"github.com/nlewo/comin/internal/profile"
 	"github.com/nlewo/comin/internal/prometheus"
 	"github.com/nlewo/comin/internal/scheduler"
 	"github.com/nlewo/comin/internal/store"
+	"github.com/nlewo/comin/internal/types"
 	"github.com/sirupsen/logrus"
 )
 
 type State struct {
-	NeedToReboot bool           `json:"need_to_reboot"`
-	IsSuspended  bool           `json:"suspended"`
-	Fetcher      fetcher.State  `json:"fetcher"`
-	Builder      builder.State  `json:"builder"`
-	Deployer     deployer.State `json:"deployer"`
-	Store        store.State    `json:"store"`
+	NeedToReboot bool `json:"need_to_reboot"`
+	// RebootReasons are the components of the current system
+	// which differ from the booted system
+	RebootReasons []string       `json:"reboot_reasons,omitempty"`
+	IsSuspended   bool           `json:"suspended"`
+	Fetcher       fetcher.State  `json:"fetcher"`
+	Builder       builder.State  `json:"builder"`
+	Deployer      deployer.State `json:"deployer"`
+	Store         store.State    `json:"store"`
+	// PendingReboot is set when a boot deployment needs a reboot
+	PendingReboot *store.PendingReboot `json:"pending_reboot,omitempty"`
+	// NextRebootAt is the next opening of a reboot window when a
+	// reboot is pending
+	NextRebootAt *time.Time `json:"next_reboot_at,omitempty"`
+	// Pin is set when the machine is pinned to a commit
+	Pin *store.Pin `json:"pin,omitempty"`
+	// Drift is set when the running system has been changed
+	// outside of comin
+	Drift *store.Drift `json:"drift,omitempty"`
 }
 
 type Manager struct {
@@ -38,7 +58,8 @@ type Manager struct {
 	stateRequestCh chan struct{}
 	stateResultCh  chan State
 
-	needToReboot bool
+	// The reasons why the machine needs to be rebooted
+	rebootReasons []string
 
 	prometheus prometheus.Prometheus
 	storage    *store.Store
@@ -47,11 +68,28 @@ type Manager struct {
 	Builder    *builder.Builder
 	deployer   *deployer.Deployer
 	executor   executor.Executor
+	reboot     types.Reboot
+	drift      types.Drift
+	logs       *logs.Logs
+	// The manager reacts to the events published by the fetcher,
+	// the builder and the deployer. The subscriptions are created
+	// by New to not miss the events published before the manager
+	// is running.
+	bus       *events.Bus
+	buildSub  *events.Subscription
+	deploySub *events.Subscription
+	// The built generation adopted by the builder at startup. The
+	// first commit selected by the fetcher is not evaluated again
+	// if it is the commit of this generation.
+	adopted *store.Generation
 
+	// isSuspended is written by the API handlers and read by the
+	// manager loop
+	mu          sync.Mutex
 	isSuspended bool
 }
 
-func New(s *store.Store, p prometheus.Prometheus, sched scheduler.Scheduler, fetcher *fetcher.Fetcher, builder *builder.Builder, deployer *deployer.Deployer, machineId string, executor executor.Executor) *Manager {
+func New(s *store.Store, p prometheus.Prometheus, sched scheduler.Scheduler, fetcher *fetcher.Fetcher, builder *builder.Builder, deployer *deployer.Deployer, machineId string, executor executor.Executor, reboot types.Reboot, drift types.Drift, logs *logs.Logs, bus *events.Bus) *Manager {
 	m := &Manager{
 		machineId:      machineId,
 		stateRequestCh: make(chan struct{}),
@@ -63,7 +101,14 @@ func New(s *store.Store, p prometheus.Prometheus, sched scheduler.Scheduler, fet
 		Builder:        builder,
 		deployer:       deployer,
 		executor:       executor,
+		reboot:         reboot,
+		drift:          drift,
+		logs:           logs,
+		bus:            bus,
+		buildSub:       bus.Subscribe(),
+		deploySub:      bus.Subscribe(),
 	}
+	p.SetBuildProgressFunc(builder.BuildProgress)
 	return m
 }
 
@@ -73,17 +118,41 @@ func (m *Manager) GetState() State {
 }
 
 func (m *Manager) toState() State {
-	return State{
-		NeedToReboot: m.needToReboot,
-		IsSuspended:  m.isSuspended,
-		Fetcher:      m.Fetcher.GetState(),
-		Builder:      m.Builder.State(),
-		Deployer:     m.deployer.State(),
-		Store:        m.storage.GetState(),
+	state := State{
+		NeedToReboot:  len(m.rebootReasons) > 0,
+		RebootReasons: m.rebootReasons,
+		IsSuspended:   m.suspended(),
+		Fetcher:       m.Fetcher.GetState(),
+		Builder:       m.Builder.State(),
+		Deployer:      m.deployer.State(),
+		Store:         m.storage.GetState(),
+		PendingReboot: m.storage.PendingReboot(),
+		Pin:           m.storage.Pin(),
+		Drift:         m.storage.Drift(),
 	}
+	if state.PendingReboot != nil {
+		if next, err := scheduler.NextWindowOpening(m.reboot.Windows, time.Now()); err == nil {
+			state.NextRebootAt = &next
+		}
+	}
+	return state
+}
+
+func (m *Manager) suspended() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.isSuspended
 }
 
 func (m *Manager) Suspend() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.suspend()
+}
+
+// suspend suspends the builder and the deployer. The manager lock has
+// to be held.
+func (m *Manager) suspend() error {
 	if m.isSuspended {
 		return fmt.Errorf("the manager is already suspended")
 	}
@@ -96,6 +165,8 @@ func (m *Manager) Suspend() error {
 }
 
 func (m *Manager) Resume() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	if !m.isSuspended {
 		return fmt.Errorf("the manager is not suspended")
 	}
@@ -107,14 +178,153 @@ func (m *Manager) Resume() error {
 	return nil
 }
 
+// Confirm confirms the deployment which is waiting for a
+// confirmation.
+func (m *Manager) Confirm() error {
+	return m.deployer.Confirm()
+}
+
+func (m *Manager) Approve(generationUUID string) error {
+	return m.deployer.Approve(generationUUID)
+}
+
+// Pin pins the machine to a commit: the branches are still fetched
+// but this commit is deployed. The commit is checked against the last
+// fetched branches before the pin is persisted in the store.
+func (m *Manager) Pin(commitId, by string) error {
+	if commitId == "" {
+		return fmt.Errorf("the commit to pin is empty")
+	}
+	commitId, err := m.Fetcher.CheckPin(commitId)
+	if err != nil {
+		return err
+	}
+	pin := store.Pin{
+		CommitId: commitId,
+		By:       by,
+		PinnedAt: time.Now().UTC(),
+	}
+	if err := m.storage.PinSet(&pin); err != nil {
+		return fmt.Errorf("failed to store the pin: %w", err)
+	}
+	logrus.Infof("manager: the machine has been pinned to the commit %s by %s", commitId, by)
+	m.Fetcher.Pin(commitId)
+	return nil
+}
+
+// Unpin removes the pin of the machine
+func (m *Manager) Unpin() error {
+	if m.storage.Pin() == nil {
+		return fmt.Errorf("the machine is not pinned")
+	}
+	if err := m.storage.PinSet(nil); err != nil {
+		return fmt.Errorf("failed to remove the pin from the store: %w", err)
+	}
+	logrus.Infof("manager: the machine has been unpinned")
+	m.Fetcher.Pin("")
+	return nil
+}
+
+// ReadLogs copies the log of a generation or a deployment to w. When
+// follow is true, it waits for new writes until the log is closed.
+func (m *Manager) ReadLogs(ctx context.Context, kind logs.Kind, id string, w io.Writer, follow bool) error {
+	return m.logs.Read(ctx, kind, id, w, follow)
+}
+
+// SubscribeEvents returns a subscription to the events published by
+// the fetcher, the builder, the deployer and the store. It has to be
+// released with UnsubscribeEvents.
+func (m *Manager) SubscribeEvents() *events.Subscription {
+	return m.bus.Subscribe()
+}
+
+func (m *Manager) UnsubscribeEvents(s *events.Subscription) {
+	m.bus.Unsubscribe(s)
+}
+
+// cleanLogs removes the logs of the generations and deployments
+// evicted from the store. The logs of the generations of the stored
+// deployments are kept.
+func (m *Manager) cleanLogs() {
+	state := m.storage.GetState()
+	generations := make([]string, 0)
+	for _, g := range state.Generations {
+		generations = append(generations, g.UUID.String())
+	}
+	deployments := make([]string, 0)
+	for _, d := range state.Deployments {
+		deployments = append(deployments, d.UUID)
+		generations = append(generations, d.Generation.UUID.String())
+	}
+	m.logs.Clean(generations, deployments)
+}
+
+// rollbackTarget returns the deployment identified by deploymentUUID
+// or, if deploymentUUID is empty, the most recent successful
+// deployment preceding the last deployment.
+func (m *Manager) rollbackTarget(deploymentUUID string) (target store.Deployment, err error) {
+	deployments := m.storage.GetState().Deployments
+	found := false
+	for i, d := range deployments {
+		if deploymentUUID != "" && d.UUID == deploymentUUID {
+			target, found = d, true
+			break
+		}
+		if deploymentUUID == "" && i > 0 && d.Status == store.Done && d.Generation.OutPath != deployments[0].Generation.OutPath {
+			target, found = d, true
+			break
+		}
+	}
+	if !found {
+		if deploymentUUID != "" {
+			return target, fmt.Errorf("the deployment %s doesn't exist", deploymentUUID)
+		}
+		return target, fmt.Errorf("there is no previous successful deployment to roll back to")
+	}
+	if !m.executor.IsStorePathExist(target.Generation.OutPath) {
+		return target, fmt.Errorf("the outpath %s of the deployment %s doesn't exist anymore", target.Generation.OutPath, target.UUID)
+	}
+	return target, nil
+}
+
+// Rollback redeploys the generation of a past deployment (by default,
+// the most recent successful deployment preceding the last
+// deployment). The manager is suspended in order to not deploy new
+// generations until it is resumed.
+func (m *Manager) Rollback(deploymentUUID string) error {
+	target, err := m.rollbackTarget(deploymentUUID)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	if !m.isSuspended {
+		if err := m.suspend(); err != nil {
+			m.mu.Unlock()
+			return err
+		}
+	}
+	m.mu.Unlock()
+	return m.deployer.Rollback(target)
+}
+
 // FetchAndBuild fetches new commits. If a new commit is available, it
-// evaluates and builds the derivation. Once built, it pushes the
-// generation on a channel which is consumed by the deployer.
+// evaluates and builds the derivation. Once built, it submits the
+// generation to the deployer.
 func (m *Manager) FetchAndBuild() {
 	go func() {
-		for {
-			select {
-			case rs := <-m.Fetcher.RepositoryStatusCh:
+		for e := range m.buildSub.C {
+			switch data := e.Data.(type) {
+			case fetcher.CommitSelected:
+				rs := data.RepositoryStatus
+				// After a restart, the fetcher first provides the
+				// commit of the generation which has possibly
+				// already been built
+				g := m.adopted
+				m.adopted = nil
+				if g != nil && g.SelectedCommitId == rs.SelectedCommitId && g.SelectedBranchIsTesting == rs.SelectedBranchIsTesting {
+					logrus.Infof("manager: the commit %s is not evaluated because it has already been built by the generation %s", rs.SelectedCommitId, g.UUID)
+					continue
+				}
 				if !rs.SelectedCommitShouldBeSigned || rs.SelectedCommitSigned {
 					logrus.Infof("manager: a generation is evaluating for commit %s", rs.SelectedCommitId)
 					err := m.Builder.Eval(rs)
@@ -124,12 +334,8 @@ func (m *Manager) FetchAndBuild() {
 				} else {
 					logrus.Infof("manager: the commit %s is not evaluated because it is not signed", rs.SelectedCommitId)
 				}
-			case generationUUID := <-m.Builder.EvaluationDone:
-				generation, err := m.storage.GenerationGet(generationUUID)
-				if err != nil {
-					logrus.Error(err)
-					continue
-				}
+			case builder.EvaluationDone:
+				generation := data.Generation
 				if generation.EvalErr != nil {
 					continue
 				}
@@ -137,28 +343,202 @@ func (m *Manager) FetchAndBuild() {
 					logrus.Infof("manager: the comin.machineId %s is not the host machine-id %s", generation.MachineId, m.machineId)
 				} else {
 					logrus.Infof("manager: the build of the generation %s is submitted", generation.UUID.String())
-					m.Builder.SubmitBuild(generationUUID)
-				}
-			case generationUUID := <-m.Builder.BuildDone:
-				generation, err := m.storage.GenerationGet(generationUUID)
-				if err != nil {
-					logrus.Error(err)
-					continue
+					m.Builder.SubmitBuild(generation.UUID)
 				}
+			case builder.BuildDone:
+				generation := data.Generation
 				if generation.BuildErr == nil {
 					logrus.Infof("manager: a generation is available for deployment with commit %s", generation.SelectedCommitId)
 					m.deployer.Submit(generation)
 				}
+				m.cleanLogs()
 			}
 		}
 
 	}()
 }
 
+// updatePendingReboot records a pending reboot when a deployment has
+// been done with the boot operation. A pending reboot is removed when
+// a newer deployment has been switched to.
+func (m *Manager) updatePendingReboot(dpl store.Deployment) {
+	if dpl.Status != store.Done {
+		return
+	}
+	switch dpl.Operation {
+	case "boot":
+		bootId, err := m.executor.ReadBootId()
+		if err != nil {
+			logrus.Errorf("manager: %s", err)
+		}
+		logrus.Infof("manager: the deployment %s needs a reboot to be activated", dpl.UUID)
+		m.bus.Publish(RebootNeeded{Deployment: dpl, Reasons: dpl.RebootReasons})
+		m.storage.PendingRebootSet(&store.PendingReboot{
+			DeploymentUUID: dpl.UUID,
+			CommitId:       dpl.Generation.SelectedCommitId,
+			OutPath:        dpl.Generation.OutPath,
+			RequestedAt:    time.Now().UTC(),
+			BootId:         bootId,
+		})
+	case "switch":
+		if m.storage.PendingReboot() != nil {
+			logrus.Infof("manager: the pending reboot is removed because the deployment %s has been switched to", dpl.UUID)
+			m.storage.PendingRebootSet(nil)
+		}
+	}
+	m.prometheus.SetPendingReboot(m.storage.PendingReboot() != nil)
+}
+
+// removePendingRebootIfRebooted removes the pending reboot if the
+// machine has been rebooted since the reboot has been requested.
+func (m *Manager) removePendingRebootIfRebooted() {
+	pending := m.storage.PendingReboot()
+	if pending == nil {
+		return
+	}
+	bootId, err := m.executor.ReadBootId()
+	if err != nil {
+		logrus.Errorf("manager: %s", err)
+		return
+	}
+	if bootId != pending.BootId {
+		logrus.Infof("manager: the machine has been rebooted, the pending reboot of the deployment %s is removed", pending.DeploymentUUID)
+		m.storage.PendingRebootSet(nil)
+	}
+}
+
+// rebootIfPending reboots the machine if a reboot is pending and now
+// is in a reboot window.
+func (m *Manager) rebootIfPending(now time.Time) {
+	pending := m.storage.PendingReboot()
+	if pending == nil || m.suspended() {
+		return
+	}
+	next, err := scheduler.NextWindowOpening(m.reboot.Windows, now)
+	if err != nil {
+		logrus.Errorf("manager: %s", err)
+		return
+	}
+	if next.After(now) {
+		logrus.Debugf("manager: the reboot of the deployment %s is scheduled at %s", pending.DeploymentUUID, next)
+		return
+	}
+	logrus.Infof("manager: rebooting the machine to activate the deployment %s", pending.DeploymentUUID)
+	if err := m.executor.Reboot(); err != nil {
+		logrus.Errorf("manager: %s", err)
+	}
+}
+
+// lastActivatedDeployment returns the last deployment whose
+// generation is expected to be the running system. It returns false
+// when the running system is unknown, for instance after a failed
+// deployment.
+func (m *Manager) lastActivatedDeployment() (store.Deployment, bool) {
+	pending := m.storage.PendingReboot()
+	for _, d := range m.storage.GetState().Deployments {
+		switch {
+		// The deployments done with the boot operation are not
+		// activated until the machine is rebooted
+		case d.Status == store.Done && d.Operation == "boot" && pending != nil:
+			continue
+		case d.Status == store.Done:
+			return d, true
+		// The running system is the one of the deployment
+		// preceding a rolled back deployment
+		case d.Status == store.RolledBack:
+			continue
+		default:
+			return store.Deployment{}, false
+		}
+	}
+	return store.Deployment{}, false
+}
+
+// checkDrift compares the running system with the generation of the
+// last deployment. If they differ, the drift is recorded in the store
+// and, with the reconcile policy, the generation of the last
+// deployment is re-activated.
+func (m *Manager) checkDrift() {
+	if m.deployer.IsDeploying() {
+		return
+	}
+	// The last deployment has not been stored yet
+	deployments := m.storage.GetState().Deployments
+	if dpl := m.deployer.Deployment(); dpl != nil && (len(deployments) == 0 || deployments[0].UUID != dpl.UUID) {
+		return
+	}
+	last, ok := m.lastActivatedDeployment()
+	if !ok {
+		return
+	}
+	current, err := m.executor.CurrentSystem()
+	if err != nil {
+		logrus.Errorf("manager: %s", err)
+		return
+	}
+	drift := m.storage.Drift()
+	if current == last.Generation.OutPath {
+		if drift != nil {
+			logrus.Infof("manager: the running system is again the generation of the deployment %s", last.UUID)
+			if err := m.storage.DriftSet(nil); err != nil {
+				logrus.Errorf("manager: failed to remove the drift from the store: %s", err)
+			}
+		}
+		m.prometheus.SetDrift(false)
+		return
+	}
+	if drift == nil || drift.OutPath != current || drift.DeploymentUUID != last.UUID {
+		logrus.Warnf("manager: the running system %s is not the outpath %s of the deployment %s", current, last.Generation.OutPath, last.UUID)
+		drift = &store.Drift{
+			OutPath:         current,
+			ExpectedOutPath: last.Generation.OutPath,
+			DeploymentUUID:  last.UUID,
+			DetectedAt:      time.Now().UTC(),
+		}
+		if err := m.storage.DriftSet(drift); err != nil {
+			logrus.Errorf("manager: failed to store the drift: %s", err)
+		}
+	}
+	m.prometheus.SetDrift(true)
+	if m.drift.Policy == "reconcile" && !m.suspended() {
+		if err := m.deployer.Reconcile(last, current); err != nil {
+			logrus.Errorf("manager: %s", err)
+		}
+	}
+}
+
 func (m *Manager) Run() {
 	logrus.Infof("manager: starting with machineId=%s", m.machineId)
-	m.needToReboot = m.executor.NeedToReboot()
-	m.prometheus.SetHostInfo(m.needToReboot)
+	m.rebootReasons = m.executor.NeedToReboot()
+	m.prometheus.SetHostInfo(m.rebootReasons)
+	m.removePendingRebootIfRebooted()
+	m.prometheus.SetPendingReboot(m.storage.PendingReboot() != nil)
+	m.cleanLogs()
+	rebootTicker := time.NewTicker(time.Minute)
+	defer rebootTicker.Stop()
+	m.prometheus.SetDrift(m.storage.Drift() != nil)
+	var driftTickerCh <-chan time.Time
+	if m.drift.Interval > 0 {
+		driftTicker := time.NewTicker(time.Duration(m.drift.Interval) * time.Second)
+		defer driftTicker.Stop()
+		driftTickerCh = driftTicker.C
+	}
+
+	// The generation built before a restart of comin has possibly
+	// not been deployed. If it has already been deployed, the
+	// deployer skips it.
+	if generation, built := m.Builder.Adopt(); built {
+		logrus.Infof("manager: the generation %s built before the restart is submitted to the deployer", generation.UUID)
+		m.adopted = &generation
+		m.deployer.Submit(generation)
+	}
+
+	// The deployment waiting for a confirmation before the restart
+	// is confirmed or rolled back before any new deployment
+	if pending := m.storage.PendingConfirmation(); pending != nil {
+		logrus.Infof("manager: the deployment %s is still waiting for a confirmation until %s", pending.Deployment.UUID, pending.Deadline)
+		m.deployer.ResumeConfirmation(*pending)
+	}
 
 	m.FetchAndBuild()
 	m.deployer.Run()
@@ -167,20 +547,49 @@ func (m *Manager) Run() {
 		select {
 		case <-m.stateRequestCh:
 			m.stateResultCh <- m.toState()
-		case dpl := <-m.deployer.DeploymentDoneCh:
-			m.prometheus.SetDeploymentInfo(dpl.Generation.SelectedCommitId, store.StatusToString(dpl.Status))
-			getsEvicted, evicted := m.storage.DeploymentInsertAndCommit(dpl)
-			if getsEvicted && evicted.ProfilePath != "" {
-				_ = profile.RemoveProfilePath(evicted.ProfilePath)
-			}
-			m.needToReboot = m.executor.NeedToReboot()
-			m.prometheus.SetHostInfo(m.needToReboot)
-			if dpl.RestartComin {
-				// TODO: stop contexts
-				logrus.Infof("manager: comin needs to be restarted")
-				logrus.Infof("manager: exiting comin to let the service manager restart it")
-				os.Exit(0)
+		case e := <-m.deploySub.C:
+			switch data := e.Data.(type) {
+			case deployer.ConfirmationRequired:
+				if err := m.storage.PendingConfirmationSet(&store.PendingConfirmation{Deployment: data.Deployment, Deadline: data.Deadline}); err != nil {
+					logrus.Errorf("manager: failed to store the pending confirmation: %s", err)
+				}
+			case deployer.DeploymentDone:
+				m.deploymentDone(data.Deployment)
 			}
+		case <-rebootTicker.C:
+			m.rebootIfPending(time.Now())
+		case <-driftTickerCh:
+			m.checkDrift()
+		}
+	}
+}
+
+// deploymentDone records a finished deployment and checks whether
+// the machine needs to be rebooted
+func (m *Manager) deploymentDone(dpl store.Deployment) {
+	m.prometheus.SetDeploymentInfo(dpl.Generation.SelectedCommitId, store.StatusToString(dpl.Status))
+	if m.storage.PendingConfirmation() != nil {
+		if err := m.storage.PendingConfirmationSet(nil); err != nil {
+			logrus.Errorf("manager: failed to remove the pending confirmation from the store: %s", err)
 		}
 	}
+	getsEvicted, evicted := m.storage.DeploymentInsertAndCommit(dpl)
+	if getsEvicted && evicted.ProfilePath != "" {
+		_ = profile.RemoveProfilePath(evicted.ProfilePath)
+	}
+	m.cleanLogs()
+	needed := len(m.rebootReasons) > 0
+	m.rebootReasons = m.executor.NeedToReboot()
+	m.prometheus.SetHostInfo(m.rebootReasons)
+	if !needed && len(m.rebootReasons) > 0 {
+		m.bus.Publish(RebootNeeded{Deployment: dpl, Reasons: m.rebootReasons})
+	}
+	m.updatePendingReboot(dpl)
+	if dpl.RestartComin {
+		// TODO: stop contexts
+		logrus.Infof("manager: comin needs to be restarted")
+		logrus.Infof("manager: exiting comin to let the service manager restart it")
+		os.Exit(0)
+	}
+	m.rebootIfPending(time.Now())
 }
@@ -3,27 +3,30 @@ package manager
 import (
 	"context"
 	"fmt"
+	"io"
 	"testing"
 	"time"
 
 	"github.com/nlewo/comin/internal/builder"
 	"github.com/nlewo/comin/internal/deployer"
+	"github.com/nlewo/comin/internal/events"
 	"github.com/nlewo/comin/internal/executor"
 	"github.com/nlewo/comin/internal/fetcher"
 	"github.com/nlewo/comin/internal/prometheus"
 	"github.com/nlewo/comin/internal/repository"
 	"github.com/nlewo/comin/internal/scheduler"
 	"github.com/nlewo/comin/internal/store"
+	"github.com/nlewo/comin/internal/types"
 	"github.com/nlewo/comin/internal/utils"
 	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
 
-var mkDeployerMock = func() *deployer.Deployer {
-	var deployFunc = func(context.Context, string, string) (bool, string, error) {
+var mkDeployerMock = func(bus *events.Bus) *deployer.Deployer {
+	var deployFunc = func(context.Context, string, string, io.Writer) (bool, string, error) {
 		return false, "", nil
 	}
-	return deployer.New(deployFunc, nil, "")
+	return deployer.New(deployFunc, nil, nil, nil, "", types.Hooks{}, types.HealthChecks{}, types.Confirmation{}, nil, nil, bus)
 }
 
 type ExecutorMock struct {
@@ -35,16 +38,31 @@ type ExecutorMock struct {
 func (n ExecutorMock) ReadMachineId() (string, error) {
 	return "", nil
 }
-func (n ExecutorMock) NeedToReboot() bool {
-	return false
+func (n ExecutorMock) NeedToReboot() []string {
+	return nil
+}
+func (n ExecutorMock) RebootReasons(outPath string) []string {
+	return nil
+}
+func (n ExecutorMock) Reboot() error {
+	return nil
+}
+func (n ExecutorMock) ReadBootId() (string, error) {
+	return "", nil
+}
+func (n ExecutorMock) CurrentSystem() (string, error) {
+	return "", nil
 }
 func (n ExecutorMock) IsStorePathExist(storePath string) bool {
 	return false
 }
-func (n ExecutorMock) Deploy(ctx context.Context, outPath, operation string) (needToRestartComin bool, profilePath string, err error) {
+func (n ExecutorMock) DiffClosures(ctx context.Context, outPath string) (types.ClosureDiff, error) {
+	return types.ClosureDiff{}, nil
+}
+func (n ExecutorMock) Deploy(ctx context.Context, outPath, operation string, logs io.Writer) (needToRestartComin bool, profilePath string, err error) {
 	return false, "", nil
 }
-func (n ExecutorMock) Eval(ctx context.Context, flakeUrl, hostname string) (drvPath string, outPath string, machineId string, err error) {
+func (n ExecutorMock) Eval(ctx context.Context, flakeUrl, hostname string, logs io.Writer) (drvPath string, outPath string, machineId string, err error) {
 	ok := <-n.evalOk
 	if ok {
 		return "drv-path", "out-path", n.machineId, nil
@@ -52,7 +70,7 @@ func (n ExecutorMock) Eval(ctx context.Context, flakeUrl, hostname string) (drvP
 		return "", "", n.machineId, fmt.Errorf("An error occured")
 	}
 }
-func (n ExecutorMock) Build(ctx context.Context, drvPath string) (err error) {
+func (n ExecutorMock) Build(ctx context.Context, drvPath string, logs io.Writer, onProgress executor.ProgressFunc) (err error) {
 	select {
 	case <-ctx.Done():
 		return ctx.Err()
@@ -72,20 +90,21 @@ func NewExecutorMock(machineId string) ExecutorMock {
 }
 
 func TestBuild(t *testing.T) {
+	bus := events.New()
 	logrus.SetLevel(logrus.DebugLevel)
 	r := utils.NewRepositoryMock()
-	f := fetcher.NewFetcher(r)
+	f := fetcher.NewFetcher(r, bus)
 	tmp := t.TempDir()
-	s, _ := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1)
+	s, _ := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1, 10, bus)
 	f.Start()
 	eMock := NewExecutorMock("")
-	b := builder.New(s, eMock, "repoPath", "", "my-machine", 2*time.Second, 2*time.Second)
-	var deployFunc = func(context.Context, string, string) (bool, string, error) {
+	b := builder.New(s, eMock, "repoPath", "", "my-machine", 2*time.Second, 2*time.Second, nil, bus)
+	var deployFunc = func(context.Context, string, string, io.Writer) (bool, string, error) {
 		return false, "profile-path", nil
 	}
-	d := deployer.New(deployFunc, nil, "")
+	d := deployer.New(deployFunc, nil, nil, nil, "", types.Hooks{}, types.HealthChecks{}, types.Confirmation{}, nil, nil, bus)
 	e, _ := executor.NewNixOS()
-	m := New(s, prometheus.New(), scheduler.New(), f, b, d, "", e)
+	m := New(s, prometheus.New(), scheduler.New(), f, b, d, "", e, types.Reboot{}, types.Drift{}, nil, bus)
 	go m.Run()
 	assert.False(t, m.Fetcher.GetState().IsFetching)
 	assert.False(t, m.Builder.State().IsEvaluating)
@@ -177,22 +196,23 @@ func TestBuild(t *testing.T) {
 }
 
 func TestDeploy(t *testing.T) {
+	bus := events.New()
 	logrus.SetLevel(logrus.DebugLevel)
 	r := utils.NewRepositoryMock()
-	f := fetcher.NewFetcher(r)
+	f := fetcher.NewFetcher(r, bus)
 	f.Start()
 	tmp := t.TempDir()
-	s, _ := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1)
+	s, _ := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1, 10, bus)
 	eMock := NewExecutorMock("")
 	eMock.evalOk <- true
 	eMock.buildOk <- true
-	b := builder.New(s, eMock, "repoPath", "", "my-machine", 2*time.Second, 2*time.Second)
-	var deployFunc = func(context.Context, string, string) (bool, string, error) {
+	b := builder.New(s, eMock, "repoPath", "", "my-machine", 2*time.Second, 2*time.Second, nil, bus)
+	var deployFunc = func(context.Context, string, string, io.Writer) (bool, string, error) {
 		return false, "profile-path", nil
 	}
-	d := deployer.New(deployFunc, nil, "")
+	d := deployer.New(deployFunc, nil, nil, nil, "", types.Hooks{}, types.HealthChecks{}, types.Confirmation{}, nil, nil, bus)
 	e, _ := executor.NewNixOS()
-	m := New(s, prometheus.New(), scheduler.New(), f, b, d, "", e)
+	m := New(s, prometheus.New(), scheduler.New(), f, b, d, "", e, types.Reboot{}, types.Drift{}, nil, bus)
 	go m.Run()
 	assert.False(t, m.Fetcher.GetState().IsFetching)
 	assert.False(t, m.Builder.State().IsEvaluating)
@@ -205,17 +225,18 @@ func TestDeploy(t *testing.T) {
 }
 
 func TestIncorrectMachineId(t *testing.T) {
+	bus := events.New()
 	logrus.SetLevel(logrus.DebugLevel)
 	r := utils.NewRepositoryMock()
-	f := fetcher.NewFetcher(r)
+	f := fetcher.NewFetcher(r, bus)
 	f.Start()
 	tmp := t.TempDir()
-	s, _ := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1)
+	s, _ := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1, 10, bus)
 	eMock := NewExecutorMock("invalid-machine-id")
-	b := builder.New(s, eMock, "repoPath", "", "my-machine", 2*time.Second, 2*time.Second)
-	d := mkDeployerMock()
+	b := builder.New(s, eMock, "repoPath", "", "my-machine", 2*time.Second, 2*time.Second, nil, bus)
+	d := mkDeployerMock(bus)
 	e, _ := executor.NewNixOS()
-	m := New(s, prometheus.New(), scheduler.New(), f, b, d, "the-test-machine-id", e)
+	m := New(s, prometheus.New(), scheduler.New(), f, b, d, "the-test-machine-id", e, types.Reboot{}, types.Drift{}, nil, bus)
 	go m.Run()
 
 	f.TriggerFetch([]string{"remote"})
@@ -229,18 +250,19 @@ func TestIncorrectMachineId(t *testing.T) {
 }
 
 func TestCorrectMachineId(t *testing.T) {
+	bus := events.New()
 	logrus.SetLevel(logrus.DebugLevel)
 	r := utils.NewRepositoryMock()
-	f := fetcher.NewFetcher(r)
+	f := fetcher.NewFetcher(r, bus)
 	f.Start()
 	tmp := t.TempDir()
-	s, _ := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1)
+	s, _ := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1, 10, bus)
 	eMock := NewExecutorMock("the-test-machine-id")
 	eMock.evalOk <- true
-	b := builder.New(s, eMock, "repoPath", "", "my-machine", 2*time.Second, 2*time.Second)
-	d := mkDeployerMock()
+	b := builder.New(s, eMock, "repoPath", "", "my-machine", 2*time.Second, 2*time.Second, nil, bus)
+	d := mkDeployerMock(bus)
 	e, _ := executor.NewNixOS()
-	m := New(s, prometheus.New(), scheduler.New(), f, b, d, "the-test-machine-id", e)
+	m := New(s, prometheus.New(), scheduler.New(), f, b, d, "the-test-machine-id", e, types.Reboot{}, types.Drift{}, nil, bus)
 	go m.Run()
 
 	f.TriggerFetch([]string{"remote"})
@@ -254,18 +276,19 @@ func TestCorrectMachineId(t *testing.T) {
 }
 
 func TestManagerWithDarwinConfiguration(t *testing.T) {
+	bus := events.New()
 	r := utils.NewRepositoryMock()
-	f := fetcher.NewFetcher(r)
+	f := fetcher.NewFetcher(r, bus)
 	tmp := t.TempDir()
 	eMock := NewExecutorMock("")
 	eMock.buildOk <- true
-	s, _ := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1)
-	b := builder.New(s, eMock, "repoPath", "", "my-machine", 2*time.Second, 2*time.Second)
-	d := mkDeployerMock()
+	s, _ := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1, 10, bus)
+	b := builder.New(s, eMock, "repoPath", "", "my-machine", 2*time.Second, 2*time.Second, nil, bus)
+	d := mkDeployerMock(bus)
 
 	// Test with Darwin configuration
 	e, _ := executor.NewNixDarwin()
-	m := New(s, prometheus.New(), scheduler.New(), f, b, d, "darwin-machine-id", e)
+	m := New(s, prometheus.New(), scheduler.New(), f, b, d, "darwin-machine-id", e, types.Reboot{}, types.Drift{}, nil, bus)
 
 	// Verify the manager was created with the correct configuration attribute
 	assert.Equal(t, "darwin-machine-id", m.machineId)
@@ -275,3 +298,380 @@ func TestManagerWithDarwinConfiguration(t *testing.T) {
 	assert.NotNil(t, state)
 	assert.Equal(t, "darwin-machine-id", m.machineId)
 }
+
+func TestRestartWithBuiltGeneration(t *testing.T) {
+	bus := events.New()
+	tmp := t.TempDir()
+	s, _ := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1, 10, bus)
+	g := s.NewGeneration("my-machine", "repoPath", "", repository.RepositoryStatus{SelectedCommitId: "id-1"})
+	_ = s.GenerationEvalStarted(g.UUID)
+	_ = s.GenerationEvalFinished(g.UUID, "drv-path", "out-path", "", nil)
+	_ = s.GenerationBuildStart(g.UUID)
+	_ = s.GenerationBuildFinished(g.UUID, nil)
+
+	// This simulates a restart of comin
+	s, _ = store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1, 10, bus)
+	_ = s.Load()
+	r := utils.NewRepositoryMock()
+	f := fetcher.NewFetcher(r, bus)
+	f.Start()
+	eMock := NewExecutorMock("")
+	b := builder.New(s, eMock, "repoPath", "", "my-machine", 2*time.Second, 2*time.Second, nil, bus)
+	var deployFunc = func(context.Context, string, string, io.Writer) (bool, string, error) {
+		return false, "profile-path", nil
+	}
+	d := deployer.New(deployFunc, nil, nil, nil, "", types.Hooks{}, types.HealthChecks{}, types.Confirmation{}, nil, nil, bus)
+	e, _ := executor.NewNixOS()
+	m := New(s, prometheus.New(), scheduler.New(), f, b, d, "", e, types.Reboot{}, types.Drift{}, nil, bus)
+	go m.Run()
+
+	// The generation built before the restart is deployed
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		dpl := m.deployer.State().Deployment
+		assert.NotNil(c, dpl)
+		if dpl != nil {
+			assert.Equal(c, g.UUID, dpl.Generation.UUID)
+		}
+	}, 5*time.Second, 100*time.Millisecond)
+
+	// The commit of this generation is not evaluated again
+	f.TriggerFetch([]string{"remote"})
+	r.RsCh <- repository.RepositoryStatus{
+		SelectedCommitId: "id-1",
+	}
+	assert.Never(t, func() bool {
+		return m.Builder.State().IsEvaluating
+	}, time.Second, 100*time.Millisecond)
+	assert.Equal(t, g.UUID.String(), m.Builder.State().GenerationUUID)
+
+	// Only the first selected commit is skipped: the same commit
+	// selected again, for instance after a failed deployment, is
+	// evaluated
+	bus.Publish(fetcher.CommitSelected{RepositoryStatus: repository.RepositoryStatus{SelectedCommitId: "id-1"}})
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.NotEqual(c, g.UUID.String(), m.Builder.State().GenerationUUID)
+	}, 5*time.Second, 100*time.Millisecond)
+}
+
+func TestConfirmationAcrossRestart(t *testing.T) {
+	bus := events.New()
+	sub := bus.Subscribe()
+	tmp := t.TempDir()
+	s, _ := store.New(tmp+"/state.json", tmp+"/gcroots", 10, 10, 10, bus)
+	s.DeploymentInsert(store.Deployment{UUID: "dpl-1", Status: store.Done, Operation: "switch", Generation: store.Generation{OutPath: "out-1"}})
+	var deployedOutPaths []string
+	var deployFunc = func(ctx context.Context, outPath, operation string, logs io.Writer) (bool, string, error) {
+		deployedOutPaths = append(deployedOutPaths, outPath)
+		return false, "", nil
+	}
+	confirmation := types.Confirmation{Enable: true, Timeout: 60}
+	eMock := NewExecutorMock("")
+	b := builder.New(s, eMock, "repoPath", "", "my-machine", 2*time.Second, 2*time.Second, nil, bus)
+	d := deployer.New(deployFunc, nil, nil, nil, s.LastActivatedOutPath(), types.Hooks{}, types.HealthChecks{}, confirmation, nil, nil, bus)
+	m := New(s, prometheus.New(), scheduler.New(), fetcher.NewFetcher(utils.NewRepositoryMock(), bus), b, d, "", eMock, types.Reboot{}, types.Drift{}, nil, bus)
+	go m.Run()
+
+	// The deployment waiting for a confirmation is recorded in the
+	// store
+	d.Submit(store.Generation{SelectedCommitId: "commit-2", OutPath: "out-2"})
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		pending := s.PendingConfirmation()
+		assert.NotNil(c, pending)
+		if pending != nil {
+			assert.Equal(c, "out-2", pending.Deployment.Generation.OutPath)
+		}
+	}, 2*time.Second, 100*time.Millisecond)
+	pending := *s.PendingConfirmation()
+
+	// This simulates a restart of comin once the deadline has
+	// passed
+	pending.Deadline = time.Now().Add(-time.Second)
+	_ = s.PendingConfirmationSet(&pending)
+	bus = events.New()
+	sub = bus.Subscribe()
+	s, _ = store.New(tmp+"/state.json", tmp+"/gcroots", 10, 10, 10, bus)
+	_ = s.Load()
+	deployedOutPaths = nil
+	b = builder.New(s, eMock, "repoPath", "", "my-machine", 2*time.Second, 2*time.Second, nil, bus)
+	d = deployer.New(deployFunc, nil, nil, nil, s.LastActivatedOutPath(), types.Hooks{}, types.HealthChecks{}, confirmation, nil, nil, bus)
+	m = New(s, prometheus.New(), scheduler.New(), fetcher.NewFetcher(utils.NewRepositoryMock(), bus), b, d, "", eMock, types.Reboot{}, types.Drift{}, nil, bus)
+	go m.Run()
+
+	// The unconfirmed deployment is rolled back
+	dpl := events.Next[deployer.DeploymentDone](sub).Deployment
+	assert.Equal(t, pending.Deployment.UUID, dpl.UUID)
+	assert.Equal(t, store.RolledBack, dpl.Status)
+	assert.Equal(t, []string{"out-1"}, deployedOutPaths)
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Nil(c, s.PendingConfirmation())
+		assert.Equal(c, pending.Deployment.UUID, s.GetState().Deployments[0].UUID)
+	}, 2*time.Second, 100*time.Millisecond)
+}
+
+type RebootExecutorMock struct {
+	ExecutorMock
+	bootId   string
+	rebooted bool
+}
+
+func (n *RebootExecutorMock) Reboot() error {
+	n.rebooted = true
+	return nil
+}
+func (n *RebootExecutorMock) ReadBootId() (string, error) {
+	return n.bootId, nil
+}
+
+func TestPendingReboot(t *testing.T) {
+	bus := events.New()
+	sub := bus.Subscribe()
+	tmp := t.TempDir()
+	s, _ := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1, 10, bus)
+	eMock := &RebootExecutorMock{ExecutorMock: NewExecutorMock(""), bootId: "boot-1"}
+	b := builder.New(s, eMock, "repoPath", "", "my-machine", 2*time.Second, 2*time.Second, nil, bus)
+	// Every Saturday from 2:00 to 3:00
+	reboot := types.Reboot{Windows: []types.Window{{Cron: "0 2 * * 6", Duration: 3600}}}
+	m := New(s, prometheus.New(), scheduler.New(), fetcher.NewFetcher(utils.NewRepositoryMock(), bus), b, mkDeployerMock(bus), "", eMock, reboot, types.Drift{}, nil, bus)
+	saturday := time.Date(2024, 6, 1, 0, 0, 0, 0, time.Local)
+
+	m.updatePendingReboot(store.Deployment{UUID: "dpl-1", Operation: "boot", Status: store.Failed})
+	assert.Nil(t, s.PendingReboot())
+
+	m.updatePendingReboot(store.Deployment{UUID: "dpl-1", Operation: "boot", Status: store.Done})
+	assert.Equal(t, "dpl-1", s.PendingReboot().DeploymentUUID)
+	assert.Equal(t, "boot-1", s.PendingReboot().BootId)
+	assert.Equal(t, "dpl-1", events.Next[RebootNeeded](sub).Deployment.UUID)
+	assert.NotNil(t, m.toState().NextRebootAt)
+
+	m.rebootIfPending(saturday.Add(time.Hour))
+	assert.False(t, eMock.rebooted)
+	m.rebootIfPending(saturday.Add(2*time.Hour + time.Minute))
+	assert.True(t, eMock.rebooted)
+
+	// The pending reboot is persisted
+	s1, _ := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1, 10, bus)
+	_ = s1.Load()
+	assert.Equal(t, "dpl-1", s1.PendingReboot().DeploymentUUID)
+
+	// The pending reboot is kept until the machine is rebooted
+	m.removePendingRebootIfRebooted()
+	assert.NotNil(t, s.PendingReboot())
+	eMock.bootId = "boot-2"
+	m.removePendingRebootIfRebooted()
+	assert.Nil(t, s.PendingReboot())
+
+	// A switch deployment removes the pending reboot
+	m.updatePendingReboot(store.Deployment{UUID: "dpl-2", Operation: "boot", Status: store.Done})
+	assert.NotNil(t, s.PendingReboot())
+	m.updatePendingReboot(store.Deployment{UUID: "dpl-3", Operation: "switch", Status: store.Done})
+	assert.Nil(t, s.PendingReboot())
+}
+
+type StorePathExecutorMock struct {
+	ExecutorMock
+	storePathExist bool
+}
+
+func (n StorePathExecutorMock) IsStorePathExist(storePath string) bool {
+	return n.storePathExist
+}
+
+func TestRollback(t *testing.T) {
+	bus := events.New()
+	sub := bus.Subscribe()
+	tmp := t.TempDir()
+	s, _ := store.New(tmp+"/state.json", tmp+"/gcroots", 10, 10, 10, bus)
+	s.DeploymentInsert(store.Deployment{UUID: "dpl-1", Status: store.Done, Operation: "switch", Generation: store.Generation{OutPath: "out-1"}})
+	s.DeploymentInsert(store.Deployment{UUID: "dpl-2", Status: store.Failed, Operation: "switch", Generation: store.Generation{OutPath: "out-2"}})
+	s.DeploymentInsert(store.Deployment{UUID: "dpl-3", Status: store.Done, Operation: "switch", Generation: store.Generation{OutPath: "out-3"}})
+	eMock := StorePathExecutorMock{ExecutorMock: NewExecutorMock("")}
+	b := builder.New(s, eMock, "repoPath", "", "my-machine", 2*time.Second, 2*time.Second, nil, bus)
+	d := mkDeployerMock(bus)
+	m := New(s, prometheus.New(), scheduler.New(), fetcher.NewFetcher(utils.NewRepositoryMock(), bus), b, d, "", eMock, types.Reboot{}, types.Drift{}, nil, bus)
+
+	_, err := m.rollbackTarget("")
+	assert.ErrorContains(t, err, "the outpath out-1 of the deployment dpl-1 doesn't exist anymore")
+
+	m.executor = StorePathExecutorMock{ExecutorMock: NewExecutorMock(""), storePathExist: true}
+	target, err := m.rollbackTarget("")
+	assert.Nil(t, err)
+	assert.Equal(t, "dpl-1", target.UUID)
+	target, err = m.rollbackTarget("dpl-2")
+	assert.Nil(t, err)
+	assert.Equal(t, "dpl-2", target.UUID)
+	_, err = m.rollbackTarget("unknown")
+	assert.ErrorContains(t, err, "the deployment unknown doesn't exist")
+
+	d.Run()
+	err = m.Rollback("")
+	assert.Nil(t, err)
+	assert.True(t, m.suspended())
+	dpl := events.Next[deployer.DeploymentDone](sub).Deployment
+	assert.Equal(t, "dpl-1", dpl.RollbackOf)
+	assert.Equal(t, "out-1", dpl.Generation.OutPath)
+	assert.Equal(t, store.Done, dpl.Status)
+}
+
+// TestRollbackWhileRunning checks with the race detector that the
+// suspension of the manager by the API handlers is synchronized with
+// the manager loop.
+func TestRollbackWhileRunning(t *testing.T) {
+	bus := events.New()
+	sub := bus.Subscribe()
+	tmp := t.TempDir()
+	s, _ := store.New(tmp+"/state.json", tmp+"/gcroots", 10, 10, 10, bus)
+	s.DeploymentInsert(store.Deployment{UUID: "dpl-1", Status: store.Done, Operation: "switch", Generation: store.Generation{OutPath: "out-1"}})
+	s.DeploymentInsert(store.Deployment{UUID: "dpl-2", Status: store.Done, Operation: "switch", Generation: store.Generation{OutPath: "out-2"}})
+	eMock := StorePathExecutorMock{ExecutorMock: NewExecutorMock(""), storePathExist: true}
+	b := builder.New(s, eMock, "repoPath", "", "my-machine", 2*time.Second, 2*time.Second, nil, bus)
+	m := New(s, prometheus.New(), scheduler.New(), fetcher.NewFetcher(utils.NewRepositoryMock(), bus), b, mkDeployerMock(bus), "", eMock, types.Reboot{}, types.Drift{}, nil, bus)
+	go m.Run()
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+				m.GetState()
+				m.rebootIfPending(time.Now())
+			}
+		}
+	}()
+	assert.Nil(t, m.Rollback(""))
+	events.Next[deployer.DeploymentDone](sub)
+	assert.True(t, m.GetState().IsSuspended)
+	assert.Nil(t, m.Resume())
+	assert.False(t, m.GetState().IsSuspended)
+	close(done)
+	<-stopped
+}
+
+func TestPin(t *testing.T) {
+	bus := events.New()
+	tmp := t.TempDir()
+	s, _ := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1, 10, bus)
+	r := utils.NewRepositoryMock()
+	f := fetcher.NewFetcher(r, bus)
+	f.Start()
+	eMock := NewExecutorMock("")
+	b := builder.New(s, eMock, "repoPath", "", "my-machine", 2*time.Second, 2*time.Second, nil, bus)
+	m := New(s, prometheus.New(), scheduler.New(), f, b, mkDeployerMock(bus), "", eMock, types.Reboot{}, types.Drift{}, nil, bus)
+
+	assert.ErrorContains(t, m.Unpin(), "the machine is not pinned")
+	assert.ErrorContains(t, m.Pin("", "alice"), "the commit to pin is empty")
+
+	err := m.Pin("commit-1", "alice")
+	assert.Nil(t, err)
+	assert.Equal(t, "commit-1", r.PinnedCommitId)
+	assert.Equal(t, "commit-1", m.toState().Pin.CommitId)
+	assert.Equal(t, "alice", m.toState().Pin.By)
+
+	// The pin is persisted
+	s1, _ := store.New(tmp+"/state.json", tmp+"/gcroots", 1, 1, 10, bus)
+	_ = s1.Load()
+	assert.Equal(t, "commit-1", s1.Pin().CommitId)
+
+	err = m.Unpin()
+	assert.Nil(t, err)
+	assert.Equal(t, "", r.PinnedCommitId)
+	assert.Nil(t, m.toState().Pin)
+
+	// A commit refused by the repository is not pinned
+	r.PinErr = fmt.Errorf("the pinned commit commit-2 doesn't exist")
+	assert.ErrorContains(t, m.Pin("commit-2", "alice"), "doesn't exist")
+	assert.Equal(t, "", r.PinnedCommitId)
+	assert.Nil(t, s.Pin())
+}
+
+type DriftExecutorMock struct {
+	ExecutorMock
+	currentSystem string
+}
+
+func (n *DriftExecutorMock) CurrentSystem() (string, error) {
+	return n.currentSystem, nil
+}
+
+func TestDrift(t *testing.T) {
+	bus := events.New()
+	tmp := t.TempDir()
+	s, _ := store.New(tmp+"/state.json", tmp+"/gcroots", 10, 10, 10, bus)
+	eMock := &DriftExecutorMock{ExecutorMock: NewExecutorMock(""), currentSystem: "out-1"}
+	b := builder.New(s, eMock, "repoPath", "", "my-machine", 2*time.Second, 2*time.Second, nil, bus)
+	d := mkDeployerMock(bus)
+	m := New(s, prometheus.New(), scheduler.New(), fetcher.NewFetcher(utils.NewRepositoryMock(), bus), b, d, "", eMock, types.Reboot{}, types.Drift{Policy: "alert"}, nil, bus)
+
+	// No deployment yet
+	m.checkDrift()
+	assert.Nil(t, s.Drift())
+
+	s.DeploymentInsert(store.Deployment{UUID: "dpl-1", Status: store.Done, Operation: "switch", Generation: store.Generation{OutPath: "out-1"}})
+	s.DeploymentInsert(store.Deployment{UUID: "dpl-2", Status: store.RolledBack, Operation: "switch", Generation: store.Generation{OutPath: "out-2"}, RolledBackTo: "out-1"})
+	m.checkDrift()
+	assert.Nil(t, s.Drift())
+
+	// The system has been switched outside of comin
+	eMock.currentSystem = "out-manual"
+	m.checkDrift()
+	assert.Equal(t, "out-manual", s.Drift().OutPath)
+	assert.Equal(t, "out-1", s.Drift().ExpectedOutPath)
+	assert.Equal(t, "dpl-1", s.Drift().DeploymentUUID)
+	assert.Equal(t, s.Drift(), m.toState().Drift)
+
+	// The drift is persisted
+	s1, _ := store.New(tmp+"/state.json", tmp+"/gcroots", 10, 10, 10, bus)
+	_ = s1.Load()
+	assert.Equal(t, "out-manual", s1.Drift().OutPath)
+
+	// A boot deployment is not expected to be running until the
+	// machine is rebooted
+	s.DeploymentInsert(store.Deployment{UUID: "dpl-3", Status: store.Done, Operation: "boot", Generation: store.Generation{OutPath: "out-3"}})
+	s.PendingRebootSet(&store.PendingReboot{DeploymentUUID: "dpl-3"})
+	eMock.currentSystem = "out-1"
+	m.checkDrift()
+	assert.Nil(t, s.Drift())
+	s.PendingRebootSet(nil)
+	m.checkDrift()
+	assert.Equal(t, "out-3", s.Drift().ExpectedOutPath)
+
+	// The drift is not checked after a failed deployment
+	s.DeploymentInsert(store.Deployment{UUID: "dpl-4", Status: store.Failed, Operation: "switch", Generation: store.Generation{OutPath: "out-4"}})
+	_ = s.DriftSet(nil)
+	m.checkDrift()
+	assert.Nil(t, s.Drift())
+}
+
+func TestDriftReconcile(t *testing.T) {
+	bus := events.New()
+	sub := bus.Subscribe()
+	tmp := t.TempDir()
+	s, _ := store.New(tmp+"/state.json", tmp+"/gcroots", 10, 10, 10, bus)
+	s.DeploymentInsert(store.Deployment{UUID: "dpl-1", Status: store.Done, Operation: "switch", Generation: store.Generation{OutPath: "out-1"}})
+	eMock := &DriftExecutorMock{ExecutorMock: NewExecutorMock(""), currentSystem: "out-manual"}
+	b := builder.New(s, eMock, "repoPath", "", "my-machine", 2*time.Second, 2*time.Second, nil, bus)
+	deployed := ""
+	var deployFunc = func(ctx context.Context, outPath, operation string, logs io.Writer) (bool, string, error) {
+		deployed = outPath
+		return false, "", nil
+	}
+	d := deployer.New(deployFunc, nil, nil, nil, "", types.Hooks{}, types.HealthChecks{}, types.Confirmation{}, nil, nil, bus)
+	m := New(s, prometheus.New(), scheduler.New(), fetcher.NewFetcher(utils.NewRepositoryMock(), bus), b, d, "", eMock, types.Reboot{}, types.Drift{Policy: "reconcile"}, nil, bus)
+	d.Run()
+
+	m.checkDrift()
+	dpl := events.Next[deployer.DeploymentDone](sub).Deployment
+	assert.Equal(t, "out-1", deployed)
+	assert.Equal(t, "out-manual", dpl.ReconciledOutPath)
+	assert.Equal(t, "switch", dpl.Operation)
+	assert.Equal(t, store.Done, dpl.Status)
+	assert.NotNil(t, s.Drift())
+
+	s.DeploymentInsert(dpl)
+	eMock.currentSystem = "out-1"
+	m.checkDrift()
+	assert.Nil(t, s.Drift())
+}
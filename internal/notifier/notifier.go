@@ -0,0 +1,326 @@
+// Package notifier sends messages on the lifecycle events of comin
+// (fetched commits, failed evaluations and builds, deployments...) to
+// webhooks, Matrix rooms, ntfy topics, Slack-compatible incoming
+// webhooks or by email. The messages are built from the events
+// published on the bus.
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/nlewo/comin/internal/builder"
+	"github.com/nlewo/comin/internal/deployer"
+	"github.com/nlewo/comin/internal/events"
+	"github.com/nlewo/comin/internal/fetcher"
+	"github.com/nlewo/comin/internal/manager"
+	"github.com/nlewo/comin/internal/repository"
+	"github.com/nlewo/comin/internal/store"
+	"github.com/nlewo/comin/internal/types"
+	"github.com/sirupsen/logrus"
+)
+
+type EventType string
+
+const (
+	CommitFetched      EventType = "commit_fetched"
+	SignatureRefused   EventType = "signature_refused"
+	FetchRefused       EventType = "fetch_refused"
+	EvalFailed         EventType = "eval_failed"
+	BuildFailed        EventType = "build_failed"
+	DeploymentStarted  EventType = "deployment_started"
+	DeploymentFinished EventType = "deployment_finished"
+	RebootNeeded       EventType = "reboot_needed"
+)
+
+var eventTypes = []EventType{
+	CommitFetched,
+	SignatureRefused,
+	FetchRefused,
+	EvalFailed,
+	BuildFailed,
+	DeploymentStarted,
+	DeploymentFinished,
+	RebootNeeded,
+}
+
+// queueSize is the number of events waiting to be sent. The events
+// are dropped when the queue is full.
+const queueSize = 64
+
+// Event is the data of the message templates. The commit fields are
+// always set while the generation and the deployment are only set by
+// the events related to them.
+type Event struct {
+	Type       EventType `json:"type"`
+	Time       time.Time `json:"time"`
+	Hostname   string    `json:"hostname"`
+	CommitId   string    `json:"commit_id"`
+	CommitMsg  string    `json:"commit_msg"`
+	RemoteName string    `json:"remote_name"`
+	BranchName string    `json:"branch_name"`
+	// The error of a failed evaluation, build or deployment
+	ErrorMsg string `json:"error_msg,omitempty"`
+	// The reasons why the machine needs to be rebooted
+	RebootReasons []string          `json:"reboot_reasons,omitempty"`
+	Generation    *store.Generation `json:"generation,omitempty"`
+	Deployment    *store.Deployment `json:"deployment,omitempty"`
+}
+
+// NewCommitEvent creates an event related to the commit selected by
+// the fetcher
+func NewCommitEvent(eventType EventType, rs repository.RepositoryStatus) Event {
+	return Event{
+		Type:       eventType,
+		CommitId:   rs.SelectedCommitId,
+		CommitMsg:  rs.SelectedCommitMsg,
+		RemoteName: rs.SelectedRemoteName,
+		BranchName: rs.SelectedBranchName,
+	}
+}
+
+// NewGenerationEvent creates an event related to a generation
+func NewGenerationEvent(eventType EventType, g store.Generation, errorMsg string) Event {
+	return Event{
+		Type:       eventType,
+		CommitId:   g.SelectedCommitId,
+		CommitMsg:  g.SelectedCommitMsg,
+		RemoteName: g.SelectedRemoteName,
+		BranchName: g.SelectedBranchName,
+		ErrorMsg:   errorMsg,
+		Generation: &g,
+	}
+}
+
+// NewDeploymentEvent creates an event related to a deployment
+func NewDeploymentEvent(eventType EventType, d store.Deployment) Event {
+	e := NewGenerationEvent(eventType, d.Generation, d.ErrorMsg)
+	e.Deployment = &d
+	return e
+}
+
+// Summary returns a sentence describing the event. It is the default
+// message of the notifiers.
+func (e Event) Summary() string {
+	commit := fmt.Sprintf("the commit %s of %s/%s", e.CommitId, e.RemoteName, e.BranchName)
+	switch e.Type {
+	case CommitFetched:
+		return fmt.Sprintf("%s has been fetched", commit)
+	case SignatureRefused:
+		return fmt.Sprintf("%s is refused because it is not signed by a trusted GPG key", commit)
+	case FetchRefused:
+		return fmt.Sprintf("%s is refused: %s", commit, e.ErrorMsg)
+	case EvalFailed:
+		return fmt.Sprintf("the evaluation of %s failed: %s", commit, e.ErrorMsg)
+	case BuildFailed:
+		return fmt.Sprintf("the build of %s failed: %s", commit, e.ErrorMsg)
+	case DeploymentStarted:
+		return fmt.Sprintf("the deployment of %s is starting", commit)
+	case DeploymentFinished:
+		if e.Deployment == nil {
+			break
+		}
+		switch e.Deployment.Status {
+		case store.Done:
+			return fmt.Sprintf("the deployment of %s succeeded", commit)
+		case store.RolledBack:
+			return fmt.Sprintf("the deployment of %s has been rolled back: %s", commit, e.ErrorMsg)
+		default:
+			return fmt.Sprintf("the deployment of %s failed: %s", commit, e.ErrorMsg)
+		}
+	case RebootNeeded:
+		if len(e.RebootReasons) > 0 {
+			return fmt.Sprintf("a reboot is needed to activate %s (%s)", commit, strings.Join(e.RebootReasons, ", "))
+		}
+		return fmt.Sprintf("a reboot is needed to activate %s", commit)
+	}
+	return fmt.Sprintf("%s: %s", e.Type, commit)
+}
+
+const defaultTemplate = "comin on {{.Hostname}}: {{.Summary}}"
+
+// funcs are the functions available in the templates
+var funcs = template.FuncMap{
+	"status": store.StatusToString,
+}
+
+func parseTemplate(text string) (*template.Template, error) {
+	return template.New("message").Funcs(funcs).Parse(text)
+}
+
+// Validate checks the configuration of a notifier
+func Validate(n types.Notifier) error {
+	for _, e := range n.Events {
+		if !slices.Contains(eventTypes, EventType(e)) {
+			return fmt.Errorf("unknown event %s", e)
+		}
+	}
+	if _, err := parseTemplate(n.Template); err != nil {
+		return fmt.Errorf("invalid template: %w", err)
+	}
+	switch n.Type {
+	case "webhook", "ntfy", "slack":
+		if n.URL == "" {
+			return fmt.Errorf("the url of a %s notifier can not be empty", n.Type)
+		}
+	case "matrix":
+		if n.Homeserver == "" || n.RoomId == "" || n.TokenPath == "" {
+			return fmt.Errorf("the homeserver, the room_id and the token_path of a matrix notifier can not be empty")
+		}
+	case "smtp":
+		if n.SMTP.Host == "" || n.SMTP.From == "" || len(n.SMTP.To) == 0 {
+			return fmt.Errorf("the smtp.host, the smtp.from and the smtp.to of a smtp notifier can not be empty")
+		}
+	default:
+		return fmt.Errorf("the type has to be webhook, matrix, ntfy, slack or smtp (current value: %s)", n.Type)
+	}
+	return nil
+}
+
+type notifier struct {
+	types.Notifier
+	template *template.Template
+}
+
+type Notifier struct {
+	hostname  string
+	notifiers []notifier
+	client    *http.Client
+	events    chan Event
+}
+
+// New creates a Notifier sending messages with the notifiers, which
+// have to be validated.
+func New(notifiers []types.Notifier, hostname string) (*Notifier, error) {
+	n := &Notifier{
+		hostname: hostname,
+		client:   &http.Client{},
+		events:   make(chan Event, queueSize),
+	}
+	for i, cfg := range notifiers {
+		text := cfg.Template
+		if text == "" {
+			text = defaultTemplate
+		}
+		t, err := parseTemplate(text)
+		if err != nil {
+			return nil, fmt.Errorf("invalid template of the notifier %d: %w", i, err)
+		}
+		n.notifiers = append(n.notifiers, notifier{Notifier: cfg, template: t})
+	}
+	return n, nil
+}
+
+// Notify queues an event to be sent by the notifiers subscribed to
+// it. It doesn't block: the event is dropped if the queue is full. A
+// nil Notifier discards the events.
+func (n *Notifier) Notify(e Event) {
+	if n == nil || len(n.notifiers) == 0 {
+		return
+	}
+	e.Time = time.Now().UTC()
+	e.Hostname = n.hostname
+	select {
+	case n.events <- e:
+	default:
+		logrus.Errorf("notifier: the %s event is dropped because the queue is full", e.Type)
+	}
+}
+
+// eventsOf returns the events built from an event published on the
+// bus. Most of the published events don't send any message.
+func eventsOf(p events.Payload) []Event {
+	switch data := p.(type) {
+	case fetcher.CommitSelected:
+		rs := data.RepositoryStatus
+		es := []Event{NewCommitEvent(CommitFetched, rs)}
+		if rs.SelectedCommitShouldBeSigned && !rs.SelectedCommitSigned {
+			es = append(es, NewCommitEvent(SignatureRefused, rs))
+		}
+		return es
+	case fetcher.FetchRefused:
+		return []Event{{
+			Type:       FetchRefused,
+			CommitId:   data.CommitId,
+			RemoteName: data.RemoteName,
+			BranchName: data.BranchName,
+			ErrorMsg:   data.ErrorMsg,
+		}}
+	case builder.EvaluationDone:
+		if data.Generation.EvalErr != nil {
+			return []Event{NewGenerationEvent(EvalFailed, data.Generation, data.Generation.EvalErrStr)}
+		}
+	case builder.BuildDone:
+		if data.Generation.BuildErr != nil {
+			return []Event{NewGenerationEvent(BuildFailed, data.Generation, data.Generation.BuildErrStr)}
+		}
+	case deployer.DeploymentStarted:
+		return []Event{NewDeploymentEvent(DeploymentStarted, data.Deployment)}
+	case deployer.DeploymentDone:
+		return []Event{NewDeploymentEvent(DeploymentFinished, data.Deployment)}
+	case manager.RebootNeeded:
+		e := NewDeploymentEvent(RebootNeeded, data.Deployment)
+		e.RebootReasons = data.Reasons
+		return []Event{e}
+	}
+	return nil
+}
+
+// Run subscribes to the events published on the bus and sends the
+// messages of the notifiers subscribed to them. It has to be called
+// before the events are published.
+func (n *Notifier) Run(bus *events.Bus) {
+	if n == nil || len(n.notifiers) == 0 {
+		return
+	}
+	sub := bus.Subscribe()
+	go func() {
+		for e := range sub.C {
+			for _, event := range eventsOf(e.Data) {
+				n.Notify(event)
+			}
+		}
+	}()
+	go func() {
+		for e := range n.events {
+			for i, cfg := range n.notifiers {
+				if len(cfg.Events) > 0 && !slices.Contains(cfg.Events, string(e.Type)) {
+					continue
+				}
+				if err := n.send(cfg, e); err != nil {
+					logrus.Errorf("notifier: failed to send the %s event with the %s notifier %d: %s", e.Type, cfg.Type, i, err)
+				}
+			}
+		}
+	}()
+}
+
+func (n *Notifier) send(cfg notifier, e Event) error {
+	var buf bytes.Buffer
+	if err := cfg.template.Execute(&buf, e); err != nil {
+		return fmt.Errorf("failed to render the template: %w", err)
+	}
+	msg := buf.String()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.Timeout)*time.Second)
+	defer cancel()
+	logrus.Debugf("notifier: sending the %s event with the %s notifier", e.Type, cfg.Type)
+	switch cfg.Type {
+	case "webhook":
+		return n.sendWebhook(ctx, cfg.Notifier, e, msg)
+	case "slack":
+		return n.sendSlack(ctx, cfg.Notifier, msg)
+	case "ntfy":
+		return n.sendNtfy(ctx, cfg.Notifier, e, msg)
+	case "matrix":
+		return n.sendMatrix(ctx, cfg.Notifier, msg)
+	case "smtp":
+		return sendSMTP(ctx, cfg.Notifier, e, msg)
+	}
+	return fmt.Errorf("unknown notifier type %s", cfg.Type)
+}
@@ -0,0 +1,150 @@
+package notifier
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nlewo/comin/internal/builder"
+	"github.com/nlewo/comin/internal/deployer"
+	"github.com/nlewo/comin/internal/events"
+	"github.com/nlewo/comin/internal/fetcher"
+	"github.com/nlewo/comin/internal/manager"
+	"github.com/nlewo/comin/internal/repository"
+	"github.com/nlewo/comin/internal/store"
+	"github.com/nlewo/comin/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+type request struct {
+	method string
+	path   string
+	header http.Header
+	body   string
+}
+
+func newServer(t *testing.T) (*httptest.Server, func() []request) {
+	var mu sync.Mutex
+	var requests []request
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		defer mu.Unlock()
+		requests = append(requests, request{method: r.Method, path: r.URL.Path, header: r.Header, body: string(body)})
+	}))
+	t.Cleanup(s.Close)
+	return s, func() []request {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]request{}, requests...)
+	}
+}
+
+func TestSummary(t *testing.T) {
+	g := store.Generation{SelectedCommitId: "commit-1", SelectedRemoteName: "origin", SelectedBranchName: "main"}
+	assert.Equal(t, "the build of the commit commit-1 of origin/main failed: boom",
+		NewGenerationEvent(BuildFailed, g, "boom").Summary())
+	d := store.Deployment{Generation: g, Status: store.Done}
+	assert.Equal(t, "the deployment of the commit commit-1 of origin/main succeeded",
+		NewDeploymentEvent(DeploymentFinished, d).Summary())
+	d.Status = store.RolledBack
+	d.ErrorMsg = "the health checks failed"
+	assert.Equal(t, "the deployment of the commit commit-1 of origin/main has been rolled back: the health checks failed",
+		NewDeploymentEvent(DeploymentFinished, d).Summary())
+	e := NewDeploymentEvent(RebootNeeded, d)
+	e.RebootReasons = []string{"kernel", "initrd"}
+	assert.Equal(t, "a reboot is needed to activate the commit commit-1 of origin/main (kernel, initrd)", e.Summary())
+}
+
+func TestValidate(t *testing.T) {
+	assert.Nil(t, Validate(types.Notifier{Type: "webhook", URL: "http://localhost", Events: []string{"build_failed"}}))
+	assert.ErrorContains(t, Validate(types.Notifier{Type: "webhook"}), "the url of a webhook notifier can not be empty")
+	assert.ErrorContains(t, Validate(types.Notifier{Type: "matrix", Homeserver: "https://matrix.org"}), "the homeserver, the room_id and the token_path")
+	assert.ErrorContains(t, Validate(types.Notifier{Type: "smtp", SMTP: types.NotifierSMTP{Host: "localhost"}}), "the smtp.host, the smtp.from and the smtp.to")
+	assert.ErrorContains(t, Validate(types.Notifier{Type: "slack", URL: "http://localhost", Events: []string{"unknown"}}), "unknown event unknown")
+	assert.ErrorContains(t, Validate(types.Notifier{Type: "slack", URL: "http://localhost", Template: "{{.Hostname"}), "invalid template")
+}
+
+func TestNotifier(t *testing.T) {
+	s, requests := newServer(t)
+	n, err := New([]types.Notifier{
+		{Type: "webhook", URL: s.URL + "/webhook", Timeout: 10},
+		{Type: "slack", URL: s.URL + "/slack", Timeout: 10, Events: []string{"deployment_finished"},
+			Template: "{{.Hostname}} deployed {{.CommitId}}: {{status .Deployment.Status}}"},
+		{Type: "ntfy", URL: s.URL + "/comin", Token: "ntfy-token", Timeout: 10, Events: []string{"build_failed"}},
+		{Type: "matrix", Homeserver: s.URL, RoomId: "!room:matrix.org", Token: "matrix-token", Timeout: 10, Events: []string{"build_failed"}},
+	}, "machine")
+	assert.Nil(t, err)
+	bus := events.New()
+	n.Run(bus)
+
+	g := store.Generation{SelectedCommitId: "commit-1", SelectedRemoteName: "origin", SelectedBranchName: "main"}
+	// The events which don't send a message are ignored
+	bus.Publish(builder.EvaluationDone{Generation: g})
+	failed := g
+	failed.BuildErr = errors.New("boom")
+	failed.BuildErrStr = "boom"
+	bus.Publish(builder.BuildDone{Generation: failed})
+	bus.Publish(deployer.DeploymentDone{Deployment: store.Deployment{Generation: g, Status: store.Done}})
+
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Len(c, requests(), 5)
+	}, 2*time.Second, 100*time.Millisecond)
+	r := requests()
+
+	assert.Equal(t, "/webhook", r[0].path)
+	var payload struct {
+		Event   Event  `json:"event"`
+		Message string `json:"message"`
+	}
+	assert.Nil(t, json.Unmarshal([]byte(r[0].body), &payload))
+	assert.Equal(t, BuildFailed, payload.Event.Type)
+	assert.Equal(t, "machine", payload.Event.Hostname)
+	assert.Equal(t, "boom", payload.Event.ErrorMsg)
+	assert.Equal(t, "comin on machine: the build of the commit commit-1 of origin/main failed: boom", payload.Message)
+
+	assert.Equal(t, "/comin", r[1].path)
+	assert.Equal(t, "Bearer ntfy-token", r[1].header.Get("Authorization"))
+	assert.Equal(t, "build_failed", r[1].header.Get("Tags"))
+	assert.Equal(t, "comin on machine: the build of the commit commit-1 of origin/main failed: boom", r[1].body)
+
+	assert.Equal(t, http.MethodPut, r[2].method)
+	assert.Regexp(t, "^/_matrix/client/v3/rooms/!room:matrix.org/send/m.room.message/comin-", r[2].path)
+	assert.Equal(t, "Bearer matrix-token", r[2].header.Get("Authorization"))
+	assert.JSONEq(t, `{"msgtype":"m.text","body":"comin on machine: the build of the commit commit-1 of origin/main failed: boom"}`, r[2].body)
+
+	assert.Equal(t, "/webhook", r[3].path)
+
+	assert.Equal(t, "/slack", r[4].path)
+	assert.JSONEq(t, `{"text":"machine deployed commit-1: done"}`, r[4].body)
+}
+
+func TestEventsOf(t *testing.T) {
+	rs := repository.RepositoryStatus{SelectedCommitId: "commit-1", SelectedCommitShouldBeSigned: true}
+	es := eventsOf(fetcher.CommitSelected{RepositoryStatus: rs})
+	assert.Len(t, es, 2)
+	assert.Equal(t, CommitFetched, es[0].Type)
+	assert.Equal(t, SignatureRefused, es[1].Type)
+
+	es = eventsOf(fetcher.FetchRefused{RemoteName: "origin", BranchName: "main", CommitId: "commit-2", ErrorMsg: "it has been hard reset"})
+	assert.Len(t, es, 1)
+	assert.Equal(t, "the commit commit-2 of origin/main is refused: it has been hard reset", es[0].Summary())
+
+	g := store.Generation{SelectedCommitId: "commit-1", SelectedRemoteName: "origin", SelectedBranchName: "main"}
+	es = eventsOf(manager.RebootNeeded{Deployment: store.Deployment{Generation: g}, Reasons: []string{"kernel"}})
+	assert.Len(t, es, 1)
+	assert.Equal(t, "a reboot is needed to activate the commit commit-1 of origin/main (kernel)", es[0].Summary())
+
+	assert.Empty(t, eventsOf(builder.BuildDone{Generation: g}))
+}
+
+func TestNotifierNil(t *testing.T) {
+	var n *Notifier
+	n.Run(events.New())
+	n.Notify(Event{Type: BuildFailed})
+}
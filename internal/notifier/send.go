@@ -0,0 +1,147 @@
+package notifier
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nlewo/comin/internal/types"
+)
+
+// do sends a HTTP request and checks the response status
+func (n *Notifier) do(ctx context.Context, method, url string, body []byte, headers map[string]string) error {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close() // nolint
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		content, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("unexpected status %s: %s", resp.Status, strings.TrimSpace(string(content)))
+	}
+	return nil
+}
+
+type webhookPayload struct {
+	Event   Event  `json:"event"`
+	Message string `json:"message"`
+}
+
+// sendWebhook posts the event and the message as JSON
+func (n *Notifier) sendWebhook(ctx context.Context, cfg types.Notifier, e Event, msg string) error {
+	body, err := json.Marshal(webhookPayload{Event: e, Message: msg})
+	if err != nil {
+		return err
+	}
+	return n.do(ctx, http.MethodPost, cfg.URL, body, map[string]string{"Content-Type": "application/json"})
+}
+
+// sendSlack posts the message to a Slack-compatible incoming webhook
+func (n *Notifier) sendSlack(ctx context.Context, cfg types.Notifier, msg string) error {
+	body, err := json.Marshal(map[string]string{"text": msg})
+	if err != nil {
+		return err
+	}
+	return n.do(ctx, http.MethodPost, cfg.URL, body, map[string]string{"Content-Type": "application/json"})
+}
+
+// sendNtfy publishes the message to a ntfy topic
+func (n *Notifier) sendNtfy(ctx context.Context, cfg types.Notifier, e Event, msg string) error {
+	headers := map[string]string{
+		"Title": fmt.Sprintf("comin on %s", e.Hostname),
+		"Tags":  string(e.Type),
+	}
+	if cfg.Token != "" {
+		headers["Authorization"] = "Bearer " + cfg.Token
+	}
+	return n.do(ctx, http.MethodPost, cfg.URL, []byte(msg), headers)
+}
+
+// sendMatrix sends the message to a Matrix room with the client-server
+// API
+func (n *Notifier) sendMatrix(ctx context.Context, cfg types.Notifier, msg string) error {
+	body, err := json.Marshal(map[string]string{"msgtype": "m.text", "body": msg})
+	if err != nil {
+		return err
+	}
+	u := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/comin-%d",
+		strings.TrimRight(cfg.Homeserver, "/"), url.PathEscape(cfg.RoomId), time.Now().UnixNano())
+	return n.do(ctx, http.MethodPut, u, body, map[string]string{
+		"Content-Type":  "application/json",
+		"Authorization": "Bearer " + cfg.Token,
+	})
+}
+
+// sendSMTP sends the message by email. STARTTLS is used when the
+// server supports it and the authentication is only done when a
+// username is configured.
+func sendSMTP(ctx context.Context, cfg types.Notifier, e Event, msg string) error {
+	port := cfg.SMTP.Port
+	if port == 0 {
+		port = 587
+	}
+	conn, err := (&net.Dialer{}).DialContext(ctx, "tcp", net.JoinHostPort(cfg.SMTP.Host, strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	c, err := smtp.NewClient(conn, cfg.SMTP.Host)
+	if err != nil {
+		_ = conn.Close()
+		return err
+	}
+	defer c.Close() // nolint
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: cfg.SMTP.Host}); err != nil {
+			return err
+		}
+	}
+	if cfg.SMTP.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", cfg.SMTP.Username, cfg.SMTP.Password, cfg.SMTP.Host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(cfg.SMTP.From); err != nil {
+		return err
+	}
+	for _, to := range cfg.SMTP.To {
+		if err := c.Rcpt(to); err != nil {
+			return err
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "From: %s\r\n", cfg.SMTP.From)
+	fmt.Fprintf(w, "To: %s\r\n", strings.Join(cfg.SMTP.To, ", "))
+	fmt.Fprintf(w, "Subject: comin on %s: %s\r\n", e.Hostname, e.Type)
+	fmt.Fprintf(w, "Date: %s\r\n", e.Time.Format(time.RFC1123Z))
+	fmt.Fprintf(w, "Content-Type: text/plain; charset=UTF-8\r\n\r\n")
+	if _, err := io.WriteString(w, strings.ReplaceAll(msg, "\n", "\r\n")+"\r\n"); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
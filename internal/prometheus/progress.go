@@ -0,0 +1,66 @@
+package prometheus
+
+import (
+	"sync/atomic"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// buildProgressCollector exposes the progress of the running build,
+// which is read from the builder when the metrics are scraped.
+type buildProgressCollector struct {
+	progressFunc atomic.Pointer[func() *types.BuildProgress]
+	descs        map[string]*prometheus.Desc
+}
+
+func newBuildProgressCollector() *buildProgressCollector {
+	descs := map[string]string{
+		"comin_build_derivations_built": "Number of derivations built by the running build.",
+		"comin_build_derivations_total": "Number of derivations to build by the running build.",
+		"comin_build_paths_downloaded":  "Number of store paths downloaded by the running build.",
+		"comin_build_paths_total":       "Number of store paths to download by the running build.",
+		"comin_build_bytes_downloaded":  "Number of bytes downloaded by the running build.",
+		"comin_build_bytes_total":       "Number of bytes to download by the running build.",
+		"comin_build_running_builds":    "Number of derivations being built.",
+	}
+	c := &buildProgressCollector{descs: make(map[string]*prometheus.Desc)}
+	for name, help := range descs {
+		c.descs[name] = prometheus.NewDesc(name, help, nil, nil)
+	}
+	return c
+}
+
+func (c *buildProgressCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, desc := range c.descs {
+		ch <- desc
+	}
+}
+
+func (c *buildProgressCollector) Collect(ch chan<- prometheus.Metric) {
+	// All metrics are 0 when no build is running
+	progress := &types.BuildProgress{}
+	if f := c.progressFunc.Load(); f != nil {
+		if p := (*f)(); p != nil {
+			progress = p
+		}
+	}
+	values := map[string]float64{
+		"comin_build_derivations_built": float64(progress.DerivationsBuilt),
+		"comin_build_derivations_total": float64(progress.DerivationsTotal),
+		"comin_build_paths_downloaded":  float64(progress.PathsDownloaded),
+		"comin_build_paths_total":       float64(progress.PathsTotal),
+		"comin_build_bytes_downloaded":  float64(progress.BytesDownloaded),
+		"comin_build_bytes_total":       float64(progress.BytesTotal),
+		"comin_build_running_builds":    float64(len(progress.RunningBuilds)),
+	}
+	for name, desc := range c.descs {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, values[name])
+	}
+}
+
+// SetBuildProgressFunc sets the function returning the progress of the
+// running build (or nil if no build is running).
+func (m Prometheus) SetBuildProgressFunc(f func() *types.BuildProgress) {
+	m.buildProgress.progressFunc.Store(&f)
+}
@@ -13,6 +13,10 @@ type Prometheus struct {
 	deploymentInfo *prometheus.GaugeVec
 	fetchCounter   *prometheus.CounterVec
 	hostInfo       *prometheus.GaugeVec
+	rebootReasons  *prometheus.GaugeVec
+	pendingReboot  prometheus.Gauge
+	drift          prometheus.Gauge
+	buildProgress  *buildProgressCollector
 }
 
 func New() Prometheus {
@@ -33,16 +37,37 @@ func New() Prometheus {
 		Name: "comin_host_info",
 		Help: "Info of the host.",
 	}, []string{"need_to_reboot"})
+	rebootReasons := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "comin_reboot_reasons",
+		Help: "The components of the current system requiring a reboot to be activated.",
+	}, []string{"reason"})
+	pendingReboot := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "comin_pending_reboot",
+		Help: "1 when a boot deployment is waiting for a reboot.",
+	})
+	drift := prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "comin_drift",
+		Help: "1 when the running system is not the generation of the last deployment.",
+	})
 	promReg.MustRegister(buildInfo)
 	promReg.MustRegister(deploymentInfo)
 	promReg.MustRegister(fetchCounter)
 	promReg.MustRegister(hostInfo)
+	promReg.MustRegister(rebootReasons)
+	promReg.MustRegister(pendingReboot)
+	buildProgress := newBuildProgressCollector()
+	promReg.MustRegister(drift)
+	promReg.MustRegister(buildProgress)
 	return Prometheus{
 		promRegistry:   promReg,
 		buildInfo:      buildInfo,
 		deploymentInfo: deploymentInfo,
 		fetchCounter:   fetchCounter,
 		hostInfo:       hostInfo,
+		rebootReasons:  rebootReasons,
+		pendingReboot:  pendingReboot,
+		drift:          drift,
+		buildProgress:  buildProgress,
 	}
 }
 
@@ -68,13 +93,33 @@ func (m Prometheus) SetDeploymentInfo(commitId, status string) {
 	m.deploymentInfo.With(prometheus.Labels{"commit_id": commitId, "status": status}).Set(1)
 }
 
-func (m Prometheus) SetHostInfo(needToReboot bool) {
+func (m Prometheus) SetHostInfo(rebootReasons []string) {
 	m.hostInfo.Reset()
 	var value string
-	if needToReboot {
+	if len(rebootReasons) > 0 {
 		value = "1"
 	} else {
 		value = "0"
 	}
 	m.hostInfo.With(prometheus.Labels{"need_to_reboot": value}).Set(1)
+	m.rebootReasons.Reset()
+	for _, reason := range rebootReasons {
+		m.rebootReasons.With(prometheus.Labels{"reason": reason}).Set(1)
+	}
+}
+
+func (m Prometheus) SetPendingReboot(pending bool) {
+	if pending {
+		m.pendingReboot.Set(1)
+	} else {
+		m.pendingReboot.Set(0)
+	}
+}
+
+func (m Prometheus) SetDrift(drift bool) {
+	if drift {
+		m.drift.Set(1)
+	} else {
+		m.drift.Set(0)
+	}
 }
@@ -0,0 +1,53 @@
+package repository
+
+import (
+	"fmt"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	"github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/nlewo/comin/internal/types"
+)
+
+// authMethod returns the go-git authentication method used to access
+// a remote. A SSH private key takes precedence over an access
+// token. It returns nil when no authentication is configured.
+func authMethod(url string, auth types.Auth) (transport.AuthMethod, error) {
+	if auth.SshPrivateKeyPath != "" {
+		return sshAuthMethod(url, auth)
+	}
+	if auth.AccessToken != "" {
+		return &http.BasicAuth{
+			// On GitLab, any non blank username is
+			// working.
+			Username: "comin",
+			Password: auth.AccessToken,
+		}, nil
+	}
+	return nil, nil
+}
+
+func sshAuthMethod(url string, auth types.Auth) (*ssh.PublicKeys, error) {
+	// The user is the one specified in the URL, such as
+	// ssh://gitea@git.example.org/owner/infra.git. It defaults
+	// to git, as used by most forges.
+	user := "git"
+	endpoint, err := transport.NewEndpoint(url)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse the remote URL %s: %w", url, err)
+	}
+	if endpoint.User != "" {
+		user = endpoint.User
+	}
+	publicKeys, err := ssh.NewPublicKeysFromFile(user, auth.SshPrivateKeyPath, auth.SshPrivateKeyPassphrase)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the SSH private key %s: %w", auth.SshPrivateKeyPath, err)
+	}
+	if auth.SshKnownHostsPath != "" {
+		publicKeys.HostKeyCallback, err = ssh.NewKnownHostsCallback(auth.SshKnownHostsPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the SSH known hosts file %s: %w", auth.SshKnownHostsPath, err)
+		}
+	}
+	return publicKeys, nil
+}
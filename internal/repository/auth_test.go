@@ -0,0 +1,102 @@
+package repository
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5/plumbing/transport/http"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+	"github.com/nlewo/comin/internal/types"
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+)
+
+func writeSshPrivateKey(t *testing.T, dir, passphrase string) (privateKeyPath string, publicKey ssh.PublicKey) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	assert.Nil(t, err)
+	var block *pem.Block
+	if passphrase == "" {
+		block, err = ssh.MarshalPrivateKey(priv, "")
+	} else {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(priv, "", []byte(passphrase))
+	}
+	assert.Nil(t, err)
+	privateKeyPath = filepath.Join(dir, "id_ed25519")
+	err = os.WriteFile(privateKeyPath, pem.EncodeToMemory(block), 0600)
+	assert.Nil(t, err)
+	publicKey, err = ssh.NewPublicKey(pub)
+	assert.Nil(t, err)
+	return
+}
+
+func TestAuthMethod(t *testing.T) {
+	auth, err := authMethod("https://example.org/owner/infra.git", types.Auth{})
+	assert.Nil(t, err)
+	assert.Nil(t, auth)
+
+	auth, err = authMethod("https://example.org/owner/infra.git", types.Auth{AccessToken: "my-secret"})
+	assert.Nil(t, err)
+	assert.Equal(t, &http.BasicAuth{Username: "comin", Password: "my-secret"}, auth)
+}
+
+func TestAuthMethodSsh(t *testing.T) {
+	dir := t.TempDir()
+	privateKeyPath, publicKey := writeSshPrivateKey(t, dir, "")
+
+	// The SSH private key takes precedence over the access token
+	auth, err := authMethod("git@example.org:owner/infra.git", types.Auth{
+		AccessToken:       "my-secret",
+		SshPrivateKeyPath: privateKeyPath,
+	})
+	assert.Nil(t, err)
+	assert.IsType(t, &gitssh.PublicKeys{}, auth)
+	assert.Equal(t, "git", auth.(*gitssh.PublicKeys).User)
+
+	auth, err = authMethod("ssh://gitea@example.org:2222/owner/infra.git", types.Auth{
+		SshPrivateKeyPath: privateKeyPath,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "gitea", auth.(*gitssh.PublicKeys).User)
+
+	knownHostsPath := filepath.Join(dir, "known_hosts")
+	err = os.WriteFile(knownHostsPath, []byte("example.org "+string(ssh.MarshalAuthorizedKey(publicKey))), 0644)
+	assert.Nil(t, err)
+	auth, err = authMethod("git@example.org:owner/infra.git", types.Auth{
+		SshPrivateKeyPath: privateKeyPath,
+		SshKnownHostsPath: knownHostsPath,
+	})
+	assert.Nil(t, err)
+	assert.NotNil(t, auth.(*gitssh.PublicKeys).HostKeyCallback)
+
+	_, err = authMethod("git@example.org:owner/infra.git", types.Auth{
+		SshPrivateKeyPath: privateKeyPath,
+		SshKnownHostsPath: filepath.Join(dir, "does-not-exist"),
+	})
+	assert.ErrorContains(t, err, "failed to load the SSH known hosts file")
+
+	_, err = authMethod("git@example.org:owner/infra.git", types.Auth{
+		SshPrivateKeyPath: filepath.Join(dir, "does-not-exist"),
+	})
+	assert.ErrorContains(t, err, "failed to load the SSH private key")
+}
+
+func TestAuthMethodSshPassphrase(t *testing.T) {
+	dir := t.TempDir()
+	privateKeyPath, _ := writeSshPrivateKey(t, dir, "my-passphrase")
+
+	_, err := authMethod("git@example.org:owner/infra.git", types.Auth{
+		SshPrivateKeyPath:       privateKeyPath,
+		SshPrivateKeyPassphrase: "my-passphrase",
+	})
+	assert.Nil(t, err)
+
+	_, err = authMethod("git@example.org:owner/infra.git", types.Auth{
+		SshPrivateKeyPath:       privateKeyPath,
+		SshPrivateKeyPassphrase: "wrong-passphrase",
+	})
+	assert.ErrorContains(t, err, "failed to load the SSH private key")
+}
@@ -3,6 +3,8 @@ package repository
 import (
 	"context"
 	"fmt"
+	"slices"
+	"strings"
 	"time"
 
 	"github.com/ProtonMail/go-crypto/openpgp"
@@ -10,21 +12,18 @@ import (
 	gitConfig "github.com/go-git/go-git/v5/config"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
-	"github.com/go-git/go-git/v5/plumbing/transport/http"
 	"github.com/nlewo/comin/internal/types"
 	"github.com/sirupsen/logrus"
 )
 
-func RepositoryClone(directory, url, commitId, accessToken string) error {
+func RepositoryClone(directory, url, commitId string, auth types.Auth) error {
 	options := &git.CloneOptions{
 		URL:        url,
 		NoCheckout: true,
 	}
-	if accessToken != "" {
-		options.Auth = &http.BasicAuth{
-			Username: "comin",
-			Password: accessToken,
-		}
+	var err error
+	if options.Auth, err = authMethod(url, auth); err != nil {
+		return err
 	}
 	repository, err := git.PlainClone(directory, false, options)
 	if err != nil {
@@ -112,37 +111,108 @@ func hardReset(r repository, newHead plumbing.Hash) error {
 	return nil
 }
 
-// fetch fetches the config.Remote
+// trackedBranches returns the name of the branches of a remote
+// which are used by comin.
+func trackedBranches(remote types.Remote) (branches []string) {
+	for _, name := range []string{remote.Branches.Main.Name, remote.Branches.Testing.Name} {
+		if name != "" && !slices.Contains(branches, name) {
+			branches = append(branches, name)
+		}
+	}
+	return
+}
+
+// fetchRefSpecs returns the refspecs of the tracked branches which
+// exist in the remote references.
+func fetchRefSpecs(remote types.Remote, remoteRefs []*plumbing.Reference) (refSpecs []gitConfig.RefSpec, fetched []string) {
+	for _, branch := range trackedBranches(remote) {
+		for _, ref := range remoteRefs {
+			if ref.Name() == plumbing.NewBranchReferenceName(branch) {
+				refSpecs = append(refSpecs, gitConfig.RefSpec(
+					fmt.Sprintf("+refs/heads/%s:refs/remotes/%s/%s", branch, remote.Name, branch)))
+				fetched = append(fetched, branch)
+				break
+			}
+		}
+	}
+	return
+}
+
+// pruneRemoteReferences removes the remote-tracking references of the
+// remote remoteName which don't correspond to one of the branches.
+func pruneRemoteReferences(r *git.Repository, remoteName string, branches []string) error {
+	prefix := fmt.Sprintf("refs/remotes/%s/", remoteName)
+	iter, err := r.References()
+	if err != nil {
+		return err
+	}
+	stale := make([]plumbing.ReferenceName, 0)
+	_ = iter.ForEach(func(ref *plumbing.Reference) error {
+		name := ref.Name().String()
+		if strings.HasPrefix(name, prefix) && !slices.Contains(branches, strings.TrimPrefix(name, prefix)) {
+			stale = append(stale, ref.Name())
+		}
+		return nil
+	})
+	for _, name := range stale {
+		logrus.Debugf("Pruning the stale reference '%s'", name)
+		if err := r.Storer.RemoveReference(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fetch fetches the tracked branches of the config.Remote and prunes
+// the other remote-tracking references of this remote.
 func fetch(r repository, remote types.Remote) (err error) {
 	logrus.Debugf("Fetching remote '%s'", remote.Name)
 	fetchOptions := git.FetchOptions{
 		RemoteName: remote.Name,
 	}
-	// TODO: support several authentication methods
-	if remote.Auth.AccessToken != "" {
-		fetchOptions.Auth = &http.BasicAuth{
-			// On GitLab, any non blank username is
-			// working.
-			Username: "comin",
-			Password: remote.Auth.AccessToken,
-		}
+	if fetchOptions.Auth, err = authMethod(remote.URL, remote.Auth); err != nil {
+		logrus.Errorf("Pull from remote '%s' failed: %s", remote.Name, err)
+		return fmt.Errorf("'git fetch %s' fails: '%s'", remote.Name, err)
 	}
 
 	// TODO: we should get a parent context
 	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(remote.Timeout)*time.Second)
 	defer cancel()
-	// TODO: we should only fetch tracked branches
+
+	gitRemote, err := r.Repository.Remote(remote.Name)
+	if err != nil {
+		return fmt.Errorf("'git fetch %s' fails: '%s'", remote.Name, err)
+	}
+	// Fetching a refspec of a branch which doesn't exist fails, so
+	// we only fetch tracked branches existing on the remote.
+	remoteRefs, err := gitRemote.ListContext(ctx, &git.ListOptions{Auth: fetchOptions.Auth})
+	if err != nil {
+		logrus.Errorf("Pull from remote '%s' failed: %s", remote.Name, err)
+		return fmt.Errorf("'git ls-remote %s' fails: '%s'", remote.Name, err)
+	}
+	var branches []string
+	fetchOptions.RefSpecs, branches = fetchRefSpecs(remote, remoteRefs)
+	if len(fetchOptions.RefSpecs) == 0 {
+		if err := pruneRemoteReferences(r.Repository, remote.Name, branches); err != nil {
+			logrus.Errorf("Failed to prune the references of the remote '%s': %s", remote.Name, err)
+		}
+		return fmt.Errorf("none of the branches %s exist on the remote '%s'", trackedBranches(remote), remote.Name)
+	}
+
 	err = r.Repository.FetchContext(ctx, &fetchOptions)
-	if err == nil {
-		logrus.Infof("New commits have been fetched from '%s'", remote.URL)
-		return nil
-	} else if err != git.NoErrAlreadyUpToDate {
+	if err != nil && err != git.NoErrAlreadyUpToDate {
 		logrus.Errorf("Pull from remote '%s' failed: %s", remote.Name, err)
 		return fmt.Errorf("'git fetch %s' fails: '%s'", remote.Name, err)
+	}
+	if err := pruneRemoteReferences(r.Repository, remote.Name, branches); err != nil {
+		logrus.Errorf("Failed to prune the references of the remote '%s': %s", remote.Name, err)
+	}
+	if err == nil {
+		logrus.Infof("New commits have been fetched from '%s'", remote.URL)
 	} else {
 		logrus.Debugf("No new commits have been fetched from the remote '%s'", remote.Name)
-		return nil
 	}
+	return nil
 }
 
 // isAncestor returns true when the commitId is an ancestor of the branch branchName
@@ -227,16 +297,42 @@ func headSignedBy(r *git.Repository, publicKeys []string) (signedBy *openpgp.Ent
 	if head == nil {
 		return nil, fmt.Errorf("repository HEAD should not be nil")
 	}
-	commit, err := r.CommitObject(head.Hash())
+	return commitSignedBy(r, head.Hash(), publicKeys)
+}
+
+func commitSignedBy(r *git.Repository, hash plumbing.Hash, publicKeys []string) (signedBy *openpgp.Entity, err error) {
+	commit, err := r.CommitObject(hash)
 	if err != nil {
 		return nil, err
 	}
 	for _, k := range publicKeys {
 		entity, err := commit.Verify(k)
 		if err == nil {
-			logrus.Debugf("Commit %s signed by %s", head.Hash(), entity.PrimaryIdentity().Name)
+			logrus.Debugf("Commit %s signed by %s", hash, entity.PrimaryIdentity().Name)
 			return entity, nil
 		}
 	}
-	return nil, fmt.Errorf("commit %s is not signed", head.Hash())
+	return nil, fmt.Errorf("commit %s is not signed", hash)
+}
+
+// checkProtectedBranch returns an error when the head of a protected
+// branch can not be used. If previousCommitId is not empty, the head
+// has to be on top of it. If requireSignature is true, the head has to
+// be signed by one of the publicKeys.
+func checkProtectedBranch(r repository, branchName, previousCommitId string, head plumbing.Hash, requireSignature bool) error {
+	if previousCommitId != "" {
+		previous := plumbing.NewHash(previousCommitId)
+		if err := hasNotBeenHardReset(r, branchName, &previous, &head); err != nil {
+			return fmt.Errorf("the protected branch '%s' refuses the commit %s: %s", branchName, head, err)
+		}
+	}
+	if requireSignature {
+		if len(r.gpgPubliKeys) == 0 {
+			return fmt.Errorf("the protected branch '%s' refuses the commit %s: no GPG public keys are configured to check its signature", branchName, head)
+		}
+		if _, err := commitSignedBy(r.Repository, head, r.gpgPubliKeys); err != nil {
+			return fmt.Errorf("the protected branch '%s' refuses the commit %s: it is not signed by a trusted GPG key", branchName, head)
+		}
+	}
+	return nil
 }
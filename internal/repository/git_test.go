@@ -10,6 +10,8 @@ import (
 	"github.com/go-git/go-git/v5"
 	"github.com/go-git/go-git/v5/plumbing"
 	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/nlewo/comin/internal/prometheus"
+	"github.com/nlewo/comin/internal/types"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -151,3 +153,50 @@ func TestHeadSignedBy(t *testing.T) {
 	assert.Nil(t, signedBy)
 
 }
+
+func TestFetchTrackedBranches(t *testing.T) {
+	remoteDir := t.TempDir()
+	cominRepositoryDir := t.TempDir()
+	remoteRepository, err := initRemoteRepostiory(remoteDir, false)
+	assert.Nil(t, err)
+	_, _ = commitFile(remoteRepository, remoteDir, "feature", "file-4")
+
+	remote := types.Remote{
+		Name: "r1",
+		URL:  remoteDir,
+		Branches: types.Branches{
+			Main: types.Branch{
+				Name: "main",
+			},
+			// This branch doesn't exist on the remote
+			Testing: types.Branch{
+				Name: "testing",
+			},
+		},
+		Timeout: 30,
+	}
+	r, err := New(types.GitConfig{Path: cominRepositoryDir, Remotes: []types.Remote{remote}}, "", prometheus.New())
+	assert.Nil(t, err)
+
+	// A stale reference left over by a previous fetch
+	head, _ := remoteRepository.Head()
+	err = r.Repository.Storer.SetReference(plumbing.NewHashReference("refs/remotes/r1/old-feature", head.Hash()))
+	assert.Nil(t, err)
+
+	err = fetch(*r, remote)
+	assert.Nil(t, err)
+	refs := make([]string, 0)
+	iter, _ := r.Repository.References()
+	_ = iter.ForEach(func(ref *plumbing.Reference) error {
+		refs = append(refs, ref.Name().String())
+		return nil
+	})
+	assert.Contains(t, refs, "refs/remotes/r1/main")
+	assert.NotContains(t, refs, "refs/remotes/r1/feature")
+	assert.NotContains(t, refs, "refs/remotes/r1/old-feature")
+
+	remote.Branches.Main.Name = "does-not-exist"
+	remote.Branches.Testing.Name = ""
+	err = fetch(*r, remote)
+	assert.ErrorContains(t, err, "none of the branches [does-not-exist] exist")
+}
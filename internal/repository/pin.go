@@ -0,0 +1,82 @@
+package repository
+
+import (
+	"fmt"
+
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// SetPin pins the repository to a commit: this commit is then selected
+// by Update instead of the heads of the branches. An empty commitId
+// removes the pin. This is thread safe.
+func (r *repository) SetPin(commitId string) {
+	r.pin.Store(&commitId)
+}
+
+func (r *repository) pinnedCommitId() string {
+	if commitId := r.pin.Load(); commitId != nil {
+		return *commitId
+	}
+	return ""
+}
+
+// CheckPin checks the commit can be pinned, as Update would do it with
+// the last fetched branches, and returns its full commit ID. This is
+// thread safe.
+func (r *repository) CheckPin(commitId string) (string, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	hash, _, _, err := r.checkPin(commitId)
+	if err != nil {
+		return "", err
+	}
+	return hash.String(), nil
+}
+
+// selectPin selects the pinned commit
+func (r *repository) selectPin(commitId string) error {
+	hash, commit, remote, err := r.checkPin(commitId)
+	if err != nil {
+		return err
+	}
+	r.RepositoryStatus.SelectedCommitId = hash.String()
+	r.RepositoryStatus.SelectedCommitMsg = commit.Message
+	r.RepositoryStatus.SelectedRemoteName = remote.Name
+	r.RepositoryStatus.SelectedBranchName = remote.Main.Name
+	r.RepositoryStatus.SelectedBranchIsTesting = false
+	return nil
+}
+
+// checkPin resolves the commit to pin and returns the remote of the
+// main branch it belongs to. This commit has to be the head of a main
+// branch or one of its ancestors. If this main branch is protected,
+// the commit has to be signed.
+func (r *repository) checkPin(commitId string) (*plumbing.Hash, *object.Commit, *Remote, error) {
+	hash, err := r.Repository.ResolveRevision(plumbing.Revision(commitId))
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("the pinned commit %s doesn't exist: %w", commitId, err)
+	}
+	commit, err := r.Repository.CommitObject(*hash)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("the pinned commit %s doesn't exist: %w", commitId, err)
+	}
+	for _, remote := range r.RepositoryStatus.Remotes {
+		if remote.FetchErrorMsg != "" || remote.Main.CommitId == "" {
+			continue
+		}
+		head := plumbing.NewHash(remote.Main.CommitId)
+		if *hash != head {
+			if found, err := isAncestor(r.Repository, *hash, head); err != nil || !found {
+				continue
+			}
+		}
+		if remote.Main.Protected {
+			if _, err := commitSignedBy(r.Repository, *hash, r.gpgPubliKeys); err != nil {
+				return nil, nil, nil, fmt.Errorf("the protected branch '%s' refuses the pinned commit %s: it is not signed by a trusted GPG key", remote.Main.Name, hash)
+			}
+		}
+		return hash, commit, remote, nil
+	}
+	return nil, nil, nil, fmt.Errorf("the pinned commit %s is not an ancestor of the head of a main branch", hash)
+}
@@ -0,0 +1,128 @@
+package repository
+
+import (
+	"os"
+	"testing"
+
+	"github.com/ProtonMail/go-crypto/openpgp"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/nlewo/comin/internal/prometheus"
+	"github.com/nlewo/comin/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPin(t *testing.T) {
+	dir := t.TempDir()
+	cominRepositoryDir := t.TempDir()
+	r1, _ := initRemoteRepostiory(dir, true)
+	c3 := HeadCommitId(r1)
+	gitConfig := types.GitConfig{
+		Path: cominRepositoryDir,
+		Remotes: []types.Remote{
+			{
+				Name: "r1",
+				URL:  dir,
+				Branches: types.Branches{
+					Main:    types.Branch{Name: "main"},
+					Testing: types.Branch{Name: "testing"},
+				},
+				Timeout: 30,
+			},
+		},
+	}
+	r, err := New(gitConfig, "", prometheus.New())
+	assert.Nil(t, err)
+	r.Fetch([]string{"r1"})
+	_ = r.Update()
+	assert.Equal(t, c3, r.RepositoryStatus.SelectedCommitId)
+
+	// The fetcher keeps fetching but the pinned commit is selected
+	r.SetPin(c3)
+	c4, _ := commitFile(r1, dir, "main", "file-4")
+	r.Fetch([]string{"r1"})
+	err = r.Update()
+	assert.Nil(t, err)
+	assert.Equal(t, c3, r.RepositoryStatus.SelectedCommitId)
+	assert.Equal(t, c3, HeadCommitId(r.Repository))
+	assert.Equal(t, c4, r.RepositoryStatus.Remotes[0].Main.CommitId)
+	assert.Equal(t, c3, r.RepositoryStatus.PinnedCommitId)
+
+	// A short commit ID can be pinned
+	commitId, err := r.CheckPin(c3[:8])
+	assert.Nil(t, err)
+	assert.Equal(t, c3, commitId)
+	r.SetPin(c3[:8])
+	err = r.Update()
+	assert.Nil(t, err)
+	assert.Equal(t, c3, r.RepositoryStatus.SelectedCommitId)
+
+	// A commit which is not on a main branch can not be pinned
+	cTesting, _ := commitFile(r1, dir, "testing", "file-5")
+	r.Fetch([]string{"r1"})
+	_, err = r.CheckPin(cTesting)
+	assert.ErrorContains(t, err, "is not an ancestor of the head of a main branch")
+	r.SetPin(cTesting)
+	err = r.Update()
+	assert.ErrorContains(t, err, "is not an ancestor of the head of a main branch")
+	assert.Equal(t, c3, r.RepositoryStatus.SelectedCommitId)
+	assert.Equal(t, c3, HeadCommitId(r.Repository))
+
+	_, err = r.CheckPin("not-a-commit")
+	assert.ErrorContains(t, err, "doesn't exist")
+	r.SetPin("0000000000000000000000000000000000000000")
+	err = r.Update()
+	assert.ErrorContains(t, err, "doesn't exist")
+
+	// Once unpinned, the head of the main branch is selected
+	r.SetPin("")
+	err = r.Update()
+	assert.Nil(t, err)
+	assert.Equal(t, c4, r.RepositoryStatus.SelectedCommitId)
+	assert.Equal(t, "", r.RepositoryStatus.PinnedCommitId)
+}
+
+func TestPinProtected(t *testing.T) {
+	dir := t.TempDir()
+	cominRepositoryDir := t.TempDir()
+	r1, _ := git.PlainInit(dir, false)
+	f, _ := os.Open("./test.private")
+	entityList, _ := openpgp.ReadArmoredKeyRing(f)
+	entity := entityList[0]
+	c1, _ := commitFile(r1, dir, "main", "file-1")
+	c2, _ := commitFileAndSign(r1, dir, "main", "file-2", entity)
+	c3, _ := commitFileAndSign(r1, dir, "main", "file-3", entity)
+	_ = r1.Storer.SetReference(plumbing.NewHashReference("refs/heads/main", plumbing.NewHash(c3)))
+
+	gitConfig := types.GitConfig{
+		Path:              cominRepositoryDir,
+		GpgPublicKeyPaths: []string{"./test.public"},
+		Remotes: []types.Remote{
+			{
+				Name: "r1",
+				URL:  dir,
+				Branches: types.Branches{
+					Main: types.Branch{Name: "main", Protected: true},
+				},
+				Timeout: 30,
+			},
+		},
+	}
+	r, err := New(gitConfig, "", prometheus.New())
+	assert.Nil(t, err)
+	r.Fetch([]string{"r1"})
+	_ = r.Update()
+	assert.Equal(t, c3, r.RepositoryStatus.SelectedCommitId)
+
+	r.SetPin(c2)
+	err = r.Update()
+	assert.Nil(t, err)
+	assert.Equal(t, c2, r.RepositoryStatus.SelectedCommitId)
+
+	_, err = r.CheckPin(c1)
+	assert.ErrorContains(t, err, "refuses the pinned commit")
+	r.SetPin(c1)
+	err = r.Update()
+	assert.ErrorContains(t, err, "refuses the pinned commit")
+	assert.Equal(t, c2, r.RepositoryStatus.SelectedCommitId)
+}
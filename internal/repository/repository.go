@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"os"
 	"slices"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ProtonMail/go-crypto/openpgp"
@@ -22,12 +24,24 @@ type repository struct {
 	RepositoryStatus RepositoryStatus
 	prometheus       prometheus.Prometheus
 	gpgPubliKeys     []string
+	// The pinned commit ID. This is a pointer because the
+	// repository struct is copied.
+	pin *atomic.Pointer[string]
+	// mu serializes the fetches and updates run by the fetcher
+	// with the checks of the commits to pin requested by the API
+	mu *sync.Mutex
 }
 
 type Repository interface {
 	FetchAndUpdate(ctx context.Context, remoteNames []string) (rsCh chan RepositoryStatus)
 	// GetRepositoryStatus is currently not thread safe and is only used to initialize the fetcher
 	GetRepositoryStatus() RepositoryStatus
+	// SetPin pins the repository to a commit. An empty commit ID
+	// removes the pin.
+	SetPin(commitId string)
+	// CheckPin checks a commit can be pinned and returns its full
+	// commit ID
+	CheckPin(commitId string) (string, error)
 }
 
 // repositoryStatus is the last saved repositoryStatus
@@ -48,6 +62,8 @@ func New(config types.GitConfig, mainCommitId string, prometheus prometheus.Prom
 	r = &repository{
 		prometheus:   prometheus,
 		gpgPubliKeys: gpgPublicKeys,
+		pin:          &atomic.Pointer[string]{},
+		mu:           &sync.Mutex{},
 	}
 
 	r.GitConfig = config
@@ -72,9 +88,12 @@ func (r *repository) FetchAndUpdate(ctx context.Context, remoteNames []string) (
 	rsCh = make(chan RepositoryStatus)
 	go func() {
 		// FIXME: switch to the FetchContext to clean resource up on timeout
+		r.mu.Lock()
 		r.Fetch(remoteNames)
 		_ = r.Update()
-		rsCh <- r.RepositoryStatus
+		rs := r.RepositoryStatus
+		r.mu.Unlock()
+		rsCh <- rs
 	}()
 	return rsCh
 }
@@ -105,6 +124,7 @@ func (r *repository) Fetch(remoteNames []string) {
 
 func (r *repository) Update() error {
 	selectedCommitId := ""
+	previous := r.RepositoryStatus
 
 	// We first walk on all Main branches in order to get a commit
 	// from a Main branch. Once found, we could then walk on all
@@ -128,9 +148,17 @@ func (r *repository) Update() error {
 			remote.Main.ErrorMsg = err.Error()
 			logrus.Debugf("Failed to getHeadFromRemoteAndBranch: %s", err)
 			continue
-		} else {
-			remote.Main.ErrorMsg = ""
 		}
+		if remote.Main.Protected && head.String() != remote.Main.CommitId {
+			if err = checkProtectedBranch(*r, remote.Main.Name, remote.Main.CommitId, head, true); err != nil {
+				remote.Main.ErrorMsg = err.Error()
+				remote.Main.RefusedCommitId = head.String()
+				logrus.Errorf("repository: %s", err)
+				continue
+			}
+		}
+		remote.Main.ErrorMsg = ""
+		remote.Main.RefusedCommitId = ""
 
 		remote.Main.CommitId = head.String()
 		remote.Main.CommitMsg = msg
@@ -178,9 +206,24 @@ func (r *repository) Update() error {
 			remote.Testing.ErrorMsg = err.Error()
 			logrus.Debugf("Failed to getHeadFromRemoteAndBranch: %s", err)
 			continue
-		} else {
-			remote.Testing.ErrorMsg = ""
 		}
+		// A testing commit can only supersede a protected main
+		// branch if it is signed.
+		if (remote.Testing.Protected || remote.Main.Protected) && head.String() != remote.Testing.CommitId {
+			var previousCommitId string
+			if remote.Testing.Protected {
+				previousCommitId = remote.Testing.CommitId
+			}
+			requireSignature := head.String() != r.RepositoryStatus.MainCommitId
+			if err = checkProtectedBranch(*r, remote.Testing.Name, previousCommitId, head, requireSignature); err != nil {
+				remote.Testing.ErrorMsg = err.Error()
+				remote.Testing.RefusedCommitId = head.String()
+				logrus.Errorf("repository: %s", err)
+				continue
+			}
+		}
+		remote.Testing.ErrorMsg = ""
+		remote.Testing.RefusedCommitId = ""
 
 		remote.Testing.CommitId = head.String()
 		remote.Testing.CommitMsg = msg
@@ -196,15 +239,47 @@ func (r *repository) Update() error {
 		}
 	}
 
+	// When the heads of the branches are refused, the previously
+	// selected commit is kept
+	if selectedCommitId == "" {
+		selectedCommitId = previous.SelectedCommitId
+	}
 	if selectedCommitId != "" {
 		r.RepositoryStatus.SelectedCommitId = selectedCommitId
 	}
 
-	if err := hardReset(*r, plumbing.NewHash(selectedCommitId)); err != nil {
+	// The pinned commit is selected instead of the heads of the
+	// branches. If it can not be selected, the previously selected
+	// commit is kept.
+	r.RepositoryStatus.PinnedCommitId = r.pinnedCommitId()
+	if r.RepositoryStatus.PinnedCommitId != "" {
+		if err := r.selectPin(r.RepositoryStatus.PinnedCommitId); err != nil {
+			r.RepositoryStatus.SelectedCommitId = previous.SelectedCommitId
+			r.RepositoryStatus.SelectedCommitMsg = previous.SelectedCommitMsg
+			r.RepositoryStatus.SelectedRemoteName = previous.SelectedRemoteName
+			r.RepositoryStatus.SelectedBranchName = previous.SelectedBranchName
+			r.RepositoryStatus.SelectedBranchIsTesting = previous.SelectedBranchIsTesting
+			r.RepositoryStatus.Error = err
+			r.RepositoryStatus.ErrorMsg = err.Error()
+			logrus.Errorf("repository: %s", err)
+			return err
+		}
+		selectedCommitId = r.RepositoryStatus.SelectedCommitId
+	}
+
+	if selectedCommitId == "" {
+		err := fmt.Errorf("no commit can be selected")
 		r.RepositoryStatus.Error = err
 		r.RepositoryStatus.ErrorMsg = err.Error()
 		return err
 	}
+	if head, err := r.Repository.Head(); err != nil || head.Hash().String() != selectedCommitId {
+		if err := hardReset(*r, plumbing.NewHash(selectedCommitId)); err != nil {
+			r.RepositoryStatus.Error = err
+			r.RepositoryStatus.ErrorMsg = err.Error()
+			return err
+		}
+	}
 
 	if len(r.gpgPubliKeys) > 0 {
 		r.RepositoryStatus.SelectedCommitShouldBeSigned = true
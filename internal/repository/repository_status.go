@@ -13,6 +13,9 @@ type MainBranch struct {
 	CommitMsg string `json:"commit_msg,omitempty"`
 	ErrorMsg  string `json:"error_msg,omitempty"`
 	OnTopOf   string `json:"on_top_of,omitempty"`
+	Protected bool   `json:"protected,omitempty"`
+	// The head of the protected branch refused by the last update
+	RefusedCommitId string `json:"refused_commit_id,omitempty"`
 }
 
 type TestingBranch struct {
@@ -21,6 +24,9 @@ type TestingBranch struct {
 	CommitMsg string `json:"commit_msg,omitempty"`
 	ErrorMsg  string `json:"error_msg,omitempty"`
 	OnTopOf   string `json:"on_top_of,omitempty"`
+	Protected bool   `json:"protected,omitempty"`
+	// The head of the protected branch refused by the last update
+	RefusedCommitId string `json:"refused_commit_id,omitempty"`
 }
 
 type Remote struct {
@@ -44,13 +50,15 @@ type RepositoryStatus struct {
 	SelectedCommitSigned    bool   `json:"selected_commit_signed"`
 	SelectedCommitSignedBy  string `json:"selected_commit_signed_by"`
 	// True if public keys were available when the commit has been checked out
-	SelectedCommitShouldBeSigned bool      `json:"selected_commit_should_be_signed"`
-	MainCommitId                 string    `json:"main_commit_id"`
-	MainRemoteName               string    `json:"main_remote_name"`
-	MainBranchName               string    `json:"main_branch_name"`
-	Remotes                      []*Remote `json:"remotes"`
-	Error                        error     `json:"-"`
-	ErrorMsg                     string    `json:"error_msg"`
+	SelectedCommitShouldBeSigned bool   `json:"selected_commit_should_be_signed"`
+	MainCommitId                 string `json:"main_commit_id"`
+	MainRemoteName               string `json:"main_remote_name"`
+	MainBranchName               string `json:"main_branch_name"`
+	// The commit ID the repository is pinned to
+	PinnedCommitId string    `json:"pinned_commit_id,omitempty"`
+	Remotes        []*Remote `json:"remotes"`
+	Error          error     `json:"-"`
+	ErrorMsg       string    `json:"error_msg"`
 }
 
 func NewRepositoryStatus(config types.GitConfig, mainCommitId string) RepositoryStatus {
@@ -64,10 +72,12 @@ func NewRepositoryStatus(config types.GitConfig, mainCommitId string) Repository
 
 			Url: remote.URL,
 			Main: &MainBranch{
-				Name: remote.Branches.Main.Name,
+				Name:      remote.Branches.Main.Name,
+				Protected: remote.Branches.Main.Protected,
 			},
 			Testing: &TestingBranch{
-				Name: remote.Branches.Testing.Name,
+				Name:      remote.Branches.Testing.Name,
+				Protected: remote.Branches.Testing.Protected,
 			},
 		}
 	}
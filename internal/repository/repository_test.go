@@ -786,3 +786,152 @@ func TestUpdateGpg(t *testing.T) {
 	assert.Equal(t, "", r.RepositoryStatus.SelectedCommitSignedBy)
 	assert.False(t, r.RepositoryStatus.SelectedCommitShouldBeSigned)
 }
+
+func TestProtectedMain(t *testing.T) {
+	dir := t.TempDir()
+	cominRepositoryDir := t.TempDir()
+	r1, _ := initRemoteRepostiory(dir, false)
+
+	f, _ := os.Open("./test.private")
+	entityList, _ := openpgp.ReadArmoredKeyRing(f)
+	entity := entityList[0]
+	c4, _ := commitFileAndSign(r1, dir, "main", "file-4", entity)
+
+	gitConfig := types.GitConfig{
+		Path:              cominRepositoryDir,
+		GpgPublicKeyPaths: []string{"./test.public"},
+		Remotes: []types.Remote{
+			{
+				Name: "r1",
+				URL:  dir,
+				Branches: types.Branches{
+					Main: types.Branch{
+						Name:      "main",
+						Protected: true,
+					},
+				},
+				Timeout: 30,
+			},
+		},
+	}
+	r, err := New(gitConfig, "", prometheus.New())
+	assert.Nil(t, err)
+	r.Fetch([]string{"r1"})
+	err = r.Update()
+	assert.Nil(t, err)
+	assert.Equal(t, c4, r.RepositoryStatus.SelectedCommitId)
+	assert.Equal(t, "", r.RepositoryStatus.Remotes[0].Main.ErrorMsg)
+
+	// An unsigned commit is refused and the previous commit is kept
+	c5, _ := commitFile(r1, dir, "main", "file-5")
+	r.Fetch([]string{"r1"})
+	assert.Nil(t, r.Update())
+	assert.Equal(t, c4, r.RepositoryStatus.SelectedCommitId)
+	assert.Equal(t, c4, HeadCommitId(r.Repository))
+	assert.Contains(t, r.RepositoryStatus.Remotes[0].Main.ErrorMsg, "is not signed by a trusted GPG key")
+	assert.Equal(t, c5, r.RepositoryStatus.Remotes[0].Main.RefusedCommitId)
+
+	c6, _ := commitFileAndSign(r1, dir, "main", "file-6", entity)
+	r.Fetch([]string{"r1"})
+	err = r.Update()
+	assert.Nil(t, err)
+	assert.Equal(t, c6, r.RepositoryStatus.SelectedCommitId)
+	assert.Equal(t, "", r.RepositoryStatus.Remotes[0].Main.ErrorMsg)
+	assert.Equal(t, "", r.RepositoryStatus.Remotes[0].Main.RefusedCommitId)
+
+	// A signed commit which is not on top of the previous one is refused
+	ref := plumbing.NewHashReference("refs/heads/main", plumbing.NewHash(c4))
+	_ = r1.Storer.SetReference(ref)
+	_, _ = commitFileAndSign(r1, dir, "main", "file-7", entity)
+	r.Fetch([]string{"r1"})
+	assert.Nil(t, r.Update())
+	assert.Equal(t, c6, r.RepositoryStatus.SelectedCommitId)
+	assert.Equal(t, c6, HeadCommitId(r.Repository))
+	assert.Contains(t, r.RepositoryStatus.Remotes[0].Main.ErrorMsg, "has been hard reset")
+}
+
+func TestProtectedMainWithTesting(t *testing.T) {
+	dir := t.TempDir()
+	cominRepositoryDir := t.TempDir()
+	r1, _ := initRemoteRepostiory(dir, true)
+
+	f, _ := os.Open("./test.private")
+	entityList, _ := openpgp.ReadArmoredKeyRing(f)
+	entity := entityList[0]
+	c4, _ := commitFileAndSign(r1, dir, "main", "file-4", entity)
+	ref := plumbing.NewHashReference("refs/heads/testing", plumbing.NewHash(c4))
+	_ = r1.Storer.SetReference(ref)
+
+	gitConfig := types.GitConfig{
+		Path:              cominRepositoryDir,
+		GpgPublicKeyPaths: []string{"./test.public"},
+		Remotes: []types.Remote{
+			{
+				Name: "r1",
+				URL:  dir,
+				Branches: types.Branches{
+					Main: types.Branch{
+						Name:      "main",
+						Protected: true,
+					},
+					Testing: types.Branch{
+						Name: "testing",
+					},
+				},
+				Timeout: 30,
+			},
+		},
+	}
+	r, err := New(gitConfig, "", prometheus.New())
+	assert.Nil(t, err)
+	r.Fetch([]string{"r1"})
+	err = r.Update()
+	assert.Nil(t, err)
+	assert.Equal(t, c4, r.RepositoryStatus.SelectedCommitId)
+	assert.Equal(t, "main", r.RepositoryStatus.SelectedBranchName)
+
+	// An unsigned testing commit doesn't supersede the protected main branch
+	_, _ = commitFile(r1, dir, "testing", "file-5")
+	r.Fetch([]string{"r1"})
+	err = r.Update()
+	assert.Nil(t, err)
+	assert.Equal(t, c4, r.RepositoryStatus.SelectedCommitId)
+	assert.Equal(t, "main", r.RepositoryStatus.SelectedBranchName)
+	assert.Contains(t, r.RepositoryStatus.Remotes[0].Testing.ErrorMsg, "is not signed by a trusted GPG key")
+
+	c6, _ := commitFileAndSign(r1, dir, "testing", "file-6", entity)
+	r.Fetch([]string{"r1"})
+	err = r.Update()
+	assert.Nil(t, err)
+	assert.Equal(t, c6, r.RepositoryStatus.SelectedCommitId)
+	assert.Equal(t, "testing", r.RepositoryStatus.SelectedBranchName)
+	assert.Equal(t, "", r.RepositoryStatus.Remotes[0].Testing.ErrorMsg)
+}
+
+func TestProtectedWithoutGpgKeys(t *testing.T) {
+	dir := t.TempDir()
+	cominRepositoryDir := t.TempDir()
+	_, _ = initRemoteRepostiory(dir, false)
+	gitConfig := types.GitConfig{
+		Path: cominRepositoryDir,
+		Remotes: []types.Remote{
+			{
+				Name: "r1",
+				URL:  dir,
+				Branches: types.Branches{
+					Main: types.Branch{
+						Name:      "main",
+						Protected: true,
+					},
+				},
+				Timeout: 30,
+			},
+		},
+	}
+	r, err := New(gitConfig, "", prometheus.New())
+	assert.Nil(t, err)
+	r.Fetch([]string{"r1"})
+	assert.ErrorContains(t, r.Update(), "no commit can be selected")
+	assert.Equal(t, "", r.RepositoryStatus.SelectedCommitId)
+	assert.Contains(t, r.RepositoryStatus.Remotes[0].Main.ErrorMsg, "no GPG public keys are configured")
+}
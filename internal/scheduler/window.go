@@ -0,0 +1,129 @@
+package scheduler
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/robfig/cron/v3"
+)
+
+// ValidateWindow returns an error if the window cron expression can
+// not be parsed or if its duration is not positive.
+func ValidateWindow(w types.Window) error {
+	if _, err := cron.ParseStandard(w.Cron); err != nil {
+		return fmt.Errorf("the cron expression '%s' is invalid: %w", w.Cron, err)
+	}
+	if w.Duration <= 0 {
+		return fmt.Errorf("the duration of the window '%s' has to be positive (current value: %d)", w.Cron, w.Duration)
+	}
+	return nil
+}
+
+// WindowContains returns true if t is in the window.
+func WindowContains(w types.Window, t time.Time) (bool, error) {
+	schedule, err := cron.ParseStandard(w.Cron)
+	if err != nil {
+		return false, err
+	}
+	duration := time.Duration(w.Duration) * time.Second
+	// The first opening after t-duration is the only one which
+	// could contain t.
+	opening := schedule.Next(t.Add(-duration))
+	return !opening.After(t), nil
+}
+
+// NextWindowOpening returns t if t is in one of the windows or if
+// there is no window. Otherwise, it returns the next opening of the
+// windows.
+func NextWindowOpening(windows []types.Window, t time.Time) (next time.Time, err error) {
+	if len(windows) == 0 {
+		return t, nil
+	}
+	for _, w := range windows {
+		contains, err := WindowContains(w, t)
+		if err != nil {
+			return next, err
+		}
+		if contains {
+			return t, nil
+		}
+		schedule, _ := cron.ParseStandard(w.Cron)
+		opening := schedule.Next(t)
+		if next.IsZero() || opening.Before(next) {
+			next = opening
+		}
+	}
+	return next, nil
+}
+
+// freezePeriod returns the beginning and the end of the freeze.
+func freezePeriod(f types.Freeze) (from, to time.Time, err error) {
+	from, err = parseFreezeTime(f.From, false)
+	if err != nil {
+		return
+	}
+	to, err = parseFreezeTime(f.To, true)
+	return
+}
+
+// parseFreezeTime parses a RFC 3339 timestamp or a date in the local
+// time zone. When end is true, a date is the end of the day.
+func parseFreezeTime(s string, end bool) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	t, err := time.ParseInLocation(time.DateOnly, s, time.Local)
+	if err != nil {
+		return t, fmt.Errorf("the freeze time '%s' has to be a RFC 3339 timestamp or a date (YYYY-MM-DD)", s)
+	}
+	if end {
+		t = t.AddDate(0, 0, 1)
+	}
+	return t, nil
+}
+
+// ValidateFreeze returns an error if the freeze times can not be
+// parsed or if the freeze ends before it begins.
+func ValidateFreeze(f types.Freeze) error {
+	from, to, err := freezePeriod(f)
+	if err != nil {
+		return err
+	}
+	if !to.After(from) {
+		return fmt.Errorf("the freeze from '%s' to '%s' ends before it begins", f.From, f.To)
+	}
+	return nil
+}
+
+// maxOpeningIterations bounds the search of the next deployment
+// opening, which alternates between windows and freezes.
+const maxOpeningIterations = 1000
+
+// NextDeploymentOpening returns t if t is in one of the windows (or
+// if there is no window) and is not in a freeze. Otherwise, it
+// returns the next time satisfying these conditions.
+func NextDeploymentOpening(windows []types.Window, freezes []types.Freeze, t time.Time) (time.Time, error) {
+	for i := 0; i < maxOpeningIterations; i++ {
+		next, err := NextWindowOpening(windows, t)
+		if err != nil {
+			return next, err
+		}
+		frozen := false
+		for _, f := range freezes {
+			from, to, err := freezePeriod(f)
+			if err != nil {
+				return next, err
+			}
+			if !next.Before(from) && next.Before(to) {
+				frozen = true
+				next = to
+			}
+		}
+		if !frozen && next.Equal(t) {
+			return t, nil
+		}
+		t = next
+	}
+	return t, fmt.Errorf("no deployment opening has been found after %s", t)
+}
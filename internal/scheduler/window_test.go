@@ -0,0 +1,93 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWindowContains(t *testing.T) {
+	// Every Saturday from 2:00 to 4:00
+	w := types.Window{Cron: "0 2 * * 6", Duration: 2 * 3600}
+	saturday := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+
+	contains, err := WindowContains(w, saturday.Add(time.Hour))
+	assert.Nil(t, err)
+	assert.False(t, contains)
+	contains, _ = WindowContains(w, saturday.Add(2*time.Hour))
+	assert.True(t, contains)
+	contains, _ = WindowContains(w, saturday.Add(3*time.Hour+59*time.Minute))
+	assert.True(t, contains)
+	contains, _ = WindowContains(w, saturday.Add(4*time.Hour))
+	assert.False(t, contains)
+	contains, _ = WindowContains(w, saturday.Add(24*time.Hour+3*time.Hour))
+	assert.False(t, contains)
+
+	_, err = WindowContains(types.Window{Cron: "invalid"}, saturday)
+	assert.NotNil(t, err)
+}
+
+func TestNextWindowOpening(t *testing.T) {
+	saturday := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	next, err := NextWindowOpening(nil, saturday)
+	assert.Nil(t, err)
+	assert.Equal(t, saturday, next)
+
+	windows := []types.Window{
+		{Cron: "0 2 * * 6", Duration: 3600},
+		{Cron: "0 1 * * *", Duration: 1800},
+	}
+	next, err = NextWindowOpening(windows, saturday)
+	assert.Nil(t, err)
+	assert.Equal(t, saturday.Add(time.Hour), next)
+
+	now := saturday.Add(2*time.Hour + 30*time.Minute)
+	next, _ = NextWindowOpening(windows, now)
+	assert.Equal(t, now, next)
+
+	next, _ = NextWindowOpening(windows, saturday.Add(3*time.Hour))
+	assert.Equal(t, saturday.Add(25*time.Hour), next)
+}
+
+func TestValidateWindow(t *testing.T) {
+	assert.Nil(t, ValidateWindow(types.Window{Cron: "0 2 * * 6", Duration: 3600}))
+	assert.ErrorContains(t, ValidateWindow(types.Window{Cron: "0 2 * *", Duration: 3600}), "is invalid")
+	assert.ErrorContains(t, ValidateWindow(types.Window{Cron: "@daily"}), "has to be positive")
+}
+
+func TestValidateFreeze(t *testing.T) {
+	assert.Nil(t, ValidateFreeze(types.Freeze{From: "2024-12-20", To: "2025-01-05"}))
+	assert.Nil(t, ValidateFreeze(types.Freeze{From: "2024-12-20T18:00:00Z", To: "2024-12-20"}))
+	assert.ErrorContains(t, ValidateFreeze(types.Freeze{From: "2024-12-20", To: "2024-12-19"}), "ends before it begins")
+	assert.ErrorContains(t, ValidateFreeze(types.Freeze{From: "20/12/2024", To: "2025-01-05"}), "has to be a RFC 3339 timestamp or a date")
+}
+
+func TestNextDeploymentOpening(t *testing.T) {
+	saturday := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	next, err := NextDeploymentOpening(nil, nil, saturday)
+	assert.Nil(t, err)
+	assert.Equal(t, saturday, next)
+
+	freezes := []types.Freeze{{From: "2024-05-31T00:00:00Z", To: "2024-06-01T12:00:00Z"}}
+	next, err = NextDeploymentOpening(nil, freezes, saturday)
+	assert.Nil(t, err)
+	assert.Equal(t, saturday.Add(12*time.Hour), next)
+
+	// Every day from 2:00 to 3:00. The window of Saturday is in
+	// the freeze.
+	windows := []types.Window{{Cron: "0 2 * * *", Duration: 3600}}
+	next, err = NextDeploymentOpening(windows, freezes, saturday)
+	assert.Nil(t, err)
+	assert.Equal(t, saturday.Add(26*time.Hour), next)
+
+	// The freeze ends in the middle of a window
+	freezes = []types.Freeze{{From: "2024-05-31T00:00:00Z", To: "2024-06-01T02:30:00Z"}}
+	next, _ = NextDeploymentOpening(windows, freezes, saturday)
+	assert.Equal(t, saturday.Add(2*time.Hour+30*time.Minute), next)
+
+	now := saturday.Add(26*time.Hour + 10*time.Minute)
+	next, _ = NextDeploymentOpening(windows, freezes, now)
+	assert.Equal(t, now, next)
+}
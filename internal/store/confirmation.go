@@ -0,0 +1,32 @@
+package store
+
+import (
+	"time"
+)
+
+// PendingConfirmation is recorded while a deployment is waiting for a
+// confirmation. When comin is restarted before the confirmation, the
+// wait is resumed or, if the deadline has passed, the deployment is
+// rolled back.
+type PendingConfirmation struct {
+	Deployment Deployment `json:"deployment"`
+	Deadline   time.Time  `json:"deadline"`
+}
+
+// PendingConfirmationSet records a pending confirmation. A nil
+// pendingConfirmation removes the pending confirmation. The store
+// file is committed.
+func (s *Store) PendingConfirmationSet(pendingConfirmation *PendingConfirmation) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Data.PendingConfirmation = pendingConfirmation
+	return s.commit()
+}
+
+// PendingConfirmation returns the pending confirmation or nil if no
+// deployment is waiting for a confirmation.
+func (s *Store) PendingConfirmation() *PendingConfirmation {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Data.PendingConfirmation
+}
@@ -9,6 +9,9 @@ const (
 	Running
 	Done
 	Failed
+	// RolledBack means the health checks failed after the switch
+	// and the previous deployment has been re-activated
+	RolledBack
 )
 
 func StatusToString(status Status) string {
@@ -21,6 +24,8 @@ func StatusToString(status Status) string {
 		return "done"
 	case Failed:
 		return "failed"
+	case RolledBack:
+		return "rolled-back"
 	}
 	return ""
 }
@@ -37,8 +42,53 @@ type Deployment struct {
 	ProfilePath  string `json:"profile_path"`
 	Status       Status `json:"status"`
 	Operation    string `json:"operation"`
+	// The components activated by a reboot which differ from the
+	// booted system, when the branch is deployed with the boot
+	// operation
+	RebootReasons []string `json:"reboot_reasons,omitempty"`
+	// The outpath re-activated when the deployment has been
+	// rolled back
+	RolledBackTo string `json:"rolled_back_to,omitempty"`
+	// The UUID of the past deployment whose generation has been
+	// redeployed by an operator (comin rollback)
+	RollbackOf string `json:"rollback_of,omitempty"`
+	// The outpath activated outside of comin which has been
+	// replaced by this deployment (drift reconciliation)
+	ReconciledOutPath string `json:"reconciled_outpath,omitempty"`
+	// The results of the hooks run by the deployment
+	Hooks []HookResult `json:"hooks,omitempty"`
 }
 
+// HookResult is the result of a pre or post deployment hook
+type HookResult struct {
+	// pre-deployment or post-deployment
+	Stage     string    `json:"stage"`
+	Argv      []string  `json:"argv"`
+	StartedAt time.Time `json:"started_at"`
+	EndedAt   time.Time `json:"ended_at"`
+	// The exit code is -1 if the command has not been started or
+	// has been killed
+	ExitCode int    `json:"exit_code"`
+	Output   string `json:"output"`
+	ErrorMsg string `json:"error_msg,omitempty"`
+}
+
+// IsTesting returns true if the generation of the deployment comes
+// from a testing branch, whatever the operation of this branch
 func (d Deployment) IsTesting() bool {
-	return d.Operation == "test"
+	return d.Generation.SelectedBranchIsTesting
+}
+
+// ActivatedOutPath returns the outpath activated by the deployment:
+// the outpath of its generation if it succeeded, the outpath it has
+// been rolled back to if it has been rolled back. It is empty when the
+// activated outpath is unknown, for instance if the deployment failed.
+func (d Deployment) ActivatedOutPath() string {
+	switch d.Status {
+	case Done:
+		return d.Generation.OutPath
+	case RolledBack:
+		return d.RolledBackTo
+	}
+	return ""
 }
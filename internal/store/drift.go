@@ -0,0 +1,34 @@
+package store
+
+import (
+	"time"
+)
+
+// Drift is recorded when the running system is not the outpath of the
+// last deployment, because it has been changed outside of comin (by a
+// manual nixos-rebuild switch for instance).
+type Drift struct {
+	// The outpath of the running system
+	OutPath string `json:"outpath"`
+	// The outpath of the last deployment
+	ExpectedOutPath string    `json:"expected_outpath"`
+	DeploymentUUID  string    `json:"deployment_uuid"`
+	DetectedAt      time.Time `json:"detected_at"`
+}
+
+// DriftSet records a drift. A nil drift removes the drift. The store
+// file is committed.
+func (s *Store) DriftSet(drift *Drift) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Data.Drift = drift
+	return s.commit()
+}
+
+// Drift returns the drift or nil if the running system is the one of
+// the last deployment.
+func (s *Store) Drift() *Drift {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Data.Drift
+}
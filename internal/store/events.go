@@ -0,0 +1,16 @@
+package store
+
+// GenerationUpdated is published each time a generation is updated
+type GenerationUpdated struct {
+	Generation Generation `json:"generation"`
+}
+
+func (GenerationUpdated) EventType() string { return "store.generation_updated" }
+
+// DeploymentInserted is published when a deployment is inserted in
+// the store
+type DeploymentInserted struct {
+	Deployment Deployment `json:"deployment"`
+}
+
+func (DeploymentInserted) EventType() string { return "store.deployment_inserted" }
@@ -1,6 +1,7 @@
 package store
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"strings"
@@ -9,6 +10,7 @@ import (
 	"github.com/dustin/go-humanize"
 	"github.com/google/uuid"
 	"github.com/nlewo/comin/internal/repository"
+	"github.com/nlewo/comin/internal/types"
 	"github.com/sirupsen/logrus"
 )
 
@@ -91,9 +93,17 @@ type Generation struct {
 	BuildEndedAt   time.Time   `json:"build-ended-at"`
 	BuildErr       error       `json:"-"`
 	BuildErrStr    string      `json:"build-err"`
+
+	// The differences between the closure of the running system
+	// and the closure of OutPath, computed once the generation is
+	// built
+	ClosureDiff    *types.ClosureDiff `json:"closure-diff,omitempty"`
+	ClosureDiffErr string             `json:"closure-diff-err,omitempty"`
 }
 
 func (s *Store) NewGeneration(hostname, repositoryPath, repositoryDir string, rs repository.RepositoryStatus) (g Generation) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	g = Generation{
 		UUID:                    uuid.New(),
 		FlakeUrl:                fmt.Sprintf("git+file://%s?dir=%s&rev=%s", repositoryPath, repositoryDir, rs.SelectedCommitId),
@@ -146,34 +156,108 @@ func GenerationShow(g Generation) {
 	case Built:
 		fmt.Printf("%sBuilt %s\n", padding, humanize.Time(g.BuildEndedAt))
 		fmt.Printf("%s  Outpath:  %s\n", padding, g.OutPath)
+		if g.ClosureDiffErr != "" {
+			fmt.Printf("%s  Closure diff failed: %s\n", padding, g.ClosureDiffErr)
+		} else if g.ClosureDiff != nil {
+			fmt.Printf("%s  Closure diff\n", padding)
+			for _, line := range strings.Split(strings.TrimRight(g.ClosureDiff.String(), "\n"), "\n") {
+				fmt.Printf("%s    %s\n", padding, line)
+			}
+		}
 	case BuildFailed:
 		fmt.Printf("%sBuild failed %s\n", padding, humanize.Time(g.BuildEndedAt))
 	}
 }
 
-// generationsGC garbage collects unwanted generations. This is not thread safe.
+// generationsGC garbage collects unwanted generations. The
+// generations of the last started and finished evaluations and builds
+// are always kept. The most recent other generations are kept until
+// the capacity of generations is reached. This is not thread safe.
 func (s *Store) generationsGC() {
-	alive := make([]*Generation, 0)
+	keep := make(map[*Generation]bool)
 	for _, g := range s.Generations {
 		if g == s.lastEvalStarted || g == s.lastEvalFinished || g == s.lastBuildStarted || g == s.lastBuildFinished {
-			alive = append(alive, g)
+			keep[g] = true
 		}
 	}
+	// Generations are ordered from the older to the most recent
+	for i := len(s.Generations) - 1; i >= 0 && len(keep) < s.capacityGenerations; i-- {
+		keep[s.Generations[i]] = true
+	}
+	alive := make([]*Generation, 0)
 	for _, g := range s.Generations {
-		keep := false
-		for _, a := range alive {
-			if g == a {
-				keep = true
-				break
-			}
-		}
-		if !keep {
+		if keep[g] {
+			alive = append(alive, g)
+		} else {
 			logrus.Infof("store: generation %s removed from the store", g.UUID)
 		}
 	}
 	s.Generations = alive
 }
 
+// generationsCommit persists generations in order to expose them
+// after a restart of comin and publishes the updated generation g.
+// This is not thread safe.
+func (s *Store) generationsCommit(g *Generation) {
+	if err := s.commit(); err != nil {
+		logrus.Errorf("store: could not commit generations to the store file: %s", err)
+	}
+	s.bus.Publish(GenerationUpdated{Generation: *g})
+}
+
+// loadGenerations restores generations read from the store file. An
+// evaluation or a build which was running when comin stopped is
+// considered as failed. As at runtime, the generations exceeding the
+// capacity of generations are removed. This is not thread safe.
+func (s *Store) loadGenerations(generations []*Generation) {
+	now := time.Now().UTC()
+	s.Generations = make([]*Generation, 0)
+	for _, g := range generations {
+		if g.EvalStatus == Evaluating {
+			g.EvalStatus = EvalFailed
+			g.EvalErrStr = "the evaluation has been interrupted by a restart of comin"
+			g.EvalEndedAt = now
+		}
+		if g.BuildStatus == Building {
+			g.BuildStatus = BuildFailed
+			g.BuildErrStr = "the build has been interrupted by a restart of comin"
+			g.BuildEndedAt = now
+		}
+		if g.EvalErrStr != "" {
+			g.EvalErr = errors.New(g.EvalErrStr)
+		}
+		if g.BuildErrStr != "" {
+			g.BuildErr = errors.New(g.BuildErrStr)
+		}
+
+		if g.EvalStatus != EvalInit && (s.lastEvalStarted == nil || g.EvalStartedAt.After(s.lastEvalStarted.EvalStartedAt)) {
+			s.lastEvalStarted = g
+		}
+		if (g.EvalStatus == Evaluated || g.EvalStatus == EvalFailed) && (s.lastEvalFinished == nil || g.EvalEndedAt.After(s.lastEvalFinished.EvalEndedAt)) {
+			s.lastEvalFinished = g
+		}
+		if g.BuildStatus != BuildInit && (s.lastBuildStarted == nil || g.BuildStartedAt.After(s.lastBuildStarted.BuildStartedAt)) {
+			s.lastBuildStarted = g
+		}
+		if (g.BuildStatus == Built || g.BuildStatus == BuildFailed) && (s.lastBuildFinished == nil || g.BuildEndedAt.After(s.lastBuildFinished.BuildEndedAt)) {
+			s.lastBuildFinished = g
+		}
+		s.Generations = append(s.Generations, g)
+	}
+	s.generationsGC()
+}
+
+// LastGeneration returns the generation of the last started
+// evaluation. This is thread safe.
+func (s *Store) LastGeneration() (g Generation, ok bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.lastEvalStarted == nil {
+		return
+	}
+	return *s.lastEvalStarted, true
+}
+
 func (s *Store) GenerationEvalStarted(uuid uuid.UUID) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -185,6 +269,7 @@ func (s *Store) GenerationEvalStarted(uuid uuid.UUID) error {
 	g.EvalStatus = Evaluating
 	s.lastEvalStarted = g
 	s.generationsGC()
+	s.generationsCommit(g)
 	return nil
 }
 
@@ -208,6 +293,7 @@ func (s *Store) GenerationEvalFinished(uuid uuid.UUID, drvPath, outPath, machine
 	g.EvalEndedAt = time.Now().UTC()
 	s.lastEvalFinished = g
 	s.generationsGC()
+	s.generationsCommit(g)
 	return nil
 }
 
@@ -222,6 +308,25 @@ func (s *Store) GenerationBuildStart(uuid uuid.UUID) error {
 	g.BuildStatus = Building
 	s.lastBuildStarted = g
 	s.generationsGC()
+	s.generationsCommit(g)
+	return nil
+}
+
+// GenerationClosureDiffSet sets the closure diff of a generation or
+// the error which occurred while computing it.
+func (s *Store) GenerationClosureDiffSet(uuid uuid.UUID, diff *types.ClosureDiff, diffErr error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g, err := s.generationGet(uuid)
+	if err != nil {
+		return err
+	}
+	g.ClosureDiff = diff
+	g.ClosureDiffErr = ""
+	if diffErr != nil {
+		g.ClosureDiffErr = diffErr.Error()
+	}
+	s.generationsCommit(g)
 	return nil
 }
 
@@ -254,6 +359,7 @@ func (s *Store) GenerationBuildFinished(uuid uuid.UUID, buildErr error) error {
 	}
 	s.lastBuildFinished = g
 	s.generationsGC()
+	s.generationsCommit(g)
 	return nil
 }
 
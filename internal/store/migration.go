@@ -0,0 +1,68 @@
+package store
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Version is the version of the store file schema written by this
+// comin version.
+const Version = "1"
+
+// ErrUnsupportedVersion is returned when the store file has been
+// written by a more recent comin version.
+var ErrUnsupportedVersion = errors.New("the store file version is not supported")
+
+// A migration migrates the content of a store file from a version to
+// the next one. The content is the decoded JSON object.
+type migration struct {
+	from        string
+	to          string
+	description string
+	migrate     func(content map[string]any) error
+}
+
+// migrations must be ordered: the to version of a migration is the
+// from version of the next one. The to version of the last migration
+// is Version.
+var migrations = []migration{
+	{
+		from:        "",
+		to:          "1",
+		description: "the version attribute is added",
+		migrate: func(content map[string]any) error {
+			return nil
+		},
+	},
+}
+
+// migrate migrates the content of a store file to the current
+// Version.
+func migrate(content []byte) ([]byte, error) {
+	var data map[string]any
+	if err := json.Unmarshal(content, &data); err != nil {
+		return nil, err
+	}
+	version, _ := data["version"].(string)
+	if version == Version {
+		return content, nil
+	}
+	for _, m := range migrations {
+		if m.from != version {
+			continue
+		}
+		logrus.Infof("store: migrating the store file from version '%s' to version '%s': %s", m.from, m.to, m.description)
+		if err := m.migrate(data); err != nil {
+			return nil, fmt.Errorf("failed to migrate the store file from version '%s' to version '%s': %w", m.from, m.to, err)
+		}
+		version = m.to
+		data["version"] = version
+	}
+	if version != Version {
+		return nil, fmt.Errorf("%w: version '%s' (supported version: '%s')", ErrUnsupportedVersion, version, Version)
+	}
+	return json.Marshal(data)
+}
@@ -0,0 +1,38 @@
+package store
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMigrate(t *testing.T) {
+	content, err := migrate([]byte(`{"deployments": [{"uuid": "1"}]}`))
+	assert.Nil(t, err)
+	var data Data
+	err = json.Unmarshal(content, &data)
+	assert.Nil(t, err)
+	assert.Equal(t, Version, data.Version)
+	assert.Equal(t, "1", data.Deployments[0].UUID)
+
+	content = []byte(`{"version": "1", "deployments": []}`)
+	migrated, err := migrate(content)
+	assert.Nil(t, err)
+	assert.Equal(t, content, migrated)
+
+	_, err = migrate([]byte(`{"version": "1000"}`))
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+
+	_, err = migrate([]byte(`{"version": `))
+	assert.NotNil(t, err)
+}
+
+func TestMigrationsAreOrdered(t *testing.T) {
+	version := ""
+	for _, m := range migrations {
+		assert.Equal(t, version, m.from)
+		version = m.to
+	}
+	assert.Equal(t, Version, version)
+}
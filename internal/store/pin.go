@@ -0,0 +1,28 @@
+package store
+
+import (
+	"time"
+)
+
+// Pin holds the machine on a commit while the branches keep moving
+type Pin struct {
+	CommitId string    `json:"commit_id"`
+	By       string    `json:"by"`
+	PinnedAt time.Time `json:"pinned_at"`
+}
+
+// PinSet records a pin. A nil pin removes the pin. The store file is
+// committed.
+func (s *Store) PinSet(pin *Pin) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Data.Pin = pin
+	return s.commit()
+}
+
+// Pin returns the pin or nil if the machine is not pinned.
+func (s *Store) Pin() *Pin {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Data.Pin
+}
@@ -0,0 +1,38 @@
+package store
+
+import (
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// PendingReboot is recorded when a deployment has been done with the
+// boot operation: the machine needs to be rebooted to activate it.
+type PendingReboot struct {
+	DeploymentUUID string    `json:"deployment_uuid"`
+	CommitId       string    `json:"commit_id"`
+	OutPath        string    `json:"outpath"`
+	RequestedAt    time.Time `json:"requested_at"`
+	// The boot ID of the machine when the reboot has been
+	// requested. It is used to detect the reboot of the machine.
+	BootId string `json:"boot_id"`
+}
+
+// PendingRebootSet records a pending reboot. A nil pendingReboot
+// removes the pending reboot. The store file is committed.
+func (s *Store) PendingRebootSet(pendingReboot *PendingReboot) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Data.PendingReboot = pendingReboot
+	if err := s.commit(); err != nil {
+		logrus.Errorf("store: could not commit the pending reboot to the store file: %s", err)
+	}
+}
+
+// PendingReboot returns the pending reboot or nil if no reboot is
+// pending.
+func (s *Store) PendingReboot() *PendingReboot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Data.PendingReboot
+}
@@ -4,8 +4,10 @@ import (
 	"encoding/json"
 	"errors"
 	"os"
+	"path/filepath"
 	"sync"
 
+	"github.com/nlewo/comin/internal/events"
 	"github.com/sirupsen/logrus"
 )
 
@@ -19,6 +21,17 @@ type Data struct {
 	// Deployments are order from the most recent to older
 	Deployments []Deployment  `json:"deployments"`
 	Generations []*Generation `json:"generations"`
+	// PendingReboot is not nil when a reboot is required to
+	// activate a boot deployment
+	PendingReboot *PendingReboot `json:"pending_reboot,omitempty"`
+	// Pin is not nil when the machine is pinned to a commit
+	Pin *Pin `json:"pin,omitempty"`
+	// Drift is not nil when the running system has been changed
+	// outside of comin
+	Drift *Drift `json:"drift,omitempty"`
+	// PendingConfirmation is not nil when a deployment is waiting
+	// for a confirmation
+	PendingConfirmation *PendingConfirmation `json:"pending_confirmation,omitempty"`
 }
 
 type Store struct {
@@ -28,6 +41,11 @@ type Store struct {
 	generationGcRoot string
 	capacityMain     int
 	capacityTesting  int
+	// The number of generations kept in the store
+	capacityGenerations int
+	// The updates of generations and deployments are published on
+	// the bus
+	bus *events.Bus
 
 	lastEvalStarted   *Generation
 	lastEvalFinished  *Generation
@@ -35,19 +53,21 @@ type Store struct {
 	lastBuildFinished *Generation
 }
 
-func New(filename, gcRootsDir string, capacityMain, capacityTesting int) (*Store, error) {
+func New(filename, gcRootsDir string, capacityMain, capacityTesting, capacityGenerations int, bus *events.Bus) (*Store, error) {
 	st := Store{
-		filename:         filename,
-		generationGcRoot: gcRootsDir + "/last-built-generation",
-		capacityMain:     capacityMain,
-		capacityTesting:  capacityTesting,
+		filename:            filename,
+		generationGcRoot:    gcRootsDir + "/last-built-generation",
+		capacityMain:        capacityMain,
+		capacityTesting:     capacityTesting,
+		capacityGenerations: capacityGenerations,
+		bus:                 bus,
 	}
 	if err := os.MkdirAll(gcRootsDir, os.ModeDir); err != nil {
 		return nil, err
 	}
 	st.Deployments = make([]Deployment, 0)
 	st.Generations = make([]*Generation, 0)
-	st.Version = "1"
+	st.Version = Version
 	return &st, nil
 }
 
@@ -76,6 +96,8 @@ func (s *Store) DeploymentInsertAndCommit(dpl Deployment) (ok bool, evicted Depl
 // DeploymentInsert inserts a deployment and return an evicted
 // deployment because the capacity has been reached.
 func (s *Store) DeploymentInsert(dpl Deployment) (getsEvicted bool, evicted Deployment) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	var qty, older int
 	capacity := s.capacityMain
 	if dpl.IsTesting() {
@@ -94,6 +116,7 @@ func (s *Store) DeploymentInsert(dpl Deployment) (getsEvicted bool, evicted Depl
 		s.Deployments = append(s.Deployments[:older], s.Deployments[older+1:]...)
 	}
 	s.Deployments = append([]Deployment{dpl}, s.Deployments...)
+	s.bus.Publish(DeploymentInserted{Deployment: dpl})
 	return
 }
 
@@ -108,29 +131,124 @@ func (s *Store) LastDeployment() (ok bool, d Deployment) {
 	return
 }
 
+// LastActivatedOutPath returns the outpath activated by the most
+// recent deployment which is not failed. This is the outpath to roll
+// back to when a new deployment fails.
+func (s *Store) LastActivatedOutPath() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, d := range s.Deployments {
+		if outPath := d.ActivatedOutPath(); outPath != "" {
+			return outPath
+		}
+	}
+	return ""
+}
+
+// Load loads the store file. If this file can not be read, the backup
+// file, containing the previous version of the store, is loaded
+// instead. The store file is not loaded if it has been written by a
+// more recent comin version.
 func (s *Store) Load() (err error) {
-	var data Data
-	content, err := os.ReadFile(s.filename)
-	if errors.Is(err, os.ErrNotExist) {
-		return nil
-	} else if err != nil {
+	data, err := read(s.filename)
+	filename := s.filename
+	if errors.Is(err, ErrUnsupportedVersion) {
+		return err
+	}
+	if err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			logrus.Errorf("store: could not load the store file %s: %s", s.filename, err)
+		}
+		var backupErr error
+		data, backupErr = read(s.backupFilename())
+		if backupErr != nil {
+			if errors.Is(err, os.ErrNotExist) && errors.Is(backupErr, os.ErrNotExist) {
+				return nil
+			}
+			if errors.Is(err, os.ErrNotExist) {
+				return backupErr
+			}
+			return err
+		}
+		err = nil
+		filename = s.backupFilename()
+		logrus.Warnf("store: the backup file %s has been loaded instead of the store file", filename)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Deployments = data.Deployments
+	s.Data.PendingReboot = data.PendingReboot
+	s.Data.Pin = data.Pin
+	s.Data.Drift = data.Drift
+	s.Data.PendingConfirmation = data.PendingConfirmation
+	s.loadGenerations(data.Generations)
+	logrus.Infof("Loaded %d deployments and %d generations from %s", len(s.Deployments), len(s.Generations), filename)
+	return
+}
+
+// read reads and migrates a store file
+func read(filename string) (data Data, err error) {
+	content, err := os.ReadFile(filename)
+	if err != nil {
 		return
 	}
-	err = json.Unmarshal(content, &data)
+	content, err = migrate(content)
 	if err != nil {
 		return
 	}
-	// FIXME: we should check the version
-	s.Deployments = data.Deployments
-	logrus.Infof("Loaded %d deployments from %s", len(s.Deployments), s.filename)
+	err = json.Unmarshal(content, &data)
 	return
 }
 
+func (s *Store) backupFilename() string {
+	return s.filename + ".bak"
+}
+
+// Commit writes the store to the store file. This is thread safe.
 func (s *Store) Commit() (err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commit()
+}
+
+// commit atomically writes the store to the store file: the store is
+// first written to a temporary file which then replaces the store
+// file. The previous store file is kept as a backup file. This is not
+// thread safe.
+func (s *Store) commit() (err error) {
 	content, err := json.Marshal(s)
 	if err != nil {
 		return
 	}
-	err = os.WriteFile(s.filename, content, 0644)
-	return
+	tmpFilename := s.filename + ".tmp"
+	f, err := os.OpenFile(tmpFilename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return
+	}
+	if _, err = f.Write(content); err != nil {
+		f.Close()
+		return
+	}
+	if err = f.Sync(); err != nil {
+		f.Close()
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	if _, err := os.Stat(s.filename); err == nil {
+		if err := os.Rename(s.filename, s.backupFilename()); err != nil {
+			return err
+		}
+	}
+	if err = os.Rename(tmpFilename, s.filename); err != nil {
+		return
+	}
+	// The directory is synced to persist the renames
+	dir, err := os.Open(filepath.Dir(s.filename))
+	if err != nil {
+		return
+	}
+	defer dir.Close()
+	return dir.Sync()
 }
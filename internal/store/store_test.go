@@ -1,8 +1,13 @@
 package store
 
 import (
+	"fmt"
+	"os"
 	"testing"
+	"time"
 
+	"github.com/google/uuid"
+	"github.com/nlewo/comin/internal/events"
 	"github.com/nlewo/comin/internal/repository"
 	"github.com/stretchr/testify/assert"
 )
@@ -10,11 +15,11 @@ import (
 func TestDeploymentCommitAndLoad(t *testing.T) {
 	tmp := t.TempDir()
 	filename := tmp + "/state.json"
-	s, _ := New(filename, tmp+"/gcroots", 2, 2)
+	s, _ := New(filename, tmp+"/gcroots", 2, 2, 10, nil)
 	err := s.Commit()
 	assert.Nil(t, err)
 
-	s1, _ := New(filename, tmp+"/gcroots", 2, 2)
+	s1, _ := New(filename, tmp+"/gcroots", 2, 2, 10, nil)
 	err = s1.Load()
 	assert.Nil(t, err)
 	assert.Equal(t, 0, len(s.Deployments))
@@ -23,7 +28,7 @@ func TestDeploymentCommitAndLoad(t *testing.T) {
 	_ = s.Commit()
 	assert.Nil(t, err)
 
-	s1, _ = New(filename, tmp+"/gcroots", 2, 2)
+	s1, _ = New(filename, tmp+"/gcroots", 2, 2, 10, nil)
 	err = s1.Load()
 	assert.Nil(t, err)
 	assert.Equal(t, 1, len(s.Deployments))
@@ -31,7 +36,7 @@ func TestDeploymentCommitAndLoad(t *testing.T) {
 
 func TestLastDeployment(t *testing.T) {
 	tmp := t.TempDir()
-	s, _ := New("state.json", tmp+"/gcroots", 2, 2)
+	s, _ := New("state.json", tmp+"/gcroots", 2, 2, 10, nil)
 	ok, _ := s.LastDeployment()
 	assert.False(t, ok)
 	s.DeploymentInsert(Deployment{UUID: "1", Operation: "switch"})
@@ -41,9 +46,24 @@ func TestLastDeployment(t *testing.T) {
 	assert.Equal(t, "2", last.UUID)
 }
 
+func TestLastActivatedOutPath(t *testing.T) {
+	tmp := t.TempDir()
+	s, _ := New("state.json", tmp+"/gcroots", 5, 5, 10, nil)
+	assert.Equal(t, "", s.LastActivatedOutPath())
+	s.DeploymentInsert(Deployment{UUID: "1", Operation: "switch", Status: Done, Generation: Generation{OutPath: "out-1"}})
+	s.DeploymentInsert(Deployment{UUID: "2", Operation: "switch", Status: Failed, Generation: Generation{OutPath: "out-2"}})
+	assert.Equal(t, "out-1", s.LastActivatedOutPath())
+	s.DeploymentInsert(Deployment{UUID: "3", Operation: "switch", Status: RolledBack, RolledBackTo: "out-1", Generation: Generation{OutPath: "out-3"}})
+	s.DeploymentInsert(Deployment{UUID: "4", Operation: "switch", Status: Failed, Generation: Generation{OutPath: "out-4"}})
+	assert.Equal(t, "out-1", s.LastActivatedOutPath())
+	s.DeploymentInsert(Deployment{UUID: "5", Operation: "switch", Status: Done, Generation: Generation{OutPath: "out-5"}})
+	assert.Equal(t, "out-5", s.LastActivatedOutPath())
+}
+
 func TestDeploymentInsert(t *testing.T) {
 	tmp := t.TempDir()
-	s, _ := New("state.json", tmp+"/gcroots", 2, 2)
+	s, _ := New("state.json", tmp+"/gcroots", 2, 2, 10, nil)
+	testingGeneration := Generation{SelectedBranchIsTesting: true}
 	var hasEvicted bool
 	var evicted Deployment
 	hasEvicted, _ = s.DeploymentInsert(Deployment{UUID: "1", Operation: "switch"})
@@ -59,16 +79,16 @@ func TestDeploymentInsert(t *testing.T) {
 	}
 	assert.Equal(t, expected, s.DeploymentList())
 
-	hasEvicted, _ = s.DeploymentInsert(Deployment{UUID: "4", Operation: "test"})
+	hasEvicted, _ = s.DeploymentInsert(Deployment{UUID: "4", Operation: "test", Generation: testingGeneration})
 	assert.False(t, hasEvicted)
-	hasEvicted, _ = s.DeploymentInsert(Deployment{UUID: "5", Operation: "test"})
+	hasEvicted, _ = s.DeploymentInsert(Deployment{UUID: "5", Operation: "test", Generation: testingGeneration})
 	assert.False(t, hasEvicted)
-	hasEvicted, evicted = s.DeploymentInsert(Deployment{UUID: "6", Operation: "test"})
+	hasEvicted, evicted = s.DeploymentInsert(Deployment{UUID: "6", Operation: "test", Generation: testingGeneration})
 	assert.True(t, hasEvicted)
 	assert.Equal(t, "4", evicted.UUID)
 	expected = []Deployment{
-		{UUID: "6", Operation: "test"},
-		{UUID: "5", Operation: "test"},
+		{UUID: "6", Operation: "test", Generation: testingGeneration},
+		{UUID: "5", Operation: "test", Generation: testingGeneration},
 		{UUID: "3", Operation: "switch"},
 		{UUID: "2", Operation: "switch"},
 	}
@@ -82,8 +102,266 @@ func TestDeploymentInsert(t *testing.T) {
 	assert.Equal(t, "3", evicted.UUID)
 }
 
+func TestDeploymentInsertByBranch(t *testing.T) {
+	tmp := t.TempDir()
+	s, _ := New("state.json", tmp+"/gcroots", 1, 2, 10, nil)
+	testingGeneration := Generation{SelectedBranchIsTesting: true}
+	// The capacity of a deployment depends on its branch, not on
+	// its operation: a testing branch can be deployed with switch
+	// or boot, and a main branch with test.
+	hasEvicted, _ := s.DeploymentInsert(Deployment{UUID: "1", Operation: "test"})
+	assert.False(t, hasEvicted)
+	hasEvicted, _ = s.DeploymentInsert(Deployment{UUID: "2", Operation: "switch", Generation: testingGeneration})
+	assert.False(t, hasEvicted)
+	hasEvicted, _ = s.DeploymentInsert(Deployment{UUID: "3", Operation: "boot", Generation: testingGeneration})
+	assert.False(t, hasEvicted)
+	hasEvicted, evicted := s.DeploymentInsert(Deployment{UUID: "4", Operation: "test", Generation: testingGeneration})
+	assert.True(t, hasEvicted)
+	assert.Equal(t, "2", evicted.UUID)
+	hasEvicted, evicted = s.DeploymentInsert(Deployment{UUID: "5", Operation: "boot"})
+	assert.True(t, hasEvicted)
+	assert.Equal(t, "1", evicted.UUID)
+	var uuids []string
+	for _, d := range s.DeploymentList() {
+		uuids = append(uuids, d.UUID)
+	}
+	assert.Equal(t, []string{"5", "4", "3"}, uuids)
+}
+
 func TestNewGeneration(t *testing.T) {
 	tmp := t.TempDir()
-	s, _ := New(tmp+"/filename", tmp+"/gcroots", 2, 2)
+	s, _ := New(tmp+"/filename", tmp+"/gcroots", 2, 2, 10, nil)
 	s.NewGeneration("hostname", "repositoryPath", "repositoryDir", repository.RepositoryStatus{})
 }
+
+func TestGenerationsCommitAndLoad(t *testing.T) {
+	tmp := t.TempDir()
+	filename := tmp + "/state.json"
+	s, _ := New(filename, tmp+"/gcroots", 2, 2, 10, nil)
+	built := s.NewGeneration("hostname", "repositoryPath", "repositoryDir", repository.RepositoryStatus{SelectedCommitId: "id-1"})
+	_ = s.GenerationEvalStarted(built.UUID)
+	_ = s.GenerationEvalFinished(built.UUID, "drv-path", "out-path", "", nil)
+	_ = s.GenerationBuildStart(built.UUID)
+	_ = s.GenerationBuildFinished(built.UUID, nil)
+
+	s1, _ := New(filename, tmp+"/gcroots", 2, 2, 10, nil)
+	err := s1.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(s1.Generations))
+	g, ok := s1.LastGeneration()
+	assert.True(t, ok)
+	assert.Equal(t, built.UUID, g.UUID)
+	assert.Equal(t, Built, g.BuildStatus)
+	assert.Equal(t, "out-path", g.OutPath)
+
+	failed := s.NewGeneration("hostname", "repositoryPath", "repositoryDir", repository.RepositoryStatus{SelectedCommitId: "id-2"})
+	_ = s.GenerationEvalStarted(failed.UUID)
+	_ = s.GenerationEvalFinished(failed.UUID, "", "", "", fmt.Errorf("an error occured"))
+
+	s1, _ = New(filename, tmp+"/gcroots", 2, 2, 10, nil)
+	err = s1.Load()
+	assert.Nil(t, err)
+	// The built generation is kept because it is the last built one
+	assert.Equal(t, 2, len(s1.Generations))
+	g, _ = s1.LastGeneration()
+	assert.Equal(t, failed.UUID, g.UUID)
+	assert.Equal(t, EvalFailed, g.EvalStatus)
+	assert.ErrorContains(t, g.EvalErr, "an error occured")
+}
+
+func TestGenerationsRetention(t *testing.T) {
+	tmp := t.TempDir()
+	filename := tmp + "/state.json"
+	s, _ := New(filename, tmp+"/gcroots", 2, 2, 10, nil)
+	var uuids []uuid.UUID
+	for i := 0; i < 5; i++ {
+		g := s.NewGeneration("hostname", "repositoryPath", "repositoryDir", repository.RepositoryStatus{SelectedCommitId: fmt.Sprintf("id-%d", i)})
+		_ = s.GenerationEvalStarted(g.UUID)
+		if i == 0 {
+			_ = s.GenerationEvalFinished(g.UUID, "drv-path", "out-path", "", nil)
+			_ = s.GenerationBuildStart(g.UUID)
+			_ = s.GenerationBuildFinished(g.UUID, nil)
+		} else {
+			_ = s.GenerationEvalFinished(g.UUID, "", "", "", fmt.Errorf("an error occured"))
+		}
+		uuids = append(uuids, g.UUID)
+	}
+	assert.Equal(t, 5, len(s.Generations))
+
+	generationUUIDs := func(s *Store) (res []uuid.UUID) {
+		for _, g := range s.Generations {
+			res = append(res, g.UUID)
+		}
+		return
+	}
+
+	// The most recent generations are kept up to the capacity
+	s1, _ := New(filename, tmp+"/gcroots", 2, 2, 3, nil)
+	assert.Nil(t, s1.Load())
+	assert.Equal(t, []uuid.UUID{uuids[0], uuids[3], uuids[4]}, generationUUIDs(s1))
+
+	// The last built generation is kept beyond the capacity
+	s1, _ = New(filename, tmp+"/gcroots", 2, 2, 1, nil)
+	assert.Nil(t, s1.Load())
+	assert.Equal(t, []uuid.UUID{uuids[0], uuids[4]}, generationUUIDs(s1))
+}
+
+func TestStoreEvents(t *testing.T) {
+	tmp := t.TempDir()
+	bus := events.New()
+	sub := bus.Subscribe()
+	s, _ := New(tmp+"/state.json", tmp+"/gcroots", 2, 2, 10, bus)
+	g := s.NewGeneration("hostname", "repositoryPath", "repositoryDir", repository.RepositoryStatus{SelectedCommitId: "id-1"})
+	_ = s.GenerationEvalStarted(g.UUID)
+	_ = s.GenerationEvalFinished(g.UUID, "drv-path", "out-path", "", nil)
+
+	updated := events.Next[GenerationUpdated](sub)
+	assert.Equal(t, g.UUID, updated.Generation.UUID)
+	assert.Equal(t, Evaluating, updated.Generation.EvalStatus)
+	updated = events.Next[GenerationUpdated](sub)
+	assert.Equal(t, Evaluated, updated.Generation.EvalStatus)
+	assert.Equal(t, "out-path", updated.Generation.OutPath)
+
+	s.DeploymentInsert(Deployment{UUID: "1", Generation: updated.Generation})
+	inserted := events.Next[DeploymentInserted](sub)
+	assert.Equal(t, "1", inserted.Deployment.UUID)
+}
+
+func TestGenerationsLoadInterrupted(t *testing.T) {
+	tmp := t.TempDir()
+	filename := tmp + "/state.json"
+	s, _ := New(filename, tmp+"/gcroots", 2, 2, 10, nil)
+	evaluating := s.NewGeneration("hostname", "repositoryPath", "repositoryDir", repository.RepositoryStatus{SelectedCommitId: "id-1"})
+	_ = s.GenerationEvalStarted(evaluating.UUID)
+
+	s1, _ := New(filename, tmp+"/gcroots", 2, 2, 10, nil)
+	err := s1.Load()
+	assert.Nil(t, err)
+	g, _ := s1.LastGeneration()
+	assert.Equal(t, EvalFailed, g.EvalStatus)
+	assert.ErrorContains(t, g.EvalErr, "interrupted")
+
+	building := s.NewGeneration("hostname", "repositoryPath", "repositoryDir", repository.RepositoryStatus{SelectedCommitId: "id-2"})
+	_ = s.GenerationEvalStarted(building.UUID)
+	_ = s.GenerationEvalFinished(building.UUID, "drv-path", "out-path", "", nil)
+	_ = s.GenerationBuildStart(building.UUID)
+
+	s1, _ = New(filename, tmp+"/gcroots", 2, 2, 10, nil)
+	err = s1.Load()
+	assert.Nil(t, err)
+	g, _ = s1.LastGeneration()
+	assert.Equal(t, building.UUID, g.UUID)
+	assert.Equal(t, Evaluated, g.EvalStatus)
+	assert.Equal(t, BuildFailed, g.BuildStatus)
+	assert.ErrorContains(t, g.BuildErr, "interrupted")
+}
+
+func TestCommitKeepsBackup(t *testing.T) {
+	tmp := t.TempDir()
+	filename := tmp + "/state.json"
+	s, _ := New(filename, tmp+"/gcroots", 2, 2, 10, nil)
+	s.DeploymentInsert(Deployment{UUID: "1", Operation: "switch"})
+	err := s.Commit()
+	assert.Nil(t, err)
+	assert.NoFileExists(t, filename+".bak")
+
+	s.DeploymentInsert(Deployment{UUID: "2", Operation: "switch"})
+	err = s.Commit()
+	assert.Nil(t, err)
+	assert.NoFileExists(t, filename+".tmp")
+
+	backup, err := read(filename + ".bak")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(backup.Deployments))
+	data, err := read(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(data.Deployments))
+}
+
+func TestLoadFallbackToBackup(t *testing.T) {
+	tmp := t.TempDir()
+	filename := tmp + "/state.json"
+	s, _ := New(filename, tmp+"/gcroots", 2, 2, 10, nil)
+	s.DeploymentInsert(Deployment{UUID: "1", Operation: "switch"})
+	_ = s.Commit()
+	s.DeploymentInsert(Deployment{UUID: "2", Operation: "switch"})
+	_ = s.Commit()
+
+	// This simulates a partial write of the store file
+	err := os.WriteFile(filename, []byte(`{"version": "1", "deploym`), 0644)
+	assert.Nil(t, err)
+	s1, _ := New(filename, tmp+"/gcroots", 2, 2, 10, nil)
+	err = s1.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(s1.Deployments))
+
+	// This simulates a crash between the two renames of a commit
+	err = os.Remove(filename)
+	assert.Nil(t, err)
+	s1, _ = New(filename, tmp+"/gcroots", 2, 2, 10, nil)
+	err = s1.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(s1.Deployments))
+
+	err = os.WriteFile(filename+".bak", []byte(`{"version": "1", "deploym`), 0644)
+	assert.Nil(t, err)
+	s1, _ = New(filename, tmp+"/gcroots", 2, 2, 10, nil)
+	err = s1.Load()
+	assert.NotNil(t, err)
+}
+
+func TestLoadUnsupportedVersion(t *testing.T) {
+	tmp := t.TempDir()
+	filename := tmp + "/state.json"
+	s, _ := New(filename, tmp+"/gcroots", 2, 2, 10, nil)
+	s.DeploymentInsert(Deployment{UUID: "1", Operation: "switch"})
+	_ = s.Commit()
+	_ = s.Commit()
+	err := os.WriteFile(filename, []byte(`{"version": "1000", "deployments": []}`), 0644)
+	assert.Nil(t, err)
+
+	// The backup file is not loaded because the store file has
+	// been written by a more recent comin version
+	s1, _ := New(filename, tmp+"/gcroots", 2, 2, 10, nil)
+	err = s1.Load()
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+	assert.Equal(t, 0, len(s1.Deployments))
+}
+
+func TestPinCommitAndLoad(t *testing.T) {
+	tmp := t.TempDir()
+	filename := tmp + "/state.json"
+	s, _ := New(filename, tmp+"/gcroots", 2, 2, 10, nil)
+	assert.Nil(t, s.Pin())
+	pinnedAt := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	err := s.PinSet(&Pin{CommitId: "commit-1", By: "alice", PinnedAt: pinnedAt})
+	assert.Nil(t, err)
+
+	s1, _ := New(filename, tmp+"/gcroots", 2, 2, 10, nil)
+	err = s1.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, &Pin{CommitId: "commit-1", By: "alice", PinnedAt: pinnedAt}, s1.Pin())
+
+	err = s1.PinSet(nil)
+	assert.Nil(t, err)
+	s2, _ := New(filename, tmp+"/gcroots", 2, 2, 10, nil)
+	_ = s2.Load()
+	assert.Nil(t, s2.Pin())
+}
+
+func TestPendingConfirmationCommitAndLoad(t *testing.T) {
+	tmp := t.TempDir()
+	s, _ := New(tmp+"/state.json", tmp+"/gcroots", 1, 1, 10, nil)
+	assert.Nil(t, s.PendingConfirmation())
+	deadline := time.Now().UTC().Truncate(time.Second)
+	err := s.PendingConfirmationSet(&PendingConfirmation{Deployment: Deployment{UUID: "dpl-1", Status: Done}, Deadline: deadline})
+	assert.Nil(t, err)
+
+	s1, _ := New(tmp+"/state.json", tmp+"/gcroots", 1, 1, 10, nil)
+	assert.Nil(t, s1.Load())
+	assert.Equal(t, "dpl-1", s1.PendingConfirmation().Deployment.UUID)
+	assert.True(t, deadline.Equal(s1.PendingConfirmation().Deadline))
+
+	assert.Nil(t, s1.PendingConfirmationSet(nil))
+	assert.Nil(t, s1.PendingConfirmation())
+}
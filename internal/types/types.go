@@ -1,5 +1,12 @@
 package types
 
+import (
+	"fmt"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+)
+
 type Remote struct {
 	Name     string
 	URL      string
@@ -24,14 +31,39 @@ type GitConfig struct {
 }
 
 type Auth struct {
-	AccessToken     string
+	AccessToken     string `yaml:"-"`
 	AccessTokenPath string `yaml:"access_token_path"`
+	// The path of a SSH private key, such as a deploy key. When
+	// set, the SSH transport is used instead of the access token.
+	SshPrivateKeyPath string `yaml:"ssh_private_key_path"`
+	// The path of a file containing the SSH private key passphrase
+	SshPrivateKeyPassphrasePath string `yaml:"ssh_private_key_passphrase_path"`
+	SshPrivateKeyPassphrase     string `yaml:"-"`
+	// The path of a known_hosts file used to verify the remote
+	// host key. If empty, the system known_hosts files are used.
+	SshKnownHostsPath string `yaml:"ssh_known_hosts_path"`
 }
 
 type Branch struct {
 	Name string `yaml:"name"`
-	// TODO: use it
+	// A protected branch only accepts commits signed by one of the
+	// GPG public keys and can not be hard reset. A testing branch
+	// can only supersede a protected main branch with a signed
+	// commit.
 	Protected bool `yaml:"protected"`
+	// The switch-to-configuration operation used to deploy the
+	// branch: switch, test or boot. It defaults to switch for the
+	// main branch and to test for the testing branch. When boot
+	// is used, the machine is rebooted during a reboot window.
+	Operation string `yaml:"operation"`
+	// The windows during which the branch can be deployed. It can
+	// be deployed at any time when no window is configured.
+	Windows []Window `yaml:"windows"`
+	// The periods during which the branch can not be deployed
+	Freezes []Freeze `yaml:"freezes"`
+	// The generations of the branch are only deployed once
+	// approved by an operator.
+	RequireApproval bool `yaml:"require_approval"`
 }
 
 type Branches struct {
@@ -42,16 +74,268 @@ type Branches struct {
 type HttpServer struct {
 	ListenAddress string `yaml:"listen_address"`
 	Port          int    `yaml:"port"`
+	// The path of a file containing the bearer token required by
+	// the TCP listener. No token is required when it is empty.
+	TokenPath string `yaml:"token_path"`
+	Token     string `yaml:"-"`
+	// An optional Unix socket listener. It is only supported by
+	// the API server.
+	UnixSocket UnixSocket `yaml:"unix_socket"`
+	// The TCP listener serves HTTPS when a certificate is
+	// configured
+	TLS TLS `yaml:"tls"`
+}
+
+// TLS configures the certificate of a listener. The certificate, the
+// key and the client CA are reloaded when their files change.
+type TLS struct {
+	CertPath string `yaml:"cert_path"`
+	KeyPath  string `yaml:"key_path"`
+	// When set, the clients have to present a certificate signed
+	// by this CA (mTLS)
+	ClientCAPath string `yaml:"client_ca_path"`
+}
+
+// UnixSocket is a listener whose clients are authorized by their
+// peer credentials. The root user is always allowed.
+type UnixSocket struct {
+	// The socket is not created when the path is empty
+	Path        string   `yaml:"path"`
+	AllowedUids []uint32 `yaml:"allowed_uids"`
+	AllowedGids []uint32 `yaml:"allowed_gids"`
+}
+
+type Builder struct {
+	// The evaluation timeout in seconds
+	EvalTimeout int `yaml:"eval_timeout"`
+	// The build timeout in seconds
+	BuildTimeout int `yaml:"build_timeout"`
+}
+
+type Store struct {
+	// The number of deployments of main branches kept in the store
+	CapacityMain int `yaml:"capacity_main"`
+	// The number of deployments of testing branches kept in the store
+	CapacityTesting int `yaml:"capacity_testing"`
+	// The number of generations kept in the store. The generations
+	// of the last evaluations and builds are kept even beyond this
+	// capacity.
+	CapacityGenerations int `yaml:"capacity_generations"`
+}
+
+type Webhook struct {
+	// The path of a file containing the secret used to
+	// authenticate push events. The webhook endpoint is disabled
+	// when no secret is configured.
+	SecretPath string `yaml:"secret_path"`
+	Secret     string `yaml:"-"`
+}
+
+// Window is a time window opening at each activation of the cron
+// expression (such as "0 2 * * 6") for Duration seconds.
+type Window struct {
+	Cron     string `yaml:"cron"`
+	Duration int    `yaml:"duration"`
+}
+
+// Freeze is a period during which no deployment is done. From and To
+// are RFC 3339 timestamps (such as "2024-12-20T18:00:00+01:00") or
+// dates (such as "2024-12-20"). A To date includes the whole day.
+type Freeze struct {
+	From   string `yaml:"from"`
+	To     string `yaml:"to"`
+	Reason string `yaml:"reason"`
+}
+
+type Reboot struct {
+	// The windows during which comin can reboot the machine after
+	// a boot deployment. The machine can be rebooted at any time
+	// when no window is configured.
+	Windows []Window `yaml:"windows"`
+}
+
+// HealthChecks are run after a switch. If they don't succeed before
+// the timeout, the previous deployment is re-activated.
+type HealthChecks struct {
+	// The delay in seconds for the health checks to succeed
+	Timeout int `yaml:"timeout"`
+	// The delay in seconds between two attempts
+	Interval int `yaml:"interval"`
+	// A command, with its arguments, which has to exit
+	// successfully
+	Argv []string `yaml:"argv"`
+	// An URL which has to respond with a 2xx status code
+	HttpUrl string `yaml:"http_url"`
+	// No systemd unit has to be in the failed state
+	NoFailedUnits bool `yaml:"no_failed_units"`
+}
+
+// Confirmation requires a deployment to be confirmed after a
+// switch. If it is not confirmed before the timeout, the previous
+// deployment is re-activated.
+type Confirmation struct {
+	Enable bool `yaml:"enable"`
+	// The delay in seconds to confirm the deployment
+	Timeout int `yaml:"timeout"`
+	// The deployment is confirmed when this URL responds with a
+	// 2xx status code. Otherwise, it has to be confirmed by an
+	// operator.
+	Url string `yaml:"url"`
+}
+
+// Hook is a command run before or after a deployment
+type Hook struct {
+	// The command and its arguments
+	Argv []string `yaml:"argv"`
+	// The delay in seconds for the command to finish
+	Timeout int `yaml:"timeout"`
+}
+
+// Hooks are run in order. A failing pre-deployment hook aborts the
+// deployment. The post-deployment hooks are run after each deployment,
+// even if it failed.
+type Hooks struct {
+	PreDeployment  []Hook `yaml:"pre_deployment"`
+	PostDeployment []Hook `yaml:"post_deployment"`
+}
+
+// Drift is the detection of changes of the running system done
+// outside of comin, such as a manual nixos-rebuild switch.
+type Drift struct {
+	// The delay in seconds between two checks of the running
+	// system
+	Interval int `yaml:"interval"`
+	// alert only reports the drift, reconcile also re-activates
+	// the generation of the last deployment
+	Policy string `yaml:"policy"`
+}
+
+// BuildProgress is the progress of a build, reported by Nix with the
+// internal-json log format.
+type BuildProgress struct {
+	DerivationsBuilt int   `json:"derivations_built"`
+	DerivationsTotal int   `json:"derivations_total"`
+	PathsDownloaded  int   `json:"paths_downloaded"`
+	PathsTotal       int   `json:"paths_total"`
+	BytesDownloaded  int64 `json:"bytes_downloaded"`
+	BytesTotal       int64 `json:"bytes_total"`
+	// The derivations being built
+	RunningBuilds []string `json:"running_builds"`
+}
+
+// Notifier sends a message on the lifecycle events of comin, such as
+// a failed build or a finished deployment.
+type Notifier struct {
+	// The backend of the notifier: webhook, matrix, ntfy, slack or
+	// smtp
+	Type string `yaml:"type"`
+	// The events sending a message. Every event sends a message
+	// when it is empty.
+	Events []string `yaml:"events"`
+	// A Go text/template rendering the message from the event. A
+	// default message is sent when it is empty.
+	Template string `yaml:"template"`
+	// The URL of the JSON webhook, of the ntfy topic or of the
+	// Slack-compatible incoming webhook
+	URL string `yaml:"url"`
+	// The path of a file containing the Matrix or ntfy access
+	// token
+	TokenPath string `yaml:"token_path"`
+	Token     string `yaml:"-"`
+	// The Matrix homeserver URL and room ID
+	Homeserver string       `yaml:"homeserver"`
+	RoomId     string       `yaml:"room_id"`
+	SMTP       NotifierSMTP `yaml:"smtp"`
+	// The delay in seconds after which the sending of a message
+	// is canceled
+	Timeout int `yaml:"timeout"`
+}
+
+type NotifierSMTP struct {
+	Host     string `yaml:"host"`
+	Port     int    `yaml:"port"`
+	Username string `yaml:"username"`
+	// The path of a file containing the SMTP password
+	PasswordPath string   `yaml:"password_path"`
+	Password     string   `yaml:"-"`
+	From         string   `yaml:"from"`
+	To           []string `yaml:"to"`
+}
+
+// PackageChange is a package whose versions or size differ between
+// two closures. The versions of a package found in both closures are
+// not listed.
+type PackageChange struct {
+	Name        string   `json:"name"`
+	OldVersions []string `json:"old_versions,omitempty"`
+	NewVersions []string `json:"new_versions,omitempty"`
+	// The size difference in bytes
+	SizeDelta int64 `json:"size_delta"`
+}
+
+// ClosureDiff is the differences between the closure of the running
+// system and the closure of a generation, in the style of nix store
+// diff-closures.
+type ClosureDiff struct {
+	Added   []PackageChange `json:"added"`
+	Removed []PackageChange `json:"removed"`
+	// The packages whose versions changed
+	Upgraded []PackageChange `json:"upgraded"`
+	// The size difference of the closures in bytes
+	SizeDelta int64 `json:"size_delta"`
+}
+
+func showVersions(versions []string) string {
+	if len(versions) == 0 {
+		return "∅"
+	}
+	return strings.Join(versions, ", ")
+}
+
+func showSizeDelta(delta int64) string {
+	if delta < 0 {
+		return "-" + humanize.IBytes(uint64(-delta))
+	}
+	return "+" + humanize.IBytes(uint64(delta))
+}
+
+// String returns a line per added, removed or upgraded package
+// followed by the closure size difference.
+func (d ClosureDiff) String() string {
+	var b strings.Builder
+	for _, c := range d.Added {
+		fmt.Fprintf(&b, "[A] %s: %s (%s)\n", c.Name, showVersions(c.NewVersions), showSizeDelta(c.SizeDelta))
+	}
+	for _, c := range d.Removed {
+		fmt.Fprintf(&b, "[R] %s: %s (%s)\n", c.Name, showVersions(c.OldVersions), showSizeDelta(c.SizeDelta))
+	}
+	for _, c := range d.Upgraded {
+		fmt.Fprintf(&b, "[U] %s: %s → %s (%s)\n", c.Name, showVersions(c.OldVersions), showVersions(c.NewVersions), showSizeDelta(c.SizeDelta))
+	}
+	fmt.Fprintf(&b, "Closure size: %s\n", showSizeDelta(d.SizeDelta))
+	return b.String()
 }
 
+// Configuration is read from the YAML configuration file. The secrets
+// can not be set in this file: they are only read from the files of
+// the *_path attributes.
 type Configuration struct {
-	Hostname              string     `yaml:"hostname"`
-	StateDir              string     `yaml:"state_dir"`
-	StateFilepath         string     `yaml:"state_filepath"`
-	FlakeSubdirectory     string     `yaml:"flake_subdirectory"`
-	Remotes               []Remote   `yaml:"remotes"`
-	ApiServer             HttpServer `yaml:"api_server"`
-	Exporter              HttpServer `yaml:"exporter"`
-	GpgPublicKeyPaths     []string   `yaml:"gpg_public_key_paths"`
-	PostDeploymentCommand string     `yaml:"post_deployment_command"`
+	Hostname              string       `yaml:"hostname"`
+	StateDir              string       `yaml:"state_dir"`
+	StateFilepath         string       `yaml:"state_filepath"`
+	FlakeSubdirectory     string       `yaml:"flake_subdirectory"`
+	Remotes               []Remote     `yaml:"remotes"`
+	ApiServer             HttpServer   `yaml:"api_server"`
+	Exporter              HttpServer   `yaml:"exporter"`
+	GpgPublicKeyPaths     []string     `yaml:"gpg_public_key_paths"`
+	PostDeploymentCommand string       `yaml:"post_deployment_command"`
+	Webhook               Webhook      `yaml:"webhook"`
+	Builder               Builder      `yaml:"builder"`
+	Store                 Store        `yaml:"store"`
+	HealthChecks          HealthChecks `yaml:"health_checks"`
+	Confirmation          Confirmation `yaml:"confirmation"`
+	Reboot                Reboot       `yaml:"reboot"`
+	Hooks                 Hooks        `yaml:"hooks"`
+	Drift                 Drift        `yaml:"drift"`
+	Notifiers             []Notifier   `yaml:"notifiers"`
 }
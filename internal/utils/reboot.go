@@ -1,28 +1,128 @@
 package utils
 
 import (
+	"errors"
+	"fmt"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 
 	"github.com/sirupsen/logrus"
 )
 
-// NeedToReboot return true when the current deployed kernel is not
-// the booted kernel. Note we should implement something smarter such
-// as described in
-// https://discourse.nixos.org/t/nixos-needsreboot-determine-if-you-need-to-reboot-your-nixos-machine/40790
-func NeedToRebootLinux() (reboot bool) {
-	current, err := os.Readlink("/run/current-system/kernel")
+// rebootComponents are the components of a NixOS system which are
+// only activated by a reboot. The kernel-params file is compared by
+// content, systemd by its version and the other ones are symlinks to
+// store paths. The CPU microcode is part of the initrd.
+var rebootComponents = []string{
+	"kernel",
+	"initrd",
+	"kernel-modules",
+	"kernel-params",
+	"systemd",
+	"firmware",
+}
+
+// readSystemComponent returns the store path of a component of a
+// system or, for the kernel-params, its content. For systemd, it
+// returns its version since a rebuild of the same version, because of
+// a patch or a dependency bump for instance, doesn't require a reboot.
+func readSystemComponent(systemPath, component string) (string, error) {
+	path := filepath.Join(systemPath, component)
+	switch component {
+	case "kernel-params":
+		content, err := os.ReadFile(path)
+		return strings.TrimSpace(string(content)), err
+	case "systemd":
+		target, err := os.Readlink(path)
+		return storePathVersion(target), err
+	}
+	return os.Readlink(path)
+}
+
+// storePathVersion returns the version of a store path such as
+// /nix/store/<hash>-systemd-256.8, the way builtins.parseDrvName
+// splits the name: the version starts after the first dash followed
+// by a digit. The store path is returned if it has no version.
+func storePathVersion(storePath string) string {
+	name := filepath.Base(storePath)
+	if len(name) > 33 && name[32] == '-' {
+		name = name[33:]
+	}
+	for i := 0; i < len(name)-1; i++ {
+		if name[i] == '-' && name[i+1] >= '0' && name[i+1] <= '9' {
+			return name[i+1:]
+		}
+	}
+	return storePath
+}
+
+// RebootReasons returns the components which differ between the
+// booted system and the current system. A component missing from
+// both systems is ignored.
+func RebootReasons(currentSystem, bootedSystem string) (reasons []string) {
+	for _, system := range []string{currentSystem, bootedSystem} {
+		if _, err := os.Stat(system); err != nil {
+			logrus.Errorf("Failed to read the system %s: %s", system, err)
+			return nil
+		}
+	}
+	for _, component := range rebootComponents {
+		current, currentErr := readSystemComponent(currentSystem, component)
+		booted, bootedErr := readSystemComponent(bootedSystem, component)
+		if errors.Is(currentErr, os.ErrNotExist) && errors.Is(bootedErr, os.ErrNotExist) {
+			continue
+		}
+		if err := errors.Join(currentErr, bootedErr); err != nil && !errors.Is(err, os.ErrNotExist) {
+			logrus.Errorf("Failed to read the %s of the systems: %s", component, err)
+			continue
+		}
+		if current != booted {
+			reasons = append(reasons, component)
+		}
+	}
+	return
+}
+
+// NeedToRebootLinux returns the reasons why the machine needs to be
+// rebooted to run the current system. It is empty when no reboot is
+// needed.
+func NeedToRebootLinux() []string {
+	return RebootReasons("/run/current-system", "/run/booted-system")
+}
+
+// ReadBootIdLinux returns an identifier of the current boot
+func ReadBootIdLinux() (string, error) {
+	bootId, err := os.ReadFile("/proc/sys/kernel/random/boot_id")
 	if err != nil {
-		logrus.Errorf("Failed to read the symlink /run/current-system/kernel: %s", err)
-		return
+		return "", fmt.Errorf("can not read file '/proc/sys/kernel/random/boot_id': %s", err)
 	}
-	booted, err := os.Readlink("/run/booted-system/kernel")
+	return strings.TrimSpace(string(bootId)), nil
+}
+
+// ReadBootIdDarwin returns the boot time as an identifier of the
+// current boot
+func ReadBootIdDarwin() (string, error) {
+	output, err := exec.Command("/usr/sbin/sysctl", "-n", "kern.boottime").Output()
 	if err != nil {
-		logrus.Errorf("Failed to read the symlink /run/booted-system/kernel: %s", err)
-		return
+		return "", fmt.Errorf("failed to get the boot time on macOS: %s", err)
 	}
-	if current != booted {
-		reboot = true
+	return strings.TrimSpace(string(output)), nil
+}
+
+func RebootLinux() error {
+	logrus.Infof("Rebooting the machine with 'systemctl reboot'")
+	if err := exec.Command("systemctl", "reboot").Run(); err != nil {
+		return fmt.Errorf("command 'systemctl reboot' fails with %s", err)
 	}
-	return
+	return nil
+}
+
+func RebootDarwin() error {
+	logrus.Infof("Rebooting the machine with 'shutdown -r now'")
+	if err := exec.Command("/sbin/shutdown", "-r", "now").Run(); err != nil {
+		return fmt.Errorf("command 'shutdown -r now' fails with %s", err)
+	}
+	return nil
 }
@@ -7,7 +7,10 @@ import (
 )
 
 type RepositoryMock struct {
-	RsCh chan repository.RepositoryStatus
+	RsCh           chan repository.RepositoryStatus
+	PinnedCommitId string
+	// The error returned by CheckPin
+	PinErr error
 }
 
 func NewRepositoryMock() (r *RepositoryMock) {
@@ -19,6 +22,12 @@ func NewRepositoryMock() (r *RepositoryMock) {
 func (r *RepositoryMock) FetchAndUpdate(ctx context.Context, remoteNames []string) (rsCh chan repository.RepositoryStatus) {
 	return r.RsCh
 }
+func (r *RepositoryMock) SetPin(commitId string) {
+	r.PinnedCommitId = commitId
+}
+func (r *RepositoryMock) CheckPin(commitId string) (string, error) {
+	return commitId, r.PinErr
+}
 func (r *RepositoryMock) GetRepositoryStatus() repository.RepositoryStatus {
 	return repository.RepositoryStatus{}
 }
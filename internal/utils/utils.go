@@ -51,3 +51,12 @@ func ReadMachineIdDarwin() (machineId string, err error) {
 	}
 	return "", fmt.Errorf("could not find Hardware UUID in system_profiler output")
 }
+
+// ReadCurrentSystem returns the store path of the running system
+func ReadCurrentSystem() (string, error) {
+	outPath, err := os.Readlink("/run/current-system")
+	if err != nil {
+		return "", fmt.Errorf("can not read the symlink '/run/current-system': %s", err)
+	}
+	return outPath, nil
+}
@@ -1,6 +1,8 @@
 package utils
 
 import (
+	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -78,8 +80,67 @@ func TestNeedToReboot(t *testing.T) {
 			// Test that the function doesn't panic and follows the right code path
 			result := NeedToRebootLinux()
 			t.Logf("NeedToReboot with %s returned: %v", tt.configurationAttr, result)
-			// The function should return a boolean without panicking
-			assert.IsType(t, false, result)
+			// The function should return the reasons without panicking
+			assert.IsType(t, []string{}, result)
 		})
 	}
 }
+
+func TestRebootReasons(t *testing.T) {
+	tmp := t.TempDir()
+	mkSystem := func(name string, links map[string]string, kernelParams string) string {
+		system := filepath.Join(tmp, name)
+		_ = os.Mkdir(system, 0755)
+		for component, target := range links {
+			_ = os.Symlink(target, filepath.Join(system, component))
+		}
+		_ = os.WriteFile(filepath.Join(system, "kernel-params"), []byte(kernelParams), 0644)
+		return system
+	}
+	booted := mkSystem("booted", map[string]string{
+		"kernel":         "/nix/store/linux-6.6/bzImage",
+		"initrd":         "/nix/store/initrd-1/initrd",
+		"kernel-modules": "/nix/store/modules-1",
+		"systemd":        "/nix/store/systemd-255",
+	}, "loglevel=4")
+
+	current := mkSystem("same", map[string]string{
+		"kernel":         "/nix/store/linux-6.6/bzImage",
+		"initrd":         "/nix/store/initrd-1/initrd",
+		"kernel-modules": "/nix/store/modules-1",
+		"systemd":        "/nix/store/systemd-255",
+	}, "loglevel=4\n")
+	assert.Empty(t, RebootReasons(current, booted))
+
+	current = mkSystem("different", map[string]string{
+		"kernel":         "/nix/store/linux-6.6/bzImage",
+		"initrd":         "/nix/store/initrd-2/initrd",
+		"kernel-modules": "/nix/store/modules-1",
+		"systemd":        "/nix/store/systemd-256",
+		"firmware":       "/nix/store/firmware",
+	}, "loglevel=4 quiet")
+	assert.Equal(t, []string{"initrd", "kernel-params", "systemd", "firmware"}, RebootReasons(current, booted))
+
+	assert.Empty(t, RebootReasons(current, filepath.Join(tmp, "does-not-exist")))
+
+	// A rebuild of systemd with the same version doesn't require a
+	// reboot
+	booted = mkSystem("booted-systemd", map[string]string{
+		"systemd": "/nix/store/0c0bvmz1ml1ar5j7yb6z9ghcx4s4zqsc-systemd-256.8",
+	}, "")
+	current = mkSystem("rebuilt-systemd", map[string]string{
+		"systemd": "/nix/store/9xqw8dvkywzyrpncd6sbpj62b91fi1ar-systemd-256.8",
+	}, "")
+	assert.Empty(t, RebootReasons(current, booted))
+	current = mkSystem("upgraded-systemd", map[string]string{
+		"systemd": "/nix/store/9xqw8dvkywzyrpncd6sbpj62b91fi1ar-systemd-256.10",
+	}, "")
+	assert.Equal(t, []string{"systemd"}, RebootReasons(current, booted))
+}
+
+func TestStorePathVersion(t *testing.T) {
+	assert.Equal(t, "256.8", storePathVersion("/nix/store/0c0bvmz1ml1ar5j7yb6z9ghcx4s4zqsc-systemd-256.8"))
+	assert.Equal(t, "256.8", storePathVersion("/nix/store/0c0bvmz1ml1ar5j7yb6z9ghcx4s4zqsc-systemd-minimal-256.8"))
+	assert.Equal(t, "255", storePathVersion("/nix/store/systemd-255"))
+	assert.Equal(t, "/nix/store/0c0bvmz1ml1ar5j7yb6z9ghcx4s4zqsc-systemd", storePathVersion("/nix/store/0c0bvmz1ml1ar5j7yb6z9ghcx4s4zqsc-systemd"))
+}
@@ -0,0 +1,183 @@
+// This package parses and authenticates push events sent by Git
+// forges in order to trigger a fetch of the corresponding remotes.
+//
+// GitHub, GitLab, Gitea (and Forgejo) payloads are supported. Other
+// tools can send a generic payload such as
+//
+//	{"url": "https://git.example.org/owner/infra.git", "branch": "main"}
+//
+// authenticated by the X-Comin-Token header or by the HMAC-SHA256 of
+// the payload in the X-Comin-Signature-256 header ("sha256=<hex>").
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/nlewo/comin/internal/types"
+)
+
+// ErrNotPush is returned when the event is not a push event, such as
+// the GitHub ping event. Such events can be safely ignored.
+var ErrNotPush = errors.New("the event is not a push event")
+
+// ErrUnauthorized is returned when the signature or the token of the
+// event is missing or invalid.
+var ErrUnauthorized = errors.New("the event signature or token is invalid")
+
+// Push is a push event sent by a Git forge
+type Push struct {
+	Forge string
+	// The URLs of the pushed repository (clone and web URLs)
+	URLs   []string
+	Branch string
+}
+
+type payload struct {
+	Ref string `json:"ref"`
+	// Used by the generic payload
+	URL    string `json:"url"`
+	Branch string `json:"branch"`
+
+	Repository struct {
+		CloneURL   string `json:"clone_url"`
+		SshURL     string `json:"ssh_url"`
+		HtmlURL    string `json:"html_url"`
+		URL        string `json:"url"`
+		GitHttpURL string `json:"git_http_url"`
+		GitSshURL  string `json:"git_ssh_url"`
+		Homepage   string `json:"homepage"`
+	} `json:"repository"`
+	Project struct {
+		GitHttpURL string `json:"git_http_url"`
+		GitSshURL  string `json:"git_ssh_url"`
+		WebURL     string `json:"web_url"`
+	} `json:"project"`
+}
+
+// Parse authenticates and parses a push event.
+func Parse(header http.Header, body []byte, secret string) (push Push, err error) {
+	switch {
+	case header.Get("X-Gitea-Event") != "" || header.Get("X-Forgejo-Event") != "":
+		push.Forge = "gitea"
+		signature := header.Get("X-Gitea-Signature")
+		if signature == "" {
+			signature = header.Get("X-Forgejo-Signature")
+		}
+		if !validSignature(body, secret, signature) {
+			return push, ErrUnauthorized
+		}
+		event := header.Get("X-Gitea-Event")
+		if event == "" {
+			event = header.Get("X-Forgejo-Event")
+		}
+		if event != "push" {
+			return push, ErrNotPush
+		}
+	case header.Get("X-GitHub-Event") != "":
+		push.Forge = "github"
+		signature, found := strings.CutPrefix(header.Get("X-Hub-Signature-256"), "sha256=")
+		if !found || !validSignature(body, secret, signature) {
+			return push, ErrUnauthorized
+		}
+		if header.Get("X-GitHub-Event") != "push" {
+			return push, ErrNotPush
+		}
+	case header.Get("X-Gitlab-Event") != "":
+		push.Forge = "gitlab"
+		if !validToken(secret, header.Get("X-Gitlab-Token")) {
+			return push, ErrUnauthorized
+		}
+		if header.Get("X-Gitlab-Event") != "Push Hook" {
+			return push, ErrNotPush
+		}
+	default:
+		push.Forge = "generic"
+		signature, found := strings.CutPrefix(header.Get("X-Comin-Signature-256"), "sha256=")
+		if !(found && validSignature(body, secret, signature)) && !validToken(secret, header.Get("X-Comin-Token")) {
+			return push, ErrUnauthorized
+		}
+	}
+
+	var p payload
+	if err = json.Unmarshal(body, &p); err != nil {
+		return push, fmt.Errorf("failed to decode the %s payload: %w", push.Forge, err)
+	}
+	push.Branch = p.Branch
+	if p.Ref != "" {
+		var found bool
+		push.Branch, found = strings.CutPrefix(p.Ref, "refs/heads/")
+		if !found {
+			// This is for instance a tag push
+			return push, ErrNotPush
+		}
+	}
+	for _, u := range []string{
+		p.URL,
+		p.Repository.CloneURL, p.Repository.SshURL, p.Repository.HtmlURL, p.Repository.URL,
+		p.Repository.GitHttpURL, p.Repository.GitSshURL, p.Repository.Homepage,
+		p.Project.GitHttpURL, p.Project.GitSshURL, p.Project.WebURL,
+	} {
+		if u != "" {
+			push.URLs = append(push.URLs, u)
+		}
+	}
+	if push.Branch == "" || len(push.URLs) == 0 {
+		return push, fmt.Errorf("the %s payload doesn't contain a branch and a repository URL", push.Forge)
+	}
+	return push, nil
+}
+
+// Remotes returns the names of the remotes corresponding to the
+// pushed repository and having the pushed branch as main or testing
+// branch.
+func (p Push) Remotes(remotes []types.Remote) (names []string) {
+	for _, remote := range remotes {
+		if p.Branch != remote.Branches.Main.Name && p.Branch != remote.Branches.Testing.Name {
+			continue
+		}
+		for _, u := range p.URLs {
+			if normalizeURL(u) == normalizeURL(remote.URL) {
+				names = append(names, remote.Name)
+				break
+			}
+		}
+	}
+	return
+}
+
+// normalizeURL returns the host and the path of a Git URL in order to
+// compare a HTTP URL with a SSH URL of the same repository.
+func normalizeURL(u string) string {
+	endpoint, err := transport.NewEndpoint(u)
+	if err != nil {
+		return u
+	}
+	path := strings.Trim(strings.TrimSuffix(strings.TrimSuffix(endpoint.Path, "/"), ".git"), "/")
+	return strings.ToLower(endpoint.Host + "/" + path)
+}
+
+func validSignature(body []byte, secret, signature string) bool {
+	if signature == "" {
+		return false
+	}
+	expected, err := hex.DecodeString(signature)
+	if err != nil {
+		return false
+	}
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+func validToken(secret, token string) bool {
+	return token != "" && subtle.ConstantTimeCompare([]byte(secret), []byte(token)) == 1
+}
@@ -0,0 +1,129 @@
+package webhook
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"testing"
+
+	"github.com/nlewo/comin/internal/types"
+	"github.com/stretchr/testify/assert"
+)
+
+func sign(body []byte, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestParseGitHub(t *testing.T) {
+	body := []byte(`{"ref": "refs/heads/main", "repository": {"clone_url": "https://github.com/owner/infra.git", "ssh_url": "git@github.com:owner/infra.git"}}`)
+	header := http.Header{}
+	header.Set("X-GitHub-Event", "push")
+	header.Set("X-Hub-Signature-256", "sha256="+sign(body, "secret"))
+	push, err := Parse(header, body, "secret")
+	assert.Nil(t, err)
+	assert.Equal(t, "github", push.Forge)
+	assert.Equal(t, "main", push.Branch)
+	assert.Equal(t, []string{"https://github.com/owner/infra.git", "git@github.com:owner/infra.git"}, push.URLs)
+
+	_, err = Parse(header, body, "another-secret")
+	assert.ErrorIs(t, err, ErrUnauthorized)
+
+	header.Set("X-GitHub-Event", "ping")
+	_, err = Parse(header, body, "secret")
+	assert.ErrorIs(t, err, ErrNotPush)
+
+	header.Set("X-GitHub-Event", "push")
+	body = []byte(`{"ref": "refs/tags/v1.0", "repository": {"clone_url": "https://github.com/owner/infra.git"}}`)
+	header.Set("X-Hub-Signature-256", "sha256="+sign(body, "secret"))
+	_, err = Parse(header, body, "secret")
+	assert.ErrorIs(t, err, ErrNotPush)
+}
+
+func TestParseGitea(t *testing.T) {
+	body := []byte(`{"ref": "refs/heads/testing-machine", "repository": {"clone_url": "https://gitea.example.org/owner/infra.git"}}`)
+	header := http.Header{}
+	header.Set("X-Gitea-Event", "push")
+	// Gitea also sends GitHub headers
+	header.Set("X-GitHub-Event", "push")
+	header.Set("X-Gitea-Signature", sign(body, "secret"))
+	push, err := Parse(header, body, "secret")
+	assert.Nil(t, err)
+	assert.Equal(t, "gitea", push.Forge)
+	assert.Equal(t, "testing-machine", push.Branch)
+
+	header.Set("X-Gitea-Signature", sign(body, "another-secret"))
+	_, err = Parse(header, body, "secret")
+	assert.ErrorIs(t, err, ErrUnauthorized)
+}
+
+func TestParseGitLab(t *testing.T) {
+	body := []byte(`{"ref": "refs/heads/main", "project": {"git_http_url": "https://gitlab.com/owner/infra.git", "git_ssh_url": "git@gitlab.com:owner/infra.git"}}`)
+	header := http.Header{}
+	header.Set("X-Gitlab-Event", "Push Hook")
+	header.Set("X-Gitlab-Token", "secret")
+	push, err := Parse(header, body, "secret")
+	assert.Nil(t, err)
+	assert.Equal(t, "gitlab", push.Forge)
+	assert.Equal(t, "main", push.Branch)
+	assert.Equal(t, []string{"https://gitlab.com/owner/infra.git", "git@gitlab.com:owner/infra.git"}, push.URLs)
+
+	header.Set("X-Gitlab-Token", "another-secret")
+	_, err = Parse(header, body, "secret")
+	assert.ErrorIs(t, err, ErrUnauthorized)
+}
+
+func TestParseGeneric(t *testing.T) {
+	body := []byte(`{"url": "https://git.example.org/owner/infra", "branch": "main"}`)
+	header := http.Header{}
+	_, err := Parse(header, body, "secret")
+	assert.ErrorIs(t, err, ErrUnauthorized)
+
+	header.Set("X-Comin-Token", "secret")
+	push, err := Parse(header, body, "secret")
+	assert.Nil(t, err)
+	assert.Equal(t, "generic", push.Forge)
+	assert.Equal(t, "main", push.Branch)
+
+	header = http.Header{}
+	header.Set("X-Comin-Signature-256", "sha256="+sign(body, "secret"))
+	_, err = Parse(header, body, "secret")
+	assert.Nil(t, err)
+
+	header.Set("X-Comin-Token", "secret")
+	_, err = Parse(header, []byte(`{"branch": "main"}`), "secret")
+	assert.ErrorContains(t, err, "doesn't contain a branch and a repository URL")
+}
+
+func TestRemotes(t *testing.T) {
+	remotes := []types.Remote{
+		{
+			Name: "origin",
+			URL:  "git@gitea.example.org:Owner/infra.git",
+			Branches: types.Branches{
+				Main:    types.Branch{Name: "main"},
+				Testing: types.Branch{Name: "testing-machine"},
+			},
+		},
+		{
+			Name: "mirror",
+			URL:  "https://github.com/owner/infra",
+			Branches: types.Branches{
+				Main: types.Branch{Name: "main"},
+			},
+		},
+	}
+	push := Push{URLs: []string{"https://gitea.example.org/owner/infra.git/"}, Branch: "main"}
+	assert.Equal(t, []string{"origin"}, push.Remotes(remotes))
+
+	push = Push{URLs: []string{"https://gitea.example.org/owner/infra.git"}, Branch: "testing-machine"}
+	assert.Equal(t, []string{"origin"}, push.Remotes(remotes))
+
+	push = Push{URLs: []string{"https://gitea.example.org/owner/infra.git"}, Branch: "feature"}
+	assert.Empty(t, push.Remotes(remotes))
+
+	push = Push{URLs: []string{"ssh://git@github.com:22/owner/infra.git"}, Branch: "main"}
+	assert.Equal(t, []string{"mirror"}, push.Remotes(remotes))
+}
@@ -11,11 +11,41 @@ in rec {
     exporter = {
       listen_address = cfg.services.comin.exporter.listen_address;
       port = cfg.services.comin.exporter.port;
-    };
+    } // (
+      lib.optionalAttrs (cfg.services.comin.exporter.token_path != null)
+        { token_path = cfg.services.comin.exporter.token_path; }
+    ) // (
+      lib.optionalAttrs (cfg.services.comin.exporter.tls.cert_path != null)
+        { tls = cfg.services.comin.exporter.tls; }
+    );
+    api_server = {
+      listen_address = cfg.services.comin.api_server.listen_address;
+      port = cfg.services.comin.api_server.port;
+    } // (
+      lib.optionalAttrs (cfg.services.comin.api_server.token_path != null)
+        { token_path = cfg.services.comin.api_server.token_path; }
+    ) // (
+      lib.optionalAttrs (cfg.services.comin.api_server.unix_socket.path != null)
+        { unix_socket = cfg.services.comin.api_server.unix_socket; }
+    ) // (
+      lib.optionalAttrs (cfg.services.comin.api_server.tls.cert_path != null)
+        { tls = cfg.services.comin.api_server.tls; }
+    );
     gpg_public_key_paths = cfg.services.comin.gpgPublicKeyPaths;
+    builder = cfg.services.comin.builder;
+    store = cfg.services.comin.store;
+    health_checks = cfg.services.comin.health_checks;
+    confirmation = cfg.services.comin.confirmation;
+    reboot = cfg.services.comin.reboot;
+    hooks = cfg.services.comin.hooks;
+    drift = cfg.services.comin.drift;
+    notifiers = cfg.services.comin.notifiers;
   } // (
     lib.optionalAttrs (cfg.services.comin.postDeploymentCommand != null)
       { post_deployment_command = cfg.services.comin.postDeploymentCommand; }
+  ) // (
+    lib.optionalAttrs (cfg.services.comin.webhook.secret_path != null)
+      { webhook.secret_path = cfg.services.comin.webhook.secret_path; }
   );
   cominConfigYaml = yaml.generate "comin.yaml" cominConfig;
 }
@@ -16,6 +16,9 @@ in {
     ];
 
     environment.systemPackages = [ package ];
+    environment.variables = lib.optionalAttrs (cfg.services.comin.api_server.unix_socket.path != null) {
+      COMIN_API_SOCKET = cfg.services.comin.api_server.unix_socket.path;
+    };
     services.comin.package = lib.mkDefault pkgs.comin or self.packages.${system}.comin or null;
     launchd.daemons.comin = {
       serviceConfig = {
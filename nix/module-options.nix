@@ -1,4 +1,187 @@
-{ config, pkgs, lib, ... }: {
+{ config, pkgs, lib, ... }:
+let
+  window = with lib; with types; submodule {
+    options = {
+      cron = mkOption {
+        type = str;
+        description = ''
+          A cron expression defining the openings of the window.
+        '';
+      };
+      duration = mkOption {
+        type = types.ints.positive;
+        description = ''
+          The duration of the window in seconds.
+        '';
+      };
+    };
+  };
+  # The TLS options of a listener
+  tls = listener: with lib; with types; {
+    cert_path = mkOption {
+      type = nullOr str;
+      default = null;
+      description = ''
+        The path of the certificate of the ${listener}. It is served over HTTPS when
+        this option is set. The certificate, its key and the client CA are reloaded
+        when their files change.
+      '';
+    };
+    key_path = mkOption {
+      type = nullOr str;
+      default = null;
+      description = ''
+        The path of the key of the certificate of the ${listener}.
+      '';
+    };
+    client_ca_path = mkOption {
+      type = nullOr str;
+      default = null;
+      description = ''
+        The path of a CA bundle. When set, the clients of the ${listener} have to
+        present a certificate signed by this CA (mTLS).
+      '';
+    };
+  };
+  freeze = with lib; with types; submodule {
+    options = {
+      from = mkOption {
+        type = str;
+        description = ''
+          The beginning of the freeze, as a RFC 3339 timestamp or a date (YYYY-MM-DD).
+        '';
+      };
+      to = mkOption {
+        type = str;
+        description = ''
+          The end of the freeze, as a RFC 3339 timestamp or a date (YYYY-MM-DD). A date
+          includes the whole day.
+        '';
+      };
+      reason = mkOption {
+        type = str;
+        default = "";
+        description = ''
+          The reason of the freeze.
+        '';
+      };
+    };
+  };
+  hook = with lib; with types; submodule {
+    options = {
+      argv = mkOption {
+        type = listOf str;
+        description = ''
+          The command to execute and its arguments.
+        '';
+      };
+      timeout = mkOption {
+        type = types.ints.positive;
+        default = 300;
+        description = ''
+          The delay in seconds after which the command is killed.
+        '';
+      };
+    };
+  };
+  notifier = with lib; with types; submodule {
+    options = {
+      type = mkOption {
+        type = enum [ "webhook" "matrix" "ntfy" "slack" "smtp" ];
+        description = ''
+          The backend of the notifier. `webhook` posts the event and the message as
+          JSON, `slack` posts the message to a Slack-compatible incoming webhook.
+        '';
+      };
+      events = mkOption {
+        type = listOf (enum [ "commit_fetched" "signature_refused" "fetch_refused" "eval_failed" "build_failed" "deployment_started" "deployment_finished" "reboot_needed" ]);
+        default = [];
+        description = ''
+          The events sending a message. Every event sends a message when it is empty.
+        '';
+      };
+      template = mkOption {
+        type = nullOr str;
+        default = null;
+        example = "{{.Hostname}}: the deployment of {{.CommitId}} is {{status .Deployment.Status}}";
+        description = ''
+          A Go text/template rendering the message from the event. A sentence
+          describing the event is sent when it is null.
+        '';
+      };
+      url = mkOption {
+        type = nullOr str;
+        default = null;
+        description = ''
+          The URL of the webhook, of the ntfy topic or of the Slack-compatible incoming
+          webhook.
+        '';
+      };
+      token_path = mkOption {
+        type = nullOr str;
+        default = null;
+        description = ''
+          The path of a file containing the Matrix or ntfy access token.
+        '';
+      };
+      homeserver = mkOption {
+        type = nullOr str;
+        default = null;
+        description = "The URL of the Matrix homeserver.";
+      };
+      room_id = mkOption {
+        type = nullOr str;
+        default = null;
+        description = "The ID of the Matrix room.";
+      };
+      smtp = mkOption {
+        default = {};
+        description = "The SMTP server sending the emails.";
+        type = submodule {
+          options = {
+            host = mkOption {
+              type = nullOr str;
+              default = null;
+              description = "The host of the SMTP server.";
+            };
+            port = mkOption {
+              type = port;
+              default = 587;
+              description = "The port of the SMTP server. STARTTLS is used when the server supports it.";
+            };
+            username = mkOption {
+              type = nullOr str;
+              default = null;
+              description = "The SMTP username. No authentication is done when it is null.";
+            };
+            password_path = mkOption {
+              type = nullOr str;
+              default = null;
+              description = "The path of a file containing the SMTP password.";
+            };
+            from = mkOption {
+              type = nullOr str;
+              default = null;
+              description = "The sender of the emails.";
+            };
+            to = mkOption {
+              type = listOf str;
+              default = [];
+              description = "The recipients of the emails.";
+            };
+          };
+        };
+      };
+      timeout = mkOption {
+        type = types.ints.positive;
+        default = 10;
+        description = ''
+          The delay in seconds after which the sending of a message is canceled.
+        '';
+      };
+    };
+  };
+in {
   options = with lib; with types; {
     services.comin = {
       enable = mkOption {
@@ -55,6 +238,316 @@
                 Open port in firewall for incoming connections to the Prometheus exporter.
               '';
             };
+            token_path = mkOption {
+              type = nullOr str;
+              default = null;
+              description = ''
+                The path of a file containing the bearer token required to scrape the metrics.
+                No token is required when this option is null.
+              '';
+            };
+            tls = tls "Prometheus exporter";
+          };
+        };
+      };
+      api_server = mkOption {
+        description = "Options for the API server used by the comin CLI.";
+        default = {};
+        type = submodule {
+          options = {
+            listen_address = mkOption {
+              type = str;
+              default = "127.0.0.1";
+              description = ''
+                Address to listen on for the API server.
+              '';
+            };
+            port = mkOption {
+              type = int;
+              default = 4242;
+              description = ''
+                Port to listen on for the API server.
+              '';
+            };
+            token_path = mkOption {
+              type = nullOr str;
+              default = null;
+              description = ''
+                The path of a file containing the bearer token required by the TCP listener
+                of the API server. The CLI reads it from the file given by `--api-token-file`
+                or `COMIN_API_TOKEN_FILE`. The webhook endpoint is authenticated by its own
+                secret. No token is required when this option is null.
+              '';
+            };
+            unix_socket = {
+              path = mkOption {
+                type = nullOr str;
+                default = null;
+                example = "/run/comin/api.sock";
+                description = ''
+                  The path of a Unix socket on which the API server also listens. Its clients
+                  are authorized by their peer credentials: root and the users or groups of
+                  `allowed_uids` and `allowed_gids` are allowed. `COMIN_API_SOCKET` is set
+                  in the system environment to let the CLI use this socket.
+                '';
+              };
+              allowed_uids = mkOption {
+                type = listOf int;
+                default = [];
+                description = ''
+                  The uids of the users allowed to use the Unix socket.
+                '';
+              };
+              allowed_gids = mkOption {
+                type = listOf int;
+                default = [];
+                description = ''
+                  The gids of the groups allowed to use the Unix socket. The primary and the
+                  supplementary groups of the users are considered.
+                '';
+              };
+            };
+            tls = tls "API server";
+          };
+        };
+      };
+      builder = mkOption {
+        description = "Options for the evaluation and the build of configurations.";
+        default = {};
+        type = submodule {
+          options = {
+            eval_timeout = mkOption {
+              type = types.ints.positive;
+              default = 1800;
+              description = ''
+                The evaluation timeout in seconds.
+              '';
+            };
+            build_timeout = mkOption {
+              type = types.ints.positive;
+              default = 1800;
+              description = ''
+                The build timeout in seconds.
+              '';
+            };
+          };
+        };
+      };
+      store = mkOption {
+        description = "Options for the comin store which keeps the deployment history.";
+        default = {};
+        type = submodule {
+          options = {
+            capacity_generations = mkOption {
+              type = types.ints.positive;
+              default = 10;
+              description = ''
+                The number of generations kept in the store and shown by comin status.
+                The generations of the last evaluations and builds are always kept.
+              '';
+            };
+            capacity_main = mkOption {
+              type = types.ints.positive;
+              default = 10;
+              description = ''
+                The number of deployments of main branches kept in the store.
+                The system profiles of evicted deployments are removed.
+              '';
+            };
+            capacity_testing = mkOption {
+              type = types.ints.positive;
+              default = 10;
+              description = ''
+                The number of deployments of testing branches kept in the store.
+              '';
+            };
+          };
+        };
+      };
+      health_checks = mkOption {
+        description = ''
+          Health checks run after a switch. If they don't succeed before the timeout, the
+          previous deployment is re-activated and the commit is not deployed again until a
+          new commit is available. Health checks are disabled when no check is configured.
+        '';
+        default = {};
+        type = submodule {
+          options = {
+            timeout = mkOption {
+              type = types.ints.positive;
+              default = 120;
+              description = ''
+                The delay in seconds for the health checks to succeed.
+              '';
+            };
+            interval = mkOption {
+              type = types.ints.positive;
+              default = 5;
+              description = ''
+                The delay in seconds between two attempts of the health checks.
+              '';
+            };
+            argv = mkOption {
+              type = nullOr (listOf str);
+              default = null;
+              example = [ "systemctl" "is-active" "nginx.service" ];
+              description = ''
+                A command and its arguments, which has to exit successfully.
+              '';
+            };
+            http_url = mkOption {
+              type = nullOr str;
+              default = null;
+              example = "http://localhost:8080/health";
+              description = ''
+                An URL which has to respond with a 2xx status code.
+              '';
+            };
+            no_failed_units = mkOption {
+              type = types.bool;
+              default = false;
+              description = ''
+                Whether no systemd unit has to be in the failed state.
+              '';
+            };
+          };
+        };
+      };
+      confirmation = mkOption {
+        description = ''
+          Options to require a confirmation of each deployment. If a deployment is not
+          confirmed before the timeout, the previous deployment is re-activated. This
+          avoids losing the access to a remote machine because of a broken configuration.
+          The pending confirmation is persisted: if comin or the machine is restarted
+          meanwhile, the wait is resumed or, if the timeout has expired, the deployment
+          is rolled back.
+        '';
+        default = {};
+        type = submodule {
+          options = {
+            enable = mkOption {
+              type = types.bool;
+              default = false;
+              description = ''
+                Whether deployments have to be confirmed.
+              '';
+            };
+            timeout = mkOption {
+              type = types.ints.positive;
+              default = 300;
+              description = ''
+                The delay in seconds to confirm a deployment.
+              '';
+            };
+            url = mkOption {
+              type = nullOr str;
+              default = null;
+              example = "https://monitoring.example.org/ping";
+              description = ''
+                The deployment is confirmed when comin reaches this URL (with a 2xx status code).
+                Otherwise, the deployment has to be confirmed by running `comin confirm`.
+              '';
+            };
+          };
+        };
+      };
+      reboot = mkOption {
+        description = "Options for the reboots required by the deployments done with the `boot` operation.";
+        default = {};
+        type = submodule {
+          options = {
+            windows = mkOption {
+              description = ''
+                The windows during which comin can reboot the machine. A window opens at each
+                activation of its cron expression and lasts `duration` seconds. The machine
+                can be rebooted at any time when no window is configured.
+              '';
+              default = [];
+              example = [ { cron = "0 2 * * 6"; duration = 7200; } ];
+              type = listOf window;
+            };
+          };
+        };
+      };
+      hooks = mkOption {
+        description = ''
+          Commands executed before and after each deployment. Hooks receive the same
+          environment variables as the `postDeploymentCommand`. Their exit code and
+          output are recorded in the deployment.
+        '';
+        default = {};
+        type = submodule {
+          options = {
+            pre_deployment = mkOption {
+              description = ''
+                Commands executed before the activation of a deployment. If one of them
+                fails, the deployment is aborted.
+              '';
+              default = [];
+              example = [ { argv = [ "systemctl" "stop" "app" ]; timeout = 60; } ];
+              type = listOf hook;
+            };
+            post_deployment = mkOption {
+              description = ''
+                Commands executed after each deployment, whatever its status.
+              '';
+              default = [];
+              example = [ { argv = [ "systemctl" "start" "app" ]; } ];
+              type = listOf hook;
+            };
+          };
+        };
+      };
+      drift = mkOption {
+        description = ''
+          Options for the detection of changes of the running system done outside of
+          comin, such as a manual `nixos-rebuild switch`.
+        '';
+        default = {};
+        type = submodule {
+          options = {
+            interval = mkOption {
+              type = types.ints.positive;
+              default = 300;
+              description = ''
+                The delay in seconds between two comparisons of the running system with
+                the generation of the last deployment.
+              '';
+            };
+            policy = mkOption {
+              type = enum [ "alert" "reconcile" ];
+              default = "alert";
+              description = ''
+                With `alert`, a drift is only reported by `comin status` and the
+                `comin_drift` metric. With `reconcile`, the generation of the last
+                deployment is also re-activated.
+              '';
+            };
+          };
+        };
+      };
+      notifiers = mkOption {
+        description = ''
+          Notifiers sending a message on the lifecycle events of comin.
+        '';
+        default = [];
+        example = [ { type = "ntfy"; url = "https://ntfy.sh/my-topic"; events = [ "build_failed" "deployment_finished" ]; } ];
+        type = listOf notifier;
+      };
+      webhook = mkOption {
+        description = "Options for the webhook receiving push events from Git forges.";
+        default = {};
+        type = submodule {
+          options = {
+            secret_path = mkOption {
+              type = nullOr str;
+              default = null;
+              description = ''
+                The path of a file containing the secret used to authenticate push events
+                sent to the API endpoint `/api/fetcher/webhook`. The endpoint is disabled
+                when this option is null.
+              '';
+            };
           };
         };
       };
@@ -86,6 +579,29 @@
                       The path of the auth file.
                     '';
                   };
+                  ssh_private_key_path = mkOption {
+                    type = str;
+                    default = "";
+                    description = ''
+                      The path of a SSH private key, such as a read-only deploy key.
+                      When set, it takes precedence over the access token.
+                    '';
+                  };
+                  ssh_private_key_passphrase_path = mkOption {
+                    type = str;
+                    default = "";
+                    description = ''
+                      The path of a file containing the passphrase of the SSH private key.
+                    '';
+                  };
+                  ssh_known_hosts_path = mkOption {
+                    type = str;
+                    default = "";
+                    description = ''
+                      The path of a known_hosts file used to verify the remote host key.
+                      If empty, the system known_hosts files are used.
+                    '';
+                  };
                 };
               };
             };
@@ -111,6 +627,58 @@
                           default = "main";
                           description = "The name of the main branch.";
                         };
+                        protected = mkOption {
+                          type = types.bool;
+                          default = false;
+                          description = ''
+                            Whether the main branch is protected. A protected branch only accepts
+                            commits signed by one of the `gpgPublicKeyPaths` keys and can not be
+                            hard reset. A testing branch can only supersede a protected main
+                            branch with a signed commit.
+                          '';
+                        };
+                        operation = mkOption {
+                          type = types.enum [ "switch" "test" "boot" ];
+                          default = "switch";
+                          description = ''
+                            The switch-to-configuration operation used to deploy the main branch.
+                            With `boot`, the machine is rebooted during a reboot window (see
+                            `services.comin.reboot.windows`) to activate the deployment. A
+                            generation which doesn't change the kernel, the initrd, the kernel
+                            modules and params, the systemd version or the firmware of the booted
+                            system is deployed with `switch` instead.
+                          '';
+                        };
+                        windows = mkOption {
+                          type = listOf window;
+                          default = [];
+                          example = [ { cron = "0 2 * * 1-5"; duration = 10800; } ];
+                          description = ''
+                            The windows during which the main branch can be deployed. A window
+                            opens at each activation of its cron expression and lasts `duration`
+                            seconds. Outside of the windows, the built generation is held until
+                            the next opening. The branch can be deployed at any time when no
+                            window is configured.
+                          '';
+                        };
+                        freezes = mkOption {
+                          type = listOf freeze;
+                          default = [];
+                          example = [ { from = "2024-12-20"; to = "2025-01-05"; reason = "Holidays"; } ];
+                          description = ''
+                            The periods during which the main branch is not deployed, even in
+                            a window.
+                          '';
+                        };
+                        require_approval = mkOption {
+                          type = types.bool;
+                          default = false;
+                          description = ''
+                            Whether the generations of the main branch are only deployed once
+                            approved with `comin approve <generation>`. The approval expires when
+                            a newer commit is fetched.
+                          '';
+                        };
                       };
                     };
                   };
@@ -124,6 +692,45 @@
                           default = "testing-${config.services.comin.hostname}";
                           description = "The name of the testing branch.";
                         };
+                        protected = mkOption {
+                          type = types.bool;
+                          default = false;
+                          description = ''
+                            Whether the testing branch is protected. A protected branch only accepts
+                            commits signed by one of the `gpgPublicKeyPaths` keys and can not be
+                            hard reset.
+                          '';
+                        };
+                        operation = mkOption {
+                          type = types.enum [ "switch" "test" "boot" ];
+                          default = "test";
+                          description = ''
+                            The switch-to-configuration operation used to deploy the testing branch.
+                          '';
+                        };
+                        windows = mkOption {
+                          type = listOf window;
+                          default = [];
+                          description = ''
+                            The windows during which the testing branch can be deployed. See
+                            `services.comin.remotes.*.branches.main.windows`.
+                          '';
+                        };
+                        freezes = mkOption {
+                          type = listOf freeze;
+                          default = [];
+                          description = ''
+                            The periods during which the testing branch is not deployed.
+                          '';
+                        };
+                        require_approval = mkOption {
+                          type = types.bool;
+                          default = false;
+                          description = ''
+                            Whether the generations of the testing branch are only deployed once
+                            approved with `comin approve <generation>`.
+                          '';
+                        };
                       };
                     };
                   };
@@ -180,7 +787,8 @@
         deployment. comin provides to the script the following
         environment variables: `COMIN_GIT_SHA`, `COMIN_GIT_REF`,
         `COMIN_GIT_MSG`, `COMIN_HOSTNAME`, `COMIN_FLAKE_URL`,
-        `COMIN_GENERATION`, `COMIN_STATUS` and `COMIN_ERROR_MSG`.";
+        `COMIN_GENERATION`, `COMIN_STATUS`, `COMIN_ERROR_MSG` and
+        `COMIN_CLOSURE_DIFF`.";
         type = nullOr path;
         default = null;
         example = lib.literalExpression ''
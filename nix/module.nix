@@ -17,6 +17,9 @@ in {
     ];
 
     environment.systemPackages = [ package ];
+    environment.variables = lib.optionalAttrs (cfg.services.comin.api_server.unix_socket.path != null) {
+      COMIN_API_SOCKET = cfg.services.comin.api_server.unix_socket.path;
+    };
     networking.firewall.allowedTCPPorts = lib.optional cfg.services.comin.exporter.openFirewall cfg.services.comin.exporter.port;
     # Use package from overlay first, then Flake package if available
     services.comin.package = lib.mkDefault pkgs.comin or self.packages.${system}.comin or null;